@@ -1,18 +1,19 @@
 module FindingWaldo
 
-go 1.24.1
+go 1.26.0
 
 require github.com/yutopp/go-rtmp v0.0.7
 
-require gocv.io/x/gocv v0.41.0 // indirect
+require gocv.io/x/gocv v0.41.0
 
 require (
 	github.com/hashicorp/errwrap v1.1.0 // indirect
 	github.com/hashicorp/go-multierror v1.1.0 // indirect
 	github.com/mitchellh/mapstructure v1.4.1 // indirect
-	github.com/pkg/errors v0.9.1 // indirect
+	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.7.0 // indirect
-	github.com/yutopp/go-amf0 v0.1.0 // indirect
+	github.com/yutopp/go-amf0 v0.1.0
 	github.com/yutopp/go-flv v0.3.1
-	golang.org/x/sys v0.3.0 // indirect
+	golang.org/x/net v0.59.0
+	golang.org/x/sys v0.48.0 // indirect
 )
@@ -1,41 +1,565 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
 	"fmt"
-	"io"
+	"image"
 	"log"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	"github.com/yutopp/go-rtmp"
+	"github.com/pkg/errors"
+	"gocv.io/x/gocv"
+
+	"FindingWaldo/waldo"
+)
+
+var (
+	configPath = flag.String("config", "", "Settings file of flag = value lines, TOML style with [section] prefixes (flags on the command line win)")
+	replayPath = flag.String("replay", "", "Run CV over this FLV instead of serving, writing a new recording and its detections to -output-dir")
+
+	logFormat = flag.String("log-format", "text", "Log output format: text or json")
+	logLevel  = flag.String("log-level", "info", "Least severe messages logged: debug, info, warn or error")
+
+	rtmpAddr = flag.String("rtmp-addr", ":1935", "RTMP listen address as host:port, an empty host listens on every interface")
+	rtmpPort = flag.Int("rtmp-port", 0, "RTMP listen port (1-65535), overrides the port in -rtmp-addr")
+
+	rtmpsAddr = flag.String("rtmps-addr", ":1936", "RTMPS listen address, used with -tls-cert and -tls-key")
+	tlsCert   = flag.String("tls-cert", "", "PEM certificate for RTMPS, served next to plain RTMP")
+	tlsKey    = flag.String("tls-key", "", "PEM private key for -tls-cert")
+
+	audioThreshold = flag.Float64("audio-threshold", 0, "Log an audio event when loudness rises above this level in dBFS (0 disables)")
+	annotateOutput = flag.Bool("annotate-output", false, "Burn detection boxes and scores into the recording by re-encoding the GOPs of keyframes with detections")
+	reencode       = flag.Bool("reencode", false, "Deprecated, same as -annotate-output")
+	encodeQP       = flag.Int("encode-qp", 0, "Quantizer for re-encoded keyframes (0 matches the source bitrate)")
+	encodeBitrate  = flag.Int("encode-bitrate", 0, "Bitrate in kbps for re-encoded keyframes (overrides -encode-qp)")
+
+	streamKeys     = flag.String("stream-keys", "", "Comma separated stream keys allowed to publish and play (empty accepts everyone)")
+	streamKeysFile = flag.String("stream-keys-file", "", "File of allowed stream keys, one per line (also $WALDO_STREAM_KEYS, comma separated)")
+	streamSecret   = flag.String("stream-secret", "", "Shared secret every publisher and player must pass as <name>?key=<secret>")
+	maxConnections = flag.Int("max-connections", 0, "Most RTMP connections open at once, more are refused (0 is unlimited)")
+	maxKeyStreams  = flag.Int("max-publishes-per-key", 0, "Most streams published at once with the same stream key (0 is unlimited)")
+
+	outputDir       = flag.String("output-dir", "received", "Directory recordings are written to")
+	recordingLayout = flag.String("recording-layout", waldo.DefaultRecordingLayout, "Recording path below -output-dir, with {name}, {conn_id}, {date} (YYYY-MM-DD) and {time} (HHMMSS)")
+	outputFormat    = flag.String("output-format", "flv", "Recording container: flv, or mp4 (fragmented, H.264 and AAC only)")
+	rejectExisting  = flag.Bool("reject-existing", false, "Reject a publish whose recording already exists instead of adding a timestamp suffix")
+
+	remuxToMP4          = flag.Bool("remux-to-mp4", false, "Copy each finished recording into an MP4 with ffmpeg")
+	deleteFLVAfterRemux = flag.Bool("delete-flv-after-remux", false, "Delete the FLV once its MP4 was written and verified")
+	remuxWorkers        = flag.Int("remux-workers", 1, "Recordings remuxed to MP4 at the same time")
+	remuxQueue          = flag.Int("remux-queue", 32, "Recordings waiting to be remuxed before new ones are skipped")
+
+	segmentDuration = flag.Duration("segment-duration", 0, "Start a new recording file at the first keyframe after this long (0 disables)")
+	segmentSizeMB   = flag.Int("segment-size-mb", 0, "Start a new recording file at the first keyframe after this many MB (0 disables)")
+
+	flushInterval      = flag.Duration("flush-interval", 2*time.Second, "Longest time recorded tags stay buffered in memory (keyframes always flush)")
+	syncInterval       = flag.Duration("fsync-interval", 10*time.Second, "How often flushed recordings are fsynced to disk")
+	hlsDir             = flag.String("hls-dir", "www", "Also write each stream as HLS to <dir>/<name>, served under /hls/<name>/playlist.m3u8, with live/cam1 named live_cam1 (empty disables)")
+	hlsCleanup         = flag.Bool("hls-cleanup", true, "Delete a stream's HLS playlist and segments when it ends")
+	hlsSegmentDuration = flag.Duration("hls-segment-duration", 2*time.Second, "Target HLS segment length, segments start on keyframes")
+	hlsWindow          = flag.Int("hls-window", 6, "Segments kept in the HLS playlist, older ones are deleted")
+	playerQueue        = flag.Int("player-queue", 256, "Tags an RTMP player may fall behind the live stream before frames are dropped")
+
+	shutdownTimeout = flag.Duration("shutdown-timeout", 5*time.Second, "Time allowed for streams to finish on SIGINT/SIGTERM")
+	streamTimeout   = flag.Duration("stream-timeout", 30*time.Second, "Close a connection when no audio or video arrived for this long, including ones that never publish (0 disables)")
+
+	httpPort         = flag.Int("http-port", 8080, "Port for the HTTP control API, /status and /metrics, on every interface")
+	httpAddr         = flag.String("http-addr", "", "Listen address of the HTTP control API in place of -http-port, e.g. 127.0.0.1:8080")
+	apiToken         = flag.String("api-token", os.Getenv("WALDO_API_TOKEN"), "Token every HTTP API request must carry as \"Authorization: Bearer <token>\" or ?token= (default $WALDO_API_TOKEN)")
+	wsOrigins        = flag.String("ws-allowed-origins", "", "Comma separated origins, e.g. https://dashboard.example.com, whose pages may open /ws endpoints besides the API's own (* allows any)")
+	metricsPerStream = flag.Bool("metrics-stream-labels", false, "Label waldo_detections_total by stream name, one series per stream ever published")
+	previewFPS       = flag.Float64("preview-max-fps", 5, "Most frames per second sent to each /streams/{name}/preview viewer (0 is unlimited)")
+	frameCacheSize   = flag.Int("frame-cache", 30, "Decoded frames kept per stream for /streams/{name}/snapshot")
+	detectionHistory = flag.Int("detection-history", 100, "Detections kept per stream for the HTTP API")
+	detectThreshold  = flag.Float64("detection-threshold", 0.75, "Minimum score for a detection to be drawn, saved or reported, changeable with POST /config/threshold")
+	eventThreshold   = flag.Float64("event-threshold", 0.8, "Minimum score for detections pushed over /ws/detections and /ws/events")
+	eventThumbnails  = flag.Bool("event-thumbnails", false, "Attach a base64 JPEG of the frame to /ws/events messages")
+
+	relayURLs        = flag.String("relay", "", "Forward streams to another RTMP server: one URL for every stream ({name} is replaced), and/or comma separated <name>=<url> entries")
+	webhookURLs      = flag.String("webhook-url", "", "Comma separated URLs POSTed a JSON notification when a stream has detections")
+	webhookCooldown  = flag.Duration("webhook-cooldown", time.Minute, "At most one webhook notification per stream in this window")
+	webhookRetries   = flag.Int("webhook-retries", waldo.DefaultWebhookRetries, "Extra delivery attempts per URL after a failure")
+	webhookRetryWait = flag.Duration("webhook-retry-delay", waldo.DefaultWebhookRetryDelay, "Wait before retrying a failed webhook, doubled for every further retry")
+	webhookQueue     = flag.Int("webhook-queue", 16, "Notifications waiting for delivery before new ones are dropped")
+	webhookTimeout   = flag.Duration("webhook-timeout", 10*time.Second, "Timeout of each webhook request")
+	webhookThumbnail = flag.Bool("webhook-thumbnail", false, "Attach a base64 JPEG of the frame to webhook notifications")
+	webhookEvery     = flag.Bool("webhook-every-detection", false, "POST every detection above -event-threshold as it is found, instead of one notification per -webhook-cooldown")
+	webhookSecret    = flag.String("webhook-secret", os.Getenv("WALDO_WEBHOOK_SECRET"), "Key signing webhook bodies with HMAC-SHA256, hex in X-Signature (default $WALDO_WEBHOOK_SECRET)")
+	maxThumbnails    = flag.Int("max-thumbnails", 100, "Detector hits saved per stream as JPEGs under -output-dir/<name>/faces (0 disables)")
+	detectionFrames  = flag.Int("detection-frames-per-minute", 6, "Annotated frames with detections saved per stream and minute, at most one a second (0 disables)")
+	detectionSaveDir = flag.String("detection-save-dir", "", "Save annotated frames with detections as <dir>/<name>/<timestamp>.jpg (default -output-dir/<name>/detections)")
+	detectionScore   = flag.Float64("detection-save-score", 0, "Minimum best detection score for a frame to be saved")
+	thumbnailMargin  = flag.Float64("thumbnail-margin", 0.2, "Extra border around saved thumbnails, as a fraction of the box size")
+	annotatedFrames  = flag.Bool("annotated-frames", false, "Save every frame run through CV with its detections drawn as <recording>.frames/<n>-<timestamp>.jpg")
+
+	sampleMode  = flag.String("sample", "keyframe", "Frames run through CV: keyframe, nth (every -sample-every frames) or all")
+	sampleEvery = flag.Int("sample-every", 5, "Process every Nth frame with -sample nth")
+	cvInterval  = flag.Duration("cv-interval", 0, "With -sample keyframe, process at most one keyframe per this much stream time")
+	cvWorkers   = flag.Int("cv-workers", runtime.NumCPU(), "Keyframes analysed in parallel per stream (0 processes them inline)")
+	cvQueue     = flag.Int("cv-queue", 8, "Keyframes waiting for a CV worker before new ones are dropped")
+	cvEveryKey  = flag.Int("cv-every-keyframe", 1, "With -sample keyframe, process only every Kth keyframe")
+	cvMaxFPS    = flag.String("cv-max-fps", "5", "Most frames run through CV per second of wall time, per stream: <fps> for every stream and/or comma separated <name>=<fps> entries, skipped ones are still recorded (empty or 0 is unlimited)")
+	cvStreamFPS = flag.Float64("cv-max-stream-fps", 0, "Most frames run through CV per second of stream time, on top of -cv-max-fps (0 is unlimited)")
+	cvResizeW   = flag.Int("cv-resize-width", 0, "Shrink frames to this width before detection, 0 with -cv-resize-height keeps the aspect ratio (boxes are reported at full size)")
+	cvResizeH   = flag.Int("cv-resize-height", 0, "Shrink frames to this height before detection, see -cv-resize-width")
+	cvStages    = flag.String("cv-stages", "", "Comma separated stages run on each frame before detection, in order: denoise, equalize, background (empty runs none)")
+	cvBgHistory = flag.Int("cv-background-history", 500, "Frames the background stage learns a fixed camera's background from")
+	cvBgThresh  = flag.Float64("cv-background-threshold", 16, "Squared distance from the background above which the background stage counts a pixel as moving")
+
+	detectorBackend = flag.String("detector", "", "Detection backend used without -templates: haar, dnn or none (default dnn with -dnn-model, haar otherwise)")
+	cascadePath     = flag.String("cascade", "", "Cascade classifier file (default $WALDO_CASCADE_PATH or "+waldo.DefaultCascadePath+")")
+	cascadeScale    = flag.Float64("cascade-scale-factor", 1.1, "Cascade image shrink per search step, above 1 (lower finds more, slower)")
+	cascadeMinNeigh = flag.Int("cascade-min-neighbors", 3, "Overlapping cascade hits needed to keep a detection (higher cuts false positives)")
+	cascadeMinSize  = flag.String("cascade-min-size", "30x30", "Smallest object the cascade looks for, WxH in pixels")
+	cascadeMaxSize  = flag.String("cascade-max-size", "", "Largest object the cascade looks for, WxH in pixels (empty is unlimited)")
+	dnnModel        = flag.String("dnn-model", "", "Network for -detector dnn (Caffe, ONNX, ...), e.g. a YOLO model")
+	dnnConfig       = flag.String("dnn-config", "", "Network config file, e.g. a Caffe .prototxt")
+	dnnLabels       = flag.String("dnn-labels", "", "Class names, one per line")
+	dnnSize         = flag.Int("dnn-size", 640, "Square network input size in pixels")
+	dnnScale        = flag.Float64("dnn-scale", 1.0/255, "Pixel value multiplier applied before inference")
+	dnnMean         = flag.String("dnn-mean", "0,0,0", "Per channel mean subtracted before inference (B,G,R)")
+	dnnSwapRB       = flag.Bool("dnn-swap-rb", true, "Feed the network RGB instead of BGR")
+	dnnConfidence   = flag.Float64("dnn-confidence", 0.5, "Minimum DNN detection score")
+	dnnModelFormat  = flag.String("dnn-model-format", "", "Layout of the network output: ssd or yolo (default by its shape)")
+	dnnNMS          = flag.Float64("dnn-nms", waldo.DefaultDNNNMS, "IoU above which overlapping YOLO boxes are merged into the best one")
+	dnnLetterbox    = flag.Bool("dnn-letterbox", false, "Pad frames to a square before inference instead of stretching them, as YOLO models expect")
+	dnnBackend      = flag.String("dnn-backend", "default", "Inference backend: default, opencv, openvino, cuda, vulkan or halide")
+	dnnTarget       = flag.String("dnn-target", "cpu", "Inference target: cpu, fp32, fp16, cuda, cudafp16, vulkan, vpu or fpga")
+	detectROI       = flag.String("roi", "", "Only search this part of each frame for Waldo, as x,y,w,h in pixels (empty searches the whole frame)")
+	detectMaxDim    = flag.Int("detect-max-dimension", 0, "Scale frames down to at most this many pixels wide or high for the detector (0 keeps the full size)")
+	motionThreshold = flag.Float64("motion-threshold", 0, "Fraction of pixels (0-1) that must change since the last frame run through detection to run it again (0 disables)")
+	headless        = flag.Bool("headless", os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == "", "Never open a display window (on when no display is available)")
+
+	templatePaths     = flag.String("templates", "", "Comma separated Waldo template images, or directories of PNG and JPEG templates (empty uses the face cascade)")
+	templateMinScale  = flag.Float64("template-min-scale", 0.5, "Smallest template scale to search")
+	templateMaxScale  = flag.Float64("template-max-scale", 1.5, "Largest template scale to search")
+	templateScaleStep = flag.Float64("template-scale-step", 0.1, "Template scale increment")
+	templateThreshold = flag.Float64("template-threshold", 0.8, "Minimum match confidence (0-1)")
+	templateTopN      = flag.Int("template-top-n", 5, "Maximum matches reported per frame")
+	templateNMSIoU    = flag.Float64("template-nms-iou", 0.3, "Drop template matches overlapping a better one by more than this intersection over union")
+	stripePrefilter   = flag.Bool("stripe-prefilter", false, "Only match templates around Waldo's red horizontal stripes, skipping frames without any")
 )
 
 func main() {
-	tcpAddr, err := net.ResolveTCPAddr("tcp", ":1935")
+	flag.Parse()
+	if *configPath != "" {
+		if err := waldo.LoadConfigFile(*configPath, flag.CommandLine); err != nil {
+			log.Panicf("Failed: %+v", err)
+		}
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(*logLevel)); err != nil {
+		log.Panicf("Failed: unknown log level %q, want debug, info, warn or error", *logLevel)
+	}
+	logOptions := &slog.HandlerOptions{Level: level}
+	switch *logFormat {
+	case "text":
+		slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, logOptions)))
+	case "json":
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, logOptions)))
+	default:
+		log.Panicf("Failed: unknown log format %q, want text or json", *logFormat)
+	}
+
+	if *headless {
+		slog.Info("Running headless")
+	} else {
+		slog.Info("Showing detections in a window")
+	}
+
+	if *outputFormat == "mp4" && *remuxToMP4 {
+		slog.Warn("-remux-to-mp4 has no effect with -output-format mp4")
+	}
+	if err := checkPaths(); err != nil {
+		log.Panicf("Failed: %+v", err)
+	}
+
+	mean, err := waldo.ParseScalar(*dnnMean)
 	if err != nil {
 		log.Panicf("Failed: %+v", err)
 	}
+	cascade := waldo.CascadeParams{ScaleFactor: *cascadeScale, MinNeighbors: *cascadeMinNeigh}
+	if cascade.MinSize, err = waldo.ParseSize(*cascadeMinSize); err != nil {
+		log.Panicf("Failed: -cascade-min-size: %+v", err)
+	}
+	if cascade.MaxSize, err = waldo.ParseSize(*cascadeMaxSize); err != nil {
+		log.Panicf("Failed: -cascade-max-size: %+v", err)
+	}
+	if err := cascade.Validate(); err != nil {
+		log.Panicf("Failed: %+v", err)
+	}
+	roi, err := waldo.ParseROI(*detectROI)
+	if err != nil {
+		log.Panicf("Failed: -roi: %+v", err)
+	}
+	visionCfg := waldo.VisionConfig{
+		Detector: waldo.DetectorConfig{
+			Backend:     *detectorBackend,
+			CascadePath: *cascadePath,
+			Cascade:     cascade,
+			Model:       *dnnModel,
+			ModelConfig: *dnnConfig,
+			LabelsPath:  *dnnLabels,
+			InputSize:   *dnnSize,
+			Scale:       *dnnScale,
+			Mean:        mean,
+			SwapRB:      *dnnSwapRB,
+			Confidence:  float32(*dnnConfidence),
+			Format:      *dnnModelFormat,
+			NetBackend:  gocv.ParseNetBackend(*dnnBackend),
+			NetTarget:   gocv.ParseNetTarget(*dnnTarget),
+
+			NMSThreshold: float32(*dnnNMS),
+			Letterbox:    *dnnLetterbox,
+		},
+		Headless:        *headless,
+		MotionThreshold: *motionThreshold,
+		MaxDimension:    *detectMaxDim,
+		ROI:             roi,
+	}
 
-	listener, err := net.ListenTCP("tcp", tcpAddr)
+	if *cvBgHistory <= 0 || *cvBgThresh <= 0 {
+		log.Panicf("Failed: -cv-background-history and -cv-background-threshold must be positive")
+	}
+	pipeline, err := waldo.NewPipelineFromNames(*cvStages, waldo.StageConfig{BackgroundHistory: *cvBgHistory, BackgroundThreshold: *cvBgThresh})
+	if err != nil {
+		log.Panicf("Failed: -cv-stages: %+v", err)
+	}
+
+	mode, err := waldo.ParseSampleMode(*sampleMode)
 	if err != nil {
 		log.Panicf("Failed: %+v", err)
 	}
+	sampling := waldo.SamplingPolicy{Mode: mode, N: *sampleEvery, MinInterval: *cvInterval, KeyframeEvery: *cvEveryKey, MaxFPS: *cvStreamFPS}
+	if (*annotateOutput || *reencode) && sampling.DecodesStream() {
+		slog.Warn("-annotate-output only applies with -sample keyframe, recordings keep the original pictures")
+	}
 
-	fmt.Printf("Listening on %s\n", tcpAddr)
+	var remuxer *waldo.Remuxer
+	if *remuxToMP4 {
+		remuxer = waldo.NewRemuxer(waldo.FFmpegRemux{}, *remuxWorkers, *remuxQueue, *deleteFLVAfterRemux)
+	}
+	maxFPS, err := waldo.ParseStreamRates(*cvMaxFPS)
+	if err != nil {
+		log.Panicf("Failed: -cv-max-fps: %+v", err)
+	}
+	relays, err := waldo.ParseRelayTargets(*relayURLs)
+	if err != nil {
+		log.Panicf("Failed: -relay: %+v", err)
+	}
 
-	srv := rtmp.NewServer(&rtmp.ServerConfig{
-		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *rtmp.ConnConfig) {
-			h := &Handler{}
+	var notifier *waldo.Notifier
+	if *webhookURLs != "" {
+		notifier = waldo.NewNotifier(waldo.NotifierConfig{
+			URLs:       strings.Split(*webhookURLs, ","),
+			Cooldown:   *webhookCooldown,
+			Retries:    *webhookRetries,
+			RetryDelay: *webhookRetryWait,
+			QueueSize:  *webhookQueue,
+			Timeout:    *webhookTimeout,
+			Thumbnails: *webhookThumbnail,
 
-			return conn, &rtmp.ConnConfig{
-				Handler: h,
+			Secret:         *webhookSecret,
+			EveryDetection: *webhookEvery,
+		})
+	}
 
-				ControlState: rtmp.StreamControlStateConfig{
-					DefaultBandwidthWindowSize: 6 * 1024 * 1024 / 8,
-				},
+	var auth waldo.Authenticator
+	if *streamSecret != "" {
+		auth = &waldo.SharedSecret{Secret: *streamSecret}
+	} else {
+		keys := waldo.NewStreamKeys(strings.Split(*streamKeys, ",")...)
+		keys.Add(strings.Split(os.Getenv("WALDO_STREAM_KEYS"), ",")...)
+		if *streamKeysFile != "" {
+			if err := keys.Load(*streamKeysFile); err != nil {
+				log.Panicf("Failed: %+v", err)
 			}
-		},
+		}
+		if !keys.Empty() {
+			auth = keys
+		}
+	}
+
+	var matcher *waldo.TemplateMatcher
+	if *templatePaths != "" {
+		paths, err := waldo.ExpandTemplatePaths(strings.Split(*templatePaths, ","))
+		if err != nil {
+			log.Panicf("Failed: %+v", err)
+		}
+		matcher, err = waldo.NewTemplateMatcher(paths, waldo.TemplateMatcherConfig{
+			MinScale:  *templateMinScale,
+			MaxScale:  *templateMaxScale,
+			ScaleStep: *templateScaleStep,
+			Threshold: *templateThreshold,
+			TopN:      *templateTopN,
+			NMSIoU:    *templateNMSIoU,
+		})
+		if err != nil {
+			log.Panicf("Failed: %+v", err)
+		}
+		slog.Info("Loaded templates", "count", len(paths))
+		defer matcher.Close()
+	}
+
+	var encode *waldo.H264EncoderConfig
+	if *annotateOutput || *reencode {
+		encode = &waldo.H264EncoderConfig{QP: *encodeQP, BitrateKbps: *encodeBitrate}
+	}
+	listenAddr, err := rtmpListenAddr(*rtmpAddr, *rtmpPort)
+	if err != nil {
+		log.Panicf("Failed: %+v", err)
+	}
+	apiAddr := *httpAddr
+	if apiAddr == "" {
+		apiAddr = fmt.Sprintf(":%d", *httpPort)
+	}
+	var origins []string
+	if *wsOrigins != "" {
+		origins = strings.Split(*wsOrigins, ",")
+	}
+
+	server, err := waldo.NewServer(waldo.Options{
+		RTMPAddr: listenAddr,
+		HTTPAddr: apiAddr,
+
+		OutputDir:       *outputDir,
+		RecordingLayout: *recordingLayout,
+		OutputFormat:    *outputFormat,
+		RejectExisting:  *rejectExisting,
+		SegmentDuration: *segmentDuration,
+		SegmentSize:     int64(*segmentSizeMB) * 1024 * 1024,
+		FlushInterval:   *flushInterval,
+		SyncInterval:    *syncInterval,
+		Remuxer:         remuxer,
+
+		HLSDir:             *hlsDir,
+		HLSSegmentDuration: *hlsSegmentDuration,
+		HLSWindow:          *hlsWindow,
+		HLSCleanup:         *hlsCleanup,
+		PlayerQueue:        *playerQueue,
+		Relays:             relays,
+
+		Auth:               auth,
+		StreamTimeout:      *streamTimeout,
+		MaxConnections:     *maxConnections,
+		MaxPublishesPerKey: *maxKeyStreams,
+
+		APIToken:         *apiToken,
+		WebSocketOrigins: origins,
+
+		Vision:             visionCfg,
+		Matcher:            matcher,
+		Pipeline:           pipeline,
+		Sampling:           sampling,
+		DetectionThreshold: *detectThreshold,
+		CVMaxFPS:           maxFPS,
+		CVResize:           image.Pt(*cvResizeW, *cvResizeH),
+		CVWorkers:          *cvWorkers,
+		CVQueue:            *cvQueue,
+		StripePrefilter:    *stripePrefilter,
+		AnnotateOutput:     encode,
+		AudioThreshold:     *audioThreshold,
+
+		Notifier:                 notifier,
+		DetectionHistory:         *detectionHistory,
+		FrameCacheSize:           *frameCacheSize,
+		EventThreshold:           *eventThreshold,
+		EventThumbnails:          *eventThumbnails,
+		MaxThumbnails:            *maxThumbnails,
+		DetectionFramesPerMinute: *detectionFrames,
+		DetectionSaveDir:         *detectionSaveDir,
+		DetectionSaveScore:       *detectionScore,
+		ThumbnailMargin:          *thumbnailMargin,
+		AnnotatedFrames:          *annotatedFrames,
+		MetricsStreamLabels:      *metricsPerStream,
+		PreviewFPS:               *previewFPS,
 	})
-	if err := srv.Serve(listener); err != nil {
+	if err != nil {
+		log.Panicf("Failed: %+v", err)
+	}
+
+	if *replayPath != "" {
+		if err := server.Replay(*replayPath); err != nil {
+			log.Panicf("Failed: %+v", err)
+		}
+		if remuxer != nil {
+			remuxer.Wait()
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := notifier.Close(ctx); err != nil {
+			slog.Warn("Some webhooks were not delivered", "err", err)
+		}
+		return
+	}
+
+	switch {
+	case *tlsCert != "" && *tlsKey != "":
+		tlsListener, err := listenRTMPS(*rtmpsAddr, *tlsCert, *tlsKey)
+		if err != nil {
+			log.Panicf("Failed: %+v", err)
+		}
+		slog.Info("RTMPS listening", "addr", tlsListener.Addr().String())
+		go func() {
+			if err := server.Serve(tlsListener); err != nil {
+				log.Panicf("Failed: %+v", err)
+			}
+		}()
+	case *tlsCert != "" || *tlsKey != "":
+		slog.Warn("RTMPS needs both -tls-cert and -tls-key, only plain RTMP is served")
+	}
+
+	if *apiToken == "" && !isLoopbackAddr(apiAddr) {
+		slog.Warn("HTTP API is open to anyone who can reach it, set -api-token or listen on localhost with -http-addr", "addr", apiAddr)
+	}
+	go func() {
+		if err := server.ListenAndServeAPI(); err != nil {
+			log.Panicf("Failed: %+v", err)
+		}
+	}()
+
+	// Finalize recordings on Ctrl-C so the FLV files stay playable
+	sigCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+
+		<-sigCtx.Done()
+		stopSignals()
+		slog.Info("Received shutdown signal, finalizing streams")
+
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			slog.Error("Shutdown timed out, forcing exit", "timeout", *shutdownTimeout)
+			os.Exit(1)
+		}
+	}()
+
+	if err := server.ListenAndServe(); err != nil {
 		log.Panicf("Failed: %+v", err)
 	}
+	<-drained
+	slog.Info("Shutdown complete")
+}
+
+// Check the files main loads itself are readable, so a typo fails at startup rather than with the
+// first stream. NewServer checks the rest of the settings
+func checkPaths() error {
+	files := map[string]string{
+		"cascade":          *cascadePath,
+		"tls-cert":         *tlsCert,
+		"tls-key":          *tlsKey,
+		"stream-keys-file": *streamKeysFile,
+	}
+	for name, path := range files {
+		if path == "" {
+			continue
+		}
+		if err := waldo.CheckReadableFile(path); err != nil {
+			return errors.Wrapf(err, "-%s", name)
+		}
+	}
+	if *templatePaths != "" {
+		paths, err := waldo.ExpandTemplatePaths(strings.Split(*templatePaths, ","))
+		if err != nil {
+			return errors.Wrap(err, "-templates")
+		}
+		for _, path := range paths {
+			if err := waldo.CheckReadableFile(path); err != nil {
+				return errors.Wrap(err, "-templates")
+			}
+		}
+	}
+
+	return nil
+}
+
+// Listen for RTMP over TLS with the given certificate and key
+func listenRTMPS(addr, certFile, keyFile string) (net.Listener, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to load TLS certificate")
+	}
+	if err := checkCertValidity(cert.Leaf, time.Now()); err != nil {
+		return nil, err
+	}
+	if until := time.Until(cert.Leaf.NotAfter); until < 7*24*time.Hour {
+		slog.Warn("TLS certificate expires soon", "not_after", cert.Leaf.NotAfter)
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to listen for RTMPS")
+	}
+
+	return tls.NewListener(l, &tls.Config{
+		// A certificate that expires while running fails every handshake, loudly, instead of being served
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if err := checkCertValidity(cert.Leaf, time.Now()); err != nil {
+				slog.Error("Rejected RTMPS connection", "remote", hello.Conn.RemoteAddr().String(), "err", err)
+				return nil, err
+			}
+			return &cert, nil
+		},
+		MinVersion: tls.VersionTLS12,
+	}), nil
+}
+
+// Fail for a certificate outside its validity period at now
+func checkCertValidity(cert *x509.Certificate, now time.Time) error {
+	if now.After(cert.NotAfter) {
+		return errors.Errorf("TLS certificate for %s expired on %s", cert.Subject.CommonName, cert.NotAfter.Format(time.RFC3339))
+	}
+	if now.Before(cert.NotBefore) {
+		return errors.Errorf("TLS certificate for %s is not valid before %s", cert.Subject.CommonName, cert.NotBefore.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Combine -rtmp-addr and -rtmp-port, port 0 keeps the port from addr
+func rtmpListenAddr(addr string, port int) (string, error) {
+	host, addrPort, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "Invalid RTMP address %q", addr)
+	}
+
+	if port == 0 {
+		if port, err = strconv.Atoi(addrPort); err != nil {
+			return "", errors.Errorf("Invalid RTMP port %q", addrPort)
+		}
+	}
+	if port < 1 || port > 65535 {
+		return "", errors.Errorf("RTMP port %d out of range 1-65535", port)
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// True when addr only accepts connections from this machine
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
 }
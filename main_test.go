@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+
+	"FindingWaldo/waldo"
+)
+
+// Write a self-signed certificate for 127.0.0.1, valid from notBefore to notAfter, and its key as PEM files
+func writeTestCert(t *testing.T, notBefore, notAfter time.Time) (certFile, keyFile string, cert *x509.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "waldo test"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert, err = x509.ParseCertificate(der); err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile, cert
+}
+
+func TestRTMPSPublish(t *testing.T) {
+	certFile, keyFile, cert := writeTestCert(t, time.Now().Add(-time.Hour), time.Now().Add(30*24*time.Hour))
+	l, err := listenRTMPS("127.0.0.1:0", certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := waldo.NewServer(waldo.Options{
+		OutputDir:   t.TempDir(),
+		NewDetector: func() (waldo.Detector, error) { return nil, errors.New("No CV in tests") },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = s.Serve(l) }()
+	t.Cleanup(s.Close)
+
+	// Only a client trusting the certificate gets through the TLS handshake, then the RTMP one
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	addr := l.Addr().String()
+	conn, err := rtmp.TLSDial("rtmps", addr, &rtmp.ConnConfig{}, &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.Connect(&rtmpmsg.NetConnectionConnect{
+		Command: rtmpmsg.NetConnectionConnectCommand{App: "live", Type: "nonprivate", FlashVer: "FMLE/3.0", TCURL: "rtmps://" + addr + "/live"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := conn.CreateStream(nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Publish(&rtmpmsg.NetStreamPublish{PublishingName: "cam", PublishingType: "live"}); err != nil {
+		t.Fatal(err)
+	}
+
+	api := s.Handler()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/streams/cam", nil))
+		if w.Code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Stream published over RTMPS never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestListenRTMPSRejectsBadCertificates(t *testing.T) {
+	expiredCert, expiredKey, _ := writeTestCert(t, time.Now().Add(-48*time.Hour), time.Now().Add(-24*time.Hour))
+	if _, err := listenRTMPS("127.0.0.1:0", expiredCert, expiredKey); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expired certificate: got %v", err)
+	}
+	if _, err := listenRTMPS("127.0.0.1:0", filepath.Join(t.TempDir(), "missing.pem"), expiredKey); err == nil {
+		t.Error("Missing certificate accepted")
+	}
+}
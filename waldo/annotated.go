@@ -0,0 +1,69 @@
+package waldo
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gocv.io/x/gocv"
+)
+
+// AnnotatedFrames Saves every frame run through CV, with its detections drawn in, as numbered JPEGs
+// in a directory next to the recording. A quick review needs no second decode and no video codec,
+// any browser or image viewer shows them. Safe for concurrent use
+type AnnotatedFrames struct {
+	mu  sync.Mutex
+	dir string // Empty while no recording is open
+	n   int
+}
+
+// Start the frames of a new recording in dir
+func (a *AnnotatedFrames) Open(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrap(err, "Failed to create annotated frame directory")
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.dir = dir
+	a.n = 0
+
+	return nil
+}
+
+// Save a frame as <n>-<timestamp>.jpg, numbered in the order frames arrive
+func (a *AnnotatedFrames) Write(frame gocv.Mat, timestamp uint32) error {
+	buf, err := gocv.IMEncode(gocv.JPEGFileExt, frame)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode annotated frame")
+	}
+	defer buf.Close()
+
+	a.mu.Lock()
+	if a.dir == "" {
+		a.mu.Unlock()
+		return nil
+	}
+	a.n++
+	p := filepath.Join(a.dir, fmt.Sprintf("%06d-%d.jpg", a.n, timestamp))
+	a.mu.Unlock()
+
+	return errors.Wrap(os.WriteFile(p, buf.GetBytes(), 0644), "Failed to save annotated frame")
+}
+
+// Stop saving until the next Open
+func (a *AnnotatedFrames) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.dir = ""
+}
+
+// received/<name>.flv (or .mp4) -> received/<name>.frames
+func annotatedFramesPath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + ".frames"
+}
@@ -0,0 +1,59 @@
+package waldo
+
+import (
+	"image"
+	"image/jpeg"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+func TestAnnotatedFramesPath(t *testing.T) {
+	if got := annotatedFramesPath(filepath.Join("received", "cam.flv")); got != filepath.Join("received", "cam.frames") {
+		t.Errorf("Got %s", got)
+	}
+}
+
+func TestAnnotatedFramesWrite(t *testing.T) {
+	frame := gocv.NewMatWithSize(48, 64, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+
+	dir := filepath.Join(t.TempDir(), "cam.frames")
+	var a AnnotatedFrames
+	if err := a.Write(frame, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Open(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, ts := range []uint32{40, 80} {
+		if err := a.Write(frame, ts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a.Close()
+	if err := a.Write(frame, 120); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the frames between Open and Close are kept, numbered in order
+	files, _ := filepath.Glob(filepath.Join(dir, "*.jpg"))
+	want := []string{filepath.Join(dir, "000001-40.jpg"), filepath.Join(dir, "000002-80.jpg")}
+	if len(files) != len(want) || files[0] != want[0] || files[1] != want[1] {
+		t.Fatalf("Got frames %v, want %v", files, want)
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Bounds().Size(); got != image.Pt(64, 48) {
+		t.Errorf("Frame is %v, want 64x48", got)
+	}
+}
@@ -0,0 +1,240 @@
+package waldo
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// streamInfo Entry in the GET /streams listing, and body of GET /streams/{name}
+type streamInfo struct {
+	Name            string    `json:"name"`
+	Remote          string    `json:"remote"`
+	RecordingPath   string    `json:"recording_path"`
+	Started         time.Time `json:"started"`
+	VideoCodec      string    `json:"video_codec,omitempty"`
+	Width           int       `json:"width,omitempty"` // Omitted until known
+	Height          int       `json:"height,omitempty"`
+	TagsWritten     uint64    `json:"tags_written"`
+	BytesWritten    uint64    `json:"bytes_written"`
+	FramesProcessed uint64    `json:"frames_processed"` // Keyframes (or sampled frames) run through CV
+	Detections      uint64    `json:"detections"`
+	Players         int       `json:"players"` // RTMP players and relays fed from the stream
+}
+
+func newStreamInfo(name string, h *Handler) streamInfo {
+	return streamInfo{
+		Name:            name,
+		Remote:          h.remoteAddr,
+		RecordingPath:   h.RecordingPath(),
+		Started:         h.started,
+		VideoCodec:      h.stats.videoCodec(),
+		Width:           int(h.stats.Width.Load()),
+		Height:          int(h.stats.Height.Load()),
+		TagsWritten:     h.stats.TagsWritten.Load(),
+		BytesWritten:    h.stats.BytesWritten.Load(),
+		FramesProcessed: h.stats.FramesProcessed.Load(),
+		Detections:      h.stats.Detections.Load(),
+		Players:         h.playback.Players(),
+	}
+}
+
+// HTTP control API over the active streams
+func newAPIHandler(config *Config, registry *StreamRegistry, events *EventBroker, metrics *Metrics, remuxer *Remuxer, started time.Time, hlsDir string, previewFPS float64, wsOrigins []string) http.Handler {
+	mux := http.NewServeMux()
+
+	if hlsDir != "" {
+		mux.Handle("GET /hls/", http.StripPrefix("/hls/", hlsFileServer(hlsDir)))
+	}
+
+	mux.HandleFunc("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, collectStatus(registry, remuxer, started))
+	})
+
+	mux.HandleFunc("GET /metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, collectStatus(registry, remuxer, started))
+		metrics.Write(w)
+	})
+
+	// Body {"threshold": 0.8}, answered with the threshold now in effect
+	mux.HandleFunc("POST /config/threshold", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Threshold *float64 `json:"threshold"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&body); err != nil || body.Threshold == nil {
+			http.Error(w, `Expected {"threshold": <0-1>}`, http.StatusBadRequest)
+			return
+		}
+		if err := config.SetDetectionThreshold(*body.Threshold); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		slog.Info("Detection threshold changed by API request", "threshold", *body.Threshold)
+		writeJSON(w, map[string]float64{"threshold": config.DetectionThreshold()})
+	})
+
+	mux.HandleFunc("GET /streams", func(w http.ResponseWriter, r *http.Request) {
+		streams := []streamInfo{}
+		for _, name := range registry.List() {
+			if h, ok := registry.Get(name); ok {
+				streams = append(streams, newStreamInfo(name, h))
+			}
+		}
+		writeJSON(w, streams)
+	})
+
+	mux.HandleFunc("GET /streams/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		h, ok := registry.Get(name)
+		if !ok {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, newStreamInfo(name, h))
+	})
+
+	mux.HandleFunc("GET /streams/{name}/detections", func(w http.ResponseWriter, r *http.Request) {
+		h, ok := registry.Get(r.PathValue("name"))
+		if !ok {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, h.history.Snapshot())
+	})
+
+	mux.HandleFunc("GET /streams/{name}/stats", func(w http.ResponseWriter, r *http.Request) {
+		h, ok := registry.Get(r.PathValue("name"))
+		if !ok {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, h.stats.response())
+	})
+
+	mux.HandleFunc("GET /streams/{name}/snapshot", func(w http.ResponseWriter, r *http.Request) {
+		h, ok := registry.Get(r.PathValue("name"))
+		if !ok {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		serveSnapshot(w, h.frames)
+	})
+
+	// Live MJPEG of the frames behind snapshot.jpg, for watching in a browser
+	mux.HandleFunc("GET /streams/{name}/preview", func(w http.ResponseWriter, r *http.Request) {
+		h, ok := registry.Get(r.PathValue("name"))
+		if !ok {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		servePreview(w, r, h.annotated, h.closed, previewFPS)
+	})
+
+	// Like snapshot, but after CV with the detections drawn in
+	mux.HandleFunc("GET /streams/{name}/snapshot.jpg", func(w http.ResponseWriter, r *http.Request) {
+		h, ok := registry.Get(r.PathValue("name"))
+		if !ok {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		serveSnapshot(w, h.annotated)
+	})
+
+	mux.HandleFunc("POST /streams/{name}/stop", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		h, ok := registry.Get(name)
+		if !ok {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+
+		slog.Info("Stopping stream by API request", "stream", name)
+		if err := h.Stop(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.Handle("GET /ws/detections", eventsWebSocket(wsOrigins,
+		func() (uint64, <-chan DetectionEvent) { return events.Subscribe(64) }, events.Unsubscribe))
+
+	// One message per frame with detections, all its boxes and optionally a thumbnail
+	mux.Handle("GET /ws/events", eventsWebSocket(wsOrigins,
+		func() (uint64, <-chan FrameEvent) { return events.SubscribeFrames(16) }, events.Unsubscribe))
+
+	return mux
+}
+
+// Refuse requests that do not carry token, as "Authorization: Bearer <token>" or, for browsers opening
+// websockets and images where headers can't be set, as ?token=. An empty token lets everything through.
+// HLS players must send the header, the playlists don't pass the query on to segments
+func requireAPIToken(token string, next http.Handler) http.Handler {
+	if token == "" {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := r.URL.Query().Get("token")
+		if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+			got = bearer
+		}
+		if !secretEqual(got, token) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="waldo"`)
+			http.Error(w, "Missing or wrong API token", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Write the latest frame in cache as a JPEG, 503 when there is none yet
+func serveSnapshot(w http.ResponseWriter, cache *FrameCache) {
+	frame, ok := cache.Latest()
+	if !ok {
+		http.Error(w, "No frame decoded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	jpeg, err := frame.JPEG()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	if _, err := w.Write(jpeg); err != nil {
+		slog.Warn("Failed to write response", "err", err)
+	}
+}
+
+// Serve HLS playlists and segments with their content types, which the system MIME tables often lack
+func hlsFileServer(dir string) http.Handler {
+	files := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Players in other origins, e.g. a page with hls.js, may fetch the stream
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		switch path.Ext(r.URL.Path) {
+		case ".m3u8":
+			// Rewritten with every segment
+			w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+			w.Header().Set("Cache-Control", "no-cache")
+		case ".ts":
+			// Never change once listed, but names are reused when a stream is published again
+			w.Header().Set("Content-Type", "video/mp2t")
+			w.Header().Set("Cache-Control", "public, max-age=60")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to write response", "err", err)
+	}
+}
@@ -0,0 +1,198 @@
+package waldo
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+	"gocv.io/x/gocv"
+)
+
+func TestRequireAPIToken(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		desc   string
+		token  string
+		url    string
+		header string
+		want   int
+	}{
+		{desc: "no token configured", url: "/status", want: http.StatusNoContent},
+		{desc: "missing", token: "t0k", url: "/streams/cam/stop", want: http.StatusUnauthorized},
+		{desc: "bearer", token: "t0k", url: "/streams/cam/stop", header: "Bearer t0k", want: http.StatusNoContent},
+		{desc: "wrong bearer", token: "t0k", url: "/status", header: "Bearer nope", want: http.StatusUnauthorized},
+		{desc: "basic auth is not a bearer", token: "t0k", url: "/status", header: "Basic t0k", want: http.StatusUnauthorized},
+		{desc: "query", token: "t0k", url: "/ws/detections?token=t0k", want: http.StatusNoContent},
+		{desc: "wrong query", token: "t0k", url: "/ws/detections?token=nope", want: http.StatusUnauthorized},
+		{desc: "header wins over query", token: "t0k", url: "/status?token=t0k", header: "Bearer nope", want: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.url, nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		requireAPIToken(tt.token, ok).ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status %d, want %d", tt.desc, w.Code, tt.want)
+		}
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s, h := newTestHandler(t, Options{})
+	defer h.OnClose()
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	api := s.Handler()
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+	if w := get("/streams/nope/snapshot"); w.Code != http.StatusNotFound {
+		t.Errorf("Unknown stream: status %d, want 404", w.Code)
+	}
+	if w := get("/streams/cam/snapshot"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Before the first frame: status %d, want 503", w.Code)
+	}
+
+	frame := gocv.NewMatWithSize(120, 160, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+	h.frames.Put(40, frame)
+
+	w := get("/streams/cam/snapshot")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status %d: %s", w.Code, w.Body)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/jpeg" {
+		t.Errorf("Content-Type %q", ct)
+	}
+	img, err := jpeg.Decode(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Bounds().Size(); got != image.Pt(160, 120) {
+		t.Errorf("Snapshot is %v, want 160x120", got)
+	}
+}
+
+func TestSnapshotJPGFromStream(t *testing.T) {
+	sample := sampleFLV(t)
+	s, h := newTestHandler(t, Options{})
+	defer h.OnClose()
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	api := s.Handler()
+
+	get := func(url string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		return w
+	}
+	if w := get("/streams/nope/snapshot.jpg"); w.Code != http.StatusNotFound {
+		t.Errorf("Unknown stream: status %d, want 404", w.Code)
+	}
+	if w := get("/streams/cam/snapshot.jpg"); w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Before the first frame: status %d, want 503", w.Code)
+	}
+
+	feedFLV(t, h, sample)
+
+	// CV workers may still be on the first keyframe
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, ok := h.annotated.Latest(); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("No keyframe decoded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	w := get("/streams/cam/snapshot.jpg")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Status %d: %s", w.Code, w.Body)
+	}
+	img, err := jpeg.Decode(w.Body)
+	if err != nil {
+		t.Fatalf("Not a JPEG: %v", err)
+	}
+	want := image.Pt(int(h.stats.Width.Load()), int(h.stats.Height.Load()))
+	if got := img.Bounds().Size(); got != want || got.X == 0 {
+		t.Errorf("Snapshot is %v, want the stream's %v", got, want)
+	}
+}
+
+func TestStreamsAPIReflectsPublish(t *testing.T) {
+	s, h := newTestHandler(t, Options{})
+	api := s.Handler()
+	get := func(url string, v any) int {
+		t.Helper()
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code == http.StatusOK && v != nil {
+			if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+				t.Fatalf("%s: %v", url, err)
+			}
+		}
+		return w.Code
+	}
+
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnVideo(0, bytes.NewReader(avcSequenceHeader(testSPS, testPPS))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 25; i++ {
+		if err := h.OnVideo(uint32(i*40), bytes.NewReader(avcFrame(i%10 == 0, []byte("cam")))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var streams []streamInfo
+	if code := get("/streams", &streams); code != http.StatusOK || len(streams) != 1 {
+		t.Fatalf("GET /streams: status %d, %v, want the one stream", code, streams)
+	}
+	got := streams[0]
+	if got.Name != "cam" || got.VideoCodec != "H.264" || got.Width != 64 || got.Height != 64 || got.TagsWritten != 26 || got.BytesWritten == 0 {
+		t.Errorf("Got %+v, want cam, H.264 64x64 with 26 tags written", got)
+	}
+	var one streamInfo
+	if code := get("/streams/cam", &one); code != http.StatusOK || one.Name != "cam" || one.TagsWritten != 26 {
+		t.Errorf("GET /streams/cam: status %d, %+v", code, one)
+	}
+	if code := get("/streams/nope", nil); code != http.StatusNotFound {
+		t.Errorf("GET /streams/nope: status %d, want 404", code)
+	}
+	var status serverStatus
+	if code := get("/status", &status); code != http.StatusOK || len(status.Streams) != 1 || status.Streams[0].Name != "cam" || status.Streams[0].BytesReceived == 0 {
+		t.Errorf("GET /status: status %d, %+v, want cam with bytes received", code, status)
+	}
+
+	// Gone once the stream ends
+	h.OnClose()
+	if code := get("/streams", &streams); code != http.StatusOK || len(streams) != 0 {
+		t.Errorf("GET /streams after close: status %d, %v, want none", code, streams)
+	}
+	if code := get("/streams/cam", nil); code != http.StatusNotFound {
+		t.Errorf("GET /streams/cam after close: status %d, want 404", code)
+	}
+	if code := get("/status", &status); code != http.StatusOK || len(status.Streams) != 0 {
+		t.Errorf("GET /status after close: status %d, %+v, want no streams", code, status)
+	}
+}
@@ -0,0 +1,184 @@
+package waldo
+
+import (
+	"encoding/binary"
+	"log/slog"
+	"math"
+
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+// AudioEvent Emitted by an AudioProcessor when something interesting is heard
+type AudioEvent struct {
+	Kind      string
+	Timestamp uint32
+	Level     float64 // dBFS
+}
+
+// PCMFrame Decoded audio handed to an AudioProcessor
+type PCMFrame struct {
+	Timestamp  uint32
+	SampleRate int
+	Channels   int
+	Samples    []int16 // Interleaved
+}
+
+// AudioProcessor Inspects decoded PCM from a stream and reports events
+type AudioProcessor interface {
+	Process(frame *PCMFrame) []AudioEvent
+}
+
+// LoudnessDetector Emits an event each time the RMS level rises above Threshold
+type LoudnessDetector struct {
+	Threshold float64 // dBFS, e.g. -10
+	above     bool
+}
+
+func (d *LoudnessDetector) Process(frame *PCMFrame) []AudioEvent {
+	level := rmsLevel(frame.Samples)
+
+	wasAbove := d.above
+	d.above = level >= d.Threshold
+	if !d.above || wasAbove {
+		return nil
+	}
+
+	return []AudioEvent{{
+		Kind:      "loud",
+		Timestamp: frame.Timestamp,
+		Level:     level,
+	}}
+}
+
+// RMS level of the samples in dBFS
+func rmsLevel(samples []int16) float64 {
+	if len(samples) == 0 {
+		return math.Inf(-1)
+	}
+
+	var sum float64
+	for _, s := range samples {
+		v := float64(s) / math.MaxInt16
+		sum += v * v
+	}
+
+	return 20 * math.Log10(math.Sqrt(sum/float64(len(samples))))
+}
+
+// audioJob Raw audio tag queued for the audio worker
+type audioJob struct {
+	timestamp uint32
+	format    flvtag.SoundFormat
+	rate      flvtag.SoundRate
+	size      flvtag.SoundSize
+	channels  flvtag.SoundType
+	data      []byte
+}
+
+// Runs the AudioProcessor off the RTMP read loop
+func runAudioWorker(logger *slog.Logger, proc AudioProcessor, jobs <-chan audioJob) {
+	warned := make(map[flvtag.SoundFormat]bool)
+
+	for job := range jobs {
+		frame, ok := decodePCM(job)
+		if !ok {
+			if !warned[job.format] {
+				logger.Warn("Audio format cannot be decoded, skipping audio detection", "sound_format", job.format)
+				warned[job.format] = true
+			}
+			continue
+		}
+
+		for _, ev := range proc.Process(frame) {
+			logger.Info("Audio event", "kind", ev.Kind, "timestamp", ev.Timestamp, "level_dbfs", ev.Level)
+		}
+	}
+}
+
+// Decode an FLV audio payload into 16-bit PCM. Only uncompressed and G.711 formats are supported
+func decodePCM(job audioJob) (*PCMFrame, bool) {
+	frame := &PCMFrame{
+		Timestamp:  job.timestamp,
+		SampleRate: soundRateHz(job.rate),
+		Channels:   1,
+	}
+	if job.channels == flvtag.SoundTypeStereo {
+		frame.Channels = 2
+	}
+
+	switch job.format {
+	case flvtag.SoundFormatLinearPCMPlatformEndian, flvtag.SoundFormatLinearPCMLittleEndian:
+		if job.size == flvtag.SoundSize8Bit {
+			frame.Samples = make([]int16, len(job.data))
+			for i, b := range job.data {
+				frame.Samples[i] = (int16(b) - 128) << 8
+			}
+		} else {
+			frame.Samples = make([]int16, len(job.data)/2)
+			for i := range frame.Samples {
+				frame.Samples[i] = int16(binary.LittleEndian.Uint16(job.data[i*2:]))
+			}
+		}
+
+	case flvtag.SoundFormatG711ALawLogarithmicPCM:
+		frame.Samples = make([]int16, len(job.data))
+		for i, b := range job.data {
+			frame.Samples[i] = alawToLinear(b)
+		}
+		frame.SampleRate = 8000
+
+	case flvtag.SoundFormatG711muLawLogarithmicPCM:
+		frame.Samples = make([]int16, len(job.data))
+		for i, b := range job.data {
+			frame.Samples[i] = ulawToLinear(b)
+		}
+		frame.SampleRate = 8000
+
+	default:
+		return nil, false
+	}
+
+	return frame, true
+}
+
+func soundRateHz(rate flvtag.SoundRate) int {
+	switch rate {
+	case flvtag.SoundRate5_5kHz:
+		return 5512
+	case flvtag.SoundRate11kHz:
+		return 11025
+	case flvtag.SoundRate22kHz:
+		return 22050
+	default:
+		return 44100
+	}
+}
+
+func alawToLinear(b byte) int16 {
+	b ^= 0x55
+	t := int16(b&0x0f) << 4
+	seg := (b & 0x70) >> 4
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= seg - 1
+	}
+	if b&0x80 != 0 {
+		return t
+	}
+	return -t
+}
+
+func ulawToLinear(b byte) int16 {
+	b = ^b
+	t := (int16(b&0x0f) << 3) + 0x84
+	t <<= (b & 0x70) >> 4
+	if b&0x80 != 0 {
+		return 0x84 - t
+	}
+	return t - 0x84
+}
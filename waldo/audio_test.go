@@ -0,0 +1,75 @@
+package waldo
+
+import (
+	"math"
+	"testing"
+)
+
+// A frame of n samples alternating between +amplitude and -amplitude of full scale
+func squareFrame(timestamp uint32, amplitude float64, n int) *PCMFrame {
+	samples := make([]int16, n)
+	for i := range samples {
+		samples[i] = int16(amplitude * math.MaxInt16)
+		if i%2 == 1 {
+			samples[i] = -samples[i]
+		}
+	}
+
+	return &PCMFrame{Timestamp: timestamp, SampleRate: 44100, Channels: 1, Samples: samples}
+}
+
+func TestRMSLevel(t *testing.T) {
+	tests := []struct {
+		name      string
+		amplitude float64
+		n         int
+		want      float64
+	}{
+		{"full scale", 1, 64, 0},
+		{"half scale", 0.5, 64, 20 * math.Log10(0.5)},
+		{"tenth", 0.1, 64, 20 * math.Log10(0.1)},
+		{"silence", 0, 64, math.Inf(-1)},
+		{"no samples", 1, 0, math.Inf(-1)},
+	}
+	for _, tt := range tests {
+		got := rmsLevel(squareFrame(0, tt.amplitude, tt.n).Samples)
+		if math.IsInf(tt.want, -1) && !math.IsInf(got, -1) || !math.IsInf(tt.want, -1) && math.Abs(got-tt.want) > 0.01 {
+			t.Errorf("%s: rmsLevel = %v dBFS, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestLoudnessDetector(t *testing.T) {
+	// One event per crossing above -10 dBFS, none while the level stays up or for silence
+	steps := []struct {
+		name      string
+		amplitude float64
+		n         int
+		loud      bool
+	}{
+		{"silence", 0, 64, false},
+		{"rises above", 0.5, 64, true},
+		{"stays above", 1, 64, false},
+		{"just below", 0.3, 64, false},
+		{"rises again", 0.4, 64, true},
+		{"silence resets", 0, 64, false},
+		{"loud after silence", 1, 64, true},
+		{"empty frame resets", 1, 0, false},
+		{"loud after empty", 0.5, 64, true},
+	}
+
+	d := &LoudnessDetector{Threshold: -10}
+	for i, step := range steps {
+		ts := uint32(i * 40)
+		events := d.Process(squareFrame(ts, step.amplitude, step.n))
+		if !step.loud {
+			if len(events) != 0 {
+				t.Errorf("%s: got %+v, want no events", step.name, events)
+			}
+			continue
+		}
+		if len(events) != 1 || events[0].Kind != "loud" || events[0].Timestamp != ts || events[0].Level < d.Threshold {
+			t.Errorf("%s: got %+v, want one loud event at %d", step.name, events, ts)
+		}
+	}
+}
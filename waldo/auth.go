@@ -0,0 +1,152 @@
+package waldo
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Authenticator Decides whether a publisher may use a stream name
+type Authenticator interface {
+	// key is empty when the publisher did not pass one. Returns the name to publish under, which must not
+	// contain the key: it ends up in recording paths, logs and the API
+	Authenticate(name, key string) (string, error)
+}
+
+// Stands in for a key that was passed as (part of) the stream name. A short hash, so a publisher keeps
+// the same name across reconnects without the key being readable from it
+func keyLabel(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "key-" + hex.EncodeToString(sum[:4])
+}
+
+// Split "mystream?key=abc123" into the stream name and key
+func parsePublishingName(publishingName string) (name, key string, err error) {
+	name, query, hasQuery := strings.Cut(publishingName, "?")
+	if !hasQuery {
+		return name, "", nil
+	}
+
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return "", "", errors.Wrap(err, "Malformed publishing name query")
+	}
+	if len(values["key"]) > 1 {
+		return "", "", errors.New("Publishing name has more than one key")
+	}
+
+	return name, values.Get("key"), nil
+}
+
+// StreamKeys Allowlist of keys permitted to publish, optionally bound to one stream name
+type StreamKeys struct {
+	keys      map[string]bool   // Valid for any stream
+	boundKeys map[string]string // Stream name -> key
+}
+
+func NewStreamKeys(keys ...string) *StreamKeys {
+	k := &StreamKeys{
+		keys:      make(map[string]bool),
+		boundKeys: make(map[string]string),
+	}
+	k.Add(keys...)
+
+	return k
+}
+
+// Allow keys for any stream. Surrounding whitespace is trimmed and empty keys ignored
+func (k *StreamKeys) Add(keys ...string) {
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); key != "" {
+			k.keys[key] = true
+		}
+	}
+}
+
+// True when no key has been configured, meaning every publisher is accepted
+func (k *StreamKeys) Empty() bool {
+	return len(k.keys) == 0 && len(k.boundKeys) == 0
+}
+
+// Add the entries of a keys file, one per line, either "<key>" or "<stream name> <key>".
+// Blank lines and lines starting with # are ignored
+func (k *StreamKeys) Load(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open stream keys file")
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		switch fields := strings.Fields(line); len(fields) {
+		case 1:
+			k.keys[fields[0]] = true
+		case 2:
+			k.boundKeys[fields[0]] = fields[1]
+		default:
+			return errors.Errorf("Invalid stream keys entry on line %d", n)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "Failed to read stream keys file")
+	}
+
+	return nil
+}
+
+// Without a ?key= suffix the key is either the whole name or its last path segment (live/<key>),
+// which is then replaced by keyLabel in the returned name
+func (k *StreamKeys) Authenticate(name, key string) (string, error) {
+	if key != "" {
+		if k.keys[key] {
+			return name, nil
+		}
+		if bound, ok := k.boundKeys[name]; ok && secretEqual(bound, key) {
+			return name, nil
+		}
+		return "", errors.Errorf("Stream key for %q is not on the allow-list", name)
+	}
+
+	if k.keys[name] {
+		return keyLabel(name), nil
+	}
+	if i := strings.LastIndex(name, "/"); i >= 0 && k.keys[name[i+1:]] {
+		return name[:i+1] + keyLabel(name[i+1:]), nil
+	}
+
+	// The name may be the key itself, so it is left out
+	return "", errors.New("Stream name is not on the allow-list and no key was passed")
+}
+
+// SharedSecret Lets any stream name publish when it presents the one secret
+type SharedSecret struct {
+	Secret string
+}
+
+func (s *SharedSecret) Authenticate(name, key string) (string, error) {
+	if key == "" {
+		// Without the query the name itself may be the secret, so it is left out
+		return "", errors.New("Stream did not pass a key, expected <name>?key=<secret>")
+	}
+	if !secretEqual(s.Secret, key) {
+		return "", errors.Errorf("Wrong stream key for %q", name)
+	}
+
+	return name, nil
+}
+
+func secretEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
@@ -0,0 +1,117 @@
+package waldo
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePublishingName(t *testing.T) {
+	tests := []struct {
+		in, name, key string
+		wantErr       bool
+	}{
+		{in: "mystream", name: "mystream"},
+		{in: "mystream?key=abc123", name: "mystream", key: "abc123"},
+		{in: "live/cam?other=1", name: "live/cam"},
+		{in: "mystream?key=a&key=b", wantErr: true},
+		{in: "mystream?key=%zz", wantErr: true},
+	}
+	for _, tt := range tests {
+		name, key, err := parsePublishingName(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parsePublishingName(%q) err = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if name != tt.name || key != tt.key {
+			t.Errorf("parsePublishingName(%q) = %q, %q, want %q, %q", tt.in, name, key, tt.name, tt.key)
+		}
+	}
+}
+
+func TestStreamKeysAuthenticate(t *testing.T) {
+	keys := NewStreamKeys("secret1", " secret2 ", "")
+	keys.boundKeys["studio"] = "boundkey"
+
+	tests := []struct {
+		desc      string
+		name, key string
+		want      string
+		wantErr   bool
+	}{
+		{desc: "query key", name: "mystream", key: "secret1", want: "mystream"},
+		{desc: "trimmed key", name: "mystream", key: "secret2", want: "mystream"},
+		{desc: "wrong query key", name: "mystream", key: "nope", wantErr: true},
+		{desc: "bare name", name: "secret1", want: keyLabel("secret1")},
+		{desc: "live/<key>", name: "live/secret1", want: "live/" + keyLabel("secret1")},
+		{desc: "nested live/<key>", name: "a/b/secret2", want: "a/b/" + keyLabel("secret2")},
+		{desc: "unknown bare name", name: "guess", wantErr: true},
+		{desc: "unknown live/<key>", name: "live/guess", wantErr: true},
+		{desc: "key in a middle segment", name: "secret1/cam", wantErr: true},
+		{desc: "bound key", name: "studio", key: "boundkey", want: "studio"},
+		{desc: "bound key on another stream", name: "other", key: "boundkey", wantErr: true},
+		{desc: "bound key as name", name: "studio/boundkey", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := keys.Authenticate(tt.name, tt.key)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: err = %v, want error %v", tt.desc, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: name = %q, want %q", tt.desc, got, tt.want)
+		}
+		for _, secret := range []string{"secret1", "secret2", "boundkey"} {
+			if strings.Contains(got, secret) || (err != nil && strings.Contains(err.Error(), secret)) {
+				t.Errorf("%s: key %q leaked into %q / %v", tt.desc, secret, got, err)
+			}
+		}
+	}
+}
+
+func TestKeyLabelStable(t *testing.T) {
+	if keyLabel("a") != keyLabel("a") || keyLabel("a") == keyLabel("b") {
+		t.Error("keyLabel is not a stable, distinct label per key")
+	}
+}
+
+func TestSharedSecretAuthenticate(t *testing.T) {
+	s := &SharedSecret{Secret: "hunter2"}
+
+	if name, err := s.Authenticate("cam", "hunter2"); err != nil || name != "cam" {
+		t.Errorf("Right secret: %q, %v", name, err)
+	}
+	if _, err := s.Authenticate("cam", "wrong"); err == nil {
+		t.Error("Wrong secret accepted")
+	}
+	_, err := s.Authenticate("hunter2", "")
+	if err == nil {
+		t.Fatal("Missing key accepted")
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Errorf("Error repeats the stream name, which may be the secret: %v", err)
+	}
+}
+
+func TestPublishWithUnlistedKeyRejected(t *testing.T) {
+	logs := captureLogs(t)
+	s, addr := startTestServer(t, Options{Auth: NewStreamKeys("secret")})
+
+	// Each publish is refused before the stream is registered
+	for i, name := range []string{"cam?key=wrong", "cam", "live/wrong"} {
+		publishTestStream(t, addr, name)
+		deadline := time.Now().Add(5 * time.Second)
+		for len(logs.find("Rejected publish")) <= i {
+			if time.Now().After(deadline) {
+				t.Fatalf("Publish as %q never rejected", name)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	if streams := s.registry.List(); len(streams) != 0 {
+		t.Fatalf("Rejected publishers registered %v", streams)
+	}
+
+	publishTestStream(t, addr, "cam?key=secret")
+	waitForStream(t, s, "cam")
+}
@@ -0,0 +1,131 @@
+package waldo
+
+import (
+	"image"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gocv.io/x/gocv"
+)
+
+// Label of the moving regions found by a BackgroundSubtractorStage. They are where the template
+// matcher searches, not detections of their own
+const motionCandidateLabel = "motion"
+
+// Foreground regions smaller than this fraction of the frame are noise, e.g. flicker or compression artifacts
+const backgroundMinArea = 0.0005
+
+// BackgroundSubtractorStage A pipeline stage separating moving things from a fixed camera's background,
+// so the template matcher only has to search where something moved. The model is learned from the frames of
+// one stream, the pipeline builds a stage per stream. Safe for concurrent use
+type BackgroundSubtractorStage struct {
+	history   int
+	threshold float64
+
+	mu   sync.Mutex
+	mog  gocv.BackgroundSubtractorMOG2
+	size image.Point // Of the frames the model learned, it starts over when they change
+	open bool
+
+	models int // Built so far, more than one means the stream changed resolution
+}
+
+// A subtractor learning the background from the last history frames. threshold is the squared distance
+// from the model above which a pixel is foreground, OpenCV defaults to 16
+func NewBackgroundSubtractorStage(history int, threshold float64) *BackgroundSubtractorStage {
+	return &BackgroundSubtractorStage{history: history, threshold: threshold}
+}
+
+// Foreground computes the mask of the moving pixels in frame, which the caller must Close, and the bounding box
+// of every moving region, scored by its share of the frame
+func (s *BackgroundSubtractorStage) Foreground(frame gocv.Mat) (gocv.Mat, []DetectionResult, error) {
+	mask := gocv.NewMat()
+	if err := s.apply(frame, &mask); err != nil {
+		_ = mask.Close()
+		return gocv.NewMat(), nil, err
+	}
+
+	// Shadows are marked 127, only confident foreground counts
+	binary := gocv.NewMat()
+	defer binary.Close()
+	gocv.Threshold(mask, &binary, 200, 255, gocv.ThresholdBinary)
+
+	contours := gocv.FindContours(binary, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+	defer contours.Close()
+
+	frameArea := float64(frame.Cols() * frame.Rows())
+	var candidates []DetectionResult
+	for i := 0; i < contours.Size(); i++ {
+		area := gocv.ContourArea(contours.At(i)) / frameArea
+		if area < backgroundMinArea {
+			continue
+		}
+		candidates = append(candidates, DetectionResult{
+			Score: area,
+			Rect:  gocv.BoundingRect(contours.At(i)),
+			Label: motionCandidateLabel,
+		})
+	}
+
+	return mask, candidates, nil
+}
+
+// Run is the StageFunc: the frame goes on unchanged, with the moving regions as candidates
+func (s *BackgroundSubtractorStage) Run(frame gocv.Mat) (gocv.Mat, []DetectionResult, error) {
+	mask, candidates, err := s.Foreground(frame)
+	_ = mask.Close()
+	if err != nil {
+		return frame, nil, err
+	}
+
+	return frame, candidates, nil
+}
+
+func (s *BackgroundSubtractorStage) apply(frame gocv.Mat, mask *gocv.Mat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if size := image.Pt(frame.Cols(), frame.Rows()); !s.open || size != s.size {
+		if s.open {
+			_ = s.mog.Close()
+		}
+		s.mog = gocv.NewBackgroundSubtractorMOG2WithParams(s.history, s.threshold, true)
+		s.size, s.open = size, true
+		s.models++
+	}
+	if err := s.mog.Apply(frame, mask); err != nil {
+		return errors.Wrap(err, "Failed to subtract background")
+	}
+
+	return nil
+}
+
+// Release the background model. A later frame starts a new one
+func (s *BackgroundSubtractorStage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.open {
+		return nil
+	}
+	s.open = false
+
+	return s.mog.Close()
+}
+
+// Split the motion candidates off stage results
+func splitMotionCandidates(results []DetectionResult) ([]DetectionResult, []image.Rectangle) {
+	var (
+		kept    []DetectionResult
+		regions []image.Rectangle
+	)
+	for _, r := range results {
+		if r.Label == motionCandidateLabel {
+			regions = append(regions, r.Rect)
+		} else {
+			kept = append(kept, r)
+		}
+	}
+
+	return kept, regions
+}
@@ -0,0 +1,28 @@
+package waldo
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Buffers above this size are left to the GC, so one huge keyframe does not stay pinned in the pool
+const maxPooledBufferSize = 1 << 20
+
+// Tag bodies are copied out of the RTMP reader into these, and released once written
+var tagBufferPool = sync.Pool{
+	New: func() any { return new(bytes.Buffer) },
+}
+
+func getTagBuffer() *bytes.Buffer {
+	buf := tagBufferPool.Get().(*bytes.Buffer)
+	buf.Reset()
+	return buf
+}
+
+// Return a buffer to the pool. Nothing may reference its bytes afterwards, nil is ignored
+func putTagBuffer(buf *bytes.Buffer) {
+	if buf == nil || buf.Cap() > maxPooledBufferSize {
+		return
+	}
+	tagBufferPool.Put(buf)
+}
@@ -0,0 +1,148 @@
+package waldo
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/pkg/errors"
+	flvtag "github.com/yutopp/go-flv/tag"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+func TestPutTagBufferDropsLargeBuffers(t *testing.T) {
+	putTagBuffer(nil)
+
+	big := bytes.NewBuffer(make([]byte, 0, 2*maxPooledBufferSize))
+	putTagBuffer(big)
+	for i := 0; i < 100; i++ {
+		if buf := getTagBuffer(); buf == big {
+			t.Fatal("A buffer over the size cap was pooled")
+		} else if buf.Len() != 0 {
+			t.Fatalf("Got a pooled buffer holding %d bytes", buf.Len())
+		}
+	}
+}
+
+// Run with -race: buffers released too early would be overwritten by another stream's tags
+func TestConcurrentStreamsKeepTheirBuffers(t *testing.T) {
+	s, _ := newTestHandler(t, Options{})
+	const streams, tags = 4, 200
+
+	var wg sync.WaitGroup
+	errs := make(chan error, streams)
+	handlers := make([]*Handler, streams)
+	for i := range handlers {
+		h := s.newHandler()
+		h.limits = s.limits
+		handlers[i] = h
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			name := fmt.Sprintf("cam%d", i)
+			if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: name}); err != nil {
+				errs <- err
+				return
+			}
+			defer h.OnClose()
+
+			// Bodies of every size, each filled with the stream's own byte
+			fill := byte('a' + i)
+			for n := 0; n < tags; n++ {
+				body := bytes.Repeat([]byte{fill}, 1+n*37%4000)
+				if err := h.OnAudio(uint32(n*20), bytes.NewReader(append([]byte{0x2f}, body...))); err != nil {
+					errs <- err
+					return
+				}
+				if err := h.OnVideo(uint32(n*20), bytes.NewReader(avcFrame(n%10 == 0, body))); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	for i, h := range handlers {
+		fill := byte('a' + i)
+		audio, video := 0, 0
+		for _, tag := range readFLV(t, h.RecordingPath()) {
+			var body []byte
+			switch data := tag.Data.(type) {
+			case *flvtag.AudioData:
+				body, _ = io.ReadAll(data.Data)
+				audio++
+			case *flvtag.VideoData:
+				b, _ := io.ReadAll(data.Data)
+				body = b[6:] // NALU length and header
+				video++
+			}
+			if len(bytes.Trim(body, string(fill))) != 0 {
+				t.Fatalf("Stream %d recorded a %T body of another stream: % x", i, tag.Data, body[:min(len(body), 16)])
+			}
+		}
+		if audio != tags || video != tags {
+			t.Errorf("Stream %d recorded %d audio and %d video tags, want %d of each", i, audio, video, tags)
+		}
+	}
+}
+
+// Copying a tag body out of the RTMP reader, into a fresh buffer as before the pool and into a pooled one
+func BenchmarkTagBodyCopy(b *testing.B) {
+	body := bytes.Repeat([]byte{0xaa}, 16*1024)
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			buf := new(bytes.Buffer)
+			if _, err := io.Copy(buf, bytes.NewReader(body)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(int64(len(body)))
+		for i := 0; i < b.N; i++ {
+			buf := getTagBuffer()
+			if _, err := io.Copy(buf, bytes.NewReader(body)); err != nil {
+				b.Fatal(err)
+			}
+			putTagBuffer(buf)
+		}
+	})
+}
+
+// Allocations per recorded audio tag, all the way through OnAudio
+func BenchmarkOnAudio(b *testing.B) {
+	s, err := NewServer(Options{
+		OutputDir:   b.TempDir(),
+		NewDetector: func() (Detector, error) { return nil, errors.New("No CV in benchmarks") },
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	h := s.newHandler()
+	h.limits = s.limits
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "bench"}); err != nil {
+		b.Fatal(err)
+	}
+	defer h.OnClose()
+
+	tag := append([]byte{0xaf, 1}, bytes.Repeat([]byte{0xaa}, 1024)...)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(tag)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := h.OnAudio(uint32(i*20), bytes.NewReader(tag)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package waldo
+
+import (
+	"bufio"
+	"flag"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+)
+
+// Config Settings that can be changed while the server runs, through the HTTP API.
+// Shared by every handler and safe for concurrent use
+type Config struct {
+	detectionThreshold atomic.Uint64 // float64 bits
+}
+
+func NewConfig(detectionThreshold float64) (*Config, error) {
+	c := &Config{}
+	if err := c.SetDetectionThreshold(detectionThreshold); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Minimum score of a detection to be drawn, saved or reported
+func (c *Config) DetectionThreshold() float64 {
+	return math.Float64frombits(c.detectionThreshold.Load())
+}
+
+func (c *Config) SetDetectionThreshold(v float64) error {
+	if math.IsNaN(v) || v < 0 || v > 1 {
+		return errors.Errorf("Detection threshold must be between 0 and 1, got %g", v)
+	}
+	c.detectionThreshold.Store(math.Float64bits(v))
+
+	return nil
+}
+
+// Load settings from a file into the flags in fs that were not given on the command line.
+// The file is a subset of TOML: key = value lines, # comments and [section] headers.
+// Keys are flag names, and a section prefixes the keys below it, so
+//
+//	[webhook]
+//	url = ["http://a/hook", "http://b/hook"]
+//
+// sets -webhook-url. Strings may be quoted, arrays are joined with commas
+func LoadConfigFile(path string, fs *flag.FlagSet) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open config file")
+	}
+	defer f.Close()
+
+	// The command line wins over the file
+	set := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+
+	section := ""
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(stripConfigComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return errors.Errorf("%s:%d: Unterminated section header", path, n)
+			}
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return errors.Errorf("%s:%d: Expected key = value", path, n)
+		}
+		name := strings.ReplaceAll(strings.TrimSpace(key), "_", "-")
+		if section != "" {
+			name = strings.ReplaceAll(section, "_", "-") + "-" + name
+		}
+		if fs.Lookup(name) == nil {
+			return errors.Errorf("%s:%d: Unknown setting %q", path, n, name)
+		}
+		value, err := parseConfigValue(strings.TrimSpace(raw))
+		if err != nil {
+			return errors.Wrapf(err, "%s:%d: %s", path, n, name)
+		}
+
+		if set[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return errors.Wrapf(err, "%s:%d: Invalid value for %s", path, n, name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return errors.Wrap(err, "Failed to read config file")
+	}
+
+	return nil
+}
+
+// Cut a line at the first # outside quotes
+func stripConfigComment(line string) string {
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == '#':
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// A value as its flag string: quotes removed and arrays joined with commas.
+// Anything unquoted, e.g. numbers, booleans and durations, is taken as is
+func parseConfigValue(s string) (string, error) {
+	switch {
+	case s == "":
+		return "", errors.New("Missing value")
+	case strings.HasPrefix(s, "["):
+		if !strings.HasSuffix(s, "]") {
+			return "", errors.New("Unterminated array")
+		}
+		var items []string
+		for _, item := range splitConfigArray(s[1 : len(s)-1]) {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			v, err := parseConfigValue(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, v)
+		}
+		return strings.Join(items, ","), nil
+	case s[0] == '"':
+		v, err := strconv.Unquote(s)
+		if err != nil {
+			return "", errors.Errorf("Invalid string %s", s)
+		}
+		return v, nil
+	case s[0] == '\'':
+		if len(s) < 2 || !strings.HasSuffix(s, "'") {
+			return "", errors.Errorf("Invalid string %s", s)
+		}
+		return s[1 : len(s)-1], nil
+	}
+
+	return s, nil
+}
+
+// Split the items of an array at the commas outside quotes
+func splitConfigArray(s string) []string {
+	var (
+		items []string
+		quote rune
+		start int
+	)
+	for i, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+
+	return append(items, s[start:])
+}
+
+// Fail unless files can be created in dir, creating it if needed
+func CheckWritableDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "Failed to create directory %s", dir)
+	}
+	f, err := os.CreateTemp(dir, ".write-check-*")
+	if err != nil {
+		return errors.Wrapf(err, "Directory %s is not writable", dir)
+	}
+	_ = f.Close()
+	_ = os.Remove(f.Name())
+
+	return nil
+}
+
+// Fail unless path is a readable regular file
+func CheckReadableFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrapf(err, "Cannot read %s", path)
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrapf(err, "Cannot read %s", path)
+	}
+	if fi.IsDir() {
+		return errors.Errorf("%s is a directory, not a file", path)
+	}
+
+	return nil
+}
@@ -0,0 +1,213 @@
+package waldo
+
+import (
+	"flag"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The flags a config file is tested against, as the command line would register them
+func testFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.String("output-dir", "received", "")
+	fs.String("webhook-url", "", "")
+	fs.Duration("webhook-cooldown", time.Minute, "")
+	fs.Bool("headless", false, "")
+	fs.Float64("detect-threshold", 0.5, "")
+	fs.String("log-level", "info", "")
+
+	return fs
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "waldo.toml")
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	path := writeConfig(t, `
+# Top level keys are flag names
+output_dir = "/srv/waldo # not a comment"
+headless = true   # trailing comment
+detect-threshold = 0.7
+
+[webhook]
+url = ["http://a/hook", 'http://b/hook']
+cooldown = 30s
+`)
+	fs := testFlagSet()
+	if err := LoadConfigFile(path, fs); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"output-dir":       "/srv/waldo # not a comment",
+		"headless":         "true",
+		"detect-threshold": "0.7",
+		"webhook-url":      "http://a/hook,http://b/hook",
+		"webhook-cooldown": "30s",
+		"log-level":        "info",
+	}
+	for name, value := range want {
+		if got := fs.Lookup(name).Value.String(); got != value {
+			t.Errorf("-%s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestLoadConfigFileCommandLineWins(t *testing.T) {
+	path := writeConfig(t, "output-dir = from-file\nlog-level = debug\n")
+	fs := testFlagSet()
+	if err := fs.Parse([]string{"-output-dir", "from-flag"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadConfigFile(path, fs); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fs.Lookup("output-dir").Value.String(); got != "from-flag" {
+		t.Errorf("-output-dir = %q, the command line should win", got)
+	}
+	if got := fs.Lookup("log-level").Value.String(); got != "debug" {
+		t.Errorf("-log-level = %q, want the file's debug", got)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	tests := []struct {
+		desc, content, wantErr string
+	}{
+		{"unknown key", "no-such-flag = 1\n", "Unknown setting"},
+		{"unknown key in section", "[webhook]\nsecret-sauce = 1\n", "webhook-secret-sauce"},
+		{"no equals", "headless\n", "Expected key = value"},
+		{"unterminated section", "[webhook\nurl = x\n", "Unterminated section"},
+		{"missing value", "output-dir =\n", "Missing value"},
+		{"unterminated string", "output-dir = \"abc\n", "Invalid string"},
+		{"unterminated array", "[webhook]\nurl = [\"a\"\n", "Unterminated array"},
+		{"invalid value", "headless = maybe\n", "Invalid value for headless"},
+		{"invalid duration", "[webhook]\ncooldown = soon\n", "webhook-cooldown"},
+	}
+	for _, tt := range tests {
+		err := LoadConfigFile(writeConfig(t, tt.content), testFlagSet())
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want it to mention %q", tt.desc, err, tt.wantErr)
+		}
+		if err != nil && !strings.Contains(err.Error(), ":") {
+			t.Errorf("%s: err %v has no line number", tt.desc, err)
+		}
+	}
+
+	if err := LoadConfigFile(filepath.Join(t.TempDir(), "missing.toml"), testFlagSet()); err == nil {
+		t.Error("Missing config file accepted")
+	}
+}
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "42", want: "42"},
+		{in: "1m30s", want: "1m30s"},
+		{in: `"quoted \"escape\""`, want: `quoted "escape"`},
+		{in: `'single \n raw'`, want: `single \n raw`},
+		{in: `["a", "b,c"]`, want: "a,b,c"},
+		{in: `[]`, want: ""},
+		{in: `[1, 2, ]`, want: "1,2"},
+		{in: `'`, wantErr: true},
+		{in: `"open`, wantErr: true},
+		{in: ``, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseConfigValue(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseConfigValue(%q) err = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("parseConfigValue(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestStripConfigComment(t *testing.T) {
+	tests := map[string]string{
+		`a = 1 # one`:          `a = 1 `,
+		`a = "x # y" # z`:      `a = "x # y" `,
+		`a = 'it''s # here' #`: `a = 'it''s # here' `,
+		`# whole line`:         ``,
+		`a = 1`:                `a = 1`,
+	}
+	for in, want := range tests {
+		if got := stripConfigComment(in); got != want {
+			t.Errorf("stripConfigComment(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestNewServerDefaults(t *testing.T) {
+	s, err := NewServer(Options{OutputDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.opts.RTMPAddr != ":1935" || s.opts.OutputFormat != "flv" || s.opts.RecordingLayout != DefaultRecordingLayout {
+		t.Errorf("Defaults are %q, %q, %q", s.opts.RTMPAddr, s.opts.OutputFormat, s.opts.RecordingLayout)
+	}
+	if s.opts.HTTPAddr != "" {
+		t.Errorf("HTTP API defaults to %q, want none", s.opts.HTTPAddr)
+	}
+}
+
+func TestOptionsValidate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc    string
+		opts    Options
+		wantErr string
+	}{
+		{"output format", Options{OutputFormat: "mkv"}, "Unknown output format"},
+		{"recording layout", Options{RecordingLayout: "../{name}"}, "escapes"},
+		{"output dir is a file", Options{OutputDir: file}, "directory"},
+		{"HLS dir under a file", Options{HLSDir: filepath.Join(file, "hls")}, "directory"},
+		{"missing model", Options{Vision: VisionConfig{Detector: DetectorConfig{Model: filepath.Join(dir, "missing.onnx")}}}, "Cannot read"},
+		{"labels are a directory", Options{Vision: VisionConfig{Detector: DetectorConfig{LabelsPath: dir}}}, "is a directory"},
+		{"detection threshold", Options{DetectionThreshold: 1.5}, "Detection threshold"},
+		{"event threshold", Options{EventThreshold: -0.1}, "Event threshold"},
+		{"motion threshold", Options{Vision: VisionConfig{MotionThreshold: 2}}, "Motion threshold"},
+		{"cv resize", Options{CVResize: image.Pt(-1, 0)}, "CV resize"},
+		{"cv workers", Options{CVWorkers: -1}, "CV workers"},
+	}
+	for _, tt := range tests {
+		err := tt.opts.Validate()
+		if err == nil {
+			t.Errorf("%s: accepted", tt.desc)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: err = %v, want it to mention %q", tt.desc, err, tt.wantErr)
+		}
+	}
+
+	created := filepath.Join(dir, "new", "recordings")
+	valid := Options{OutputDir: created, Vision: VisionConfig{Detector: DetectorConfig{Model: file}}, DetectionThreshold: 0.5}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Valid options rejected: %v", err)
+	}
+	if fi, err := os.Stat(created); err != nil || !fi.IsDir() {
+		t.Error("Validate did not create the output directory")
+	}
+}
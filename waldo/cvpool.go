@@ -0,0 +1,146 @@
+package waldo
+
+import (
+	"bytes"
+	"log/slog"
+	"time"
+
+	flvtag "github.com/yutopp/go-flv/tag"
+	"gocv.io/x/gocv"
+)
+
+// cvJob A decoded frame handed to CV. Whoever runs the job closes frame
+type cvJob struct {
+	timestamp uint32
+	frame     gocv.Mat
+
+	rateLimited bool // Skipped by the CV rate limiter
+
+	detections []DetectionResult // Found by runCVJob
+}
+
+// ProcessedFrame A place in the ordered writer, filled with the tags to write there once they are ready.
+// A single tag, or a whole GOP held for re-encoding
+type ProcessedFrame chan []orderedTag
+
+// orderedTag A tag and the pooled buffer holding its body, released once written (nil if not pooled)
+type orderedTag struct {
+	tag        *flvtag.FlvTag
+	buf        *bytes.Buffer
+	detections []DetectionResult // Written as an onDetection tag right after tag
+}
+
+func readyFrame(t orderedTag) ProcessedFrame {
+	f := make(ProcessedFrame, 1)
+	f <- []orderedTag{t}
+	return f
+}
+
+// Start the CV workers. Called once publishing starts
+func (h *Handler) startCV() {
+	h.cvJobs = make(chan *cvJob, h.cvQueue)
+	for i := 0; i < h.cvWorkers; i++ {
+		h.cvWG.Add(1)
+		go func() {
+			defer h.cvWG.Done()
+			for job := range h.cvJobs {
+				h.runCVJob(job)
+				_ = job.frame.Close()
+				// The frame went out long ago, the detections land after whatever was written since
+				h.injectDetections(job.timestamp, job.detections)
+			}
+		}()
+	}
+}
+
+// Queue a frame for the workers without blocking, dropping it when they are behind
+func (h *Handler) submitCV(job *cvJob) {
+	select {
+	case h.cvJobs <- job:
+	default:
+		_ = job.frame.Close()
+		dropped := h.stats.FramesDropped.Add(1)
+		h.metrics.CVFramesDropped.Add(1)
+		h.logger.Debug("CV queue full, dropping frame", "timestamp", job.timestamp, "dropped", dropped)
+	}
+}
+
+// Write tags from ordered as they become ready, in the order they were queued
+func (h *Handler) startOrderedWriter() {
+	h.ordered = make(chan ProcessedFrame, 4*h.cvQueue+64)
+	h.orderedDone = make(chan struct{})
+	go func() {
+		defer close(h.orderedDone)
+		for f := range h.ordered {
+			for _, t := range <-f {
+				if err := h.writeTag(t.tag); err != nil {
+					h.logRepeated(slog.LevelError, "write-tag", "Failed to write tag", "type", t.tag.TagType, "timestamp", t.tag.Timestamp, "err", err)
+				}
+				putTagBuffer(t.buf)
+				h.injectDetections(t.tag.Timestamp, t.detections)
+			}
+		}
+	}()
+}
+
+// Write a tag and then its detections, behind any GOP still being re-encoded.
+// buf, the pooled buffer holding the tag body, is released once the encoder has copied it out
+func (h *Handler) emitTag(tag *flvtag.FlvTag, buf *bytes.Buffer, detections []DetectionResult) error {
+	t := orderedTag{tag: tag, buf: buf, detections: detections}
+	switch {
+	case h.gop != nil:
+		h.gop.add(t)
+		return nil
+	case h.ordered != nil:
+		h.ordered <- readyFrame(t)
+		return nil
+	}
+
+	defer putTagBuffer(buf)
+	if err := h.writeTag(tag); err != nil {
+		return err
+	}
+	h.injectDetections(tag.Timestamp, detections)
+
+	return nil
+}
+
+// Run CV on a job and count the outcome
+func (h *Handler) runCVJob(job *cvJob) {
+	start := time.Now()
+	if err := h.processFrameWithCV(job); err != nil {
+		h.stats.FramesFailed.Add(1)
+		h.logger.Error("Failed to process video frame", "timestamp", job.timestamp, "err", err)
+		return
+	}
+	if !job.rateLimited {
+		h.frameProcessed(time.Since(start))
+	}
+}
+
+// Count a frame run through CV, and how long that took
+func (h *Handler) frameProcessed(elapsed time.Duration) {
+	h.stats.FramesProcessed.Add(1)
+	h.stats.CVTime.Add(uint64(elapsed))
+	h.metrics.CVFramesProcessed.Add(1)
+	h.metrics.CVDuration.Observe(elapsed.Seconds())
+}
+
+// Stop the decoder and accept no more jobs, wait for the workers to finish the queued ones, for the GOP writer
+// and for the ordered writer to drain. Safe to call more than once
+func (h *Handler) stopCV() {
+	h.cvStop.Do(func() {
+		// Pictures still in the decoder go to the workers first
+		h.closeStreamDecoder()
+		if h.cvJobs != nil {
+			close(h.cvJobs)
+		}
+		h.cvWG.Wait()
+		h.stopGOPWriter()
+
+		if h.ordered != nil {
+			close(h.ordered)
+			<-h.orderedDone
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package waldo
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	flvtag "github.com/yutopp/go-flv/tag"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+	"gocv.io/x/gocv"
+)
+
+func TestOrderedWriterWaitsForSlowCV(t *testing.T) {
+	_, h := newTestHandler(t, Options{})
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	h.startOrderedWriter()
+	if err := h.OnVideo(0, bytes.NewReader(avcSequenceHeader(testSPS, testPPS))); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keyframe at 40 is still in CV when the picture at 80 arrives
+	slow := make(ProcessedFrame, 1)
+	h.ordered <- slow
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		slow <- []orderedTag{{tag: &flvtag.FlvTag{TagType: flvtag.TagTypeVideo, Timestamp: 40, Data: &flvtag.VideoData{
+			FrameType:     flvtag.FrameTypeKeyFrame,
+			CodecID:       flvtag.CodecIDAVC,
+			AVCPacketType: flvtag.AVCPacketTypeNALU,
+			Data:          bytes.NewReader(avcFrame(true, []byte("slow"))[5:]),
+		}}}}
+	}()
+
+	start := time.Now()
+	if err := h.OnVideo(80, bytes.NewReader(avcFrame(false, []byte("fast")))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("OnVideo took %v behind the slow frame, it must not wait for CV", elapsed)
+	}
+	h.OnClose()
+
+	var timestamps []uint32
+	for _, tag := range readFLV(t, h.RecordingPath()) {
+		if tag.TagType == flvtag.TagTypeVideo {
+			timestamps = append(timestamps, tag.Timestamp)
+		}
+	}
+	if len(timestamps) != 3 || timestamps[0] != 0 || timestamps[1] != 40 || timestamps[2] != 80 {
+		t.Errorf("Video written at %v, want [0 40 80]", timestamps)
+	}
+}
+
+// slowDetector Takes delay over every frame and finds nothing
+type slowDetector struct {
+	delay time.Duration
+	calls atomic.Int32
+}
+
+func (d *slowDetector) Detect(gocv.Mat) ([]Detection, error) {
+	d.calls.Add(1)
+	time.Sleep(d.delay)
+	return nil, nil
+}
+
+func (d *slowDetector) Close() error {
+	return nil
+}
+
+func TestOnVideoLatencyWithSlowDetector(t *testing.T) {
+	sample := sampleFLV(t)
+	detector := &slowDetector{delay: 300 * time.Millisecond}
+	s, err := NewServer(Options{
+		OutputDir:   t.TempDir(),
+		NewDetector: func() (Detector, error) { return detector, nil },
+		CVWorkers:   1,
+		CVQueue:     1,
+		Vision:      VisionConfig{Headless: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.newHandler()
+	h.limits = s.limits
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every tag is timed as the read loop would see it, the detector must never show
+	var slowest time.Duration
+	for _, tag := range readFLV(t, sample) {
+		start := time.Now()
+		if err := replayTag(h, tag); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := tag.Data.(*flvtag.VideoData); ok {
+			slowest = max(slowest, time.Since(start))
+		}
+	}
+	h.OnClose()
+
+	if detector.calls.Load() == 0 {
+		t.Fatal("The detector never ran")
+	}
+	if slowest >= detector.delay {
+		t.Errorf("Slowest OnVideo took %v, the detector %v per frame", slowest, detector.delay)
+	}
+}
+
+// The read loop's cost of a picture, with CV on workers
+func BenchmarkOnVideo(b *testing.B) {
+	s, err := NewServer(Options{
+		OutputDir:   b.TempDir(),
+		NewDetector: func() (Detector, error) { return &slowDetector{delay: 50 * time.Millisecond}, nil },
+		CVWorkers:   2,
+		CVQueue:     4,
+		Vision:      VisionConfig{Headless: true},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	h := s.newHandler()
+	h.limits = s.limits
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "bench"}); err != nil {
+		b.Fatal(err)
+	}
+	defer h.OnClose()
+	if err := h.OnVideo(0, bytes.NewReader(avcSequenceHeader(testSPS, testPPS))); err != nil {
+		b.Fatal(err)
+	}
+
+	payload := bytes.Repeat([]byte{0xaa}, 4096)
+	frames := [][]byte{avcFrame(true, payload), avcFrame(false, payload)}
+	b.SetBytes(int64(len(frames[1])))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := h.OnVideo(uint32(i*40), bytes.NewReader(frames[min(i%30, 1)])); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
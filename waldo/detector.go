@@ -0,0 +1,486 @@
+package waldo
+
+import (
+	"bufio"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gocv.io/x/gocv"
+)
+
+// Detection An object found in a frame
+type Detection struct {
+	Rect  image.Rectangle
+	Label string
+	Score float32 // 0..1, 1 for detectors without a confidence
+}
+
+// Detector A computer vision backend. Implementations are not safe for concurrent use
+type Detector interface {
+	Detect(img gocv.Mat) ([]Detection, error)
+	Close() error
+}
+
+// DetectorConfig Selects and configures the backend built by NewDetector
+type DetectorConfig struct {
+	Backend string // "haar", "dnn" or "none". Empty picks dnn when a Model is set, haar otherwise
+
+	// Haar cascade file. Falls back to $WALDO_CASCADE_PATH, then the bundled face cascade.
+	// Relative paths are tried against the working directory, then the executable's directory
+	CascadePath string
+	Cascade     CascadeParams // Zero uses DefaultCascadeParams
+
+	// DNN model (Caffe, ONNX, TensorFlow, ... anything gocv.ReadNet accepts)
+	Model       string
+	ModelConfig string  // e.g. the .prototxt of a Caffe model, empty for ONNX
+	LabelsPath  string  // Class names, one per line, in class id order
+	InputSize   int     // Square network input in pixels
+	Scale       float64 // Pixel value multiplier, e.g. 1/255
+	Mean        gocv.Scalar
+	SwapRB      bool
+	Confidence  float32 // Minimum score reported
+	Format      string  // Output layout, "ssd" or "yolo". Empty goes by the output's shape
+
+	// YOLO boxes overlapping a better one by more than this IoU are dropped, zero uses DefaultDNNNMS
+	NMSThreshold float32
+	// Pad frames to a square before scaling them to the input, as YOLO models are trained,
+	// rather than stretching them. Boxes are mapped back to the frame either way
+	Letterbox bool
+
+	// Where inference runs, the defaults are OpenCV's own implementation on the CPU
+	NetBackend gocv.NetBackendType
+	NetTarget  gocv.NetTargetType
+}
+
+// Build the configured detector. The caller owns the result and must Close it
+func NewDetector(config DetectorConfig) (Detector, error) {
+	backend := config.Backend
+	if backend == "" && config.Model != "" {
+		backend = "dnn"
+	}
+
+	switch backend {
+	case "", "haar":
+		params := config.Cascade
+		if params == (CascadeParams{}) {
+			params = DefaultCascadeParams()
+		}
+		return NewHaarDetector(config.CascadePath, params)
+	case "dnn":
+		return NewDNNDetector(config)
+	case "none":
+		return NoopDetector{}, nil
+	}
+
+	return nil, errors.Errorf("Unknown detector backend %q, want haar, dnn or none", config.Backend)
+}
+
+// CascadeParams DetectMultiScale tuning. Fewer neighbours and a finer scale step find more, and more wrongly
+type CascadeParams struct {
+	ScaleFactor  float64     // Image shrink per pyramid level, above 1
+	MinNeighbors int         // Overlapping hits needed to keep a detection
+	MinSize      image.Point // Smallest object searched for
+	MaxSize      image.Point // Largest object searched for, zero is unlimited
+}
+
+func DefaultCascadeParams() CascadeParams {
+	return CascadeParams{ScaleFactor: 1.1, MinNeighbors: 3, MinSize: image.Pt(30, 30)}
+}
+
+func (p CascadeParams) Validate() error {
+	if !(p.ScaleFactor > 1) {
+		return errors.Errorf("Cascade scale factor must be above 1, got %g", p.ScaleFactor)
+	}
+	if p.MinNeighbors < 0 {
+		return errors.Errorf("Cascade min neighbors must be at least 0, got %d", p.MinNeighbors)
+	}
+	if p.MinSize.X < 0 || p.MinSize.Y < 0 || p.MaxSize.X < 0 || p.MaxSize.Y < 0 {
+		return errors.Errorf("Cascade sizes cannot be negative, got min %v max %v", p.MinSize, p.MaxSize)
+	}
+	if p.MaxSize != (image.Point{}) && (p.MaxSize.X < p.MinSize.X || p.MaxSize.Y < p.MinSize.Y) {
+		return errors.Errorf("Cascade max size %v is below min size %v", p.MaxSize, p.MinSize)
+	}
+
+	return nil
+}
+
+// HaarDetector Finds objects, frontal faces by default, with a Haar cascade classifier
+type HaarDetector struct {
+	classifier gocv.CascadeClassifier
+	Label      string
+
+	// DetectMultiScale tuning
+	ScaleFactor  float64
+	MinNeighbors int
+	MinSize      image.Point
+	MaxSize      image.Point
+}
+
+// Load the cascade at path (see DetectorConfig.CascadePath)
+func NewHaarDetector(path string, params CascadeParams) (*HaarDetector, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	cascadePath, err := resolveCascadePath(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &HaarDetector{
+		classifier:   gocv.NewCascadeClassifier(),
+		Label:        "face",
+		ScaleFactor:  params.ScaleFactor,
+		MinNeighbors: params.MinNeighbors,
+		MinSize:      params.MinSize,
+		MaxSize:      params.MaxSize,
+	}
+	if !d.classifier.Load(cascadePath) {
+		d.classifier.Close()
+		return nil, errors.Errorf("Error reading cascade file: %s", cascadePath)
+	}
+
+	return d, nil
+}
+
+// The cascade gives a yes/no answer, so every detection scores 1
+func (d *HaarDetector) Detect(img gocv.Mat) ([]Detection, error) {
+	if img.Empty() {
+		return nil, errors.New("Cannot detect on an empty frame")
+	}
+
+	rects := d.classifier.DetectMultiScaleWithParams(img, d.ScaleFactor, d.MinNeighbors, 0, d.MinSize, d.MaxSize)
+	detections := make([]Detection, 0, len(rects))
+	for _, r := range rects {
+		detections = append(detections, Detection{Rect: r, Label: d.Label, Score: 1})
+	}
+
+	return detections, nil
+}
+
+func (d *HaarDetector) Close() error {
+	return d.classifier.Close()
+}
+
+// IoU above which overlapping YOLO boxes are one object, as in YOLOv5's own inference
+const DefaultDNNNMS = 0.45
+
+// Gray YOLOv5 pads letterboxed inputs with
+var letterboxColor = color.RGBA{R: 114, G: 114, B: 114}
+
+// DNNDetector Runs an object detection network through OpenCV's dnn module.
+//
+// Three output layouts are understood: SSD style [1, 1, N, 7] rows of
+// (image, class, score, left, top, right, bottom) in relative coordinates,
+// YOLOv5 style [1, N, 5+classes] rows of (cx, cy, w, h, objectness, class scores...) in input pixels,
+// and YOLOv8 style [1, 4+classes, N] columns of (cx, cy, w, h, class scores...) in input pixels
+type DNNDetector struct {
+	net    gocv.Net
+	config DetectorConfig
+	labels []string
+}
+
+// Load the model and labels named in config
+func NewDNNDetector(config DetectorConfig) (*DNNDetector, error) {
+	if config.Model == "" {
+		return nil, errors.New("DNN detector needs a model file")
+	}
+	if config.InputSize <= 0 {
+		return nil, errors.Errorf("Invalid DNN input size %d", config.InputSize)
+	}
+	if config.Format != "" && config.Format != "ssd" && config.Format != "yolo" {
+		return nil, errors.Errorf("Unknown DNN output format %q, want ssd or yolo", config.Format)
+	}
+	if config.NMSThreshold < 0 || config.NMSThreshold > 1 {
+		return nil, errors.Errorf("DNN NMS threshold must be between 0 and 1, got %g", config.NMSThreshold)
+	}
+	if config.NMSThreshold == 0 {
+		config.NMSThreshold = DefaultDNNNMS
+	}
+
+	d := &DNNDetector{config: config}
+	if config.LabelsPath != "" {
+		labels, err := readLabels(config.LabelsPath)
+		if err != nil {
+			return nil, err
+		}
+		d.labels = labels
+	}
+
+	// ONNX files carry the whole network, other frameworks may need the config file
+	if strings.EqualFold(filepath.Ext(config.Model), ".onnx") {
+		d.net = gocv.ReadNetFromONNX(config.Model)
+	} else {
+		d.net = gocv.ReadNet(config.Model, config.ModelConfig)
+	}
+	if d.net.Empty() {
+		d.net.Close()
+		return nil, errors.Errorf("Error reading network model: %s", config.Model)
+	}
+
+	if err := d.net.SetPreferableBackend(config.NetBackend); err != nil {
+		d.net.Close()
+		return nil, errors.Wrap(err, "Failed to set DNN backend")
+	}
+	if err := d.net.SetPreferableTarget(config.NetTarget); err != nil {
+		d.net.Close()
+		return nil, errors.Wrap(err, "Failed to set DNN target")
+	}
+
+	return d, nil
+}
+
+func (d *DNNDetector) Detect(img gocv.Mat) ([]Detection, error) {
+	if img.Empty() {
+		return nil, errors.New("Cannot detect on an empty frame")
+	}
+
+	// The frame is centered in the padding like YOLO's own letterboxing, boxes are moved back by offset
+	input, offset, bounds := img, image.Point{}, image.Rect(0, 0, img.Cols(), img.Rows())
+	if d.config.Letterbox && img.Cols() != img.Rows() {
+		var side int
+		offset, side = letterboxOffset(img.Cols(), img.Rows())
+		padded := gocv.NewMat()
+		defer padded.Close()
+		err := gocv.CopyMakeBorder(img, &padded, offset.Y, side-img.Rows()-offset.Y, offset.X, side-img.Cols()-offset.X,
+			gocv.BorderConstant, letterboxColor)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to letterbox frame")
+		}
+		input = padded
+	}
+
+	size := image.Pt(d.config.InputSize, d.config.InputSize)
+	blob := gocv.BlobFromImage(input, d.config.Scale, size, d.config.Mean, d.config.SwapRB, false)
+	defer blob.Close()
+
+	d.net.SetInput(blob, "")
+	out := d.net.Forward("")
+	defer out.Close()
+
+	values, err := out.DataPtrFloat32()
+	if err != nil {
+		return nil, errors.Wrap(err, "Unexpected network output")
+	}
+
+	dims := out.Size()
+	ssd := len(dims) == 4 && dims[3] == 7
+	yolo := len(dims) == 3 && min(dims[1], dims[2]) >= 5
+	switch {
+	case ssd && d.config.Format != "yolo":
+		return clipDetections(d.parseSSD(values, input.Cols(), input.Rows()), offset, bounds), nil
+	case yolo && d.config.Format != "ssd":
+		return clipDetections(d.parseYOLO(values, dims[1], dims[2], input.Cols(), input.Rows()), offset, bounds), nil
+	}
+
+	if d.config.Format != "" {
+		return nil, errors.Errorf("Network output shape %v is not %s", dims, d.config.Format)
+	}
+	return nil, errors.Errorf("Unsupported network output shape %v", dims)
+}
+
+func (d *DNNDetector) parseSSD(values []float32, width, height int) []Detection {
+	var detections []Detection
+	for i := 0; i+7 <= len(values); i += 7 {
+		score := values[i+2]
+		if score < d.config.Confidence {
+			continue
+		}
+		detections = append(detections, Detection{
+			Rect: image.Rect(
+				int(values[i+3]*float32(width)), int(values[i+4]*float32(height)),
+				int(values[i+5]*float32(width)), int(values[i+6]*float32(height)),
+			).Intersect(image.Rect(0, 0, width, height)),
+			Label: d.label(int(values[i+1])),
+			Score: score,
+		})
+	}
+
+	return detections
+}
+
+// Boxes of a YOLO output of dims1 x dims2 values. YOLOv5 has a row per box, YOLOv8 a column per box and
+// no objectness. They are told apart by the boxes being the larger dimension: thousands of candidate boxes,
+// at most a few hundred classes
+func (d *DNNDetector) parseYOLO(values []float32, dims1, dims2, width, height int) []Detection {
+	sx := float32(width) / float32(d.config.InputSize)
+	sy := float32(height) / float32(d.config.InputSize)
+
+	v8 := dims1 < dims2
+	boxes, attrs, classes := dims1, dims2, 5
+	if v8 {
+		boxes, attrs, classes = dims2, dims1, 4
+	}
+	at := func(box, attr int) float32 {
+		if v8 {
+			return values[attr*boxes+box]
+		}
+		return values[box*attrs+attr]
+	}
+
+	var (
+		rects  []image.Rectangle
+		scores []float64
+		labels []string
+	)
+	for b := 0; b < boxes; b++ {
+		class, score := 0, float32(0)
+		for c := classes; c < attrs; c++ {
+			if s := at(b, c); s > score {
+				class, score = c-classes, s
+			}
+		}
+		if !v8 {
+			score *= at(b, 4)
+		}
+		if score < d.config.Confidence {
+			continue
+		}
+
+		cx, cy, w, h := at(b, 0)*sx, at(b, 1)*sy, at(b, 2)*sx, at(b, 3)*sy
+		rects = append(rects, image.Rect(int(cx-w/2), int(cy-h/2), int(cx+w/2), int(cy+h/2)))
+		scores = append(scores, float64(score))
+		labels = append(labels, d.label(class))
+	}
+
+	// YOLO reports many overlapping boxes per object
+	var detections []Detection
+	for _, i := range nmsIndices(rects, scores, float64(d.config.NMSThreshold)) {
+		detections = append(detections, Detection{
+			Rect:  rects[i].Intersect(image.Rect(0, 0, width, height)),
+			Label: labels[i],
+			Score: float32(scores[i]),
+		})
+	}
+
+	return detections
+}
+
+// Where a cols x rows frame sits in its letterboxed square, and the square's side
+func letterboxOffset(cols, rows int) (image.Point, int) {
+	side := max(cols, rows)
+	return image.Pt((side-cols)/2, (side-rows)/2), side
+}
+
+// Move boxes from the letterboxed input back by offset and cut them down to the frame's bounds,
+// dropping those entirely outside, e.g. in the padding
+func clipDetections(detections []Detection, offset image.Point, bounds image.Rectangle) []Detection {
+	kept := detections[:0]
+	for _, d := range detections {
+		if d.Rect = d.Rect.Sub(offset).Intersect(bounds); !d.Rect.Empty() {
+			kept = append(kept, d)
+		}
+	}
+
+	return kept
+}
+
+// Name of a class id, the id itself when no labels were loaded
+func (d *DNNDetector) label(class int) string {
+	if class >= 0 && class < len(d.labels) {
+		return d.labels[class]
+	}
+
+	return "class " + strconv.Itoa(class)
+}
+
+func (d *DNNDetector) Close() error {
+	return d.net.Close()
+}
+
+// NoopDetector Never finds anything, for recording without CV
+type NoopDetector struct{}
+
+func (NoopDetector) Detect(gocv.Mat) ([]Detection, error) { return nil, nil }
+func (NoopDetector) Close() error                         { return nil }
+
+// Read class names, one per line
+func readLabels(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to open labels file")
+	}
+	defer f.Close()
+
+	var labels []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		labels = append(labels, strings.TrimSpace(scanner.Text()))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "Failed to read labels file")
+	}
+
+	return labels, nil
+}
+
+// Parse "b,g,r" (or fewer values) into a Scalar
+func ParseScalar(s string) (gocv.Scalar, error) {
+	var v [4]float64
+	parts := strings.Split(s, ",")
+	if len(parts) > len(v) {
+		return gocv.Scalar{}, errors.Errorf("Too many values in %q", s)
+	}
+	for i, p := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+		if err != nil {
+			return gocv.Scalar{}, errors.Wrapf(err, "Invalid value in %q", s)
+		}
+		v[i] = f
+	}
+
+	return gocv.NewScalar(v[0], v[1], v[2], v[3]), nil
+}
+
+// Parse "WxH", or a single number for a square, into a size. Empty is zero
+func ParseSize(s string) (image.Point, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return image.Point{}, nil
+	}
+
+	w, h, square := strings.Cut(strings.ToLower(s), "x")
+	if !square {
+		h = w
+	}
+	x, err := strconv.Atoi(strings.TrimSpace(w))
+	if err != nil {
+		return image.Point{}, errors.Errorf("Invalid size %q, want WxH", s)
+	}
+	y, err := strconv.Atoi(strings.TrimSpace(h))
+	if err != nil {
+		return image.Point{}, errors.Errorf("Invalid size %q, want WxH", s)
+	}
+
+	return image.Pt(x, y), nil
+}
+
+// Parse "x,y,w,h" into a rectangle. Empty is the zero rectangle, no ROI
+func ParseROI(s string) (image.Rectangle, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return image.Rectangle{}, nil
+	}
+
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, errors.Errorf("Invalid ROI %q, want x,y,w,h", s)
+	}
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil {
+			return image.Rectangle{}, errors.Errorf("Invalid ROI %q, want x,y,w,h", s)
+		}
+		v[i] = n
+	}
+	if v[0] < 0 || v[1] < 0 || v[2] <= 0 || v[3] <= 0 {
+		return image.Rectangle{}, errors.Errorf("ROI %q needs a position of at least 0 and a positive size", s)
+	}
+
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
@@ -0,0 +1,129 @@
+package waldo
+
+import (
+	"image"
+	"reflect"
+	"testing"
+)
+
+func TestParseYOLO(t *testing.T) {
+	d := &DNNDetector{
+		config: DetectorConfig{InputSize: 100, Confidence: 0.5, NMSThreshold: 0.45},
+		labels: []string{"person", "dog"},
+	}
+
+	// Boxes as (cx, cy, w, h, objectness, person, dog): a dog, a weaker overlapping dog, a low scoring person
+	boxes := [][]float32{
+		{50, 50, 20, 20, 0.9, 0.1, 0.9},
+		{52, 50, 20, 20, 0.9, 0.1, 0.8},
+		{20, 20, 10, 10, 0.5, 0.9, 0.1},
+	}
+	// Models report far more boxes than attributes, which is how the layouts are told apart
+	for len(boxes) < 10 {
+		boxes = append(boxes, make([]float32, 7))
+	}
+	want := []Detection{{Rect: image.Rect(40, 40, 60, 60), Label: "dog", Score: boxes[0][4] * boxes[0][6]}}
+
+	// YOLOv5 has a row per box
+	var v5 []float32
+	for _, b := range boxes {
+		v5 = append(v5, b...)
+	}
+	if got := d.parseYOLO(v5, len(boxes), 7, 100, 100); !reflect.DeepEqual(got, want) {
+		t.Errorf("v5: got %v, want %v", got, want)
+	}
+
+	// YOLOv8 has a column per box and no objectness, so the class scores are taken as they are
+	var v8 []float32
+	for _, attr := range []int{0, 1, 2, 3, 5, 6} {
+		for _, b := range boxes {
+			v8 = append(v8, b[attr])
+		}
+	}
+	want[0].Score = 0.9
+	want = append(want, Detection{Rect: image.Rect(15, 15, 25, 25), Label: "person", Score: 0.9})
+	if got := d.parseYOLO(v8, 6, len(boxes), 100, 100); !reflect.DeepEqual(got, want) {
+		t.Errorf("v8: got %v, want %v", got, want)
+	}
+}
+
+func TestDNNLetterboxMapping(t *testing.T) {
+	d := &DNNDetector{config: DetectorConfig{InputSize: 100, Confidence: 0.5, NMSThreshold: 0.45, Letterbox: true}}
+
+	// A 200x100 frame padded to a 200x200 square, which the network sees at 100x100
+	offset, side := letterboxOffset(200, 100)
+	if offset != image.Pt(0, 50) || side != 200 {
+		t.Fatalf("letterboxOffset = %v, %d, want (0,50), 200", offset, side)
+	}
+
+	// YOLOv5 rows of (cx, cy, w, h, objectness, class) in input pixels
+	boxes := [][]float32{
+		{50, 50, 20, 20, 1, 0.9},  // Center of the frame
+		{20, 10, 10, 10, 1, 0.9},  // In the top padding
+		{80, 50, 10, 10, 1, 0.45}, // Below the threshold
+		{80, 30, 10, 10, 1, 0.55}, // Just above it, straddling the top of the frame
+	}
+	var values []float32
+	for _, b := range boxes {
+		values = append(values, b...)
+	}
+	for len(values) < 10*6 {
+		values = append(values, make([]float32, 6)...)
+	}
+
+	got := clipDetections(d.parseYOLO(values, len(values)/6, 6, side, side), offset, image.Rect(0, 0, 200, 100))
+	want := []Detection{
+		{Rect: image.Rect(80, 30, 120, 70), Label: "class 0", Score: 0.9},
+		{Rect: image.Rect(150, 0, 170, 20), Label: "class 0", Score: 0.55},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestClipDetections(t *testing.T) {
+	// A 100x60 frame letterboxed to 100x100 sits 20 pixels down
+	detections := []Detection{
+		{Rect: image.Rect(10, 30, 20, 40), Label: "inside"},
+		{Rect: image.Rect(10, 10, 20, 30), Label: "straddles top"},
+		{Rect: image.Rect(10, 85, 20, 95), Label: "padding"},
+	}
+	want := []Detection{
+		{Rect: image.Rect(10, 10, 20, 20), Label: "inside"},
+		{Rect: image.Rect(10, 0, 20, 10), Label: "straddles top"},
+	}
+	got := clipDetections(detections, image.Pt(0, 20), image.Rect(0, 0, 100, 60))
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseROI(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    image.Rectangle
+		wantErr bool
+	}{
+		{in: "", want: image.Rectangle{}},
+		{in: "  ", want: image.Rectangle{}},
+		{in: "10,20,300,200", want: image.Rect(10, 20, 310, 220)},
+		{in: " 0, 0, 1, 1 ", want: image.Rect(0, 0, 1, 1)},
+		{in: "10,20,300", wantErr: true},
+		{in: "10,20,300,200,5", wantErr: true},
+		{in: "a,20,300,200", wantErr: true},
+		{in: "1.5,20,300,200", wantErr: true},
+		{in: "-1,20,300,200", wantErr: true},
+		{in: "10,20,0,200", wantErr: true},
+		{in: "10,20,300,-5", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseROI(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseROI(%q) err = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseROI(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
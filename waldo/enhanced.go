@@ -0,0 +1,90 @@
+package waldo
+
+import (
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+// Enhanced RTMP (veovera.org) sets the top bit of the first video byte and follows it with a FourCC
+// naming the codec. go-flv does not know the format: it reads that bit as part of the frame type
+// and the packet type as the codec id, and leaves the FourCC in the tag body. The tag still
+// encodes back byte for byte, so it is recorded and relayed untouched
+const exVideoHeaderFlag flvtag.FrameType = 0x08
+
+// exVideoPacketType Packet type of an enhanced RTMP video tag
+type exVideoPacketType uint8
+
+const (
+	exVideoSequenceStart        exVideoPacketType = 0
+	exVideoCodedFrames          exVideoPacketType = 1
+	exVideoSequenceEnd          exVideoPacketType = 2
+	exVideoCodedFramesX         exVideoPacketType = 3 // Coded frames without a composition time
+	exVideoMetadata             exVideoPacketType = 4
+	exVideoMPEG2TSSequenceStart exVideoPacketType = 5
+	exVideoMultitrack           exVideoPacketType = 6
+	exVideoModEx                exVideoPacketType = 7
+)
+
+// exVideoHeader The enhanced RTMP fields of a video tag
+type exVideoHeader struct {
+	PacketType exVideoPacketType
+	FourCC     string // Empty when it could not be found, e.g. behind a ModEx prefix
+}
+
+// Whether a decoded video tag uses the enhanced RTMP header
+func isExVideo(video *flvtag.VideoData) bool {
+	return video.FrameType&exVideoHeaderFlag != 0
+}
+
+// Whether a decoded video tag is a keyframe, legacy or enhanced
+func isVideoKeyframe(video *flvtag.VideoData) bool {
+	return video.FrameType&^exVideoHeaderFlag == flvtag.FrameTypeKeyFrame
+}
+
+// Whether a decoded video tag is a sequence header every decoder has to see first, legacy AVC or enhanced
+func isExVideoSequenceStart(video *flvtag.VideoData) bool {
+	packetType := exVideoPacketType(video.CodecID)
+	return isExVideo(video) && (packetType == exVideoSequenceStart || packetType == exVideoMPEG2TSSequenceStart)
+}
+
+// Read the enhanced RTMP header of a decoded video tag, body being what go-flv left after the first byte.
+// False for legacy tags
+func parseExVideoHeader(video *flvtag.VideoData, body []byte) (exVideoHeader, bool) {
+	if !isExVideo(video) {
+		return exVideoHeader{}, false
+	}
+
+	ex := exVideoHeader{PacketType: exVideoPacketType(video.CodecID)}
+	switch ex.PacketType {
+	case exVideoModEx:
+		// go-flv took this for AVC and consumed 4 bytes of it, the FourCC is out of reach
+	case exVideoMultitrack:
+		// The multitrack type and the packet type of the tracks come first
+		if len(body) >= 5 {
+			ex.FourCC = string(body[1:5])
+		}
+	default:
+		if len(body) >= 4 {
+			ex.FourCC = string(body[:4])
+		}
+	}
+
+	return ex, true
+}
+
+// Human readable name of an enhanced RTMP video FourCC
+func videoFourCCName(fourCC string) string {
+	switch fourCC {
+	case "avc1":
+		return "H.264"
+	case "hvc1":
+		return "HEVC"
+	case "av01":
+		return "AV1"
+	case "vp09":
+		return "VP9"
+	case "":
+		return "unknown"
+	}
+
+	return fourCC
+}
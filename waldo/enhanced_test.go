@@ -0,0 +1,104 @@
+package waldo
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+// Video tag bodies of a recording, read straight from the file so go-flv cannot hide a difference
+func rawFLVVideo(t *testing.T, p string) [][]byte {
+	t.Helper()
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 13 || string(b[:3]) != "FLV" {
+		t.Fatalf("%s is not an FLV file", p)
+	}
+
+	var bodies [][]byte
+	for b = b[13:]; len(b) > 0; {
+		if len(b) < 11 {
+			t.Fatalf("Truncated tag header in %s", p)
+		}
+		size := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		if len(b) < 11+size+4 {
+			t.Fatalf("Truncated tag in %s", p)
+		}
+		if b[0] == 9 {
+			bodies = append(bodies, b[11:11+size])
+		}
+		b = b[11+size+4:]
+	}
+
+	return bodies
+}
+
+// Enhanced RTMP video tag body: the header byte of a frame and packet type, the FourCC, then payload
+func exVideoTag(keyframe bool, packetType exVideoPacketType, fourCC string, payload []byte) []byte {
+	frameType := byte(2)
+	if keyframe {
+		frameType = 1
+	}
+	b := append([]byte{0x80 | frameType<<4 | byte(packetType)}, fourCC...)
+
+	return append(b, payload...)
+}
+
+func TestEnhancedVideoPassesThrough(t *testing.T) {
+	streams := map[string][][]byte{
+		"hevc": {
+			exVideoTag(true, exVideoSequenceStart, "hvc1", []byte{0x01, 0x01, 0x60, 0x00, 0x00, 0x00, 0x90, 0x00}),
+			exVideoTag(true, exVideoCodedFrames, "hvc1", []byte{0, 0, 0, 0, 0, 0, 3, 0x26, 0x01, 0xaf}),
+			exVideoTag(false, exVideoCodedFrames, "hvc1", []byte{0, 0, 0x28, 0, 0, 0, 3, 0x02, 0x01, 0xd0}),
+			exVideoTag(false, exVideoCodedFramesX, "hvc1", []byte{0, 0, 0, 3, 0x02, 0x01, 0xd1}),
+		},
+		"av1": {
+			exVideoTag(true, exVideoSequenceStart, "av01", []byte{0x81, 0x08, 0x0c, 0x00}),
+			exVideoTag(true, exVideoCodedFrames, "av01", []byte{0x12, 0x00, 0x0a, 0x0b, 0x00, 0x00, 0x00, 0x24}),
+			exVideoTag(false, exVideoCodedFrames, "av01", []byte{0x12, 0x00, 0x32, 0x02, 0x10, 0x00}),
+			exVideoTag(false, exVideoSequenceEnd, "av01", nil),
+		},
+	}
+
+	for name, tags := range streams {
+		t.Run(name, func(t *testing.T) {
+			s, addr := startTestServer(t, Options{PlayerQueue: 16})
+			publisher := publishTestStream(t, addr, name)
+			h := waitForStream(t, s, name)
+			player := playTestStream(t, addr, name)
+			deadline := time.Now().Add(5 * time.Second)
+			for h.playback.Players() == 0 {
+				if time.Now().After(deadline) {
+					t.Fatal("Player never subscribed")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			for i, tag := range tags {
+				publisher.video(t, uint32(i*40), tag)
+			}
+
+			// Players get every byte as published
+			for i, tag := range tags {
+				if body, _ := player.video(t); !bytes.Equal(body, tag) {
+					t.Errorf("Played tag %d is % x, want % x", i, body, tag)
+				}
+			}
+
+			// And so does the recording
+			_ = publisher.conn.Close()
+			waitForClose(t, h)
+			recorded := rawFLVVideo(t, h.RecordingPath())
+			if len(recorded) != len(tags) {
+				t.Fatalf("Recorded %d video tags, want %d", len(recorded), len(tags))
+			}
+			for i, tag := range tags {
+				if !bytes.Equal(recorded[i], tag) {
+					t.Errorf("Recorded tag %d is % x, want % x", i, recorded[i], tag)
+				}
+			}
+		})
+	}
+}
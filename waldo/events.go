@@ -0,0 +1,96 @@
+package waldo
+
+import (
+	"image"
+	"sync"
+	"sync/atomic"
+)
+
+// DetectionEvent A detection pushed to live subscribers
+type DetectionEvent struct {
+	Stream     string          `json:"stream"`
+	Timestamp  uint32          `json:"timestamp"`
+	Rect       image.Rectangle `json:"rect"`
+	Confidence float64         `json:"confidence"`
+}
+
+// FrameEvent Every detection in a frame, pushed to live subscribers as one message
+type FrameEvent struct {
+	Stream    string      `json:"stream"`
+	Timestamp uint32      `json:"timestamp"`
+	Rects     []EventRect `json:"rects"`
+	Thumbnail []byte      `json:"thumbnail,omitempty"` // JPEG of the annotated frame, base64 in the JSON
+}
+
+// EventRect A bounding box in a FrameEvent
+type EventRect struct {
+	Rect       image.Rectangle `json:"rect"`
+	Label      string          `json:"label,omitempty"`
+	Confidence float64         `json:"confidence"`
+}
+
+// EventBroker Fans detection events out to subscribers without ever blocking the publisher.
+// A subscriber whose buffer is full misses events
+type EventBroker struct {
+	subs      sync.Map // uint64 -> chan DetectionEvent
+	frameSubs sync.Map // uint64 -> chan FrameEvent
+	nextID    atomic.Uint64
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{}
+}
+
+// Register a subscriber. Call Unsubscribe with the returned id when done
+func (b *EventBroker) Subscribe(buffer int) (uint64, <-chan DetectionEvent) {
+	id := b.nextID.Add(1)
+	ch := make(chan DetectionEvent, buffer)
+	b.subs.Store(id, ch)
+
+	return id, ch
+}
+
+// Register a subscriber to whole frames. Call Unsubscribe with the returned id when done
+func (b *EventBroker) SubscribeFrames(buffer int) (uint64, <-chan FrameEvent) {
+	id := b.nextID.Add(1)
+	ch := make(chan FrameEvent, buffer)
+	b.frameSubs.Store(id, ch)
+
+	return id, ch
+}
+
+func (b *EventBroker) Unsubscribe(id uint64) {
+	b.subs.Delete(id)
+	b.frameSubs.Delete(id)
+}
+
+// Whether anyone listens to frames, so publishers can skip building events, thumbnails in particular
+func (b *EventBroker) HasFrameSubscribers() bool {
+	found := false
+	b.frameSubs.Range(func(_, _ any) bool {
+		found = true
+		return false
+	})
+
+	return found
+}
+
+func (b *EventBroker) PublishFrame(ev FrameEvent) {
+	b.frameSubs.Range(func(_, v any) bool {
+		select {
+		case v.(chan FrameEvent) <- ev:
+		default:
+		}
+		return true
+	})
+}
+
+func (b *EventBroker) Publish(ev DetectionEvent) {
+	b.subs.Range(func(_, v any) bool {
+		select {
+		case v.(chan DetectionEvent) <- ev:
+		default:
+		}
+		return true
+	})
+}
@@ -0,0 +1,79 @@
+package waldo
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/yutopp/go-flv"
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+// test/sample.mp4 (H.264 and AAC) remuxed to FLV with ffmpeg. Skips the test when ffmpeg is missing
+func sampleFLV(t *testing.T) string {
+	t.Helper()
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg not on PATH")
+	}
+
+	p := filepath.Join(t.TempDir(), "sample.flv")
+	cmd := exec.Command(ffmpeg, "-loglevel", "error", "-i", filepath.Join("..", "test", "sample.mp4"), "-c", "copy", "-f", "flv", p)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("Failed to convert the sample: %v\n%s", err, out)
+	}
+
+	return p
+}
+
+// Every tag of an FLV file, with the payloads read into memory
+func readFLV(t *testing.T, p string) []*flvtag.FlvTag {
+	t.Helper()
+	f, err := os.Open(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	dec, err := flv.NewDecoder(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tags []*flvtag.FlvTag
+	for {
+		var tag flvtag.FlvTag
+		if err := dec.Decode(&tag); err == io.EOF {
+			return tags
+		} else if err != nil {
+			t.Fatalf("Tag %d of %s: %v", len(tags), p, err)
+		}
+		switch data := tag.Data.(type) {
+		case *flvtag.VideoData:
+			b, err := io.ReadAll(data.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data.Data = bytes.NewReader(b)
+		case *flvtag.AudioData:
+			b, err := io.ReadAll(data.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data.Data = bytes.NewReader(b)
+		}
+		tags = append(tags, &tag)
+	}
+}
+
+// Hand every tag of an FLV file to a handler that already published, as the RTMP server would
+func feedFLV(t *testing.T, h *Handler, p string) {
+	t.Helper()
+	for _, tag := range readFLV(t, p) {
+		if err := replayTag(h, tag); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package waldo
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+	"gocv.io/x/gocv"
+)
+
+// CachedFrame A decoded picture kept for snapshots
+type CachedFrame struct {
+	Timestamp uint32
+	Width     int
+	Height    int
+	Data      []byte // BGR, 3 bytes per pixel
+}
+
+// FrameCache Ring buffer of the most recently decoded pictures of a stream.
+// Subscribers get every new frame as it is put, or miss it when their buffer is full
+type FrameCache struct {
+	mu     sync.RWMutex
+	frames []CachedFrame
+	next   int
+	count  int
+
+	subs   map[uint64]chan CachedFrame
+	nextID uint64
+}
+
+func NewFrameCache(size int) *FrameCache {
+	if size < 1 {
+		size = 1
+	}
+
+	return &FrameCache{frames: make([]CachedFrame, size)}
+}
+
+// Keep a copy of a BGR frame, replacing the oldest one when full
+func (c *FrameCache) Put(timestamp uint32, frame gocv.Mat) {
+	f := CachedFrame{
+		Timestamp: timestamp,
+		Width:     frame.Cols(),
+		Height:    frame.Rows(),
+		Data:      frame.ToBytes(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.frames[c.next] = f
+	c.next = (c.next + 1) % len(c.frames)
+	if c.count < len(c.frames) {
+		c.count++
+	}
+
+	for _, ch := range c.subs {
+		select {
+		case ch <- f:
+		default:
+		}
+	}
+}
+
+// Receive frames as they are put. Call Unsubscribe with the returned id when done
+func (c *FrameCache) Subscribe(buffer int) (uint64, <-chan CachedFrame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.subs == nil {
+		c.subs = make(map[uint64]chan CachedFrame)
+	}
+	c.nextID++
+	ch := make(chan CachedFrame, buffer)
+	c.subs[c.nextID] = ch
+
+	return c.nextID, ch
+}
+
+func (c *FrameCache) Unsubscribe(id uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.subs, id)
+}
+
+// The most recent frame, false when nothing was decoded yet
+func (c *FrameCache) Latest() (CachedFrame, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.count == 0 {
+		return CachedFrame{}, false
+	}
+
+	return c.frames[(c.next-1+len(c.frames))%len(c.frames)], true
+}
+
+// Compress the frame as JPEG
+func (f CachedFrame) JPEG() ([]byte, error) {
+	img, err := gocv.NewMatFromBytes(f.Height, f.Width, gocv.MatTypeCV8UC3, f.Data)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid cached frame")
+	}
+	defer img.Close()
+
+	buf, err := gocv.IMEncode(gocv.JPEGFileExt, img)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to encode JPEG")
+	}
+	defer buf.Close()
+
+	return append([]byte(nil), buf.GetBytes()...), nil
+}
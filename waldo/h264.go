@@ -0,0 +1,599 @@
+package waldo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"gocv.io/x/gocv"
+)
+
+var annexBStartCode = []byte{0x00, 0x00, 0x00, 0x01}
+
+// Access units waiting for a stream decoder's ffmpeg, about a second of video
+const decoderQueue = 32
+
+// AVCDecoderConfig The AVCDecoderConfigurationRecord sent in an AVC sequence header
+type AVCDecoderConfig struct {
+	Profile    uint8
+	Level      uint8
+	LengthSize int // Bytes in each NALU length prefix
+	SPS        [][]byte
+	PPS        [][]byte
+
+	// Picture size from the first SPS, 0 if it could not be parsed
+	ParsedWidth  int
+	ParsedHeight int
+}
+
+// Parse an AVCDecoderConfigurationRecord (ISO/IEC 14496-15)
+func parseAVCDecoderConfig(data []byte) (*AVCDecoderConfig, error) {
+	if len(data) < 6 || data[0] != 1 {
+		return nil, errors.New("Invalid AVCDecoderConfigurationRecord")
+	}
+
+	cfg := &AVCDecoderConfig{
+		Profile:    data[1],
+		Level:      data[3],
+		LengthSize: int(data[4]&0x03) + 1,
+	}
+
+	readSets := func(p []byte, count int) ([][]byte, []byte, error) {
+		sets := make([][]byte, 0, count)
+		for i := 0; i < count; i++ {
+			if len(p) < 2 {
+				return nil, nil, errors.New("Truncated parameter set length")
+			}
+			n := int(binary.BigEndian.Uint16(p))
+			p = p[2:]
+			if n > len(p) {
+				return nil, nil, errors.New("Truncated parameter set")
+			}
+			sets = append(sets, append([]byte(nil), p[:n]...))
+			p = p[n:]
+		}
+		return sets, p, nil
+	}
+
+	var err error
+	rest := data[6:]
+	if cfg.SPS, rest, err = readSets(rest, int(data[5]&0x1f)); err != nil {
+		return nil, err
+	}
+	if len(rest) < 1 {
+		return nil, errors.New("Missing PPS count")
+	}
+	if cfg.PPS, _, err = readSets(rest[1:], int(rest[0])); err != nil {
+		return nil, err
+	}
+
+	if len(cfg.SPS) > 0 {
+		if sps, err := parseSPS(cfg.SPS[0]); err == nil {
+			cfg.ParsedWidth = sps.Width
+			cfg.ParsedHeight = sps.Height
+		}
+	}
+
+	return cfg, nil
+}
+
+// Write SPS and PPS as Annex-B NAL units, so a decoder can start from the next picture
+func (c *AVCDecoderConfig) annexBHeader() []byte {
+	out := new(bytes.Buffer)
+	for _, set := range append(c.SPS, c.PPS...) {
+		out.Write(annexBStartCode)
+		out.Write(set)
+	}
+
+	return out.Bytes()
+}
+
+// Whether o carries the same parameter sets and NALU length size, e.g. a repeated sequence header
+func (c *AVCDecoderConfig) Equal(o *AVCDecoderConfig) bool {
+	if c == nil || o == nil {
+		return c == o
+	}
+
+	return c.LengthSize == o.LengthSize && bytes.Equal(c.annexBHeader(), o.annexBHeader())
+}
+
+// Some encoders send Annex-B start codes inside FLV instead of length prefixes
+func isAnnexB(data []byte) bool {
+	return bytes.HasPrefix(data, []byte{0x00, 0x00, 0x01}) || bytes.HasPrefix(data, annexBStartCode)
+}
+
+// Convert length-prefixed (AVCC) NAL units, as carried in FLV, to an Annex-B byte stream
+func avccToAnnexB(data []byte, lengthSize int) ([]byte, error) {
+	out := new(bytes.Buffer)
+	for len(data) > 0 {
+		if len(data) < lengthSize {
+			return nil, errors.New("Truncated NALU length prefix")
+		}
+		n := 0
+		for _, b := range data[:lengthSize] {
+			n = n<<8 | int(b)
+		}
+		data = data[lengthSize:]
+		if n > len(data) {
+			return nil, errors.Errorf("NALU length %d exceeds remaining %d bytes", n, len(data))
+		}
+
+		out.Write(annexBStartCode)
+		out.Write(data[:n])
+		data = data[n:]
+	}
+
+	return out.Bytes(), nil
+}
+
+// DecodeError Returned when a picture could not be decoded. The packet should be passed through untouched
+type DecodeError struct {
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return "Video decode failed: " + e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// DecodedFrame A picture from an H264StreamDecoder. The receiver owns Mat and must Close it
+type DecodedFrame struct {
+	Timestamp uint32
+	Mat       gocv.Mat
+}
+
+// H264StreamDecoder Decodes an H.264 (or HEVC) stream through one long running ffmpeg,
+// so inter-frames are decoded against their reference pictures, and keyframes fed on their own
+// never wait for a process to start.
+//
+// Decoding is asynchronous: access units queue up for ffmpeg, frames chosen by the sample function
+// come out of Frames, and both are dropped while ffmpeg or the receiver is behind unless the decoder is lossless
+type H264StreamDecoder struct {
+	cmd      *exec.Cmd
+	stdin    io.WriteCloser
+	stdout   io.ReadCloser
+	stderr   *bytes.Buffer
+	sample   func(index uint64) bool
+	lossless bool // Wait for ffmpeg and the receiver rather than drop units and frames
+	units    chan []byte
+	frames   chan DecodedFrame
+	done     chan struct{}
+	written  chan struct{}
+
+	// Set by the feeder only
+	skipping  bool // A unit was dropped, so pictures referring to it are until the next keyframe
+	closeOnce sync.Once
+
+	writeErr atomic.Value // error, the first write to ffmpeg that failed
+
+	// Presentation times of fed pictures not yet decoded. Pictures come out in display order,
+	// so each one takes the earliest
+	mu      sync.Mutex
+	pending []uint32
+}
+
+// Start ffmpeg for an H.264 stream. Fails when ffmpeg is not on PATH.
+// A lossless decoder hands over every sampled frame, stalling ffmpeg and then Feed while the receiver is busy
+func NewH264StreamDecoder(sample func(index uint64) bool, lossless bool) (*H264StreamDecoder, error) {
+	return newStreamDecoder("h264", "H.264", sample, lossless)
+}
+
+// Same as NewH264StreamDecoder, for an HEVC stream
+func NewHEVCStreamDecoder(sample func(index uint64) bool, lossless bool) (*H264StreamDecoder, error) {
+	return newStreamDecoder("hevc", "HEVC", sample, lossless)
+}
+
+// format is the ffmpeg demuxer of the Annex-B input. Pictures come out as BMP,
+// which carries its own size, so the picture size never has to be known up front
+func newStreamDecoder(format, codec string, sample func(index uint64) bool, lossless bool) (*H264StreamDecoder, error) {
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errors.Wrapf(err, "ffmpeg is required for %s decoding", codec)
+	}
+
+	d := &H264StreamDecoder{
+		cmd: exec.Command(path,
+			"-loglevel", "error",
+			"-fflags", "nobuffer", "-flags", "low_delay",
+			"-probesize", "32", "-analyzeduration", "0",
+			"-f", format, "-i", "pipe:0",
+			"-vsync", "passthrough",
+			"-f", "image2pipe", "-c:v", "bmp", "pipe:1",
+		),
+		stderr:   new(bytes.Buffer),
+		sample:   sample,
+		lossless: lossless,
+		units:    make(chan []byte, decoderQueue),
+		frames:   make(chan DecodedFrame, 4),
+		done:     make(chan struct{}),
+		written:  make(chan struct{}),
+	}
+	d.cmd.Stderr = d.stderr
+
+	if d.stdin, err = d.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if d.stdout, err = d.cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err := d.cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "Failed to start ffmpeg")
+	}
+
+	go d.writeUnits()
+	go d.readFrames()
+
+	return d, nil
+}
+
+// Queue the next access unit, as Annex-B, for the decoder. pts is its presentation time,
+// the tag timestamp plus its composition time. False when the unit was dropped: the queue was full,
+// or an earlier unit was dropped and this is not the keyframe decoding can resume from.
+// Only a lossless decoder waits for room. Not safe for concurrent use
+func (d *H264StreamDecoder) Feed(annexB []byte, keyframe bool, pts uint32) (bool, error) {
+	if err, _ := d.writeErr.Load().(error); err != nil {
+		return false, &DecodeError{Err: errors.Wrapf(err, "ffmpeg: %s", d.stderr.String())}
+	}
+	if d.skipping && !keyframe {
+		return false, nil
+	}
+
+	// Taken before the unit can reach ffmpeg, so its picture always finds it
+	d.mu.Lock()
+	d.pending = append(d.pending, pts)
+	d.mu.Unlock()
+
+	if d.lossless {
+		d.units <- annexB
+		return true, nil
+	}
+	select {
+	case d.units <- annexB:
+		d.skipping = false
+		return true, nil
+	default:
+		d.mu.Lock()
+		d.pending = d.pending[:len(d.pending)-1]
+		d.mu.Unlock()
+		d.skipping = true
+		return false, nil
+	}
+}
+
+// Write queued units to ffmpeg until the input ends. After a failed write the rest are discarded
+func (d *H264StreamDecoder) writeUnits() {
+	defer close(d.written)
+	defer func() { _ = d.stdin.Close() }()
+
+	for unit := range d.units {
+		if d.writeErr.Load() != nil {
+			continue
+		}
+		if _, err := d.stdin.Write(unit); err != nil {
+			d.writeErr.Store(err)
+		}
+	}
+}
+
+// Sampled pictures, closed once the decoder exits
+func (d *H264StreamDecoder) Frames() <-chan DecodedFrame {
+	return d.frames
+}
+
+// Read BMP pictures until ffmpeg exits. Never blocks on the receiver unless lossless,
+// so ffmpeg never stalls the feeder
+func (d *H264StreamDecoder) readFrames() {
+	defer close(d.done)
+	defer close(d.frames)
+
+	// "BM" and the file size
+	header := make([]byte, 6)
+	for index := uint64(0); ; index++ {
+		if _, err := io.ReadFull(d.stdout, header); err != nil {
+			return
+		}
+		size := binary.LittleEndian.Uint32(header[2:])
+		if header[0] != 'B' || header[1] != 'M' || size < uint32(len(header)) {
+			slog.Error("Decoder output is not BMP, stopping it")
+			// Keep ffmpeg from blocking on a full pipe until it sees its input end
+			_, _ = io.Copy(io.Discard, d.stdout)
+			return
+		}
+		buf := make([]byte, size)
+		copy(buf, header)
+		if _, err := io.ReadFull(d.stdout, buf[len(header):]); err != nil {
+			return
+		}
+
+		ts := d.nextPTS()
+		if !d.sample(index) {
+			continue
+		}
+
+		mat, err := gocv.IMDecode(buf, gocv.IMReadColor)
+		if err != nil || mat.Empty() {
+			_ = mat.Close()
+			slog.Error("Failed to read decoded picture", "err", err)
+			continue
+		}
+
+		if d.lossless {
+			d.frames <- DecodedFrame{Timestamp: ts, Mat: mat}
+			continue
+		}
+		select {
+		case d.frames <- DecodedFrame{Timestamp: ts, Mat: mat}:
+		default:
+			_ = mat.Close()
+		}
+	}
+}
+
+// Take the earliest pending presentation time, 0 if none is left
+func (d *H264StreamDecoder) nextPTS() uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(d.pending) == 0 {
+		return 0
+	}
+	first := 0
+	for i, pts := range d.pending {
+		if pts < d.pending[first] {
+			first = i
+		}
+	}
+	pts := d.pending[first]
+	d.pending = append(d.pending[:first], d.pending[first+1:]...)
+
+	return pts
+}
+
+// End the input. Queued units still reach ffmpeg, and their pictures come out of Frames,
+// which closes once they are all decoded
+func (d *H264StreamDecoder) CloseInput() {
+	d.closeOnce.Do(func() { close(d.units) })
+}
+
+// Stop ffmpeg and release pictures nobody received
+func (d *H264StreamDecoder) Close() error {
+	d.CloseInput()
+	for f := range d.frames {
+		_ = f.Mat.Close()
+	}
+	<-d.done
+	<-d.written
+
+	return d.cmd.Wait()
+}
+
+// Split an Annex-B byte stream into NAL units (without start codes)
+func splitAnnexB(data []byte) [][]byte {
+	var nalus [][]byte
+	start := -1
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			nalus = append(nalus, bytes.TrimRight(data[start:i], "\x00"))
+		}
+		start = i + 3
+		i += 2
+	}
+	if start >= 0 && start < len(data) {
+		nalus = append(nalus, data[start:])
+	}
+
+	return nalus
+}
+
+// H.264 NAL unit types we care about when repackaging encoder output
+const (
+	naluTypeIDR = 5
+	naluTypeSEI = 6
+	naluTypeAUD = 9
+)
+
+// Whether a NALU payload carries an IDR slice, rather than only an I-slice later frames may refer past
+func hasIDRSlice(cfg *AVCDecoderConfig, data []byte) bool {
+	stream, err := toAnnexB(cfg, data, false)
+	if err != nil {
+		return false
+	}
+	for _, nalu := range splitAnnexB(stream) {
+		if len(nalu) > 0 && nalu[0]&0x1f == naluTypeIDR {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Parameter set id used for re-encoded GOPs, so they never clobber the publisher's own SPS/PPS.
+// A re-encoded GOP's IDR activates them, the publisher's next IDR switches back to its own
+const encoderParamSetID = 31
+
+// H264EncoderConfig Rate control for re-encoded GOPs.
+// With both fields 0 the encoder targets the measured source bitrate
+type H264EncoderConfig struct {
+	QP          int // Constant quantizer, used when BitrateKbps is 0
+	BitrateKbps int
+}
+
+// Quantizer used when neither a QP nor any bitrate is known
+const defaultEncodeQP = 23
+
+// H264Encoder Re-encodes BGR frames into H.264 by running ffmpeg/libx264, one GOP at a time
+type H264Encoder struct {
+	ffmpegPath string
+	config     H264EncoderConfig
+}
+
+// Fails when ffmpeg is not on PATH
+func NewH264Encoder(config H264EncoderConfig) (*H264Encoder, error) {
+	path, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		return nil, errors.Wrap(err, "ffmpeg is required for H.264 encoding")
+	}
+
+	return &H264Encoder{ffmpegPath: path, config: config}, nil
+}
+
+// GOPEncoding Frames being encoded as one GOP: an IDR with in-band SPS/PPS, then P-frames only
+type GOPEncoding struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bytes.Buffer
+	stderr *bytes.Buffer
+	width  int
+	height int
+	frames int
+}
+
+// Start encoding a GOP of width x height frames at fps (0 if unknown).
+// profile is the AVC profile_idc of the original stream (0 if unknown),
+// sourceKbps the publisher's measured bitrate (0 if unknown)
+func (e *H264Encoder) StartGOP(width, height int, fps float64, profile uint8, sourceKbps int) (*GOPEncoding, error) {
+	args := []string{
+		"-loglevel", "error",
+		"-f", "rawvideo", "-pix_fmt", "bgr24",
+		"-s", fmt.Sprintf("%dx%d", width, height),
+	}
+	if fps > 0 {
+		args = append(args, "-framerate", strconv.FormatFloat(fps, 'f', -1, 64))
+	}
+	args = append(args,
+		"-i", "pipe:0",
+		"-c:v", "libx264", "-pix_fmt", "yuv420p",
+		"-tune", "zerolatency", "-bf", "0",
+		// A single IDR, and access unit delimiters to split the output on
+		"-x264-params", fmt.Sprintf("sps-id=%d:aud=1:keyint=infinite:scenecut=0", encoderParamSetID),
+	)
+	switch profile {
+	case 66:
+		args = append(args, "-profile:v", "baseline")
+	case 77:
+		args = append(args, "-profile:v", "main")
+	case 100:
+		args = append(args, "-profile:v", "high")
+	}
+	switch {
+	case e.config.BitrateKbps > 0:
+		args = append(args, "-b:v", fmt.Sprintf("%dk", e.config.BitrateKbps))
+	case e.config.QP > 0:
+		args = append(args, "-qp", strconv.Itoa(e.config.QP))
+	case sourceKbps > 0:
+		args = append(args, "-b:v", fmt.Sprintf("%dk", sourceKbps))
+	default:
+		args = append(args, "-qp", strconv.Itoa(defaultEncodeQP))
+	}
+	args = append(args, "-f", "h264", "pipe:1")
+
+	g := &GOPEncoding{
+		cmd:    exec.Command(e.ffmpegPath, args...),
+		stdout: new(bytes.Buffer),
+		stderr: new(bytes.Buffer),
+		width:  width,
+		height: height,
+	}
+	g.cmd.Stdout = g.stdout
+	g.cmd.Stderr = g.stderr
+
+	var err error
+	if g.stdin, err = g.cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if err := g.cmd.Start(); err != nil {
+		return nil, errors.Wrap(err, "Failed to start ffmpeg")
+	}
+
+	return g, nil
+}
+
+// Add the next frame, in display order
+func (g *GOPEncoding) Write(frame gocv.Mat) error {
+	if frame.Cols() != g.width || frame.Rows() != g.height {
+		return errors.Errorf("Frame is %dx%d, the GOP started at %dx%d", frame.Cols(), frame.Rows(), g.width, g.height)
+	}
+	if _, err := g.stdin.Write(frame.ToBytes()); err != nil {
+		return errors.Wrapf(err, "ffmpeg: %s", g.stderr.String())
+	}
+	g.frames++
+
+	return nil
+}
+
+// Frames written so far
+func (g *GOPEncoding) Frames() int {
+	return g.frames
+}
+
+// Wait for the encoder and return one access unit per frame, as length-prefixed NAL units.
+// The first is the IDR with its SPS/PPS, under encoderParamSetID
+func (g *GOPEncoding) Finish(lengthSize int) ([][]byte, error) {
+	_ = g.stdin.Close()
+	if err := g.cmd.Wait(); err != nil {
+		return nil, errors.Wrapf(err, "ffmpeg failed to encode GOP: %s", g.stderr.String())
+	}
+
+	units := splitAccessUnits(g.stdout.Bytes(), lengthSize)
+	if len(units) != g.frames {
+		return nil, errors.Errorf("Encoder produced %d pictures for %d frames", len(units), g.frames)
+	}
+
+	return units, nil
+}
+
+// Stop the encoder, discarding its output
+func (g *GOPEncoding) Abort() {
+	_ = g.stdin.Close()
+	_ = g.cmd.Process.Kill()
+	_ = g.cmd.Wait()
+}
+
+// Split encoder output on its access unit delimiters and repackage each access unit as AVCC,
+// keeping only parameter sets and picture data
+func splitAccessUnits(annexB []byte, lengthSize int) [][]byte {
+	var units [][]byte
+	var au *bytes.Buffer
+	for _, nalu := range splitAnnexB(annexB) {
+		if len(nalu) == 0 {
+			continue
+		}
+		switch nalu[0] & 0x1f {
+		case naluTypeAUD:
+			if au != nil && au.Len() > 0 {
+				units = append(units, au.Bytes())
+			}
+			au = new(bytes.Buffer)
+			continue
+		case naluTypeSEI:
+			continue
+		}
+		if au == nil {
+			au = new(bytes.Buffer)
+		}
+
+		n := len(nalu)
+		for i := lengthSize - 1; i >= 0; i-- {
+			au.WriteByte(byte(n >> (8 * i)))
+		}
+		au.Write(nalu)
+	}
+	if au != nil && au.Len() > 0 {
+		units = append(units, au.Bytes())
+	}
+
+	return units
+}
@@ -0,0 +1,110 @@
+package waldo
+
+import (
+	"io"
+	"testing"
+
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+func TestStreamDecoderFeedDropsUntilKeyframe(t *testing.T) {
+	d := &H264StreamDecoder{units: make(chan []byte, 1)}
+	feed := func(keyframe bool, pts uint32) bool {
+		t.Helper()
+		queued, err := d.Feed([]byte{0}, keyframe, pts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return queued
+	}
+
+	if !feed(true, 0) {
+		t.Fatal("The first keyframe was dropped")
+	}
+	if feed(false, 40) {
+		t.Fatal("A unit was queued with the queue full")
+	}
+	<-d.units
+	if feed(false, 80) {
+		t.Error("A picture after a dropped one was queued before the next keyframe")
+	}
+	if !feed(true, 120) {
+		t.Fatal("The next keyframe was dropped with room in the queue")
+	}
+	if want := []uint32{0, 120}; len(d.pending) != len(want) || d.pending[0] != want[0] || d.pending[1] != want[1] {
+		t.Errorf("Pending presentation times %v, want %v", d.pending, want)
+	}
+}
+
+func TestStreamDecoderDecodesFixture(t *testing.T) {
+	type unit struct {
+		stream   []byte
+		keyframe bool
+		pts      uint32
+	}
+	var cfg *AVCDecoderConfig
+	var units []unit
+	for _, tag := range readFLV(t, sampleFLV(t)) {
+		video, ok := tag.Data.(*flvtag.VideoData)
+		if !ok || video.CodecID != flvtag.CodecIDAVC {
+			continue
+		}
+		body, err := io.ReadAll(video.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if video.AVCPacketType == flvtag.AVCPacketTypeSequenceHeader {
+			if cfg, err = parseAVCDecoderConfig(body); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if cfg == nil {
+			continue
+		}
+		keyframe := video.FrameType == flvtag.FrameTypeKeyFrame
+		stream, err := toAnnexB(cfg, body, keyframe)
+		if err != nil {
+			t.Fatal(err)
+		}
+		units = append(units, unit{stream, keyframe, tag.Timestamp + uint32(video.CompositionTime)})
+	}
+	if cfg == nil || len(units) == 0 {
+		t.Fatal("The sample has no AVC pictures")
+	}
+
+	dec, err := NewH264StreamDecoder(func(uint64) bool { return true }, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Lossless, so Feed waits while the frames below are not taken
+	fed := make(chan error, 1)
+	go func() {
+		defer dec.CloseInput()
+		for _, u := range units {
+			if _, err := dec.Feed(u.stream, u.keyframe, u.pts); err != nil {
+				fed <- err
+				return
+			}
+		}
+		fed <- nil
+	}()
+
+	var frames int
+	for f := range dec.Frames() {
+		if f.Mat.Cols() != cfg.ParsedWidth || f.Mat.Rows() != cfg.ParsedHeight {
+			t.Errorf("Decoded a %dx%d picture, the stream is %dx%d", f.Mat.Cols(), f.Mat.Rows(), cfg.ParsedWidth, cfg.ParsedHeight)
+		}
+		frames++
+		_ = f.Mat.Close()
+	}
+	if err := <-fed; err != nil {
+		t.Fatal(err)
+	}
+	if err := dec.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if frames == 0 {
+		t.Fatal("No picture decoded")
+	}
+}
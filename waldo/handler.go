@@ -0,0 +1,1857 @@
+package waldo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yutopp/go-flv"
+	flvtag "github.com/yutopp/go-flv/tag"
+	"github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+	"gocv.io/x/gocv"
+)
+
+// Handler An RTMP connection handler.
+//
+// One Handler is created per connection, so publishers never share state
+type Handler struct {
+	rtmp.DefaultHandler
+	conn       *rtmp.Conn
+	closed     chan struct{} // Closed once OnClose has run
+	remoteAddr string
+	logger     *slog.Logger  // Carries the remote address, and the stream name once publishing
+	auth       Authenticator // Of publishers and players, nil accepts everyone
+	registry   *StreamRegistry
+	streamName string
+	fileName   string // streamName made safe for paths, see sanitizeStreamName
+
+	connID          uint64 // Numbers connections since startup
+	outputDir       string
+	recordingLayout string // Path of each recording below outputDir, see renderRecordingLayout
+	outputFormat    string // flv or mp4
+	rejectExisting  bool   // Refuse to publish when the recording file exists, instead of adding a suffix
+
+	mu            sync.Mutex // Guards fields read by the HTTP API, and draining
+	recordingPath string
+	publishing    atomic.Bool // Set once OnPublish succeeded, media is dropped before that
+
+	// In-flight media callbacks. Once draining is set no new ones start, so shutdown can wait for them
+	inflight sync.WaitGroup
+	draining bool
+
+	writeMu  sync.Mutex // Guards the recording, which shutdown may close from another goroutine
+	flvFile  *os.File
+	flvBuf   *bufio.Writer
+	flvCount *countingWriter
+	flvEnc   recordingEncoder // *flv.Encoder, or *MP4Encoder with outputFormat mp4
+
+	// Segmenting, with both limits 0 a stream is recorded into a single file.
+	// Segments are named <recordingBase>-<index>-<HHMMSS>.<outputFormat>
+	segmentDuration time.Duration
+	segmentSize     int64
+	recordingBase   string
+	segmentIndex    int
+	segmentStart    time.Time
+
+	// Replayed at the top of every segment
+	metadataHeader  *flvtag.ScriptData
+	videoHeader     *flvtag.VideoData
+	videoHeaderData []byte
+	audioHeader     *flvtag.AudioData
+	audioHeaderData []byte
+
+	// Buffered output reaches the OS on every keyframe or flushInterval, and the disk every syncInterval
+	flushInterval time.Duration
+	syncInterval  time.Duration
+	lastFlush     time.Time
+	lastSync      time.Time
+	writeErr      error  // First write failure, later ones are not reported again
+	lastTimestamp uint32 // Of the last tag written, injected script tags never go below it
+
+	// Incoming timestamps per kind, read loop only. Anomalies are logged and counted, the tags kept
+	audioTS   timestampTrack
+	videoTS   timestampTrack
+	audioNorm TimestampNormalizer // Every tag is recorded, relayed and analysed at its normalized timestamp
+	videoNorm TimestampNormalizer
+
+	remuxer *Remuxer // Converts the finished recording to MP4, nil disables it
+
+	visionCfg VisionConfig
+	visionMu  sync.Mutex // Detectors are not safe for concurrent use
+	vision    *Vision
+	matcher   *TemplateMatcher // Shared by all handlers, nil falls back to the cascade
+	config    *Config          // Runtime settings, shared by all handlers
+
+	newDetector func() (Detector, error) // Replaces visionCfg.Detector when set
+	sink        DetectionSink            // Also receives every frame's detections, nil when not embedded
+
+	// The last frame that was not static, what the motion filter compares against. Guarded by visionMu
+	lastProcessedFrame gocv.Mat
+
+	// Only match templates around red stripes, see DetectWaldoStripes
+	stripePrefilter bool
+
+	// Recent detections and decoded pictures, exposed over the HTTP API
+	history   *DetectionHistory
+	frames    *FrameCache
+	annotated *FrameCache // The last frame through CV, with its detections drawn in
+
+	// Every processed keyframe's detections, saved next to the recording
+	sidecar *DetectionSidecar
+
+	// Detections appended to <recording>.detections.json as they are found
+	timeline DetectionTimeline
+
+	// Frames run through CV, with detections drawn, saved next to the recording. nil disables them
+	annotatedFrames *AnnotatedFrames
+
+	// Detector hits are saved as JPEGs under <outputDir>/<file name>/faces, grown by thumbnailMargin, at most maxThumbnails per stream
+	thumbnailMargin float64
+	maxThumbnails   int
+	thumbnails      atomic.Int64 // Saved or being saved
+	thumbnailsOnce  sync.Once
+
+	// Annotated frames with a detection scoring at least detectionSaveScore are saved under
+	// <detectionSaveDir>/<file name>, or <outputDir>/<file name>/detections. A nil limiter disables it
+	detectionFrames    *WindowLimiter
+	detectionSaveDir   string
+	detectionSaveScore float64
+
+	// Live detection feed, events below eventThreshold are not sent
+	events          *EventBroker
+	eventThreshold  float64
+	eventThumbnails bool // Attach a JPEG to frame events
+
+	notifier *Notifier // Webhooks for detections, nil disables them
+	metrics  *Metrics  // Process-wide counters for /metrics, shared by all handlers
+
+	// From onMetaData, read loop only
+	metadata StreamMetadata
+
+	// SPS/PPS from the latest AVC sequence header, needed to decode NALUs
+	avcConfig  *AVCDecoderConfig
+	hevcConfig *HEVCDecoderConfig
+
+	// Codec of the latest video tag, logged whenever it changes
+	videoCodec      flvtag.CodecID
+	videoCodecKnown bool
+	videoFourCC     string // Enhanced RTMP
+
+	// Warnings already logged, by key, and repeated errors being rate limited
+	warnMu  sync.Mutex
+	warned  map[string]bool
+	repeats map[string]*repeatedLog
+
+	// Which frames get CV, all decoded by streamDecoder: the sampled keyframes alone,
+	// or the whole stream when sampling beyond keyframes
+	sampling            SamplingPolicy
+	streamDecoder       *H264StreamDecoder // Started on a keyframe, restarted after a new sequence header
+	streamDecoderCodec  flvtag.CodecID
+	streamDecoderFailed bool
+	keyframeSampler     *KeyframeSampler // Thins out keyframes in SampleKeyframes mode
+	streamThrottle      FrameThrottle    // Caps decoded frames at the policy's MaxFPS in the other modes
+	cvMaxFPS            *StreamRates     // Picks the stream's cvLimiter
+	cvLimiter           *CVRateLimiter   // Caps CV in wall time, nil is unlimited
+	cvResize            image.Point      // Frames are shrunk to this before detection, see detectionSize
+	pipeline            *Pipeline        // Stages run before detection, the stream's own copy once publishing. nil has none
+
+	// Keyframes are analysed by a pool of cvWorkers, with up to cvQueue waiting. 0 workers processes them inline
+	cvWorkers int
+	cvQueue   int
+	cvJobs    chan *cvJob
+	cvWG      sync.WaitGroup
+	cvStop    sync.Once
+
+	// When re-encoding every tag goes through ordered, and is written in arrival order
+	ordered     chan ProcessedFrame
+	orderedDone chan struct{}
+
+	// GOPs whose keyframe has detections are annotated and re-encoded with annotateOutput,
+	// otherwise recorded as received. See reencode.go
+	annotateOutput   bool
+	encodeCfg        *H264EncoderConfig
+	encoder          *H264Encoder
+	gop              *gopJob            // Being received, its tags are held until the next keyframe
+	gopDecoder       *H264StreamDecoder // Fed every picture, started on a keyframe
+	gopDecoderFailed bool
+	gops             chan *gopJob
+	gopsDone         chan struct{}
+
+	// Counters for the status API, started is set before the stream is registered
+	stats     StreamStats
+	started   time.Time
+	statsStop chan struct{} // Stops the rate updates, nil until publishing
+
+	// Incoming video volume, used to match the source bitrate when re-encoding
+	videoBytes   uint64
+	firstVideoTS uint32
+	lastVideoTS  uint32
+
+	// Optional audio event detection, nil disables it
+	audioProc AudioProcessor
+	audioJobs chan audioJob
+
+	// Live HLS copy of the stream under hlsDir/<file name>, empty hlsDir disables it
+	hlsDir             string
+	hlsSegmentDuration time.Duration
+	hlsWindow          int
+	hlsCleanup         bool          // Delete the playlist and segments when the stream ends
+	hls                *HLSSegmenter // Fed from writeTag, guarded by writeMu
+
+	// Players of this stream get the GOP cache and then every tag written, up to playerQueue behind
+	playback    *GOPCache
+	playerQueue int
+
+	// Forwards the stream to the URL relays gives for its name, nil when it is not relayed
+	relays *RelayTargets
+	relay  *Relay
+
+	// Set when this connection plays another connection's stream instead of publishing
+	playbackSource *GOPCache
+	player         *Player
+
+	// Closes the connection when no audio or video arrived for streamTimeout, 0 disables it.
+	// Runs from the start, so connections that never publish are closed too. Players are exempt
+	streamTimeout time.Duration
+	idleTimer     *time.Timer
+
+	// Shared caps on connections and publishes per stream key, nil is unlimited
+	limits       *ConnLimiter
+	connAdmitted bool   // Holds one of the limiter's connections
+	publishKey   string // Holds one of the limiter's publishes for this key
+}
+
+// Keep the connection so the stream can be stopped from outside
+func (h *Handler) OnServe(conn *rtmp.Conn) {
+	h.conn = conn
+	h.metrics.ActiveConnections.Add(1)
+	h.connAdmitted = h.limits.AcquireConn()
+
+	if h.streamTimeout > 0 {
+		h.idleTimer = time.AfterFunc(h.streamTimeout, h.onIdle)
+	}
+}
+
+// Path of the FLV file being written, empty before publishing starts
+func (h *Handler) RecordingPath() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.recordingPath
+}
+
+// How long Stop waits for the frames being handled before giving up
+const stopTimeout = 10 * time.Second
+
+// End the stream the way Shutdown does: let the frames being handled reach the recording first, then
+// close the connection. OnClose runs as part of that, so it never races OnVideo or OnAudio
+func (h *Handler) Stop() error {
+	if h.conn == nil {
+		return errors.New("Connection not established")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+	defer cancel()
+
+	return errors.Wrap(h.Shutdown(ctx), "Failed to stop stream")
+}
+
+// Close the connection, which ends the stream through OnClose
+func (h *Handler) disconnect() error {
+	if h.conn == nil {
+		return errors.New("Connection not established")
+	}
+
+	return h.conn.Close()
+}
+
+// Called when RTMP connection is established
+func (h *Handler) OnConnect(timestamp uint32, cmd *rtmpmsg.NetConnectionConnect) error {
+	if !h.connAdmitted {
+		h.metrics.ConnectionsRejected.Add(1)
+		h.logger.Warn("Rejected connection, too many open", "max", h.limits.MaxConns)
+		return errors.New("Too many connections")
+	}
+	h.logger.Info("New connection")
+	return nil
+}
+
+// Required to meet interface (Unused)
+func (h *Handler) OnCreateStream(timestamp uint32, cmd *rtmpmsg.NetConnectionCreateStream) error {
+	return nil
+}
+
+// Client is requesting to send a stream, complete inital setup
+func (h *Handler) OnPublish(_ *rtmp.StreamContext, timestamp uint32, cmd *rtmpmsg.NetStreamPublish) error {
+	// One stream per connection. A publish that failed after registering has left state behind, so it can't be retried either
+	if h.publishing.Load() || h.streamName != "" || h.player != nil {
+		return errors.New("Cannot publish on this connection")
+	}
+
+	// The raw name may carry a key, so nothing is logged before the authenticator has taken it out
+	name, key, err := parsePublishingName(cmd.PublishingName)
+	if err != nil {
+		h.logger.Warn("Rejected publish", "err", err)
+		return err
+	}
+	if h.auth != nil {
+		if name, err = h.auth.Authenticate(name, key); err != nil {
+			h.logger.Warn("Rejected publish", "err", err)
+			return err
+		}
+	}
+	// The connection's logger only takes the name once the stream is registered, a rejected publish may be retried
+	logger := h.logger.With("stream", name)
+	logger.Info("Receiving stream")
+	fileName, err := sanitizeStreamName(name)
+	if err != nil {
+		logger.Warn("Rejected publish", "err", err)
+		return err
+	}
+
+	if !h.limits.AcquirePublish(key) {
+		h.metrics.PublishesRejected.Add(1)
+		logger.Warn("Rejected publish, too many streams with this key", "max", h.limits.MaxPublishesPerKey)
+		return errors.New("Too many streams published with this key")
+	}
+	h.started = time.Now()
+	h.playback = NewGOPCache()
+	if err := h.registry.Register(name, h); err != nil {
+		h.limits.ReleasePublish(key)
+		logger.Warn("Rejected publish", "err", err)
+		return err
+	}
+	h.publishKey = key
+	h.streamName = name
+	h.fileName = fileName
+	h.logger = logger
+
+	// Record streams as FLV, or MP4 with -output-format mp4
+	p, err := renderRecordingLayout(h.outputDir, h.recordingLayout, h.recordingExt(), fileName, h.connID, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return errors.Wrap(err, "Failed to create recording directory")
+	}
+
+	h.writeMu.Lock()
+	h.recordingBase = strings.TrimSuffix(p, h.recordingExt())
+	err = h.openRecordingLocked()
+	h.writeMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// The ROI is cropped by applyComputerVision, before frames are resized and for templates too
+	visionCfg := h.visionCfg
+	visionCfg.ROI = image.Rectangle{}
+	var vision *Vision
+	if h.newDetector != nil {
+		var detector Detector
+		if detector, err = h.newDetector(); err == nil {
+			vision = NewVisionWithConfig(visionCfg, detector)
+		}
+	} else {
+		vision, err = NewVision(visionCfg)
+	}
+	if err != nil {
+		h.logger.Warn("Vision unavailable, recording without CV", "err", err)
+	} else {
+		h.vision = vision
+		h.lastProcessedFrame = gocv.NewMat()
+	}
+	h.pipeline = h.pipeline.ForStream()
+	h.cvLimiter = NewCVRateLimiter(h.cvMaxFPS.Rate(name))
+
+	if h.cvWorkers > 0 {
+		h.startCV()
+	}
+	// Stream sampling decodes on the read loop and never re-encodes, so it needs no ordering
+	if h.encodeCfg != nil && !h.sampling.DecodesStream() {
+		h.startOrderedWriter()
+		h.startGOPWriter()
+	}
+
+	if h.hlsDir != "" {
+		hls, err := NewHLSSegmenter(filepath.Join(h.hlsDir, h.fileName), uint32(h.hlsSegmentDuration.Milliseconds()), h.hlsWindow)
+		if err != nil {
+			h.logger.Warn("Publishing without HLS", "err", err)
+		} else {
+			h.hls = hls
+		}
+	}
+
+	if h.audioProc != nil {
+		h.audioJobs = make(chan audioJob, 64)
+		go runAudioWorker(h.logger, h.audioProc, h.audioJobs)
+	}
+
+	h.statsStop = make(chan struct{})
+	go h.stats.run(time.Second, h.statsStop)
+	go h.logStats(statsLogInterval, h.statsStop)
+
+	if target := h.relays.URL(name); target != "" {
+		relay, err := StartRelay(target, h.playback, h.playerQueue, h.logger)
+		if err != nil {
+			h.logger.Warn("Publishing without relay", "err", err)
+		} else {
+			h.relay = relay
+		}
+	}
+
+	h.touch()
+	h.publishing.Store(true)
+
+	return nil
+}
+
+// Called when the publisher went quiet without disconnecting, e.g. because it crashed,
+// or the connection never published at all. Runs on the timer's goroutine: Stop drains the tags
+// being handled first, so OnClose never closes the stream decoder under feedDecoder
+func (h *Handler) onIdle() {
+	h.metrics.IdleDisconnects.Add(1)
+	h.logger.Warn("No media received, closing idle connection", "timeout", h.streamTimeout)
+	if err := h.Stop(); err != nil {
+		h.logger.Error("Failed to close idle stream", "err", err)
+	}
+}
+
+// Push back the idle timeout, called for every media tag
+func (h *Handler) touch() {
+	if h.idleTimer != nil {
+		h.idleTimer.Reset(h.streamTimeout)
+	}
+}
+
+// Create a new file at p. An earlier recording is never overwritten: with reject set that is an error,
+// otherwise a timestamp (and counter) suffix is added
+func createRecordingFile(p string, reject bool) (*os.File, string, error) {
+	ext := filepath.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	stamp := time.Now().Format("20060102-150405")
+
+	candidate := p
+	for i := 1; ; i++ {
+		f, err := os.OpenFile(candidate, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0666)
+		if err == nil {
+			return f, candidate, nil
+		}
+		if !os.IsExist(err) || reject {
+			return nil, "", err
+		}
+
+		if i == 1 {
+			candidate = fmt.Sprintf("%s-%s%s", base, stamp, ext)
+		} else {
+			candidate = fmt.Sprintf("%s-%s-%d%s", base, stamp, i, ext)
+		}
+	}
+}
+
+// Extension of recording files, from outputFormat
+func (h *Handler) recordingExt() string {
+	if h.outputFormat == "mp4" {
+		return ".mp4"
+	}
+
+	return ".flv"
+}
+
+// Create the next recording file (or segment) and its encoder. writeMu must be held
+func (h *Handler) openRecordingLocked() error {
+	now := time.Now()
+	p := h.recordingBase + h.recordingExt()
+	if h.segmenting() {
+		h.segmentIndex++
+		p = fmt.Sprintf("%s-%03d-%s%s", h.recordingBase, h.segmentIndex, now.Format("150405"), h.recordingExt())
+	}
+
+	f, p, err := createRecordingFile(p, h.rejectExisting)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create recording file")
+	}
+	h.mu.Lock()
+	h.recordingPath = p
+	h.mu.Unlock()
+	h.logger.Info("Saving recording", "path", p)
+
+	if err := h.timeline.Open(timelinePath(p)); err != nil {
+		h.logger.Warn("Recording without a detection timeline", "err", err)
+	}
+	if h.annotatedFrames != nil {
+		if err := h.annotatedFrames.Open(annotatedFramesPath(p)); err != nil {
+			h.logger.Warn("Recording without annotated frames", "err", err)
+		}
+	}
+
+	buf := bufio.NewWriterSize(f, 256*1024)
+	counter := &countingWriter{w: buf, total: &h.stats.BytesWritten}
+	var enc recordingEncoder
+	if h.outputFormat == "mp4" {
+		enc = NewMP4Encoder(counter)
+	} else if enc, err = flv.NewEncoder(counter, flv.FlagsAudio|flv.FlagsVideo); err != nil {
+		_ = f.Close()
+		return errors.Wrap(err, "Failed to create flv encoder")
+	}
+
+	h.flvFile = f
+	h.flvBuf = buf
+	h.flvCount = counter
+	h.flvEnc = enc
+	h.lastFlush = now
+	h.lastSync = now
+	h.segmentStart = now
+
+	return nil
+}
+
+// Append a tag to the recording. Dropped once the recording is finalized
+func (h *Handler) writeTag(tag *flvtag.FlvTag) error {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	return h.writeTagLocked(tag)
+}
+
+// writeMu must be held
+func (h *Handler) writeTagLocked(tag *flvtag.FlvTag) error {
+	if h.flvEnc == nil {
+		return nil
+	}
+
+	header, err := h.cacheHeaderLocked(tag)
+	if err == nil && (h.playback != nil || h.hls != nil) {
+		err = h.teeTagLocked(tag, header)
+	}
+	if err == nil && !header && h.segmentDueLocked(tag) {
+		err = h.rolloverLocked(tag.Timestamp)
+	}
+	if err == nil && h.flvEnc != nil {
+		err = h.flvEnc.Encode(tag)
+		h.lastTimestamp = tag.Timestamp
+		if err == nil {
+			h.stats.TagsWritten.Add(1)
+		}
+	}
+	if err == nil && h.flvEnc != nil {
+		video, ok := tag.Data.(*flvtag.VideoData)
+		keyframe := ok && isVideoKeyframe(video)
+		if keyframe || time.Since(h.lastFlush) >= h.flushInterval {
+			err = h.flushLocked(time.Since(h.lastSync) >= h.syncInterval)
+		}
+	}
+
+	if err != nil {
+		h.metrics.WriteErrors.Add(1)
+	}
+	// Report a broken recording once rather than for every tag
+	if err == nil || h.writeErr != nil {
+		return nil
+	}
+	h.writeErr = err
+	return errors.Wrap(err, "Recording is failing, further write errors for this stream are suppressed")
+}
+
+// Whether recordings are split by duration or size
+func (h *Handler) segmenting() bool {
+	return h.segmentDuration > 0 || h.segmentSize > 0
+}
+
+// Keep the metadata and sequence headers, which every segment has to start with, and report whether tag is one.
+// Header payloads are read here, so the tag gets a fresh reader over the same bytes. writeMu must be held
+func (h *Handler) cacheHeaderLocked(tag *flvtag.FlvTag) (bool, error) {
+	switch data := tag.Data.(type) {
+	case *flvtag.ScriptData:
+		// Cue points and injected detections belong to their moment in the stream
+		if _, ok := data.Objects["onMetaData"]; !ok {
+			return false, nil
+		}
+		h.metadataHeader = data
+		return true, nil
+
+	case *flvtag.VideoData:
+		// HEVC keeps its packet header in the body
+		exHeader := isExVideoSequenceStart(data)
+		avcHeader := !isExVideo(data) && data.CodecID == flvtag.CodecIDAVC && data.AVCPacketType == flvtag.AVCPacketTypeSequenceHeader
+		if !avcHeader && !exHeader && (isExVideo(data) || data.CodecID != codecIDHEVC) {
+			return false, nil
+		}
+		b, err := io.ReadAll(data.Data)
+		if err != nil {
+			return false, err
+		}
+		data.Data = bytes.NewReader(b)
+		if !avcHeader && !exHeader && (len(b) == 0 || flvtag.AVCPacketType(b[0]) != flvtag.AVCPacketTypeSequenceHeader) {
+			return false, nil
+		}
+		h.videoHeader = &flvtag.VideoData{FrameType: data.FrameType, CodecID: data.CodecID, AVCPacketType: data.AVCPacketType}
+		h.videoHeaderData = b
+		return true, nil
+
+	case *flvtag.AudioData:
+		if data.SoundFormat != flvtag.SoundFormatAAC || data.AACPacketType != flvtag.AACPacketTypeSequenceHeader {
+			return false, nil
+		}
+		b, err := io.ReadAll(data.Data)
+		if err != nil {
+			return false, err
+		}
+		data.Data = bytes.NewReader(b)
+		h.audioHeader = &flvtag.AudioData{
+			SoundFormat:   data.SoundFormat,
+			SoundRate:     data.SoundRate,
+			SoundSize:     data.SoundSize,
+			SoundType:     data.SoundType,
+			AACPacketType: data.AACPacketType,
+		}
+		h.audioHeaderData = b
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// Hand a tag to the live outputs, players and HLS, so they carry exactly what is recorded.
+// The payload is read, so the tag gets a fresh reader over the same bytes. writeMu must be held
+func (h *Handler) teeTagLocked(tag *flvtag.FlvTag, header bool) error {
+	var body []byte
+	switch data := tag.Data.(type) {
+	case *flvtag.VideoData:
+		b, err := io.ReadAll(data.Data)
+		if err != nil {
+			return err
+		}
+		data.Data = bytes.NewReader(b)
+		body = b
+	case *flvtag.AudioData:
+		b, err := io.ReadAll(data.Data)
+		if err != nil {
+			return err
+		}
+		data.Data = bytes.NewReader(b)
+		body = b
+	}
+
+	if h.playback != nil {
+		p, err := newPlaybackTag(tag, body, header)
+		if err != nil {
+			return err
+		}
+		h.playback.Write(p)
+	}
+	if h.hls != nil {
+		h.writeHLSLocked(tag, body)
+	}
+
+	return nil
+}
+
+// Segments only ever start on a keyframe, once the current one is long or large enough.
+// Streams without video have no keyframes, any audio tag starts their next segment. writeMu must be held
+func (h *Handler) segmentDueLocked(tag *flvtag.FlvTag) bool {
+	if !h.segmenting() {
+		return false
+	}
+	switch data := tag.Data.(type) {
+	case *flvtag.VideoData:
+		if !isVideoKeyframe(data) {
+			return false
+		}
+	case *flvtag.AudioData:
+		if h.stats.VideoFrames.Load() > 0 {
+			return false
+		}
+	default:
+		return false
+	}
+
+	return (h.segmentDuration > 0 && time.Since(h.segmentStart) >= h.segmentDuration) ||
+		(h.segmentSize > 0 && h.flvCount.n >= h.segmentSize)
+}
+
+// Finish the current segment and start the next one with the cached headers, so it plays on its own.
+// writeMu must be held
+func (h *Handler) rolloverLocked(timestamp uint32) error {
+	h.closeRecordingLocked()
+	if err := h.openRecordingLocked(); err != nil {
+		return err
+	}
+
+	if h.metadataHeader != nil {
+		if err := h.flvEnc.Encode(&flvtag.FlvTag{TagType: flvtag.TagTypeScriptData, Timestamp: timestamp, Data: h.metadataHeader}); err != nil {
+			return err
+		}
+	}
+	if h.videoHeader != nil {
+		video := *h.videoHeader
+		video.Data = bytes.NewReader(h.videoHeaderData)
+		if err := h.flvEnc.Encode(&flvtag.FlvTag{TagType: flvtag.TagTypeVideo, Timestamp: timestamp, Data: &video}); err != nil {
+			return err
+		}
+	}
+	if h.audioHeader != nil {
+		audio := *h.audioHeader
+		audio.Data = bytes.NewReader(h.audioHeaderData)
+		if err := h.flvEnc.Encode(&flvtag.FlvTag{TagType: flvtag.TagTypeAudio, Timestamp: timestamp, Data: &audio}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// countingWriter Counts the bytes written to a segment, and adds them to total
+type countingWriter struct {
+	w     io.Writer
+	n     int64
+	total *atomic.Uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.total.Add(uint64(n))
+	return n, err
+}
+
+// Push buffered tags to the OS, and to disk when sync is set. writeMu must be held
+func (h *Handler) flushLocked(sync bool) error {
+	if err := h.flvBuf.Flush(); err != nil {
+		return err
+	}
+	h.lastFlush = time.Now()
+
+	if !sync {
+		return nil
+	}
+	if err := h.flvFile.Sync(); err != nil {
+		return err
+	}
+	h.lastSync = h.lastFlush
+
+	return nil
+}
+
+// Close the FLV file so everything written so far is on disk, and end the HLS output. Safe to call more than once
+func (h *Handler) finalizeRecording() {
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	h.closeRecordingLocked()
+	h.closeHLSLocked()
+}
+
+// Flush and close the current file, then write its sidecar and hand it to the remuxer. writeMu must be held
+func (h *Handler) closeRecordingLocked() {
+	if h.flvFile != nil {
+		// MP4 holds back the last fragment until it is complete
+		if c, ok := h.flvEnc.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				h.logger.Error("Failed to finish recording", "err", err)
+			}
+		}
+		if err := h.flushLocked(true); err != nil {
+			h.logger.Error("Failed to flush recording", "err", err)
+		}
+		if err := h.flvFile.Close(); err != nil {
+			h.logger.Error("Failed to close recording", "err", err)
+		}
+
+		if err := h.sidecar.WriteFile(sidecarPath(h.RecordingPath())); err != nil {
+			h.logger.Error("Failed to write detection sidecar", "err", err)
+		}
+		h.sidecar.Reset()
+		if err := h.timeline.Close(); err != nil {
+			h.logger.Error("Failed to write detection timeline", "err", err)
+		}
+		if h.annotatedFrames != nil {
+			h.annotatedFrames.Close()
+		}
+
+		if h.remuxer != nil && h.outputFormat != "mp4" {
+			h.remuxer.Remux(h.RecordingPath())
+		}
+	}
+	h.flvFile = nil
+	h.flvBuf = nil
+	h.flvCount = nil
+	h.flvEnc = nil
+}
+
+// Let in-flight frames reach the recording, flush and close it, disconnect the publisher
+// and wait for OnClose to finish. Used when the server shuts down
+func (h *Handler) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.draining = true
+	h.mu.Unlock()
+
+	idle := make(chan struct{})
+	go func() {
+		h.inflight.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	// Detections still in flight belong in the sidecar
+	h.stopCV()
+	h.finalizeRecording()
+
+	if err := h.disconnect(); err != nil {
+		return err
+	}
+
+	select {
+	case <-h.closed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Metadata from stream
+func (h *Handler) OnSetDataFrame(timestamp uint32, data *rtmpmsg.NetStreamSetDataFrame) error {
+	if !h.beginWrite() {
+		return nil
+	}
+	defer h.inflight.Done()
+
+	// Script tags go with the video, or the audio of a stream without any
+	if h.videoNorm.started {
+		timestamp = h.videoNorm.Apply(timestamp)
+	} else {
+		timestamp = h.audioNorm.Apply(timestamp)
+	}
+	r := bytes.NewReader(data.Payload)
+
+	h.stats.BytesReceived.Add(uint64(len(data.Payload)))
+	h.metrics.BytesReceived.Add(uint64(len(data.Payload)))
+	h.metrics.ScriptTags.Add(1)
+
+	var script flvtag.ScriptData
+	if err := flvtag.DecodeScriptData(r, &script); err != nil {
+		h.logRepeated(slog.LevelWarn, "decode-script", "Failed to decode script data", "timestamp", timestamp, "err", err)
+		return nil // ignore
+	}
+
+	if meta, ok := parseStreamMetadata(&script); ok {
+		h.setMetadata(meta)
+	}
+
+	if err := h.emitTag(&flvtag.FlvTag{
+		TagType:   flvtag.TagTypeScriptData,
+		Timestamp: timestamp,
+		Data:      &script,
+	}, nil, nil); err != nil {
+		h.logRepeated(slog.LevelError, "write-script", "Failed to write script data", "timestamp", timestamp, "err", err)
+	}
+
+	return nil
+}
+
+// Audio from stream
+func (h *Handler) OnAudio(timestamp uint32, payload io.Reader) error {
+	h.touch()
+	h.metrics.AudioTags.Add(1)
+
+	if !h.beginWrite() {
+		return nil
+	}
+	defer h.inflight.Done()
+
+	payload = countReader(payload, &h.stats.BytesReceived, &h.metrics.BytesReceived)
+	h.stats.observe(timestamp)
+	h.checkTimestamp("audio", &h.audioTS, timestamp)
+	timestamp = h.normalizeTimestamp("audio", &h.audioNorm, timestamp)
+
+	var audio flvtag.AudioData
+	if err := flvtag.DecodeAudioData(payload, &audio); err != nil {
+		return err
+	}
+	audio.Data = countReader(audio.Data, &h.stats.AudioBytes)
+
+	flvBody := getTagBuffer()
+	if _, err := io.Copy(flvBody, audio.Data); err != nil {
+		putTagBuffer(flvBody)
+		return err
+	}
+	audio.Data = flvBody
+
+	if h.audioJobs != nil {
+		job := audioJob{
+			timestamp: timestamp,
+			format:    audio.SoundFormat,
+			rate:      audio.SoundRate,
+			size:      audio.SoundSize,
+			channels:  audio.SoundType,
+			data:      append([]byte(nil), flvBody.Bytes()...),
+		}
+
+		// Never block ingestion on audio detection
+		select {
+		case h.audioJobs <- job:
+		default:
+		}
+	}
+
+	if err := h.emitTag(&flvtag.FlvTag{
+		TagType:   flvtag.TagTypeAudio,
+		Timestamp: timestamp,
+		Data:      &audio,
+	}, flvBody, nil); err != nil {
+		h.logRepeated(slog.LevelError, "write-audio", "Failed to write audio", "timestamp", timestamp, "err", err)
+	}
+
+	return nil
+}
+
+// Keep the publisher's description of the stream. Only the read loop touches metadata
+func (h *Handler) setMetadata(meta StreamMetadata) {
+	h.metadata = meta
+	h.stats.setResolution(meta.Width, meta.Height)
+	h.logger.Info("Stream metadata", "width", meta.Width, "height", meta.Height, "framerate", meta.FrameRate,
+		"video_codec", videoCodecName(meta.VideoCodecID), "audio_codec_id", meta.AudioCodecID)
+
+	if meta.VideoCodecID != 0 && meta.VideoCodecID != flvtag.CodecIDAVC && meta.VideoCodecID != codecIDHEVC {
+		h.logger.Warn("Metadata announces a codec without CV support", "video_codec", videoCodecName(meta.VideoCodecID),
+			"codec_id", meta.VideoCodecID)
+	}
+}
+
+// Whether video of codec may be decoded for CV. When the metadata names another codec, the tags
+// are not what the publisher claims and are left alone
+func (h *Handler) codecMatchesMetadata(codec flvtag.CodecID) bool {
+	if h.metadata.VideoCodecID == 0 || h.metadata.VideoCodecID == codec {
+		return true
+	}
+	h.warnOnce("metadata-codec", "Video tags do not match the codec in the metadata, skipping CV",
+		"tags", videoCodecName(codec), "metadata", videoCodecName(h.metadata.VideoCodecID))
+
+	return false
+}
+
+// Register a media callback with shutdown. False once the stream is draining, or when nothing was
+// published yet: a client sending media before (or after a failed) publish has it dropped
+func (h *Handler) beginWrite() bool {
+	if !h.publishing.Load() {
+		h.warnOnce("not-publishing", "Dropping media sent without a successful publish")
+		return false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.draining {
+		return false
+	}
+	h.inflight.Add(1)
+
+	return true
+}
+
+// Video from stream. Frames are processed here
+func (h *Handler) OnVideo(timestamp uint32, payload io.Reader) error {
+	h.touch()
+	h.metrics.VideoTags.Add(1)
+
+	// The recording is being finalized, nothing more can be written
+	if !h.beginWrite() {
+		return nil
+	}
+	defer h.inflight.Done()
+
+	payload = countReader(payload, &h.stats.BytesReceived, &h.metrics.BytesReceived)
+	h.stats.observe(timestamp)
+	h.checkTimestamp("video", &h.videoTS, timestamp)
+	timestamp = h.normalizeTimestamp("video", &h.videoNorm, timestamp)
+	h.stats.VideoFrames.Add(1)
+
+	var video flvtag.VideoData
+	if err := flvtag.DecodeVideoData(payload, &video); err != nil {
+		return err
+	}
+	video.Data = countReader(video.Data, &h.stats.VideoBytes)
+
+	flvBody := getTagBuffer()
+	if _, err := io.Copy(flvBody, video.Data); err != nil {
+		putTagBuffer(flvBody)
+		return err
+	}
+
+	if h.videoBytes == 0 {
+		h.firstVideoTS = timestamp
+	}
+	h.videoBytes += uint64(flvBody.Len())
+	h.lastVideoTS = timestamp
+
+	ex, isEx := parseExVideoHeader(&video, flvBody.Bytes())
+	if isEx {
+		// The packet type sits where the codec id would, only the FourCC names the codec
+		if ex.FourCC != "" && ex.FourCC != h.videoFourCC {
+			h.logger.Info("Video codec", "codec", videoFourCCName(ex.FourCC), "fourcc", ex.FourCC, "enhanced_rtmp", true)
+			h.videoFourCC = ex.FourCC
+			h.videoCodecKnown = false
+			h.stats.VideoCodec.Store(videoFourCCName(ex.FourCC))
+		}
+	} else if !h.videoCodecKnown || video.CodecID != h.videoCodec {
+		h.logger.Info("Video codec", "codec", videoCodecName(video.CodecID), "codec_id", video.CodecID)
+		h.videoCodec = video.CodecID
+		h.videoCodecKnown = true
+		h.videoFourCC = ""
+		h.stats.VideoCodec.Store(videoCodecName(video.CodecID))
+	}
+
+	if !isEx && video.CodecID == codecIDHEVC {
+		if packetType, data, err := splitHEVCPacket(flvBody.Bytes()); err == nil && packetType == flvtag.AVCPacketTypeSequenceHeader {
+			cfg, err := parseHEVCDecoderConfig(data)
+			if err != nil {
+				h.logger.Warn("Failed to parse HEVC sequence header", "err", err)
+			} else {
+				h.hevcConfig = cfg
+				h.closeStreamDecoder()
+				h.logger.Info("HEVC sequence header", "vps", len(cfg.VPS), "sps", len(cfg.SPS), "pps", len(cfg.PPS))
+			}
+		}
+	}
+
+	if !isEx && video.CodecID == flvtag.CodecIDAVC && video.AVCPacketType == flvtag.AVCPacketTypeSequenceHeader {
+		cfg, err := parseAVCDecoderConfig(flvBody.Bytes())
+		switch {
+		case err != nil:
+			h.logger.Warn("Failed to parse AVC sequence header", "err", err)
+		case cfg.Equal(h.avcConfig):
+			// Many encoders repeat the header, e.g. before every keyframe. Nothing to restart
+		default:
+			if prev := h.avcConfig; prev != nil {
+				// Pictures already fed are decoded and analysed before the restart
+				h.logger.Info("AVC sequence header changed mid-stream, restarting decoding",
+					"width", cfg.ParsedWidth, "height", cfg.ParsedHeight, "prev_width", prev.ParsedWidth, "prev_height", prev.ParsedHeight)
+			}
+			h.avcConfig = cfg
+			h.stats.setResolution(cfg.ParsedWidth, cfg.ParsedHeight)
+			h.closeStreamDecoder() // The picture size may have changed
+			h.closeGOPDecoder()
+			h.logger.Info("AVC sequence header",
+				"profile", cfg.Profile, "level", cfg.Level, "width", cfg.ParsedWidth, "height", cfg.ParsedHeight)
+		}
+	}
+
+	if isEx {
+		// Nothing here decodes enhanced RTMP payloads yet
+		h.warnOnce("enhanced-"+ex.FourCC, "No CV for enhanced RTMP video, recording it untouched",
+			"codec", videoFourCCName(ex.FourCC), "fourcc", ex.FourCC)
+	} else if !h.codecMatchesMetadata(video.CodecID) {
+		// Not what the publisher announced, recorded without CV
+	} else if h.gops != nil && video.CodecID == flvtag.CodecIDAVC {
+		// Held a GOP at a time, analysed and maybe re-encoded by the GOP writer
+		h.splitGOP(flvBody.Bytes(), &video, timestamp)
+	} else if h.sampling.DecodesStream() {
+		// Sampled pictures are only analysed, every payload is recorded as received
+		h.feedDecoder(flvBody.Bytes(), &video, timestamp)
+	} else if video.FrameType == flvtag.FrameTypeKeyFrame && isVideoPicture(&video, flvBody.Bytes()) && h.sampleKeyframe(timestamp) {
+		// The decoder works on a copy, so a failure can never corrupt the recorded frame
+		h.feedDecoder(flvBody.Bytes(), &video, timestamp)
+		h.keyframeSampler.End()
+	}
+
+	video.Data = flvBody
+
+	if err := h.emitTag(&flvtag.FlvTag{
+		TagType:   flvtag.TagTypeVideo,
+		Timestamp: timestamp,
+		Data:      &video,
+	}, flvBody, nil); err != nil {
+		h.logRepeated(slog.LevelError, "write-video", "Failed to write video", "timestamp", timestamp, "err", err)
+	}
+	// Detections of frames decoded by now follow this one
+	h.processDecoded()
+
+	return nil
+}
+
+// Add a recorded tag to the HLS output. Only H.264 and AAC are segmented. writeMu must be held
+func (h *Handler) writeHLSLocked(tag *flvtag.FlvTag, body []byte) {
+	switch data := tag.Data.(type) {
+	case *flvtag.VideoData:
+		if data.CodecID == flvtag.CodecIDAVC && !isExVideo(data) {
+			h.checkHLSLocked(h.hls.WriteVideo(tag.Timestamp, data.CompositionTime, isVideoKeyframe(data),
+				data.AVCPacketType == flvtag.AVCPacketTypeSequenceHeader, body))
+		}
+	case *flvtag.AudioData:
+		if data.SoundFormat == flvtag.SoundFormatAAC {
+			h.checkHLSLocked(h.hls.WriteAudio(tag.Timestamp, data.AACPacketType == flvtag.AACPacketTypeSequenceHeader, body))
+		}
+	}
+}
+
+// Stop HLS output after its first error, the recording carries on. writeMu must be held
+func (h *Handler) checkHLSLocked(err error) {
+	if err == nil {
+		return
+	}
+	h.logger.Error("HLS output failed, stopping it", "err", err)
+	h.closeHLSLocked()
+}
+
+// Finish the playlist, and delete it with its segments when hlsCleanup is set. writeMu must be held
+func (h *Handler) closeHLSLocked() {
+	if h.hls == nil {
+		return
+	}
+	if err := h.hls.Close(); err != nil {
+		h.logger.Warn("Failed to finish HLS output", "err", err)
+	}
+	if h.hlsCleanup {
+		if err := h.hls.Remove(); err != nil {
+			h.logger.Warn("Failed to delete HLS output", "err", err)
+		}
+	}
+	h.hls = nil
+}
+
+// Whether a legacy video tag carries a picture. AVC and HEVC sequence headers are flagged as keyframes too,
+// and must not use up the sampler's turn of the picture that follows them
+func isVideoPicture(video *flvtag.VideoData, body []byte) bool {
+	switch video.CodecID {
+	case flvtag.CodecIDAVC:
+		return video.AVCPacketType == flvtag.AVCPacketTypeNALU
+	case codecIDHEVC:
+		return len(body) > 0 && flvtag.AVCPacketType(body[0]) == flvtag.AVCPacketTypeNALU
+	}
+
+	return true
+}
+
+// Whether CV should run on this keyframe
+func (h *Handler) sampleKeyframe(timestamp uint32) bool {
+	ok := h.keyframeSampler.Begin(timestamp)
+	if !ok {
+		h.stats.FramesSkipped.Add(1)
+		processed, skipped := h.keyframeSampler.Counts()
+		h.logger.Debug("Skipping keyframe", "timestamp", timestamp, "processed", processed, "skipped", skipped)
+	}
+
+	return ok
+}
+
+// Cleanup when connection closes
+func (h *Handler) OnClose() {
+	h.logger.Info("Connection closed", "frames_processed", h.stats.FramesProcessed.Load(),
+		"frames_failed", h.stats.FramesFailed.Load(), "frames_skipped", h.stats.FramesSkipped.Load(), "cv_fps", h.averageCVFPS())
+	defer close(h.closed)
+	defer h.metrics.ActiveConnections.Add(-1)
+
+	if h.idleTimer != nil {
+		h.idleTimer.Stop()
+	}
+	if h.connAdmitted {
+		h.limits.ReleaseConn()
+	}
+	h.limits.ReleasePublish(h.publishKey)
+	h.stopCV()
+	h.cvLimiter.Stop()
+	h.finalizeRecording()
+	h.closePlayer()
+	if h.playback != nil {
+		h.playback.Close()
+	}
+
+	if h.audioJobs != nil {
+		close(h.audioJobs)
+	}
+	if h.statsStop != nil {
+		close(h.statsStop)
+	}
+
+	h.visionMu.Lock()
+	if h.vision != nil {
+		if err := h.vision.Close(); err != nil {
+			h.logger.Error("Failed to release vision resources", "err", err)
+		}
+		_ = h.lastProcessedFrame.Close()
+		h.vision = nil
+	}
+	if err := h.pipeline.Close(); err != nil {
+		h.logger.Error("Failed to release CV stages", "err", err)
+	}
+	h.visionMu.Unlock()
+
+	if h.streamName != "" {
+		h.registry.Unregister(h.streamName, h)
+	}
+}
+
+// Warn about a tag timestamped before the previous one of its kind, or far after it,
+// which usually means the encoder or the uplink is struggling
+func (h *Handler) checkTimestamp(kind string, track *timestampTrack, timestamp uint32) {
+	prev := track.last
+	delta, ok := track.next(timestamp)
+	switch {
+	case !ok:
+	case delta < 0:
+		count := h.stats.TimestampsBackwards.Add(1)
+		h.logger.Warn("Timestamp went backwards", "kind", kind, "timestamp", timestamp, "previous", prev,
+			"delta_ms", delta, "count", count)
+	case time.Duration(delta)*time.Millisecond > timestampJumpLimit:
+		count := h.stats.TimestampJumps.Add(1)
+		h.logger.Warn("Timestamp jumped ahead", "kind", kind, "timestamp", timestamp, "previous", prev,
+			"delta_ms", delta, "count", count)
+	}
+}
+
+// Move an audio or video timestamp onto the recording's timeline, logging when the publisher's clock restarted
+func (h *Handler) normalizeTimestamp(kind string, norm *TimestampNormalizer, timestamp uint32) uint32 {
+	rebases := norm.Rebases()
+	out := norm.Normalize(timestamp)
+	if norm.Rebases() != rebases {
+		h.logger.Warn("Publisher timestamps restarted, rebasing the recording's timeline", "kind", kind, "timestamp", timestamp,
+			"normalized", out, "offset_ms", norm.Offset())
+	}
+
+	return out
+}
+
+/*
+ *
+ * Computer Vision Functions
+ *
+ */
+
+// Run Computer Vision on a decoded frame. The recorded frame is never changed,
+// GOPs are re-encoded by the GOP writer. Safe to call from CV workers
+func (h *Handler) processFrameWithCV(job *cvJob) error {
+	// Over the wall time budget, the frame is left alone
+	if !h.cvLimiter.Allow() {
+		job.rateLimited = true
+		h.stats.FramesSkipped.Add(1)
+		return nil
+	}
+
+	var err error
+	job.detections, err = h.applyComputerVision(&job.frame, job.timestamp)
+
+	return err
+}
+
+// Convert a NALU payload to Annex-B, optionally preceded by the SPS/PPS from the sequence header
+func toAnnexB(cfg *AVCDecoderConfig, data []byte, withParamSets bool) ([]byte, error) {
+	stream := new(bytes.Buffer)
+	if withParamSets {
+		stream.Write(cfg.annexBHeader())
+	}
+
+	if isAnnexB(data) {
+		stream.Write(data)
+	} else {
+		annexB, err := avccToAnnexB(data, cfg.LengthSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "Malformed NALU payload")
+		}
+		stream.Write(annexB)
+	}
+
+	return stream.Bytes(), nil
+}
+
+// Log a warning the first time key is seen
+func (h *Handler) warnOnce(key, msg string, args ...any) {
+	h.warnMu.Lock()
+	defer h.warnMu.Unlock()
+
+	if h.warned[key] {
+		return
+	}
+	if h.warned == nil {
+		h.warned = make(map[string]bool)
+	}
+	h.warned[key] = true
+	h.logger.Warn(msg, args...)
+}
+
+// Shortest time between two records of the same repeated error
+const repeatLogInterval = 10 * time.Second
+
+// repeatedLog An error being rate limited, and how often it was held back since it was last logged
+type repeatedLog struct {
+	last       time.Time
+	suppressed int
+}
+
+// Log an error that may repeat for every tag, such as a failing disk. The first one is logged
+// right away, then at most one per repeatLogInterval along with how many were held back
+func (h *Handler) logRepeated(level slog.Level, key, msg string, args ...any) {
+	h.warnMu.Lock()
+	defer h.warnMu.Unlock()
+
+	if h.repeats == nil {
+		h.repeats = make(map[string]*repeatedLog)
+	}
+	r, ok := h.repeats[key]
+	if !ok {
+		r = &repeatedLog{}
+		h.repeats[key] = r
+	}
+	now := time.Now()
+	if !r.last.IsZero() && now.Sub(r.last) < repeatLogInterval {
+		r.suppressed++
+		return
+	}
+	if r.suppressed > 0 {
+		args = append(args, "suppressed", r.suppressed)
+	}
+	r.last, r.suppressed = now, 0
+	h.logger.Log(context.Background(), level, msg, args...)
+}
+
+// Feed a picture to the persistent decoder: every one when sampling decodes the stream,
+// otherwise the sampled keyframes alone. CV runs on the frames as they come out, see processDecoded
+func (h *Handler) feedDecoder(body []byte, video *flvtag.VideoData, timestamp uint32) {
+	keyframe := video.FrameType == flvtag.FrameTypeKeyFrame
+	pts := timestamp + uint32(video.CompositionTime)
+
+	var stream []byte
+	var err error
+	switch video.CodecID {
+	case flvtag.CodecIDAVC:
+		if video.AVCPacketType != flvtag.AVCPacketTypeNALU {
+			return
+		}
+		// Without SPS/PPS the decoder would only be fed garbage
+		if h.avcConfig == nil {
+			h.warnOnce("no-avc-config", "Skipping CV until an AVC sequence header arrives")
+			return
+		}
+		stream, err = toAnnexB(h.avcConfig, body, keyframe)
+	case codecIDHEVC:
+		packetType, data, splitErr := splitHEVCPacket(body)
+		if splitErr != nil || packetType != flvtag.AVCPacketTypeNALU {
+			return
+		}
+		if h.hevcConfig == nil {
+			h.warnOnce("no-hevc-config", "Skipping CV until an HEVC sequence header arrives")
+			return
+		}
+		stream, err = hevcToAnnexB(h.hevcConfig, data, keyframe)
+		pts = timestamp
+	default:
+		h.warnOnce(fmt.Sprintf("codec-%d", video.CodecID), "No CV for this codec, passing video through",
+			"codec", videoCodecName(video.CodecID), "codec_id", video.CodecID)
+		return
+	}
+	if err != nil {
+		h.logger.Warn("Failed to convert video frame", "timestamp", timestamp, "err", err)
+		return
+	}
+
+	if h.streamDecoder != nil && h.streamDecoderCodec != video.CodecID {
+		h.closeStreamDecoder()
+	}
+	if h.streamDecoder == nil {
+		// Inter-frames are useless without the keyframe they refer to
+		if !keyframe || h.streamDecoderFailed {
+			return
+		}
+		sample := h.sampling.Sample
+		if !h.sampling.DecodesStream() {
+			sample = func(uint64) bool { return true }
+		}
+		newDecoder := NewH264StreamDecoder
+		if video.CodecID == codecIDHEVC {
+			newDecoder = NewHEVCStreamDecoder
+		}
+		dec, err := newDecoder(sample, false)
+		if err != nil {
+			h.logger.Warn("Decoding unavailable, skipping CV", "err", err)
+			h.streamDecoderFailed = true
+			return
+		}
+		h.streamDecoder, h.streamDecoderCodec = dec, video.CodecID
+	}
+
+	queued, err := h.streamDecoder.Feed(stream, keyframe, pts)
+	if err != nil {
+		// Restart from the next keyframe
+		h.logger.Warn("Stream decoder failed", "timestamp", timestamp, "err", err)
+		h.closeStreamDecoder()
+		return
+	}
+	if !queued {
+		dropped := h.stats.DecodeDropped.Add(1)
+		h.logger.Debug("Decoder queue full, dropping video until the next keyframe", "timestamp", timestamp, "dropped", dropped)
+	}
+}
+
+// Run CV on the frames the decoder has ready, without waiting for more
+func (h *Handler) processDecoded() {
+	for h.streamDecoder != nil {
+		select {
+		case f, ok := <-h.streamDecoder.Frames():
+			if !ok {
+				h.closeStreamDecoder()
+				return
+			}
+			h.analyseFrame(f)
+		default:
+			return
+		}
+	}
+}
+
+// Hand a decoded frame to the CV workers, or analyse it here and write its detections
+func (h *Handler) analyseFrame(f DecodedFrame) {
+	// Stream sampling caps frames at the policy's MaxFPS, the keyframe sampler already did
+	if h.sampling.DecodesStream() && !h.streamThrottle.Allow(f.Timestamp) {
+		h.stats.FramesSkipped.Add(1)
+		_ = f.Mat.Close()
+		return
+	}
+
+	job := &cvJob{timestamp: f.Timestamp, frame: f.Mat}
+	if h.cvJobs != nil {
+		h.submitCV(job)
+		return
+	}
+	h.runCVJob(job)
+	_ = job.frame.Close()
+	h.injectDetections(job.timestamp, job.detections)
+}
+
+// Stop the stream decoder, if running, analysing the pictures still in it
+func (h *Handler) closeStreamDecoder() {
+	dec := h.streamDecoder
+	if dec == nil {
+		return
+	}
+	h.streamDecoder = nil
+
+	dec.CloseInput()
+	for f := range dec.Frames() {
+		h.analyseFrame(f)
+	}
+	if err := dec.Close(); err != nil {
+		h.logger.Warn("Stream decoder exited", "err", err)
+	}
+}
+
+// Apply computer vision to the frame. The frame is not drawn on, see drawDetections
+func (h *Handler) applyComputerVision(frame *gocv.Mat, timestamp uint32) ([]DetectionResult, error) {
+	// Snapshots show the picture as received, without boxes
+	h.frames.Put(timestamp, *frame)
+	h.stats.setResolution(frame.Cols(), frame.Rows())
+
+	// Static scenes skip detection entirely
+	if moving, score := h.hasMotion(*frame); !moving {
+		h.stats.FramesStatic.Add(1)
+		h.logger.Debug("Static frame, skipping detection", "timestamp", timestamp, "motion", score)
+		return nil, nil
+	}
+
+	// Only the -roi part of the frame is searched
+	detectFrame := *frame
+	region, roi, ok := cropROI(*frame, h.visionCfg.ROI)
+	if !ok {
+		return nil, nil
+	}
+	if region != nil {
+		defer region.Close()
+		detectFrame = *region
+	}
+
+	// Detection runs on a smaller copy when -cv-resize-* is set. Boxes are scaled and moved back to the frame
+	fx, fy := 1.0, 1.0
+	if size := detectionSize(detectFrame.Cols(), detectFrame.Rows(), h.cvResize); size != image.Pt(detectFrame.Cols(), detectFrame.Rows()) {
+		small := gocv.NewMat()
+		defer small.Close()
+		if err := gocv.Resize(detectFrame, &small, size, 0, 0, gocv.InterpolationArea); err != nil {
+			return nil, errors.Wrap(err, "Failed to resize frame for CV")
+		}
+		fx = float64(detectFrame.Cols()) / float64(size.X)
+		fy = float64(detectFrame.Rows()) / float64(size.Y)
+		detectFrame = small
+	}
+
+	// The -cv-stages prepare the picture for the detector, and may report detections of their own
+	staged, stageResults, err := h.pipeline.Run(detectFrame)
+	if err != nil {
+		return nil, err
+	}
+	if staged.Ptr() != detectFrame.Ptr() {
+		defer staged.Close()
+		detectFrame = staged
+	}
+	// Moving regions from a background stage narrow down the template search, they are not detections
+	stageResults, motion := splitMotionCandidates(stageResults)
+	for i := range stageResults {
+		stageResults[i].Rect = scaleRect(stageResults[i].Rect, fx, fy).Add(roi.Min)
+		stageResults[i].Timestamp = timestamp
+	}
+
+	if h.matcher != nil {
+		results, err := h.matchTemplates(detectFrame, motion)
+		if err != nil {
+			return nil, err
+		}
+		for i := range results {
+			results[i].Rect = scaleRect(results[i].Rect, fx, fy).Add(roi.Min)
+		}
+		results = append(results, stageResults...)
+		threshold := h.config.DetectionThreshold()
+		kept := results[:0]
+		for _, d := range results {
+			if d.Score >= threshold {
+				d.Timestamp = timestamp
+				kept = append(kept, d)
+			}
+		}
+		// A stage may have found the same Waldo as the templates
+		results = suppressOverlaps(kept, h.matcher.config.NMSIoU)
+		if len(results) > 0 {
+			h.logger.Info("Found Waldo", "timestamp", timestamp,
+				"matches", len(results), "best_score", results[0].Score, "rect", results[0].Rect)
+		}
+		h.reportDetections(*frame, timestamp, results)
+		return results, nil
+	}
+
+	// Fall back to the configured detector
+	h.visionMu.Lock()
+	if h.vision == nil {
+		h.visionMu.Unlock()
+		return nil, nil
+	}
+	detections, err := h.vision.Detect(detectFrame)
+	var crops [][]byte
+	if err == nil {
+		for i := range detections {
+			detections[i].Rect = scaleRect(detections[i].Rect, fx, fy).Add(roi.Min)
+		}
+		threshold := h.config.DetectionThreshold()
+		kept := detections[:0]
+		for _, d := range detections {
+			if float64(d.Score) >= threshold {
+				kept = append(kept, d)
+			}
+		}
+		detections = kept
+
+		if len(detections) > 0 && h.thumbnails.Load() < int64(h.maxThumbnails) {
+			if crops, err = h.vision.Crops(*frame, detections, h.thumbnailMargin); err != nil {
+				h.logger.Warn("Failed to crop detections", "timestamp", timestamp, "err", err)
+				err = nil
+			}
+		}
+	}
+	h.visionMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	h.saveThumbnails(timestamp, crops)
+
+	results := make([]DetectionResult, 0, len(detections))
+	for _, d := range detections {
+		results = append(results, DetectionResult{Timestamp: timestamp, Score: float64(d.Score), Rect: d.Rect, Scale: 1, Label: d.Label})
+	}
+	results = append(results, stageResults...)
+	if len(results) > 0 {
+		h.logger.Info("Detected objects", "timestamp", timestamp, "count", len(detections))
+	}
+	h.reportDetections(*frame, timestamp, results)
+
+	return results, nil
+}
+
+// Run the template matcher, with stripePrefilter only around red stripes. When motion has regions,
+// only around those, and with stripePrefilter only around the stripes that moved
+func (h *Handler) matchTemplates(frame gocv.Mat, motion []image.Rectangle) ([]DetectionResult, error) {
+	if !h.stripePrefilter {
+		if len(motion) > 0 {
+			return h.matcher.MatchRegions(frame, motion), nil
+		}
+		return h.matcher.Match(frame), nil
+	}
+
+	stripes, err := detectWaldoStripes(frame)
+	if err != nil {
+		return nil, err
+	}
+	if len(motion) > 0 {
+		moved := stripes[:0]
+		for _, s := range stripes {
+			if slices.ContainsFunc(motion, s.Overlaps) {
+				moved = append(moved, s)
+			}
+		}
+		stripes = moved
+	}
+	if len(stripes) == 0 {
+		return nil, nil
+	}
+
+	return h.matcher.MatchRegions(frame, stripes), nil
+}
+
+// Run the motion pre-filter, returning whether the frame moved since the last one that was
+// processed, and its motion score. Moving frames become the new reference.
+// Frames count as moving when there is no Vision or the filter is disabled
+func (h *Handler) hasMotion(frame gocv.Mat) (bool, float64) {
+	h.visionMu.Lock()
+	defer h.visionMu.Unlock()
+
+	if h.vision == nil || h.visionCfg.MotionThreshold <= 0 {
+		return true, 1
+	}
+	if h.vision.IsStaticFrame(h.lastProcessedFrame, frame, h.visionCfg.MotionThreshold) {
+		return false, h.vision.MotionScore()
+	}
+	frame.CopyTo(&h.lastProcessedFrame)
+
+	return true, h.vision.MotionScore()
+}
+
+// Record, show and notify the detections on an annotated copy of the frame, the frame itself is left as is.
+// Frames without detections skip the copy unless they are shown
+func (h *Handler) reportDetections(frame gocv.Mat, timestamp uint32, results []DetectionResult) {
+	h.visionMu.Lock()
+	showing := h.vision != nil && h.vision.window != nil
+	h.visionMu.Unlock()
+	if len(results) == 0 && !showing {
+		h.annotated.Put(timestamp, frame)
+		h.saveAnnotatedFrame(frame, timestamp)
+		h.recordDetections(frame, timestamp, results)
+		return
+	}
+
+	annotated := frame.Clone()
+	defer annotated.Close()
+	h.drawDetections(&annotated, results)
+	h.annotated.Put(timestamp, annotated)
+	h.saveAnnotatedFrame(annotated, timestamp)
+
+	h.visionMu.Lock()
+	if h.vision != nil {
+		h.vision.Show(annotated)
+	}
+	h.visionMu.Unlock()
+	h.recordDetections(annotated, timestamp, results)
+	h.notifyDetections(annotated, timestamp, results)
+}
+
+// Add a frame to the recording's annotated frames, when they are being saved
+func (h *Handler) saveAnnotatedFrame(frame gocv.Mat, timestamp uint32) {
+	if h.annotatedFrames == nil {
+		return
+	}
+	if err := h.annotatedFrames.Write(frame, timestamp); err != nil {
+		h.logRepeated(slog.LevelWarn, "annotated-frame", "Failed to save annotated frame", "timestamp", timestamp, "err", err)
+	}
+}
+
+// Outline the detections with their scores, in the template outline color when matching templates
+func (h *Handler) drawDetections(frame *gocv.Mat, results []DetectionResult) {
+	if h.matcher != nil {
+		drawDetections(frame, results, matchOutline)
+		return
+	}
+
+	h.visionMu.Lock()
+	defer h.visionMu.Unlock()
+	if h.vision != nil {
+		h.vision.DrawDetections(frame, results)
+	}
+}
+
+// Report detections to the webhooks, unless the stream was reported within the cooldown.
+// In EveryDetection mode they are sent by recordDetections instead
+func (h *Handler) notifyDetections(frame gocv.Mat, timestamp uint32, results []DetectionResult) {
+	if h.notifier == nil || h.notifier.cfg.EveryDetection || len(results) == 0 || !h.notifier.Allow(h.streamName) {
+		return
+	}
+
+	payload := WebhookPayload{Stream: h.streamName, Timestamp: timestamp, Rects: len(results)}
+	if h.notifier.cfg.Thumbnails {
+		jpg, err := encodeThumbnail(frame)
+		if err != nil {
+			h.logger.Warn("Notifying without a thumbnail", "err", err)
+		}
+		payload.Thumbnail = jpg
+	}
+	if !h.notifier.Enqueue(payload) {
+		h.metrics.WebhooksDropped.Add(1)
+	}
+}
+
+// Save the annotated frame as <timestamp>.jpg in the stream's detection directory, within the rate limits.
+// Returns the path, empty when nothing was saved
+func (h *Handler) saveDetectionFrame(frame gocv.Mat, timestamp uint32) string {
+	if h.detectionFrames == nil || !h.detectionFrames.Allow(time.Now()) {
+		return ""
+	}
+
+	buf, err := gocv.IMEncode(gocv.JPEGFileExt, frame)
+	if err != nil {
+		h.logger.Warn("Failed to encode detection frame", "timestamp", timestamp, "err", err)
+		return ""
+	}
+	defer buf.Close()
+
+	dir := filepath.Join(h.outputDir, h.fileName, "detections")
+	if h.detectionSaveDir != "" {
+		dir = filepath.Join(h.detectionSaveDir, h.fileName)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		h.logger.Warn("Failed to create detection frame directory", "dir", dir, "err", err)
+		return ""
+	}
+
+	// Workers can finish frames with the same timestamp, so never overwrite
+	for n := 0; ; n++ {
+		p := filepath.Join(dir, fmt.Sprintf("%d.jpg", timestamp))
+		if n > 0 {
+			p = filepath.Join(dir, fmt.Sprintf("%d-%d.jpg", timestamp, n))
+		}
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			h.logger.Warn("Failed to save detection frame", "path", p, "err", err)
+			return ""
+		}
+
+		_, err = f.Write(buf.GetBytes())
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			h.logger.Warn("Failed to save detection frame", "path", p, "err", err)
+			_ = os.Remove(p)
+			return ""
+		}
+		return p
+	}
+}
+
+// Write detection crops to the faces directory until maxThumbnails have been saved
+func (h *Handler) saveThumbnails(timestamp uint32, crops [][]byte) {
+	if len(crops) == 0 {
+		return
+	}
+
+	dir := filepath.Join(h.outputDir, h.fileName, "faces")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		h.logger.Warn("Failed to create thumbnail directory", "dir", dir, "err", err)
+		return
+	}
+
+	for idx, jpg := range crops {
+		if h.thumbnails.Add(1) > int64(h.maxThumbnails) {
+			h.thumbnailsOnce.Do(func() {
+				h.logger.Info("Thumbnail limit reached, no more are saved for this stream", "limit", h.maxThumbnails)
+			})
+			return
+		}
+
+		p := filepath.Join(dir, fmt.Sprintf("%d_%d.jpg", timestamp, idx))
+		if err := os.WriteFile(p, jpg, 0644); err != nil {
+			h.logger.Warn("Failed to save thumbnail", "path", p, "err", err)
+		}
+	}
+}
+
+// Keep detections for the API and sidecar, and push confident ones to live subscribers
+func (h *Handler) recordDetections(frame gocv.Mat, timestamp uint32, results []DetectionResult) {
+	var thumbnail string
+	for _, d := range results {
+		if d.Score >= h.detectionSaveScore {
+			thumbnail = h.saveDetectionFrame(frame, timestamp)
+			break
+		}
+	}
+
+	h.stats.Detections.Add(uint64(len(results)))
+	h.metrics.AddDetections(h.streamName, len(results))
+	h.history.Add(results...)
+	h.sidecar.Add(timestamp, results)
+	if h.sink != nil && len(results) > 0 {
+		h.sink.Detections(h.streamName, timestamp, results)
+	}
+	if err := h.timeline.Add(h.streamName, timestamp, h.videoNorm.Offset(), results, thumbnail); err != nil {
+		h.logger.Warn("Failed to append to detection timeline", "timestamp", timestamp, "err", err)
+	}
+
+	if h.events == nil {
+		return
+	}
+	var rects []EventRect
+	for _, d := range results {
+		if d.Score < h.eventThreshold {
+			continue
+		}
+		event := DetectionEvent{
+			Stream:     h.streamName,
+			Timestamp:  d.Timestamp,
+			Rect:       d.Rect,
+			Confidence: d.Score,
+		}
+		h.events.Publish(event)
+		if h.notifier != nil && h.notifier.cfg.EveryDetection && !h.notifier.Notify(event) {
+			h.metrics.WebhooksDropped.Add(1)
+		}
+		rects = append(rects, EventRect{Rect: d.Rect, Label: d.Label, Confidence: d.Score})
+	}
+	h.publishFrameEvent(frame, timestamp, rects)
+}
+
+// Push a frame's detections to /ws/events subscribers, with a thumbnail when eventThumbnails is set
+func (h *Handler) publishFrameEvent(frame gocv.Mat, timestamp uint32, rects []EventRect) {
+	if len(rects) == 0 || !h.events.HasFrameSubscribers() {
+		return
+	}
+
+	ev := FrameEvent{Stream: h.streamName, Timestamp: timestamp, Rects: rects}
+	if h.eventThumbnails {
+		jpg, err := encodeThumbnail(frame)
+		if err != nil {
+			h.logger.Warn("Sending detection event without a thumbnail", "err", err)
+		}
+		ev.Thumbnail = jpg
+	}
+	h.events.PublishFrame(ev)
+}
+
+// Frames run through CV per second of stream time, over the whole stream
+func (h *Handler) averageCVFPS() float64 {
+	elapsed := h.stats.LastTimestamp.Load() - h.stats.FirstTimestamp.Load()
+	if elapsed == 0 {
+		return 0
+	}
+
+	return float64(h.stats.FramesProcessed.Load()) * 1000 / float64(elapsed)
+}
+
+// Average incoming video bitrate so far, 0 until there is enough to measure
+func (h *Handler) sourceKbps() int {
+	elapsed := h.lastVideoTS - h.firstVideoTS
+	if elapsed < 1000 {
+		return 0
+	}
+
+	// bits per millisecond == kbits per second
+	return int(h.videoBytes * 8 / uint64(elapsed))
+}
@@ -0,0 +1,718 @@
+package waldo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	flvtag "github.com/yutopp/go-flv/tag"
+	"github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+	"gocv.io/x/gocv"
+)
+
+// A handler as Server.Serve builds it, recording to a temporary directory without CV
+func newTestHandler(t *testing.T, opts Options) (*Server, *Handler) {
+	t.Helper()
+	opts.OutputDir = t.TempDir()
+	opts.NewDetector = func() (Detector, error) {
+		return nil, errors.New("No CV in tests")
+	}
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.newHandler()
+	h.limits = s.limits
+
+	return s, h
+}
+
+func TestOnPublishTwiceIsRejected(t *testing.T) {
+	s, h := newTestHandler(t, Options{})
+	defer h.OnClose()
+
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "first"}); err != nil {
+		t.Fatal(err)
+	}
+	recording := h.RecordingPath()
+
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "second"}); err == nil {
+		t.Fatal("Second publish on one connection accepted")
+	}
+	if got := s.registry.List(); len(got) != 1 || got[0] != "first" {
+		t.Errorf("Registered streams %v, want only first", got)
+	}
+	if h.RecordingPath() != recording {
+		t.Errorf("Recording moved from %s to %s", recording, h.RecordingPath())
+	}
+	files, _ := filepath.Glob(filepath.Join(s.opts.OutputDir, "*", "*"))
+	if len(files) != 1 {
+		t.Errorf("Recordings %v, want one", files)
+	}
+}
+
+func TestOnPublishRetryAfterRejection(t *testing.T) {
+	s, first := newTestHandler(t, Options{MaxPublishesPerKey: 1, Auth: NewStreamKeys("k")})
+	if err := first.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam?key=k"}); err != nil {
+		t.Fatal(err)
+	}
+
+	second := s.newHandler()
+	second.limits = s.limits
+	defer second.OnClose()
+	if err := second.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam?key=k"}); err == nil {
+		t.Fatal("Two publishes of one key accepted with -max-streams-per-key 1")
+	}
+	first.OnClose()
+	if _, err := os.Stat(first.RecordingPath()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The key is free again, and the failed attempts left nothing behind on the second connection
+	if err := second.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam?key=k"}); err != nil {
+		t.Fatalf("Publish after the first stream ended: %v", err)
+	}
+}
+
+func TestMediaBeforePublishDropped(t *testing.T) {
+	s, h := newTestHandler(t, Options{})
+	defer h.OnClose()
+
+	send := func() {
+		t.Helper()
+		if err := h.OnVideo(0, bytes.NewReader(avcSequenceHeader(testSPS, testPPS))); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.OnVideo(0, bytes.NewReader(avcFrame(true, nil))); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.OnAudio(0, bytes.NewReader([]byte{0xaf, 0, 0x12, 0x10})); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Before any publish, then after a rejected one
+	send()
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam?key=a&key=b"}); err == nil {
+		t.Fatal("Publish with two keys accepted")
+	}
+	send()
+	if n := h.stats.TagsWritten.Load(); n != 0 {
+		t.Errorf("%d tags written without a publish", n)
+	}
+	if files, _ := filepath.Glob(filepath.Join(s.opts.OutputDir, "*", "*")); len(files) != 0 {
+		t.Errorf("Files %v created without a publish", files)
+	}
+
+	// The connection can still publish, and only what follows is recorded
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	send()
+	if n := h.stats.TagsWritten.Load(); n != 3 {
+		t.Errorf("%d tags written after publishing, want 3", n)
+	}
+}
+
+func TestOnPlayAuthenticates(t *testing.T) {
+	s, publisher := newTestHandler(t, Options{Auth: NewStreamKeys("k")})
+	defer publisher.OnClose()
+	if err := publisher.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "live/k"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"live/" + keyLabel("k"), "live/" + keyLabel("k") + "?key=wrong", "live/wrong"} {
+		player := s.newHandler()
+		if err := player.OnPlay(&rtmp.StreamContext{}, 0, &rtmpmsg.NetStreamPlay{StreamName: name}); err == nil {
+			t.Errorf("Played %q without the key", name)
+		}
+		player.OnClose()
+	}
+
+	player := s.newHandler()
+	defer player.OnClose()
+	if err := player.OnPlay(&rtmp.StreamContext{}, 0, &rtmpmsg.NetStreamPlay{StreamName: "live/k"}); err != nil {
+		t.Fatalf("Play with the key: %v", err)
+	}
+	if publisher.playback.Players() != 1 {
+		t.Errorf("Publisher has %d players, want 1", publisher.playback.Players())
+	}
+
+	if err := publisher.OnPlay(&rtmp.StreamContext{}, 0, &rtmpmsg.NetStreamPlay{StreamName: "live/k"}); err == nil {
+		t.Error("Publishing connection allowed to play")
+	}
+}
+
+func TestIdleStreamClosed(t *testing.T) {
+	s, addr := startTestServer(t, Options{StreamTimeout: 300 * time.Millisecond})
+	p := publishTestStream(t, addr, "cam")
+	p.gops(t, 10, 5)
+	h := waitForStream(t, s, "cam")
+
+	// Nothing more is sent, the server hangs up on its own
+	waitForClose(t, h)
+	if _, ok := s.registry.Get("cam"); ok {
+		t.Error("Idle stream still registered")
+	}
+	if got := h.metrics.IdleDisconnects.Load(); got != 1 {
+		t.Errorf("%d idle disconnects counted, want 1", got)
+	}
+
+	// Every tag sent made it into a complete file
+	tags := readFLV(t, h.RecordingPath())
+	if len(tags) != 11 {
+		t.Errorf("Recording has %d tags, want the sequence header and 10 frames", len(tags))
+	}
+}
+
+func TestConcurrentOnPublishKeepsFilesApart(t *testing.T) {
+	s, _ := newTestHandler(t, Options{})
+	names := []string{"cam1", "cam2", "cam3"}
+	handlers := make([]*Handler, len(names))
+	for i := range handlers {
+		handlers[i] = s.newHandler()
+		handlers[i].limits = s.limits
+	}
+
+	// Each handler publishes and records at the same time as the others, every picture naming its stream
+	var wg sync.WaitGroup
+	errs := make(chan error, len(names))
+	for i, h := range handlers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: names[i]}); err != nil {
+				errs <- err
+				return
+			}
+			defer h.OnClose()
+			if err := h.OnVideo(0, bytes.NewReader(avcSequenceHeader(testSPS, testPPS))); err != nil {
+				errs <- err
+				return
+			}
+			for n := 0; n < 100; n++ {
+				if err := h.OnVideo(uint32(n*40), bytes.NewReader(avcFrame(n%10 == 0, []byte(names[i])))); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	paths := make(map[string]bool)
+	for i, h := range handlers {
+		if paths[h.RecordingPath()] {
+			t.Fatalf("Two streams recorded to %s", h.RecordingPath())
+		}
+		paths[h.RecordingPath()] = true
+
+		pictures := avcPictures(t, readFLV(t, h.RecordingPath()))
+		if len(pictures) != 100 {
+			t.Errorf("%s recorded %d pictures, want 100", names[i], len(pictures))
+		}
+		for _, p := range pictures {
+			if !bytes.HasSuffix(p, []byte(names[i])) {
+				t.Fatalf("%s recorded a picture % x of another stream", names[i], p)
+			}
+		}
+	}
+}
+
+func TestRepublishWithinASecondGetsNewFile(t *testing.T) {
+	s, _ := newTestHandler(t, Options{})
+
+	var paths []string
+	for i := 0; i < 3; i++ {
+		h := s.newHandler()
+		h.limits = s.limits
+		if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.OnVideo(0, bytes.NewReader(avcSequenceHeader(testSPS, testPPS))); err != nil {
+			t.Fatal(err)
+		}
+		h.OnClose()
+		paths = append(paths, h.RecordingPath())
+	}
+
+	for i, p := range paths {
+		for _, q := range paths[:i] {
+			if p == q {
+				t.Fatalf("Two sessions recorded to %s", p)
+			}
+		}
+		if len(readFLV(t, p)) != 1 {
+			t.Errorf("Session %d lost its recording %s", i, p)
+		}
+	}
+}
+
+func TestSegmentsStartWithHeadersAndKeyframe(t *testing.T) {
+	_, h := newTestHandler(t, Options{SegmentSize: 8 * 1024})
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Dir(h.RecordingPath())
+
+	// AAC LC 44.1kHz stereo, then 10s of video with a keyframe every 400ms and audio in between
+	if err := h.OnAudio(0, bytes.NewReader([]byte{0xaf, 0, 0x12, 0x10})); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnVideo(0, bytes.NewReader(avcSequenceHeader(testSPS, testPPS))); err != nil {
+		t.Fatal(err)
+	}
+	payload := bytes.Repeat([]byte{0xaa}, 500)
+	for i := 0; i < 250; i++ {
+		if err := h.OnVideo(uint32(i*40), bytes.NewReader(avcFrame(i%10 == 0, payload))); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.OnAudio(uint32(i*40+20), bytes.NewReader(append([]byte{0xaf, 1}, payload[:100]...))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h.OnClose()
+
+	segments, err := filepath.Glob(filepath.Join(dir, "*.flv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("Segments %v, want the stream split in at least 3", segments)
+	}
+	name := regexp.MustCompile(`-(\d{3})-\d{6}\.flv$`)
+	pictures := 0
+	for i, p := range segments {
+		if m := name.FindStringSubmatch(p); m == nil || m[1] != fmt.Sprintf("%03d", i+1) {
+			t.Errorf("Segment %d is named %s, want index %03d and a start time", i, filepath.Base(p), i+1)
+		}
+
+		// Both sequence headers before any picture or sample, and a keyframe first
+		videoHeader, audioHeader, first := false, false, true
+		for _, tag := range readFLV(t, p) {
+			switch data := tag.Data.(type) {
+			case *flvtag.VideoData:
+				if data.AVCPacketType == flvtag.AVCPacketTypeSequenceHeader {
+					videoHeader = true
+					continue
+				}
+				if first && (!videoHeader || !audioHeader || data.FrameType != flvtag.FrameTypeKeyFrame) {
+					t.Errorf("%s starts with a picture of frame type %d, video header %v, audio header %v",
+						filepath.Base(p), data.FrameType, videoHeader, audioHeader)
+				}
+				first = false
+				pictures++
+			case *flvtag.AudioData:
+				if data.AACPacketType == flvtag.AACPacketTypeSequenceHeader {
+					audioHeader = true
+				} else if first {
+					t.Errorf("%s has audio before its first keyframe", filepath.Base(p))
+				}
+			}
+		}
+	}
+	if pictures != 250 {
+		t.Errorf("Segments hold %d pictures, want 250", pictures)
+	}
+}
+
+// countingDetector Counts the frames it is run on
+type countingDetector struct {
+	calls int
+}
+
+func (d *countingDetector) Detect(gocv.Mat) ([]Detection, error) {
+	d.calls++
+	return nil, nil
+}
+
+func (d *countingDetector) Close() error {
+	return nil
+}
+
+func TestProcessFrameWithCVHonoursMaxFPS(t *testing.T) {
+	rates, err := ParseStreamRates("2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	detector := &countingDetector{}
+	s, err := NewServer(Options{
+		OutputDir:   t.TempDir(),
+		NewDetector: func() (Detector, error) { return detector, nil },
+		CVMaxFPS:    rates,
+		Vision:      VisionConfig{Headless: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.newHandler()
+	h.limits = s.limits
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.OnClose()
+
+	// 10 frames spread over one second of wall time
+	frame := gocv.NewMatWithSize(64, 64, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+	for i := 0; i < 10; i++ {
+		job := &cvJob{timestamp: uint32(i * 100), frame: frame}
+		if err := h.processFrameWithCV(job); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if detector.calls == 0 || detector.calls > 3 {
+		t.Errorf("Detector ran %d times for 10 frames in 1s at 2 fps, want 1 to 3", detector.calls)
+	}
+	if skipped := h.stats.FramesSkipped.Load(); skipped != uint64(10-detector.calls) {
+		t.Errorf("%d frames counted as skipped, want %d", skipped, 10-detector.calls)
+	}
+}
+
+func TestDetectionThresholdFiltersEvents(t *testing.T) {
+	detector := &fixedDetector{detections: []Detection{{Rect: image.Rect(8, 8, 24, 24), Label: "waldo", Score: 0.7}}}
+	s, err := NewServer(Options{
+		OutputDir:          t.TempDir(),
+		NewDetector:        func() (Detector, error) { return detector, nil },
+		DetectionThreshold: 0.5,
+		Vision:             VisionConfig{Headless: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.newHandler()
+	h.limits = s.limits
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.OnClose()
+	id, events := s.Events().Subscribe(4)
+	defer s.Events().Unsubscribe(id)
+
+	frame := gocv.NewMatWithSize(64, 64, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+	detect := func(timestamp uint32) []DetectionResult {
+		t.Helper()
+		results, err := h.applyComputerVision(&frame, timestamp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return results
+	}
+
+	if results := detect(0); len(results) != 1 || results[0].Score != 0.7 {
+		t.Fatalf("Got %v at threshold 0.5, want the 0.7 detection", results)
+	}
+	select {
+	case ev := <-events:
+		if ev.Stream != "cam" || ev.Confidence != 0.7 {
+			t.Errorf("Got event %+v, want the 0.7 detection on cam", ev)
+		}
+	default:
+		t.Fatal("No event for a detection above the threshold")
+	}
+
+	// Raised while the stream runs, as POST /config/threshold does
+	api := s.Handler()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/config/threshold", strings.NewReader(`{"threshold": 0.8}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Setting the threshold answered %d: %s", w.Code, w.Body)
+	}
+	if results := detect(40); len(results) != 0 {
+		t.Errorf("Got %v at threshold 0.8, want nothing", results)
+	}
+	select {
+	case ev := <-events:
+		t.Errorf("Got event %+v for a detection below the threshold", ev)
+	default:
+	}
+}
+
+// capturedRecord A log record with the attributes of its logger and its own
+type capturedRecord struct {
+	level slog.Level
+	msg   string
+	attrs map[string]slog.Value
+}
+
+// captureHandler A slog handler keeping every record, groups left out
+type captureHandler struct {
+	mu      *sync.Mutex
+	records *[]capturedRecord
+	attrs   []slog.Attr
+}
+
+// Log every record through a captureHandler until the test ends
+func captureLogs(t *testing.T) *captureHandler {
+	t.Helper()
+	h := &captureHandler{mu: new(sync.Mutex), records: new([]capturedRecord)}
+	prev := slog.Default()
+	slog.SetDefault(slog.New(h))
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	return h
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool {
+	return true
+}
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	rec := capturedRecord{level: r.Level, msg: r.Message, attrs: make(map[string]slog.Value)}
+	for _, a := range h.attrs {
+		rec.attrs[a.Key] = a.Value
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		rec.attrs[a.Key] = a.Value
+		return true
+	})
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	*h.records = append(*h.records, rec)
+
+	return nil
+}
+
+func (h *captureHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &captureHandler{mu: h.mu, records: h.records, attrs: append(slices.Clip(h.attrs), attrs...)}
+}
+
+func (h *captureHandler) WithGroup(string) slog.Handler {
+	return h
+}
+
+// Records logged so far with message msg
+func (h *captureHandler) find(msg string) []capturedRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var found []capturedRecord
+	for _, r := range *h.records {
+		if r.msg == msg {
+			found = append(found, r)
+		}
+	}
+
+	return found
+}
+
+func TestLogRecordsCarryConnection(t *testing.T) {
+	logs := captureLogs(t)
+	s, addr := startTestServer(t, Options{})
+	publishTestStream(t, addr, "cam1")
+	publishTestStream(t, addr, "cam2")
+	handlers := map[string]*Handler{"cam1": waitForStream(t, s, "cam1"), "cam2": waitForStream(t, s, "cam2")}
+
+	// Each stream's records name it, its connection and where it comes from
+	received := logs.find("Receiving stream")
+	if len(received) != 2 {
+		t.Fatalf("Logged %d streams received, want 2", len(received))
+	}
+	connIDs := make(map[uint64]bool)
+	for _, r := range received {
+		h, ok := handlers[r.attrs["stream"].String()]
+		if !ok {
+			t.Fatalf("Record %+v names no stream published", r)
+		}
+		if r.attrs["remote"].String() != h.remoteAddr || r.attrs["conn_id"].Uint64() != h.connID {
+			t.Errorf("Record %+v, want remote %s and conn_id %d", r, h.remoteAddr, h.connID)
+		}
+		connIDs[h.connID] = true
+	}
+	if len(connIDs) != 2 {
+		t.Errorf("Both streams logged with connection %v", connIDs)
+	}
+
+	// A repeated error is logged once per interval, then with how many were held back
+	h := handlers["cam1"]
+	for i := 0; i < 3; i++ {
+		h.logRepeated(slog.LevelWarn, "write-video", "Failed to write video", "err", errors.New("Disk full"))
+	}
+	h.warnMu.Lock()
+	h.repeats["write-video"].last = time.Now().Add(-repeatLogInterval)
+	h.warnMu.Unlock()
+	h.logRepeated(slog.LevelWarn, "write-video", "Failed to write video", "err", errors.New("Disk full"))
+
+	failed := logs.find("Failed to write video")
+	if len(failed) != 2 {
+		t.Fatalf("Logged the error %d times, want 2", len(failed))
+	}
+	if _, ok := failed[0].attrs["suppressed"]; ok {
+		t.Errorf("First record %+v counts suppressed repeats", failed[0])
+	}
+	if n := failed[1].attrs["suppressed"]; n.Int64() != 2 {
+		t.Errorf("Second record held back %v repeats, want 2", n)
+	}
+	for _, r := range failed {
+		if r.level != slog.LevelWarn || r.attrs["stream"].String() != "cam1" || r.attrs["conn_id"].Uint64() != h.connID {
+			t.Errorf("Record %+v, want a warning on cam1's connection", r)
+		}
+	}
+}
+
+func TestRecordingFlushedUpToLastKeyframe(t *testing.T) {
+	// Only keyframes flush, the interval never comes around
+	_, h := newTestHandler(t, Options{FlushInterval: time.Hour, SyncInterval: time.Hour})
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnVideo(0, bytes.NewReader(avcSequenceHeader(testSPS, testPPS))); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 9; i++ {
+		if err := h.OnVideo(uint32(i*40), bytes.NewReader(avcFrame(i%5 == 0, []byte{byte(i)}))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The process dies here: no OnClose, only what was flushed is on disk
+	tags := readFLV(t, h.RecordingPath())
+	h.OnClose()
+	if len(tags) != 7 {
+		t.Fatalf("%d tags on disk, want the sequence header and frames up to the keyframe at 200", len(tags))
+	}
+	if last := tags[len(tags)-1]; last.Timestamp != 200 || !isVideoKeyframe(last.Data.(*flvtag.VideoData)) {
+		t.Errorf("Last tag on disk is %+v, want the keyframe at 200", last)
+	}
+	// Closing flushes the rest
+	if tags := readFLV(t, h.RecordingPath()); len(tags) != 10 {
+		t.Errorf("%d tags recorded after OnClose, want 10", len(tags))
+	}
+}
+
+func TestDetectionFramesSavedAsJPEG(t *testing.T) {
+	sample := sampleFLV(t)
+	outputDir := t.TempDir()
+	s, err := NewServer(Options{
+		OutputDir: outputDir,
+		NewDetector: func() (Detector, error) {
+			return &fixedDetector{detections: []Detection{{Rect: image.Rect(8, 8, 48, 48), Label: "waldo", Score: 0.9}}}, nil
+		},
+		Vision:                   VisionConfig{Headless: true},
+		DetectionFramesPerMinute: 1000,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.newHandler()
+	h.limits = s.limits
+	if err := replayFLV(sample, h); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every frame saved is listed in the timeline, and decodes at the stream's picture size
+	entries, _, err := ReadTimeline(timelinePath(h.RecordingPath()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	width, height := int(h.stats.Width.Load()), int(h.stats.Height.Load())
+	var saved int
+	for _, e := range entries {
+		if e.Thumbnail == "" {
+			continue
+		}
+		saved++
+		if dir := filepath.Join(outputDir, h.fileName, "detections"); filepath.Dir(e.Thumbnail) != dir {
+			t.Errorf("Frame saved as %s, want it in %s", e.Thumbnail, dir)
+		}
+		f, err := os.Open(e.Thumbnail)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := jpeg.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", e.Thumbnail, err)
+		}
+		if size := img.Bounds().Size(); size.X != width || size.Y != height {
+			t.Errorf("%s is %v, want %dx%d", e.Thumbnail, size, width, height)
+		}
+	}
+	if saved == 0 {
+		t.Error("No detection frame saved")
+	}
+}
+
+func TestSaveDetectionFrameToSaveDir(t *testing.T) {
+	saveDir := t.TempDir()
+	_, h := newTestHandler(t, Options{DetectionSaveDir: saveDir, DetectionFramesPerMinute: 60})
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "live/cam"}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.OnClose()
+
+	frame := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(0, 0, 255, 0), 48, 64, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+	p := h.saveDetectionFrame(frame, 1234)
+	if want := filepath.Join(saveDir, "live_cam", "1234.jpg"); p != want {
+		t.Fatalf("Saved as %q, want %q", p, want)
+	}
+	b, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := jpeg.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := img.Bounds().Size(); size != image.Pt(64, 48) {
+		t.Errorf("Saved frame is %v, want 64x48", size)
+	}
+
+	// At most one a second
+	if p := h.saveDetectionFrame(frame, 1274); p != "" {
+		t.Errorf("Second frame within a second saved as %s", p)
+	}
+
+	// Without a save dir, next to the recordings
+	s, h := newTestHandler(t, Options{DetectionFramesPerMinute: 60})
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "live/cam"}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.OnClose()
+	if p, want := h.saveDetectionFrame(frame, 1234), filepath.Join(s.opts.OutputDir, "live_cam", "detections", "1234.jpg"); p != want {
+		t.Errorf("Saved as %q, want %q", p, want)
+	}
+}
+
+func TestOutputPathsUseFileName(t *testing.T) {
+	hlsDir := t.TempDir()
+	s, h := newTestHandler(t, Options{HLSDir: hlsDir, MaxThumbnails: 10})
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "live/cam1"}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.OnClose()
+	h.saveThumbnails(40, [][]byte{{0xff, 0xd8, 0xff, 0xd9}})
+
+	// Nested names are flattened like the recording's, never turned into directories
+	for _, p := range []string{filepath.Join(hlsDir, "live_cam1"), filepath.Join(s.opts.OutputDir, "live_cam1", "faces", "40_0.jpg")} {
+		if _, err := os.Stat(p); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, p := range []string{filepath.Join(hlsDir, "live"), filepath.Join(s.opts.OutputDir, "live", "cam1")} {
+		if _, err := os.Stat(p); err == nil {
+			t.Errorf("%s created from the raw stream name", p)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package waldo
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+// FLV codec id that encoders (ffmpeg forks, OBS plugins, SRS) use for HEVC in legacy RTMP.
+// go-flv does not know it, so the AVC style packet header is left in the tag body
+const codecIDHEVC flvtag.CodecID = 12
+
+// Human readable name of an FLV video codec id
+func videoCodecName(id flvtag.CodecID) string {
+	switch id {
+	case flvtag.CodecIDJPEG:
+		return "JPEG"
+	case flvtag.CodecIDSorensonH263:
+		return "Sorenson H.263"
+	case flvtag.CodecIDScreenVideo, flvtag.CodecIDScreenVideoVersion2:
+		return "Screen Video"
+	case flvtag.CodecIDOn2VP6, flvtag.CodecIDOn2VP6WithAlphaChannel:
+		return "On2 VP6"
+	case flvtag.CodecIDAVC:
+		return "H.264"
+	case codecIDHEVC:
+		return "HEVC"
+	}
+
+	return "unknown"
+}
+
+// Split the packet type and composition time off an HEVC tag body
+func splitHEVCPacket(body []byte) (flvtag.AVCPacketType, []byte, error) {
+	if len(body) < 4 {
+		return 0, nil, errors.New("Truncated HEVC packet header")
+	}
+
+	return flvtag.AVCPacketType(body[0]), body[4:], nil
+}
+
+// HEVCDecoderConfig The HEVCDecoderConfigurationRecord sent in an HEVC sequence header
+type HEVCDecoderConfig struct {
+	LengthSize int // Bytes in each NALU length prefix
+	VPS        [][]byte
+	SPS        [][]byte
+	PPS        [][]byte
+}
+
+// HEVC NAL unit types of the parameter sets
+const (
+	hevcNALUTypeVPS = 32
+	hevcNALUTypeSPS = 33
+	hevcNALUTypePPS = 34
+)
+
+// Parse an HEVCDecoderConfigurationRecord (ISO/IEC 14496-15)
+func parseHEVCDecoderConfig(data []byte) (*HEVCDecoderConfig, error) {
+	if len(data) < 23 || data[0] != 1 {
+		return nil, errors.New("Invalid HEVCDecoderConfigurationRecord")
+	}
+
+	cfg := &HEVCDecoderConfig{
+		LengthSize: int(data[21]&0x03) + 1,
+	}
+
+	p := data[23:]
+	for i := 0; i < int(data[22]); i++ {
+		if len(p) < 3 {
+			return nil, errors.New("Truncated parameter set array")
+		}
+		naluType := p[0] & 0x3f
+		count := int(binary.BigEndian.Uint16(p[1:]))
+		p = p[3:]
+
+		for j := 0; j < count; j++ {
+			if len(p) < 2 {
+				return nil, errors.New("Truncated parameter set length")
+			}
+			n := int(binary.BigEndian.Uint16(p))
+			p = p[2:]
+			if n > len(p) {
+				return nil, errors.New("Truncated parameter set")
+			}
+			set := append([]byte(nil), p[:n]...)
+			p = p[n:]
+
+			switch naluType {
+			case hevcNALUTypeVPS:
+				cfg.VPS = append(cfg.VPS, set)
+			case hevcNALUTypeSPS:
+				cfg.SPS = append(cfg.SPS, set)
+			case hevcNALUTypePPS:
+				cfg.PPS = append(cfg.PPS, set)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// Write VPS, SPS and PPS as Annex-B NAL units, so a decoder can start from the next picture
+func (c *HEVCDecoderConfig) annexBHeader() []byte {
+	out := new(bytes.Buffer)
+	for _, sets := range [][][]byte{c.VPS, c.SPS, c.PPS} {
+		for _, set := range sets {
+			out.Write(annexBStartCode)
+			out.Write(set)
+		}
+	}
+
+	return out.Bytes()
+}
+
+// Convert an HEVC NALU payload to Annex-B, optionally preceded by the VPS/SPS/PPS from the sequence header
+func hevcToAnnexB(cfg *HEVCDecoderConfig, data []byte, withParamSets bool) ([]byte, error) {
+	stream := new(bytes.Buffer)
+	if withParamSets {
+		stream.Write(cfg.annexBHeader())
+	}
+
+	if isAnnexB(data) {
+		stream.Write(data)
+	} else {
+		annexB, err := avccToAnnexB(data, cfg.LengthSize)
+		if err != nil {
+			return nil, errors.Wrap(err, "Malformed HEVC payload")
+		}
+		stream.Write(annexB)
+	}
+
+	return stream.Bytes(), nil
+}
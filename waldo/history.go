@@ -0,0 +1,51 @@
+package waldo
+
+import (
+	"sync"
+)
+
+// DetectionHistory Fixed-size ring buffer of the most recent detections, safe for concurrent use
+type DetectionHistory struct {
+	mu   sync.RWMutex
+	buf  []DetectionResult
+	next int
+	full bool
+}
+
+func NewDetectionHistory(size int) *DetectionHistory {
+	if size < 1 {
+		size = 1
+	}
+
+	return &DetectionHistory{
+		buf: make([]DetectionResult, size),
+	}
+}
+
+// Append detections, overwriting the oldest once full
+func (d *DetectionHistory) Add(results ...DetectionResult) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, r := range results {
+		d.buf[d.next] = r
+		d.next = (d.next + 1) % len(d.buf)
+		if d.next == 0 {
+			d.full = true
+		}
+	}
+}
+
+// Buffered detections, oldest first
+func (d *DetectionHistory) Snapshot() []DetectionResult {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if !d.full {
+		return append([]DetectionResult(nil), d.buf[:d.next]...)
+	}
+
+	out := make([]DetectionResult, 0, len(d.buf))
+	out = append(out, d.buf[d.next:]...)
+	return append(out, d.buf[:d.next]...)
+}
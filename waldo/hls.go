@@ -0,0 +1,439 @@
+package waldo
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// MPEG-TS layout of every segment: one program with H.264 video and, once seen, AAC audio
+const (
+	tsPacketSize = 188
+	tsPIDPAT     = 0x0000
+	tsPIDPMT     = 0x1000
+	tsPIDVideo   = 0x0100
+	tsPIDAudio   = 0x0101
+
+	tsStreamTypeH264 = 0x1b
+	tsStreamTypeAAC  = 0x0f
+)
+
+// tsMuxer Writes PES packets as MPEG-TS. Continuity counters carry over from one segment to the next
+type tsMuxer struct {
+	w          io.Writer
+	continuity map[uint16]byte
+}
+
+func newTSMuxer() *tsMuxer {
+	return &tsMuxer{continuity: make(map[uint16]byte)}
+}
+
+// Write the PAT and PMT, which every segment has to start with
+func (m *tsMuxer) writeTables(audio bool) error {
+	pat := []byte{
+		0x00,       // table_id
+		0xb0, 0x0d, // section_syntax_indicator, section_length 13
+		0x00, 0x01, // transport_stream_id
+		0xc1,       // version 0, current_next
+		0x00, 0x00, // section_number, last_section_number
+		0x00, 0x01, // program_number 1
+		0xe0 | tsPIDPMT>>8, tsPIDPMT & 0xff,
+	}
+	if err := m.writeSection(tsPIDPAT, pat); err != nil {
+		return err
+	}
+
+	streams := [][]byte{{tsStreamTypeH264, 0xe0 | tsPIDVideo>>8, tsPIDVideo & 0xff, 0xf0, 0x00}}
+	if audio {
+		streams = append(streams, []byte{tsStreamTypeAAC, 0xe0 | tsPIDAudio>>8, tsPIDAudio & 0xff, 0xf0, 0x00})
+	}
+	sectionLength := 13 + 5*len(streams)
+	pmt := []byte{
+		0x02, // table_id
+		0xb0 | byte(sectionLength>>8), byte(sectionLength),
+		0x00, 0x01, // program_number
+		0xc1,
+		0x00, 0x00,
+		0xe0 | tsPIDVideo>>8, tsPIDVideo & 0xff, // PCR PID
+		0xf0, 0x00, // program_info_length
+	}
+	for _, s := range streams {
+		pmt = append(pmt, s...)
+	}
+
+	return m.writeSection(tsPIDPMT, pmt)
+}
+
+// Write a PSI section, with its CRC, in a single packet
+func (m *tsMuxer) writeSection(pid uint16, section []byte) error {
+	crc := mpegCRC32(section)
+	payload := append([]byte{0x00}, section...) // pointer_field
+	payload = append(payload, byte(crc>>24), byte(crc>>16), byte(crc>>8), byte(crc))
+
+	return m.writePackets(pid, payload, true, -1, false)
+}
+
+// Wrap an elementary stream frame in a PES packet. Timestamps are in 90 kHz units, dts < 0 omits it
+func (m *tsMuxer) writePES(pid uint16, streamID byte, pts, dts int64, data []byte, keyframe bool) error {
+	header := []byte{0x00, 0x00, 0x01, streamID, 0x00, 0x00, 0x80, 0x80, 0x05}
+	if dts >= 0 && dts != pts {
+		header[7] = 0xc0
+		header[8] = 0x0a
+	}
+	header = append(header, pesTimestamp(header[7]>>6, pts)...)
+	if header[7] == 0xc0 {
+		header = append(header, pesTimestamp(0x01, dts)...)
+	}
+
+	// Video may exceed the 16 bit length, 0 leaves it unbounded
+	if n := len(header) - 6 + len(data); n <= math.MaxUint16 && streamID != 0xe0 {
+		header[4], header[5] = byte(n>>8), byte(n)
+	}
+
+	pcr := int64(-1)
+	if pid == tsPIDVideo {
+		pcr = dts
+		if pcr < 0 {
+			pcr = pts
+		}
+	}
+
+	return m.writePackets(pid, append(header, data...), false, pcr, keyframe)
+}
+
+// The 5 byte PTS/DTS field
+func pesTimestamp(marker byte, ts int64) []byte {
+	return []byte{
+		marker<<4 | byte(ts>>29)&0x0e | 0x01,
+		byte(ts >> 22),
+		byte(ts>>14) | 0x01,
+		byte(ts >> 7),
+		byte(ts<<1) | 0x01,
+	}
+}
+
+// Split payload into transport packets. The first one carries the PCR (when pcr >= 0) and the random
+// access flag, the last one is padded with adaptation field stuffing
+func (m *tsMuxer) writePackets(pid uint16, payload []byte, psi bool, pcr int64, keyframe bool) error {
+	first := true
+	for len(payload) > 0 || first {
+		pkt := make([]byte, 4, tsPacketSize)
+		pkt[0] = 0x47
+		pkt[1] = byte(pid>>8) & 0x1f
+		if first {
+			pkt[1] |= 0x40 // payload_unit_start_indicator
+		}
+		pkt[2] = byte(pid)
+		cc := m.continuity[pid]
+		m.continuity[pid] = (cc + 1) & 0x0f
+
+		var adaptation []byte
+		if first && (pcr >= 0 || keyframe) {
+			flags := byte(0)
+			if keyframe {
+				flags |= 0x40
+			}
+			adaptation = []byte{flags}
+			if pcr >= 0 {
+				adaptation[0] |= 0x10
+				adaptation = append(adaptation,
+					byte(pcr>>25), byte(pcr>>17), byte(pcr>>9), byte(pcr>>1), byte(pcr<<7)|0x7e, 0x00)
+			}
+		}
+
+		room := tsPacketSize - 4
+		if adaptation != nil {
+			room -= 1 + len(adaptation)
+		}
+		if len(payload) < room && !psi {
+			// Stuff the adaptation field so the payload ends the packet
+			if adaptation == nil {
+				adaptation = []byte{}
+				room-- // Its length byte
+				if len(payload) < room {
+					adaptation = append(adaptation, 0x00)
+					room--
+				}
+			}
+			for len(payload) < room {
+				adaptation = append(adaptation, 0xff)
+				room--
+			}
+		}
+
+		if adaptation != nil {
+			pkt[3] = 0x30 | cc
+			pkt = append(pkt, byte(len(adaptation)))
+			pkt = append(pkt, adaptation...)
+		} else {
+			pkt[3] = 0x10 | cc
+		}
+
+		n := min(room, len(payload))
+		pkt = append(pkt, payload[:n]...)
+		payload = payload[n:]
+		for len(pkt) < tsPacketSize {
+			pkt = append(pkt, 0xff) // PSI sections are padded after the CRC
+		}
+
+		if _, err := m.w.Write(pkt); err != nil {
+			return err
+		}
+		first = false
+	}
+
+	return nil
+}
+
+var mpegCRCTable = func() (t [256]uint32) {
+	for i := range t {
+		c := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if c&0x80000000 != 0 {
+				c = c<<1 ^ 0x04c11db7
+			} else {
+				c <<= 1
+			}
+		}
+		t[i] = c
+	}
+	return t
+}()
+
+// CRC-32/MPEG-2 of a PSI section
+func mpegCRC32(data []byte) uint32 {
+	crc := uint32(0xffffffff)
+	for _, b := range data {
+		crc = crc<<8 ^ mpegCRCTable[byte(crc>>24)^b]
+	}
+
+	return crc
+}
+
+// Prepend an ADTS header, so raw AAC frames from FLV can be carried in MPEG-TS
+func adtsFrame(asc []byte, frame []byte) ([]byte, error) {
+	if len(asc) < 2 {
+		return nil, errors.New("AudioSpecificConfig too short")
+	}
+	objectType := asc[0] >> 3
+	freqIndex := (asc[0]&0x07)<<1 | asc[1]>>7
+	channels := (asc[1] >> 3) & 0x0f
+	if objectType == 0 || objectType > 4 {
+		objectType = 2 // ADTS can only signal the first four profiles, AAC-LC is the safe choice
+	}
+
+	n := len(frame) + 7
+	header := []byte{
+		0xff, 0xf1,
+		(objectType-1)<<6 | freqIndex<<2 | channels>>2,
+		(channels&0x03)<<6 | byte(n>>11),
+		byte(n >> 3),
+		byte(n&0x07)<<5 | 0x1f,
+		0xfc,
+	}
+
+	return append(header, frame...), nil
+}
+
+// Access unit delimiter, which some players need in front of every H.264 picture
+var annexBAUD = []byte{0x00, 0x00, 0x00, 0x01, 0x09, 0xf0}
+
+// hlsSegment A finished segment listed in the playlist
+type hlsSegment struct {
+	name     string
+	duration float64 // Seconds
+}
+
+// HLSSegmenter Cuts a stream into MPEG-TS segments at keyframes and keeps a sliding window playlist.m3u8
+// in dir. Not safe for concurrent use, it is fed from the RTMP read loop
+type HLSSegmenter struct {
+	dir            string
+	targetDuration uint32 // Milliseconds
+	window         int
+
+	mux      *tsMuxer
+	file     *os.File
+	buf      *bufio.Writer
+	seq      int // Number of the next segment
+	start    uint32
+	last     uint32
+	open     bool
+	segments []hlsSegment
+
+	avcConfig *AVCDecoderConfig
+	aacConfig []byte
+	hasVideo  bool
+}
+
+// Segments of about targetDuration, window of them kept in the playlist
+func NewHLSSegmenter(dir string, targetDuration uint32, window int) (*HLSSegmenter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "Failed to create HLS directory")
+	}
+	if window < 1 {
+		window = 1
+	}
+
+	return &HLSSegmenter{dir: dir, targetDuration: targetDuration, window: window, mux: newTSMuxer()}, nil
+}
+
+// Add a video tag body, AVC packet header already stripped. Other codecs are not supported
+func (s *HLSSegmenter) WriteVideo(timestamp uint32, compositionTime int32, keyframe bool, sequenceHeader bool, data []byte) error {
+	if sequenceHeader {
+		cfg, err := parseAVCDecoderConfig(data)
+		if err != nil {
+			return err
+		}
+		s.avcConfig = cfg
+		return nil
+	}
+	if s.avcConfig == nil {
+		return nil
+	}
+	s.hasVideo = true
+
+	if keyframe && (!s.open || timestamp-s.start >= s.targetDuration) {
+		if err := s.startSegment(timestamp); err != nil {
+			return err
+		}
+	}
+	if !s.open {
+		// Segments have to start with a keyframe
+		return nil
+	}
+
+	annexB, err := toAnnexB(s.avcConfig, data, keyframe)
+	if err != nil {
+		return err
+	}
+	dts := int64(timestamp) * 90
+	pts := dts + int64(compositionTime)*90
+	s.last = timestamp
+
+	return s.mux.writePES(tsPIDVideo, 0xe0, pts, dts, append(append([]byte(nil), annexBAUD...), annexB...), keyframe)
+}
+
+// Add an AAC tag body, packet type already stripped. Audio-only streams are cut on duration alone
+func (s *HLSSegmenter) WriteAudio(timestamp uint32, sequenceHeader bool, data []byte) error {
+	if sequenceHeader {
+		s.aacConfig = append([]byte(nil), data...)
+		return nil
+	}
+	if s.aacConfig == nil {
+		return nil
+	}
+
+	if !s.hasVideo && (!s.open || timestamp-s.start >= s.targetDuration) {
+		if err := s.startSegment(timestamp); err != nil {
+			return err
+		}
+	}
+	if !s.open {
+		return nil
+	}
+
+	frame, err := adtsFrame(s.aacConfig, data)
+	if err != nil {
+		return err
+	}
+	pts := int64(timestamp) * 90
+	if timestamp > s.last {
+		s.last = timestamp
+	}
+
+	return s.mux.writePES(tsPIDAudio, 0xc0, pts, -1, frame, false)
+}
+
+// Finish the current segment and open the next, starting at timestamp
+func (s *HLSSegmenter) startSegment(timestamp uint32) error {
+	if err := s.finishSegment(timestamp, false); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("segment%d.ts", s.seq)
+	f, err := os.Create(filepath.Join(s.dir, name))
+	if err != nil {
+		return errors.Wrap(err, "Failed to create HLS segment")
+	}
+	s.seq++
+	s.file = f
+	s.buf = bufio.NewWriterSize(f, 64*1024)
+	s.mux.w = s.buf
+	s.start = timestamp
+	s.last = timestamp
+	s.open = true
+
+	return s.mux.writeTables(s.aacConfig != nil)
+}
+
+// Close the open segment, lasting until end, list it and drop segments that left the window
+func (s *HLSSegmenter) finishSegment(end uint32, final bool) error {
+	if !s.open {
+		if final {
+			return s.writePlaylist(true)
+		}
+		return nil
+	}
+	s.open = false
+
+	err := s.buf.Flush()
+	if cerr := s.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to write HLS segment")
+	}
+
+	s.segments = append(s.segments, hlsSegment{
+		name:     filepath.Base(s.file.Name()),
+		duration: float64(end-s.start) / 1000,
+	})
+	for len(s.segments) > s.window {
+		_ = os.Remove(filepath.Join(s.dir, s.segments[0].name))
+		s.segments = s.segments[1:]
+	}
+
+	return s.writePlaylist(final)
+}
+
+// Replace playlist.m3u8. Written to a temporary file first, so readers never see half of it
+func (s *HLSSegmenter) writePlaylist(final bool) error {
+	target := float64(s.targetDuration) / 1000
+	for _, seg := range s.segments {
+		target = math.Max(target, seg.duration)
+	}
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(target)))
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", s.seq-len(s.segments))
+	for _, seg := range s.segments {
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", seg.duration, seg.name)
+	}
+	if final {
+		b.WriteString("#EXT-X-ENDLIST\n")
+	}
+
+	p := filepath.Join(s.dir, "playlist.m3u8")
+	if err := os.WriteFile(p+".tmp", []byte(b.String()), 0644); err != nil {
+		return errors.Wrap(err, "Failed to write HLS playlist")
+	}
+
+	return errors.Wrap(os.Rename(p+".tmp", p), "Failed to write HLS playlist")
+}
+
+// Finish the last segment and mark the playlist as ended
+func (s *HLSSegmenter) Close() error {
+	return s.finishSegment(s.last, true)
+}
+
+// Delete the stream's directory, with the playlist and every segment. Call after Close
+func (s *HLSSegmenter) Remove() error {
+	return errors.Wrap(os.RemoveAll(s.dir), "Failed to delete HLS directory")
+}
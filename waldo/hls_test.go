@@ -0,0 +1,121 @@
+package waldo
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The segments listed in dir's playlist, and its media sequence number
+func readPlaylist(t *testing.T, dir string) ([]string, int, bool) {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(dir, "playlist.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var segments []string
+	seq, ended := -1, false
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		switch {
+		case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
+			seq, err = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
+			if err != nil {
+				t.Fatalf("Bad media sequence %q", line)
+			}
+		case line == "#EXT-X-ENDLIST":
+			ended = true
+		case !strings.HasPrefix(line, "#"):
+			segments = append(segments, line)
+		}
+	}
+
+	return segments, seq, ended
+}
+
+// Whether the first video packet of a TS segment is a random access point carrying an IDR picture
+func segmentStartsWithKeyframe(t *testing.T, p string) bool {
+	t.Helper()
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) == 0 || len(data)%tsPacketSize != 0 {
+		t.Fatalf("%s is %d bytes, not whole TS packets", p, len(data))
+	}
+
+	for ; len(data) > 0; data = data[tsPacketSize:] {
+		pkt := data[:tsPacketSize]
+		pid := uint16(pkt[1]&0x1f)<<8 | uint16(pkt[2])
+		if pkt[0] != 0x47 || pid != tsPIDVideo || pkt[1]&0x40 == 0 {
+			continue
+		}
+		payload := pkt[4:]
+		randomAccess := false
+		if pkt[3]&0x20 != 0 {
+			randomAccess = payload[0] > 0 && payload[1]&0x40 != 0
+			payload = payload[1+int(payload[0]):]
+		}
+
+		return randomAccess && bytes.Contains(payload, []byte{0, 0, 1, 0x65})
+	}
+
+	return false
+}
+
+func TestHLSSegmenter(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewHLSSegmenter(dir, 1000, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Bodies with the 5 byte AVC packet header stripped, as writeHLSLocked passes them
+	if err := s.WriteVideo(0, 0, true, true, avcSequenceHeader(testSPS, testPPS)[5:]); err != nil {
+		t.Fatal(err)
+	}
+	// 10s at 25 fps with a keyframe every 400ms, so segments are cut at 1.2s
+	for i := 0; i < 250; i++ {
+		keyframe := i%10 == 0
+		if err := s.WriteVideo(uint32(i*40), 0, keyframe, false, avcFrame(keyframe, []byte{byte(i)})[5:]); err != nil {
+			t.Fatal(err)
+		}
+
+		if i == 100 {
+			// Live, the window is full and rolled over
+			segments, seq, ended := readPlaylist(t, dir)
+			if len(segments) != 3 || seq != 0 || ended {
+				t.Fatalf("Live playlist lists %v from %d, ended %v, want 3 segments from 0", segments, seq, ended)
+			}
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, seq, ended := readPlaylist(t, dir)
+	if !ended {
+		t.Error("Closed playlist has no #EXT-X-ENDLIST")
+	}
+	// 250 frames in 1.2s segments make 9, the window keeps the last 3
+	if want := []string{"segment6.ts", "segment7.ts", "segment8.ts"}; strings.Join(segments, ",") != strings.Join(want, ",") || seq != 6 {
+		t.Fatalf("Playlist lists %v from %d, want %v from 6", segments, seq, want)
+	}
+	for _, name := range segments {
+		if !segmentStartsWithKeyframe(t, filepath.Join(dir, name)) {
+			t.Errorf("%s does not start with a keyframe", name)
+		}
+	}
+
+	// Segments out of the window are deleted
+	files, err := filepath.Glob(filepath.Join(dir, "*.ts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != len(segments) {
+		t.Errorf("%d segments on disk, the playlist lists %d", len(files), len(segments))
+	}
+}
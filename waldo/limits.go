@@ -0,0 +1,78 @@
+package waldo
+
+import (
+	"sync"
+)
+
+// ConnLimiter Caps the RTMP connections open at once, and the streams published at once with
+// the same stream key. Zero limits are unlimited. Safe for concurrent use, and nil admits everyone
+type ConnLimiter struct {
+	MaxConns           int
+	MaxPublishesPerKey int // Publishes without a key are not limited, their stream names are unique anyway
+
+	mu        sync.Mutex
+	conns     int
+	publishes map[string]int
+}
+
+// Admit a new connection, which must be released with ReleaseConn. False when too many are open
+func (l *ConnLimiter) AcquireConn() bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.MaxConns > 0 && l.conns >= l.MaxConns {
+		return false
+	}
+	l.conns++
+
+	return true
+}
+
+func (l *ConnLimiter) ReleaseConn() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.conns--
+}
+
+// Admit a publish with key, which must be released with ReleasePublish.
+// False when the key is already publishing MaxPublishesPerKey streams
+func (l *ConnLimiter) AcquirePublish(key string) bool {
+	if l == nil || key == "" {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.MaxPublishesPerKey > 0 && l.publishes[key] >= l.MaxPublishesPerKey {
+		return false
+	}
+	if l.publishes == nil {
+		l.publishes = make(map[string]int)
+	}
+	l.publishes[key]++
+
+	return true
+}
+
+func (l *ConnLimiter) ReleasePublish(key string) {
+	if l == nil || key == "" {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.publishes[key]--; l.publishes[key] <= 0 {
+		delete(l.publishes, key)
+	}
+}
@@ -0,0 +1,57 @@
+package waldo
+
+import "testing"
+
+func TestConnLimiterConns(t *testing.T) {
+	l := &ConnLimiter{MaxConns: 2}
+	if !l.AcquireConn() || !l.AcquireConn() {
+		t.Fatal("Refused a connection below the limit")
+	}
+	if l.AcquireConn() {
+		t.Fatal("Admitted a connection over the limit")
+	}
+	l.ReleaseConn()
+	if !l.AcquireConn() {
+		t.Error("Refused a connection after one was released")
+	}
+}
+
+func TestConnLimiterPublishes(t *testing.T) {
+	l := &ConnLimiter{MaxPublishesPerKey: 1}
+	if !l.AcquirePublish("k1") {
+		t.Fatal("Refused the first publish with a key")
+	}
+	if l.AcquirePublish("k1") {
+		t.Error("Admitted a second publish with the same key")
+	}
+	if !l.AcquirePublish("k2") {
+		t.Error("Refused a publish with another key")
+	}
+	for range 3 {
+		if !l.AcquirePublish("") {
+			t.Fatal("Limited publishes without a key")
+		}
+	}
+
+	l.ReleasePublish("k1")
+	if !l.AcquirePublish("k1") {
+		t.Error("Refused a publish after the key's last one was released")
+	}
+	l.ReleasePublish("k1")
+	l.ReleasePublish("k2")
+	if len(l.publishes) != 0 {
+		t.Errorf("Released keys are still tracked: %v", l.publishes)
+	}
+}
+
+func TestConnLimiterUnlimited(t *testing.T) {
+	for _, l := range []*ConnLimiter{nil, {}} {
+		for range 10 {
+			if !l.AcquireConn() || !l.AcquirePublish("k") {
+				t.Fatalf("Limiter %+v refused, want everyone admitted", l)
+			}
+		}
+		l.ReleaseConn()
+		l.ReleasePublish("k")
+	}
+}
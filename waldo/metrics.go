@@ -0,0 +1,149 @@
+package waldo
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Metrics Process-wide counters for /metrics. Unlike StreamStats they outlive the streams feeding them
+type Metrics struct {
+	ActiveConnections atomic.Int64
+	AudioTags         atomic.Uint64
+	VideoTags         atomic.Uint64
+	ScriptTags        atomic.Uint64
+	BytesReceived     atomic.Uint64
+	WriteErrors       atomic.Uint64 // Failed recording writes, including the ones not logged
+	CVFramesProcessed atomic.Uint64
+	CVFramesDropped   atomic.Uint64
+	CVDuration        *Histogram // Seconds spent on each processed frame
+
+	ConnectionsRejected atomic.Uint64 // Over the connection limit
+	PublishesRejected   atomic.Uint64 // Over the per stream key limit
+	IdleDisconnects     atomic.Uint64 // Closed by the idle timeout
+	WebhooksDropped     atomic.Uint64 // Notifications dropped with the webhook queue full
+
+	// Detections by stream name. Every stream ever published gets a series,
+	// so names are only kept with streamLabels set and everything is summed under "" otherwise
+	streamLabels bool
+	mu           sync.Mutex
+	detections   map[string]uint64
+}
+
+// Bounds of the CV duration buckets, in seconds
+var cvDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+func NewMetrics(streamLabels bool) *Metrics {
+	return &Metrics{
+		CVDuration:   NewHistogram(cvDurationBuckets),
+		streamLabels: streamLabels,
+		detections:   make(map[string]uint64),
+	}
+}
+
+// Count detections found on stream
+func (m *Metrics) AddDetections(stream string, n int) {
+	if n == 0 {
+		return
+	}
+	if !m.streamLabels {
+		stream = ""
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.detections[stream] += uint64(n)
+}
+
+// Render the metrics in the Prometheus text exposition format
+func (m *Metrics) Write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP waldo_active_connections RTMP connections currently open.\n")
+	fmt.Fprintf(w, "# TYPE waldo_active_connections gauge\n")
+	fmt.Fprintf(w, "waldo_active_connections %d\n", m.ActiveConnections.Load())
+
+	fmt.Fprintf(w, "# HELP waldo_tags_received_total FLV tags received, by type.\n")
+	fmt.Fprintf(w, "# TYPE waldo_tags_received_total counter\n")
+	fmt.Fprintf(w, "waldo_tags_received_total{type=\"audio\"} %d\n", m.AudioTags.Load())
+	fmt.Fprintf(w, "waldo_tags_received_total{type=\"video\"} %d\n", m.VideoTags.Load())
+	fmt.Fprintf(w, "waldo_tags_received_total{type=\"script\"} %d\n", m.ScriptTags.Load())
+
+	counters := []struct {
+		name, help string
+		value      uint64
+	}{
+		{"waldo_bytes_received_total", "Bytes of audio, video and metadata received by all streams.", m.BytesReceived.Load()},
+		{"waldo_flv_write_errors_total", "Failed writes to recordings.", m.WriteErrors.Load()},
+		{"waldo_cv_frames_processed_total", "Frames run through computer vision.", m.CVFramesProcessed.Load()},
+		{"waldo_cv_frames_dropped_total", "Keyframes dropped because a CV queue was full.", m.CVFramesDropped.Load()},
+		{"waldo_connections_rejected_total", "RTMP connections refused over -max-connections.", m.ConnectionsRejected.Load()},
+		{"waldo_publishes_rejected_total", "Publishes refused over -max-publishes-per-key.", m.PublishesRejected.Load()},
+		{"waldo_idle_disconnects_total", "Connections closed after sending no media for -stream-timeout.", m.IdleDisconnects.Load()},
+		{"waldo_webhooks_dropped_total", "Webhook notifications dropped because the queue was full.", m.WebhooksDropped.Load()},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+		fmt.Fprintf(w, "%s %d\n", c.name, c.value)
+	}
+
+	m.CVDuration.Write(w, "waldo_cv_process_duration_seconds", "Time spent decoding, analysing and re-encoding a frame.")
+
+	m.mu.Lock()
+	streams := make([]string, 0, len(m.detections))
+	for stream := range m.detections {
+		streams = append(streams, stream)
+	}
+	sort.Strings(streams)
+	fmt.Fprintf(w, "# HELP waldo_detections_total Objects detected.\n")
+	fmt.Fprintf(w, "# TYPE waldo_detections_total counter\n")
+	if !m.streamLabels {
+		fmt.Fprintf(w, "waldo_detections_total %d\n", m.detections[""])
+	} else {
+		for _, stream := range streams {
+			fmt.Fprintf(w, "waldo_detections_total{stream=\"%s\"} %d\n", escapeLabel(stream), m.detections[stream])
+		}
+	}
+	m.mu.Unlock()
+}
+
+// Histogram Cumulative Prometheus histogram over fixed buckets, safe for concurrent use
+type Histogram struct {
+	bounds []float64
+
+	mu     sync.Mutex
+	counts []uint64 // Per bucket, not cumulative, the last one is +Inf
+	sum    float64
+}
+
+// bounds must be sorted ascending
+func NewHistogram(bounds []float64) *Histogram {
+	return &Histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.counts[i]++
+	h.sum += v
+}
+
+func (h *Histogram) Write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var total uint64
+	for i, bound := range h.bounds {
+		total += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%g\"} %d\n", name, bound, total)
+	}
+	total += h.counts[len(h.bounds)]
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, total)
+	fmt.Fprintf(w, "%s_sum %g\n", name, h.sum)
+	fmt.Fprintf(w, "%s_count %d\n", name, total)
+}
@@ -0,0 +1,102 @@
+package waldo
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/yutopp/go-amf0"
+	flvtag "github.com/yutopp/go-flv/tag"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+// Scrape /metrics into series (name with labels) and values
+func scrapeMetrics(t *testing.T, api http.Handler) map[string]float64 {
+	t.Helper()
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /metrics: status %d", w.Code)
+	}
+
+	series := make(map[string]float64)
+	sc := bufio.NewScanner(w.Body)
+	for sc.Scan() {
+		line := sc.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if i < 0 || err != nil {
+			t.Fatalf("Bad metrics line %q", line)
+		}
+		series[line[:i]] = v
+	}
+
+	return series
+}
+
+func TestMetricsCountTags(t *testing.T) {
+	s, h := newTestHandler(t, Options{})
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.OnClose()
+
+	var received int
+	var script bytes.Buffer
+	if err := flvtag.EncodeScriptData(&script, &flvtag.ScriptData{Objects: map[string]amf0.ECMAArray{
+		"onMetaData": {"width": float64(64), "height": float64(64)},
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnSetDataFrame(0, &rtmpmsg.NetStreamSetDataFrame{Payload: script.Bytes()}); err != nil {
+		t.Fatal(err)
+	}
+	received += script.Len()
+
+	// 3 audio and 11 video tags: the AAC and AVC headers, then 2 samples and 10 pictures
+	tags := [][]byte{{0xaf, 0, 0x12, 0x10}, avcSequenceHeader(testSPS, testPPS)}
+	for i := 0; i < 10; i++ {
+		if i%5 == 0 {
+			tags = append(tags, []byte{0xaf, 1, byte(i)})
+		}
+		tags = append(tags, avcFrame(i == 0, []byte{byte(i)}))
+	}
+	for i, tag := range tags {
+		received += len(tag)
+		var err error
+		if tag[0] == 0xaf {
+			err = h.OnAudio(uint32(i*20), bytes.NewReader(tag))
+		} else {
+			err = h.OnVideo(uint32(i*20), bytes.NewReader(tag))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := scrapeMetrics(t, s.Handler())
+	want := map[string]float64{
+		`waldo_tags_received_total{type="audio"}`:  3,
+		`waldo_tags_received_total{type="video"}`:  11,
+		`waldo_tags_received_total{type="script"}`: 1,
+		"waldo_bytes_received_total":               float64(received),
+		"waldo_flv_write_errors_total":             0,
+		"waldo_detections_total":                   0,
+	}
+	for name, v := range want {
+		if g, ok := got[name]; !ok || g != v {
+			t.Errorf("%s = %v (present %v), want %v", name, g, ok, v)
+		}
+	}
+	// No CV in tests, but the histogram is always exposed
+	if _, ok := got[`waldo_cv_process_duration_seconds_bucket{le="+Inf"}`]; !ok {
+		t.Error("No CV duration histogram")
+	}
+}
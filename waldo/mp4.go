@@ -0,0 +1,389 @@
+package waldo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+// recordingEncoder Writes tags to a recording, flv.Encoder or MP4Encoder
+type recordingEncoder interface {
+	Encode(tag *flvtag.FlvTag) error
+}
+
+// Track ids and timescale of MP4 recordings. FLV timestamps are milliseconds, so they map 1:1
+const (
+	mp4VideoTrack = 1
+	mp4AudioTrack = 2
+	mp4Timescale  = 1000
+)
+
+// mp4Sample A sample waiting for its fragment to be written
+type mp4Sample struct {
+	dts      uint32
+	cto      int32
+	duration uint32
+	keyframe bool
+	data     []byte
+}
+
+// MP4Encoder Muxes FLV tags with H.264 video and AAC audio into a fragmented MP4, one fragment per GOP.
+// Everything up to the last complete fragment stays playable if the process dies.
+// Nothing is written until the first keyframe after the AVC sequence header, which fixes the tracks:
+// audio is only recorded when its sequence header came before that. Other codecs and script data are dropped
+type MP4Encoder struct {
+	w io.Writer
+
+	avcConfig []byte // AVCDecoderConfigurationRecord, as in the sequence header
+	width     int
+	height    int
+	aacConfig []byte // AudioSpecificConfig
+
+	started  bool
+	hasAudio bool
+	base     uint32 // Timestamp of the first keyframe, the start of the file
+	sequence uint32 // Fragments written
+
+	video []mp4Sample
+	audio []mp4Sample
+}
+
+func NewMP4Encoder(w io.Writer) *MP4Encoder {
+	return &MP4Encoder{w: w}
+}
+
+// Add a tag, writing the pending fragment when a keyframe starts the next one
+func (e *MP4Encoder) Encode(tag *flvtag.FlvTag) error {
+	switch data := tag.Data.(type) {
+	case *flvtag.VideoData:
+		if data.CodecID != flvtag.CodecIDAVC || isExVideo(data) {
+			return nil
+		}
+		body, err := io.ReadAll(data.Data)
+		if err != nil {
+			return err
+		}
+		if data.AVCPacketType == flvtag.AVCPacketTypeSequenceHeader {
+			return e.setAVCConfig(body)
+		}
+		if data.AVCPacketType != flvtag.AVCPacketTypeNALU {
+			return nil
+		}
+		return e.addVideo(tag.Timestamp, data.CompositionTime, data.FrameType == flvtag.FrameTypeKeyFrame, body)
+
+	case *flvtag.AudioData:
+		if data.SoundFormat != flvtag.SoundFormatAAC {
+			return nil
+		}
+		body, err := io.ReadAll(data.Data)
+		if err != nil {
+			return err
+		}
+		if data.AACPacketType == flvtag.AACPacketTypeSequenceHeader {
+			e.aacConfig = body
+			return nil
+		}
+		if !e.hasAudio || tag.Timestamp < e.base {
+			return nil
+		}
+		e.audio = appendSample(e.audio, mp4Sample{dts: tag.Timestamp - e.base, data: body, keyframe: true})
+	}
+
+	return nil
+}
+
+func (e *MP4Encoder) setAVCConfig(body []byte) error {
+	cfg, err := parseAVCDecoderConfig(body)
+	if err != nil {
+		return err
+	}
+	if e.started && (cfg.ParsedWidth != e.width || cfg.ParsedHeight != e.height) {
+		// The sample description is fixed once written, this needs a new recording
+		return errors.New("Video size changed mid-stream, which MP4 recordings cannot follow")
+	}
+	e.avcConfig = body
+	e.width, e.height = cfg.ParsedWidth, cfg.ParsedHeight
+
+	return nil
+}
+
+func (e *MP4Encoder) addVideo(timestamp uint32, cto int32, keyframe bool, body []byte) error {
+	if !e.started {
+		if !keyframe || e.avcConfig == nil {
+			return nil
+		}
+		e.started = true
+		e.base = timestamp
+		e.hasAudio = e.aacConfig != nil
+		if _, err := e.w.Write(e.header()); err != nil {
+			return err
+		}
+	}
+	if timestamp < e.base {
+		return nil
+	}
+
+	if keyframe && len(e.video) > 0 {
+		// The keyframe's timestamp ends the last picture of the GOP
+		last := &e.video[len(e.video)-1]
+		last.duration = timestamp - e.base - last.dts
+		if err := e.writeFragment(); err != nil {
+			return err
+		}
+	}
+	e.video = appendSample(e.video, mp4Sample{dts: timestamp - e.base, cto: cto, keyframe: keyframe, data: body})
+
+	return nil
+}
+
+// Append a sample, which gives the one before it its duration
+func appendSample(samples []mp4Sample, s mp4Sample) []mp4Sample {
+	if n := len(samples); n > 0 && s.dts >= samples[n-1].dts {
+		samples[n-1].duration = s.dts - samples[n-1].dts
+	}
+
+	return append(samples, s)
+}
+
+// Write the pending samples. Close has to be called to write the last fragment
+func (e *MP4Encoder) Close() error {
+	if !e.started || len(e.video)+len(e.audio) == 0 {
+		return nil
+	}
+	// Without a following sample, the last one lasts as long as the one before it
+	for _, samples := range [][]mp4Sample{e.video, e.audio} {
+		if n := len(samples); n > 1 && samples[n-1].duration == 0 {
+			samples[n-1].duration = samples[n-2].duration
+		}
+	}
+
+	return e.writeFragment()
+}
+
+func (e *MP4Encoder) writeFragment() error {
+	e.sequence++
+
+	// Audio after the last picture carries over, its duration is not known yet
+	audio := e.audio
+	var keep []mp4Sample
+	if len(e.video) > 0 && len(audio) > 0 {
+		end := e.video[len(e.video)-1].dts + e.video[len(e.video)-1].duration
+		i := len(audio)
+		for i > 0 && audio[i-1].dts >= end {
+			i--
+		}
+		if i > 0 && audio[i-1].duration == 0 {
+			i-- // Still waiting for its successor
+		}
+		audio, keep = audio[:i], append([]mp4Sample(nil), audio[i:]...)
+	}
+
+	tracks := []struct {
+		id      uint32
+		samples []mp4Sample
+	}{{mp4VideoTrack, e.video}, {mp4AudioTrack, audio}}
+
+	// Build the moof twice, the data offsets depend on its size
+	var moof []byte
+	for pass := 0; pass < 2; pass++ {
+		offset := uint32(len(moof)) + 8
+		var trafs [][]byte
+		for _, t := range tracks {
+			if len(t.samples) == 0 {
+				continue
+			}
+			trafs = append(trafs, mp4Traf(t.id, t.samples, offset))
+			for _, s := range t.samples {
+				offset += uint32(len(s.data))
+			}
+		}
+		moof = mp4Box("moof", append([][]byte{mp4FullBox("mfhd", 0, 0, u32(e.sequence))}, trafs...)...)
+	}
+
+	var mdat [][]byte
+	for _, t := range tracks {
+		for _, s := range t.samples {
+			mdat = append(mdat, s.data)
+		}
+	}
+	if _, err := e.w.Write(moof); err != nil {
+		return err
+	}
+	if _, err := e.w.Write(mp4Box("mdat", mdat...)); err != nil {
+		return err
+	}
+
+	e.video = e.video[:0]
+	e.audio = keep
+
+	return nil
+}
+
+// ftyp and moov, describing the tracks
+func (e *MP4Encoder) header() []byte {
+	ftyp := mp4Box("ftyp", []byte("iso5"), u32(0x200), []byte("iso5iso6avc1mp41"))
+
+	traks := [][]byte{e.videoTrak()}
+	trexs := [][]byte{mp4Trex(mp4VideoTrack)}
+	if e.hasAudio {
+		traks = append(traks, e.audioTrak())
+		trexs = append(trexs, mp4Trex(mp4AudioTrack))
+	}
+
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		u32(0), u32(0), u32(mp4Timescale), u32(0), // times, duration
+		u32(0x00010000), []byte{0x01, 0x00}, make([]byte, 10), // rate, volume
+		mp4Matrix(), make([]byte, 24), u32(mp4AudioTrack+1))
+	moov := mp4Box("moov", append(append([][]byte{mvhd}, traks...), mp4Box("mvex", trexs...))...)
+
+	return append(ftyp, moov...)
+}
+
+func (e *MP4Encoder) videoTrak() []byte {
+	avc1 := mp4Box("avc1",
+		make([]byte, 6), []byte{0x00, 0x01}, // reserved, data_reference_index
+		make([]byte, 16), // pre_defined, reserved
+		u16(uint16(e.width)), u16(uint16(e.height)),
+		u32(0x00480000), u32(0x00480000), u32(0), // 72 dpi, reserved
+		u16(1), make([]byte, 32), // frame_count, compressorname
+		u16(0x0018), u16(0xffff), // depth, pre_defined
+		mp4Box("avcC", e.avcConfig))
+
+	return mp4Trak(mp4VideoTrack, "vide", uint32(e.width), uint32(e.height),
+		mp4FullBox("vmhd", 0, 1, make([]byte, 8)), avc1)
+}
+
+func (e *MP4Encoder) audioTrak() []byte {
+	channels, rate := aacChannelsAndRate(e.aacConfig)
+
+	esds := mp4FullBox("esds", 0, 0, mp4Descriptor(0x03,
+		u16(mp4AudioTrack), []byte{0x00},
+		mp4Descriptor(0x04,
+			[]byte{0x40, 0x15}, make([]byte, 3), u32(0), u32(0), // AAC, audio stream, buffer size, bitrates
+			mp4Descriptor(0x05, e.aacConfig)),
+		mp4Descriptor(0x06, []byte{0x02})))
+	mp4a := mp4Box("mp4a",
+		make([]byte, 6), []byte{0x00, 0x01},
+		make([]byte, 8),
+		u16(uint16(channels)), u16(16), make([]byte, 4), // channels, sample size, pre_defined, reserved
+		u32(uint32(rate)<<16),
+		esds)
+
+	return mp4Trak(mp4AudioTrack, "soun", 0, 0, mp4FullBox("smhd", 0, 0, make([]byte, 4)), mp4a)
+}
+
+// Channel count and sample rate from an AudioSpecificConfig
+func aacChannelsAndRate(asc []byte) (int, int) {
+	rates := []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+	if len(asc) < 2 {
+		return 2, 44100
+	}
+	freqIndex := int((asc[0]&0x07)<<1 | asc[1]>>7)
+	channels := int((asc[1] >> 3) & 0x0f)
+	rate := 44100
+	if freqIndex < len(rates) {
+		rate = rates[freqIndex]
+	}
+	if channels == 0 {
+		channels = 2
+	}
+
+	return channels, rate
+}
+
+func mp4Trak(id uint32, handler string, width, height uint32, mediaHeader, sampleEntry []byte) []byte {
+	volume := []byte{0x00, 0x00}
+	if handler == "soun" {
+		volume = []byte{0x01, 0x00}
+	}
+	tkhd := mp4FullBox("tkhd", 0, 0x03,
+		u32(0), u32(0), u32(id), u32(0), u32(0), // times, track_ID, reserved, duration
+		make([]byte, 8), u16(0), u16(0), volume, u16(0), // reserved, layer, alternate_group, volume, reserved
+		mp4Matrix(), u32(width<<16), u32(height<<16))
+
+	mdhd := mp4FullBox("mdhd", 0, 0, u32(0), u32(0), u32(mp4Timescale), u32(0), u16(0x55c4), u16(0)) // und
+	hdlr := mp4FullBox("hdlr", 0, 0, u32(0), []byte(handler), make([]byte, 12), []byte("FindingWaldo\x00"))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, u32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, u32(1), sampleEntry),
+		mp4FullBox("stts", 0, 0, u32(0)),
+		mp4FullBox("stsc", 0, 0, u32(0)),
+		mp4FullBox("stsz", 0, 0, u32(0), u32(0)),
+		mp4FullBox("stco", 0, 0, u32(0)))
+
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, mp4Box("minf", mediaHeader, dinf, stbl)))
+}
+
+func mp4Trex(id uint32) []byte {
+	return mp4FullBox("trex", 0, 0, u32(id), u32(1), u32(0), u32(0), u32(0))
+}
+
+// Track fragment. dataOffset is where the samples start in the mdat, counted from the start of the moof
+func mp4Traf(id uint32, samples []mp4Sample, dataOffset uint32) []byte {
+	tfhd := mp4FullBox("tfhd", 0, 0x020000, u32(id)) // default-base-is-moof
+	tfdt := mp4FullBox("tfdt", 1, 0, u64(uint64(samples[0].dts)))
+
+	// data-offset, sample duration, size, flags and composition time offset
+	entries := [][]byte{u32(uint32(len(samples))), u32(dataOffset)}
+	for _, s := range samples {
+		flags := uint32(0x01010000) // depends on others, not a sync sample
+		if s.keyframe {
+			flags = 0x02000000
+		}
+		entries = append(entries, u32(s.duration), u32(uint32(len(s.data))), u32(flags), u32(uint32(s.cto)))
+	}
+	trun := mp4FullBox("trun", 1, 0x000f01, entries...)
+
+	return mp4Box("traf", tfhd, tfdt, trun)
+}
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := bytes.NewBuffer(make([]byte, 0, size))
+	b.Write(u32(uint32(size)))
+	b.WriteString(typ)
+	for _, p := range payload {
+		b.Write(p)
+	}
+
+	return b.Bytes()
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{header}, payload...)...)
+}
+
+// An MPEG-4 descriptor with its length in the 4 byte form
+func mp4Descriptor(tag byte, payload ...[]byte) []byte {
+	n := 0
+	for _, p := range payload {
+		n += len(p)
+	}
+	b := []byte{tag, 0x80 | byte(n>>21)&0x7f, 0x80 | byte(n>>14)&0x7f, 0x80 | byte(n>>7)&0x7f, byte(n) & 0x7f}
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+
+	return b
+}
+
+// Identity transformation matrix
+func mp4Matrix() []byte {
+	m := make([]byte, 0, 36)
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		m = append(m, u32(v)...)
+	}
+
+	return m
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
@@ -0,0 +1,92 @@
+package waldo
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Longest stream name accepted for a recording
+const maxStreamNameLength = 128
+
+// InvalidStreamNameError Returned when a publishing name cannot be used for a recording.
+// OnPublish turns it into a rejected publish
+type InvalidStreamNameError struct {
+	Name   string
+	Reason string
+}
+
+func (e *InvalidStreamNameError) Error() string {
+	return fmt.Sprintf("Invalid stream name %q: %s", e.Name, e.Reason)
+}
+
+// Turn a stream name (query already stripped) into a file name without an extension.
+// Only letters, digits, '-', '_' and '.' are allowed, '/' separated names like live/cam1 become live_cam1
+func sanitizeStreamName(name string) (string, error) {
+	if name == "" {
+		return "", &InvalidStreamNameError{Name: name, Reason: "empty"}
+	}
+	if len(name) > maxStreamNameLength {
+		return "", &InvalidStreamNameError{Name: name, Reason: fmt.Sprintf("longer than %d bytes", maxStreamNameLength)}
+	}
+
+	var b strings.Builder
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", &InvalidStreamNameError{Name: name, Reason: "empty or relative path segment"}
+		}
+		if b.Len() > 0 {
+			b.WriteByte('_')
+		}
+		for _, c := range segment {
+			switch {
+			case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_', c == '.':
+				b.WriteRune(c)
+			default:
+				return "", &InvalidStreamNameError{Name: name, Reason: fmt.Sprintf("character %q not allowed", c)}
+			}
+		}
+	}
+
+	safe := b.String()
+	if strings.HasPrefix(safe, ".") {
+		return "", &InvalidStreamNameError{Name: name, Reason: "starts with '.'"}
+	}
+
+	return safe, nil
+}
+
+// Default layout of recordings below the output directory
+const DefaultRecordingLayout = "{name}/{date}/{time}.flv"
+
+// Expand a recording layout for a stream. {name} is the sanitized stream name, {conn_id} the connection number,
+// {date} YYYY-MM-DD and {time} HHMMSS of start. The result ends in ext, is joined to dir and never escapes it
+func renderRecordingLayout(dir, layout, ext, name string, connID uint64, start time.Time) (string, error) {
+	rel := strings.NewReplacer(
+		"{name}", name,
+		"{conn_id}", strconv.FormatUint(connID, 10),
+		"{date}", start.Format("2006-01-02"),
+		"{time}", start.Format("150405"),
+	).Replace(layout)
+	switch filepath.Ext(rel) {
+	case ext:
+	case ".flv", ".mp4":
+		rel = strings.TrimSuffix(rel, filepath.Ext(rel)) + ext
+	default:
+		rel += ext
+	}
+
+	if filepath.IsAbs(rel) {
+		return "", errors.Errorf("Recording layout %q must be relative to the output directory", layout)
+	}
+	p := filepath.Join(dir, rel)
+	if r, err := filepath.Rel(dir, p); err != nil || r == "." || r == ".." || strings.HasPrefix(r, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("Recording layout %q escapes the output directory", layout)
+	}
+
+	return p, nil
+}
@@ -0,0 +1,76 @@
+package waldo
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeStreamName(t *testing.T) {
+	tests := []struct {
+		in, want string
+		wantErr  bool
+	}{
+		{in: "cam1", want: "cam1"},
+		{in: "live/cam1", want: "live_cam1"},
+		{in: "cam-1_v2.hd", want: "cam-1_v2.hd"},
+		{in: strings.Repeat("a", maxStreamNameLength), want: strings.Repeat("a", maxStreamNameLength)},
+		{in: "", wantErr: true},
+		{in: strings.Repeat("a", maxStreamNameLength+1), wantErr: true},
+		{in: "../etc/passwd", wantErr: true},
+		{in: "live/../cam", wantErr: true},
+		{in: "live//cam", wantErr: true},
+		{in: "/cam", wantErr: true},
+		{in: "live/", wantErr: true},
+		{in: ".hidden", wantErr: true},
+		{in: "cam 1", wantErr: true},
+		{in: `cam\1`, wantErr: true},
+		{in: "cam%2F1", wantErr: true},
+		{in: "kamera-ü", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := sanitizeStreamName(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("sanitizeStreamName(%q) err = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if _, ok := err.(*InvalidStreamNameError); err != nil && !ok {
+			t.Errorf("sanitizeStreamName(%q) err is %T, want *InvalidStreamNameError", tt.in, err)
+		}
+		if got != tt.want {
+			t.Errorf("sanitizeStreamName(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRenderRecordingLayout(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Date(2024, 3, 9, 14, 5, 7, 0, time.UTC)
+
+	tests := []struct {
+		layout, ext string
+		want        string // Relative to dir
+		wantErr     bool
+	}{
+		{layout: DefaultRecordingLayout, ext: ".flv", want: "cam/2024-03-09/140507.flv"},
+		{layout: DefaultRecordingLayout, ext: ".mp4", want: "cam/2024-03-09/140507.mp4"},
+		{layout: "{name}-{conn_id}", ext: ".flv", want: "cam-7.flv"},
+		{layout: "{name}.recording", ext: ".flv", want: "cam.recording.flv"},
+		{layout: "./{date}/../{name}", ext: ".flv", want: "cam.flv"},
+		{layout: "../{name}", ext: ".flv", wantErr: true},
+		{layout: "{name}/../../{name}", ext: ".flv", wantErr: true},
+		{layout: "/tmp/{name}", ext: ".flv", wantErr: true},
+		{layout: "..", ext: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := renderRecordingLayout(dir, tt.layout, tt.ext, "cam", 7, start)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("renderRecordingLayout(%q) err = %v, want error %v", tt.layout, err, tt.wantErr)
+			continue
+		}
+		if want := filepath.Join(dir, filepath.FromSlash(tt.want)); !tt.wantErr && got != want {
+			t.Errorf("renderRecordingLayout(%q) = %q, want %q", tt.layout, got, want)
+		}
+	}
+}
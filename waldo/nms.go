@@ -0,0 +1,75 @@
+package waldo
+
+import (
+	"image"
+	"sort"
+)
+
+// Non-maximum suppression: keep the highest scoring box, drop every remaining one overlapping it
+// by more than iouThreshold (intersection over union), repeat. Kept boxes are returned best first
+func NMS(rects []image.Rectangle, scores []float64, iouThreshold float64) []image.Rectangle {
+	keep := nmsIndices(rects, scores, iouThreshold)
+	kept := make([]image.Rectangle, 0, len(keep))
+	for _, i := range keep {
+		kept = append(kept, rects[i])
+	}
+
+	return kept
+}
+
+// Indices of the boxes NMS keeps, best first
+func nmsIndices(rects []image.Rectangle, scores []float64, iouThreshold float64) []int {
+	order := make([]int, len(rects))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return scores[order[a]] > scores[order[b]] })
+
+	var keep []int
+	suppressed := make([]bool, len(rects))
+	for n, i := range order {
+		if suppressed[i] {
+			continue
+		}
+		keep = append(keep, i)
+		for _, j := range order[n+1:] {
+			if !suppressed[j] && iou(rects[i], rects[j]) > iouThreshold {
+				suppressed[j] = true
+			}
+		}
+	}
+
+	return keep
+}
+
+// Intersection over union of two boxes, 0 when either is empty
+func iou(a, b image.Rectangle) float64 {
+	inter := a.Intersect(b)
+	if inter.Empty() {
+		return 0
+	}
+	i := float64(inter.Dx() * inter.Dy())
+	union := float64(a.Dx()*a.Dy()+b.Dx()*b.Dy()) - i
+
+	return i / union
+}
+
+// Drop results overlapping a better one by more than iouThreshold, see nmsIndices. Kept ones are best first
+func suppressOverlaps(results []DetectionResult, iouThreshold float64) []DetectionResult {
+	if len(results) < 2 {
+		return results
+	}
+
+	rects := make([]image.Rectangle, len(results))
+	scores := make([]float64, len(results))
+	for i, d := range results {
+		rects[i], scores[i] = d.Rect, d.Score
+	}
+	keep := nmsIndices(rects, scores, iouThreshold)
+	kept := make([]DetectionResult, 0, len(keep))
+	for _, i := range keep {
+		kept = append(kept, results[i])
+	}
+
+	return kept
+}
@@ -0,0 +1,130 @@
+package waldo
+
+import (
+	"image"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestIoU(t *testing.T) {
+	tests := []struct {
+		a, b image.Rectangle
+		want float64
+	}{
+		{image.Rect(0, 0, 10, 10), image.Rect(0, 0, 10, 10), 1},
+		{image.Rect(0, 0, 10, 10), image.Rect(20, 20, 30, 30), 0},
+		{image.Rect(0, 0, 10, 10), image.Rect(10, 0, 20, 10), 0}, // Touching edges
+		{image.Rect(0, 0, 10, 10), image.Rect(5, 0, 15, 10), 50.0 / 150},
+		{image.Rect(0, 0, 10, 10), image.Rect(2, 2, 4, 4), 4.0 / 100},
+		{image.Rect(0, 0, 10, 10), image.Rectangle{}, 0},
+	}
+	for _, tt := range tests {
+		if got := iou(tt.a, tt.b); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("iou(%v, %v) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestNMS(t *testing.T) {
+	a, b := image.Rect(0, 0, 10, 10), image.Rect(5, 0, 15, 10) // IoU 1/3
+
+	tests := []struct {
+		desc   string
+		rects  []image.Rectangle
+		scores []float64
+		iou    float64
+		want   []image.Rectangle
+	}{
+		{desc: "identical", rects: []image.Rectangle{a, a, a}, scores: []float64{0.5, 0.9, 0.7}, iou: 0.5, want: []image.Rectangle{a}},
+		{
+			desc:   "disjoint",
+			rects:  []image.Rectangle{a, image.Rect(20, 0, 30, 10), image.Rect(0, 20, 10, 30)},
+			scores: []float64{0.5, 0.9, 0.7},
+			iou:    0.1,
+			want:   []image.Rectangle{image.Rect(20, 0, 30, 10), image.Rect(0, 20, 10, 30), a},
+		},
+		{desc: "overlap at the threshold kept", rects: []image.Rectangle{a, b}, scores: []float64{0.9, 0.8}, iou: 1.0 / 3, want: []image.Rectangle{a, b}},
+		{desc: "overlap above the threshold dropped", rects: []image.Rectangle{a, b}, scores: []float64{0.8, 0.9}, iou: 0.33, want: []image.Rectangle{b}},
+		{desc: "empty", want: []image.Rectangle{}},
+	}
+	for _, tt := range tests {
+		if got := NMS(tt.rects, tt.scores, tt.iou); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestSuppressOverlaps(t *testing.T) {
+	d := func(score float64, x0, y0, x1, y1 int) DetectionResult {
+		return DetectionResult{Score: score, Rect: image.Rect(x0, y0, x1, y1)}
+	}
+
+	tests := []struct {
+		desc string
+		in   []DetectionResult
+		iou  float64
+		want []DetectionResult
+	}{
+		{desc: "empty", in: nil, iou: 0.3, want: nil},
+		{desc: "single", in: []DetectionResult{d(0.5, 0, 0, 10, 10)}, iou: 0.3, want: []DetectionResult{d(0.5, 0, 0, 10, 10)}},
+		{
+			desc: "shifted duplicate dropped, best kept",
+			in:   []DetectionResult{d(0.7, 1, 0, 11, 10), d(0.9, 0, 0, 10, 10)},
+			iou:  0.3,
+			want: []DetectionResult{d(0.9, 0, 0, 10, 10)},
+		},
+		{
+			desc: "disjoint kept best first",
+			in:   []DetectionResult{d(0.6, 0, 0, 10, 10), d(0.8, 50, 50, 60, 60)},
+			iou:  0.3,
+			want: []DetectionResult{d(0.8, 50, 50, 60, 60), d(0.6, 0, 0, 10, 10)},
+		},
+		{
+			desc: "overlap below the threshold kept",
+			in:   []DetectionResult{d(0.9, 0, 0, 10, 10), d(0.8, 8, 0, 18, 10)},
+			iou:  0.3,
+			want: []DetectionResult{d(0.9, 0, 0, 10, 10), d(0.8, 8, 0, 18, 10)},
+		},
+		{
+			// b is suppressed by a, so c, which only overlaps b, survives
+			desc: "chain",
+			in:   []DetectionResult{d(0.9, 0, 0, 10, 10), d(0.8, 3, 0, 13, 10), d(0.7, 6, 0, 16, 10)},
+			iou:  0.3,
+			want: []DetectionResult{d(0.9, 0, 0, 10, 10), d(0.7, 6, 0, 16, 10)},
+		},
+		{
+			desc: "threshold 1 keeps everything but exact ties",
+			in:   []DetectionResult{d(0.9, 0, 0, 10, 10), d(0.8, 1, 0, 11, 10)},
+			iou:  1,
+			want: []DetectionResult{d(0.9, 0, 0, 10, 10), d(0.8, 1, 0, 11, 10)},
+		},
+	}
+	for _, tt := range tests {
+		if got := suppressOverlaps(tt.in, tt.iou); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.desc, got, tt.want)
+		}
+	}
+}
+
+func TestTemplateMatcherBestSuppressesBeforeTopN(t *testing.T) {
+	m := &TemplateMatcher{config: TemplateMatcherConfig{Threshold: 0.5, TopN: 2, NMSIoU: 0.3}}
+	results := []DetectionResult{
+		{Score: 0.95, Rect: image.Rect(0, 0, 10, 10)},
+		{Score: 0.94, Rect: image.Rect(1, 0, 11, 10)}, // The same Waldo at the next scale
+		{Score: 0.93, Rect: image.Rect(0, 1, 10, 11)}, // And again
+		{Score: 0.40, Rect: image.Rect(80, 80, 90, 90)},
+		{Score: 0.70, Rect: image.Rect(50, 50, 60, 60)},
+	}
+
+	got := m.best(results)
+	want := []image.Rectangle{image.Rect(0, 0, 10, 10), image.Rect(50, 50, 60, 60)}
+	if len(got) != len(want) {
+		t.Fatalf("Got %v, want boxes %v", got, want)
+	}
+	for i := range want {
+		if got[i].Rect != want[i] {
+			t.Errorf("Result %d is %v, want %v", i, got[i].Rect, want[i])
+		}
+	}
+}
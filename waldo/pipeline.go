@@ -0,0 +1,222 @@
+package waldo
+
+import (
+	stderrors "errors"
+	"image"
+	"strings"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	"gocv.io/x/gocv"
+)
+
+// StageFunc One step of a Pipeline. It returns the frame for the next stage, either its input or a new
+// Mat the pipeline then owns, and any detections it made. Stages must keep the frame's size,
+// so every detection is in the same coordinates
+type StageFunc func(frame gocv.Mat) (gocv.Mat, []DetectionResult, error)
+
+// StreamStage A stage with state learned from one stream's frames, e.g. a background model.
+// ForStream builds one per stream, and Close releases it with the stream
+type StreamStage interface {
+	Run(frame gocv.Mat) (gocv.Mat, []DetectionResult, error)
+	Close() error
+}
+
+// pipelineStage A named StageFunc that can be switched off without rebuilding the pipeline
+type pipelineStage struct {
+	name     string
+	fn       StageFunc
+	newStage func() StreamStage // Set instead of fn for stages with per stream state
+	state    StreamStage        // The stream's instance of newStage
+	enabled  *atomic.Bool       // Shared with the stage's copies in every stream's pipeline
+}
+
+// Pipeline CV stages run in order on every frame before detection, e.g. to clean up the picture.
+// Stages are added at startup, after which Run is safe for concurrent use. Each stream runs its own
+// copy from ForStream, so stages keeping state never mix streams. A nil Pipeline does nothing
+type Pipeline struct {
+	stages []*pipelineStage
+}
+
+// Append an enabled stage. Not safe to call while frames are running
+func (p *Pipeline) AddStage(name string, fn func(gocv.Mat) (gocv.Mat, []DetectionResult, error)) {
+	p.add(&pipelineStage{name: name, fn: fn})
+}
+
+// Append an enabled stage built anew for every stream by newStage. Not safe to call while frames are running
+func (p *Pipeline) AddStreamStage(name string, newStage func() StreamStage) {
+	p.add(&pipelineStage{name: name, newStage: newStage})
+}
+
+func (p *Pipeline) add(s *pipelineStage) {
+	s.enabled = &atomic.Bool{}
+	s.enabled.Store(true)
+	p.stages = append(p.stages, s)
+}
+
+// The pipeline one stream runs, with its own instance of every stream stage. Switching a stage on
+// or off in p still applies to it. The caller must Close it when the stream ends. Nil-safe
+func (p *Pipeline) ForStream() *Pipeline {
+	if p == nil {
+		return nil
+	}
+	stream := &Pipeline{stages: make([]*pipelineStage, 0, len(p.stages))}
+	for _, s := range p.stages {
+		if s.newStage != nil {
+			state := s.newStage()
+			s = &pipelineStage{name: s.name, fn: state.Run, state: state, enabled: s.enabled}
+		}
+		stream.stages = append(stream.stages, s)
+	}
+
+	return stream
+}
+
+// Switch a stage on or off, false if there is no stage of that name
+func (p *Pipeline) SetEnabled(name string, enabled bool) bool {
+	if p == nil {
+		return false
+	}
+	for _, s := range p.stages {
+		if s.name == name {
+			s.enabled.Store(enabled)
+			return true
+		}
+	}
+
+	return false
+}
+
+// Run the enabled stages in order, each on the previous one's output, and collect their detections.
+// The result is frame itself when no stage replaced it, otherwise it belongs to the caller, who must Close it
+func (p *Pipeline) Run(frame gocv.Mat) (gocv.Mat, []DetectionResult, error) {
+	if p == nil {
+		return frame, nil, nil
+	}
+
+	var (
+		current = frame
+		results []DetectionResult
+	)
+	for _, s := range p.stages {
+		// Stream stages only run in the copies made by ForStream
+		if !s.enabled.Load() || s.fn == nil {
+			continue
+		}
+		out, found, err := s.fn(current)
+		if err != nil {
+			if current.Ptr() != frame.Ptr() {
+				_ = current.Close()
+			}
+			return frame, nil, errors.Wrapf(err, "CV stage %s failed", s.name)
+		}
+		// Intermediate frames are released as soon as the next stage has replaced them
+		if out.Ptr() != current.Ptr() && current.Ptr() != frame.Ptr() {
+			_ = current.Close()
+		}
+		current = out
+		results = append(results, found...)
+	}
+
+	return current, results, nil
+}
+
+// Release the state of a stream's stages, e.g. its background model. Nil-safe
+func (p *Pipeline) Close() error {
+	if p == nil {
+		return nil
+	}
+	var errs []error
+	for _, s := range p.stages {
+		if s.state != nil {
+			errs = append(errs, s.state.Close())
+		}
+	}
+
+	return stderrors.Join(errs...)
+}
+
+// StageConfig Settings of the built in stages that have any
+type StageConfig struct {
+	// Frames the background stage learns the background from, and the squared distance from it
+	// above which a pixel is foreground
+	BackgroundHistory   int
+	BackgroundThreshold float64
+}
+
+// Build a pipeline from comma separated names of built in stages, nil when there are none
+func NewPipelineFromNames(names string, config StageConfig) (*Pipeline, error) {
+	var p *Pipeline
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if p == nil {
+			p = &Pipeline{}
+		}
+		// Each stream learns its own background, see ForStream
+		if name == "background" {
+			p.AddStreamStage(name, func() StreamStage {
+				return NewBackgroundSubtractorStage(config.BackgroundHistory, config.BackgroundThreshold)
+			})
+			continue
+		}
+		fn, ok := builtinStages[name]
+		if !ok {
+			return nil, errors.Errorf("Unknown CV stage %q, want denoise, equalize or background", name)
+		}
+		p.AddStage(name, fn)
+	}
+
+	return p, nil
+}
+
+// Stages that can be named in -cv-stages
+var builtinStages = map[string]StageFunc{
+	"denoise":  denoiseStage,
+	"equalize": equalizeStage,
+}
+
+// Smooth out sensor noise and compression artifacts, which produce false matches
+func denoiseStage(frame gocv.Mat) (gocv.Mat, []DetectionResult, error) {
+	out := gocv.NewMat()
+	if err := gocv.GaussianBlur(frame, &out, image.Pt(3, 3), 0, 0, gocv.BorderDefault); err != nil {
+		_ = out.Close()
+		return frame, nil, errors.Wrap(err, "Failed to blur frame")
+	}
+
+	return out, nil, nil
+}
+
+// Even out the lighting with adaptive histogram equalization of the lightness, leaving the colors alone
+func equalizeStage(frame gocv.Mat) (gocv.Mat, []DetectionResult, error) {
+	lab := gocv.NewMat()
+	defer lab.Close()
+	if err := gocv.CvtColor(frame, &lab, gocv.ColorBGRToLab); err != nil {
+		return frame, nil, errors.Wrap(err, "Failed to convert frame to Lab")
+	}
+
+	channels := gocv.Split(lab)
+	defer func() {
+		for _, c := range channels {
+			_ = c.Close()
+		}
+	}()
+	clahe := gocv.NewCLAHEWithParams(2, image.Pt(8, 8))
+	defer clahe.Close()
+	if err := clahe.Apply(channels[0], &channels[0]); err != nil {
+		return frame, nil, errors.Wrap(err, "Failed to equalize lightness")
+	}
+	if err := gocv.Merge(channels, &lab); err != nil {
+		return frame, nil, errors.Wrap(err, "Failed to merge Lab channels")
+	}
+
+	out := gocv.NewMat()
+	if err := gocv.CvtColor(lab, &out, gocv.ColorLabToBGR); err != nil {
+		_ = out.Close()
+		return frame, nil, errors.Wrap(err, "Failed to convert frame to BGR")
+	}
+
+	return out, nil, nil
+}
@@ -0,0 +1,99 @@
+package waldo
+
+import (
+	"image"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+func TestBackgroundStagePerStream(t *testing.T) {
+	p, err := NewPipelineFromNames("background", StageConfig{BackgroundHistory: 50, BackgroundThreshold: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	small, large := p.ForStream(), p.ForStream()
+	defer small.Close()
+	defer large.Close()
+
+	smallFrame := gocv.NewMatWithSize(240, 320, gocv.MatTypeCV8UC3)
+	defer smallFrame.Close()
+	largeFrame := gocv.NewMatWithSize(480, 640, gocv.MatTypeCV8UC3)
+	defer largeFrame.Close()
+
+	// Interleaved like two publishers sharing the CV workers
+	for i := 0; i < 10; i++ {
+		for _, run := range []struct {
+			p     *Pipeline
+			frame gocv.Mat
+		}{{small, smallFrame}, {large, largeFrame}} {
+			out, _, err := run.p.Run(run.frame)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out.Ptr() != run.frame.Ptr() {
+				t.Fatal("Background stage replaced the frame")
+			}
+		}
+	}
+
+	for name, stream := range map[string]*Pipeline{"small": small, "large": large} {
+		bg := stream.stages[0].state.(*BackgroundSubtractorStage)
+		if bg.models != 1 {
+			t.Errorf("%s stream built %d background models, want 1", name, bg.models)
+		}
+	}
+	if small.stages[0].state == large.stages[0].state {
+		t.Error("Streams share a background model")
+	}
+	if got := small.stages[0].state.(*BackgroundSubtractorStage).size; got != image.Pt(320, 240) {
+		t.Errorf("Small stream model is for %v", got)
+	}
+}
+
+// fakeStreamStage Counts how often it was closed
+type fakeStreamStage struct {
+	closed int
+}
+
+func (s *fakeStreamStage) Run(frame gocv.Mat) (gocv.Mat, []DetectionResult, error) {
+	return frame, nil, nil
+}
+
+func (s *fakeStreamStage) Close() error {
+	s.closed++
+	return nil
+}
+
+func TestPipelineForStream(t *testing.T) {
+	p := &Pipeline{}
+	var built []*fakeStreamStage
+	p.AddStreamStage("fake", func() StreamStage {
+		s := &fakeStreamStage{}
+		built = append(built, s)
+		return s
+	})
+
+	first, second := p.ForStream(), p.ForStream()
+	if len(built) != 2 || first.stages[0].state == second.stages[0].state {
+		t.Fatalf("Built %d stage instances for 2 streams, want one each", len(built))
+	}
+
+	if !p.SetEnabled("fake", false) {
+		t.Fatal("SetEnabled did not find the stage")
+	}
+	if first.stages[0].enabled.Load() || second.stages[0].enabled.Load() {
+		t.Error("Switching a stage off did not reach the streams")
+	}
+
+	if err := first.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if built[0].closed != 1 || built[1].closed != 0 {
+		t.Errorf("Closing one stream closed %d and %d stages, want 1 and 0", built[0].closed, built[1].closed)
+	}
+	// The shared pipeline holds no state of its own
+	if err := p.Close(); err != nil || built[1].closed != 0 {
+		t.Error("Closing the shared pipeline released a stream's stage")
+	}
+}
@@ -0,0 +1,343 @@
+package waldo
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pkg/errors"
+	flvtag "github.com/yutopp/go-flv/tag"
+	"github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+// Chunk streams media is sent to players on
+const (
+	playbackAudioChunkStream  = 5
+	playbackVideoChunkStream  = 6
+	playbackScriptChunkStream = 8
+)
+
+// Most tags kept for one GOP. A stream with longer GOPs is only cached again from its next keyframe
+const maxGOPTags = 4096
+
+// playbackTag A tag as relayed to players. Immutable once created, so players share it
+type playbackTag struct {
+	tagType   flvtag.TagType
+	timestamp uint32
+	header    bool               // Metadata or a sequence header
+	keyframe  bool               // Video keyframe, not a sequence header
+	body      []byte             // Encoded audio or video tag body, as sent in an RTMP message
+	script    *flvtag.ScriptData // Script tags are sent object by object
+}
+
+// Copy a tag for players, body being its audio or video payload. The tag's own reader is left alone
+func newPlaybackTag(tag *flvtag.FlvTag, body []byte, header bool) (*playbackTag, error) {
+	p := &playbackTag{tagType: tag.TagType, timestamp: tag.Timestamp, header: header}
+
+	var buf bytes.Buffer
+	switch data := tag.Data.(type) {
+	case *flvtag.ScriptData:
+		p.script = data
+		return p, nil
+
+	case *flvtag.VideoData:
+		video := *data
+		video.Data = bytes.NewReader(body)
+		if err := flvtag.EncodeVideoData(&buf, &video); err != nil {
+			return nil, err
+		}
+		p.keyframe = !header && isVideoKeyframe(data)
+
+	case *flvtag.AudioData:
+		audio := *data
+		audio.Data = bytes.NewReader(body)
+		if err := flvtag.EncodeAudioData(&buf, &audio); err != nil {
+			return nil, err
+		}
+
+	default:
+		return nil, errors.Errorf("Unexpected tag data %T", tag.Data)
+	}
+	p.body = buf.Bytes()
+
+	return p, nil
+}
+
+// Player A subscriber to a stream. Tags it does not take in time are dropped,
+// after which its video resumes at the next keyframe so the decoder never sees a broken GOP
+type Player struct {
+	tags    chan *playbackTag
+	dropped atomic.Uint64
+
+	// Guarded by the cache's mu
+	skipVideo bool
+	closed    bool
+}
+
+// Dropped tags, for the log
+func (p *Player) Dropped() uint64 {
+	return p.dropped.Load()
+}
+
+// GOPCache Everything a new player needs to start decoding right away: the metadata, the latest
+// sequence headers and every tag since the most recent keyframe. Live tags are fanned out to the
+// subscribed players without ever blocking the publisher. Safe for concurrent use
+type GOPCache struct {
+	mu       sync.Mutex
+	metadata *playbackTag
+	video    *playbackTag // Sequence headers
+	audio    *playbackTag
+	gop      []*playbackTag // Starts with a keyframe, empty until the first one
+	players  map[*Player]struct{}
+	closed   bool
+}
+
+func NewGOPCache() *GOPCache {
+	return &GOPCache{players: make(map[*Player]struct{})}
+}
+
+// Cache a tag and hand it to every player
+func (c *GOPCache) Write(tag *playbackTag) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+
+	switch {
+	case tag.header && tag.tagType == flvtag.TagTypeScriptData:
+		c.metadata = tag
+	case tag.header && tag.tagType == flvtag.TagTypeVideo:
+		c.video = tag
+	case tag.header && tag.tagType == flvtag.TagTypeAudio:
+		c.audio = tag
+	case tag.keyframe:
+		clear(c.gop)
+		c.gop = append(c.gop[:0], tag)
+	case len(c.gop) >= maxGOPTags:
+		clear(c.gop)
+		c.gop = c.gop[:0]
+	case len(c.gop) > 0:
+		c.gop = append(c.gop, tag)
+	}
+
+	for p := range c.players {
+		c.offerLocked(p, tag)
+	}
+}
+
+// Queue a tag for a player, or drop it when the player is behind. mu must be held
+func (c *GOPCache) offerLocked(p *Player, tag *playbackTag) {
+	if tag.tagType == flvtag.TagTypeVideo && p.skipVideo {
+		if !tag.keyframe {
+			p.dropped.Add(1)
+			return
+		}
+		// The decoder is starting over, give it the sequence header again
+		if c.video != nil && !c.sendLocked(p, c.video) {
+			return
+		}
+		p.skipVideo = false
+	}
+
+	c.sendLocked(p, tag)
+}
+
+// mu must be held
+func (c *GOPCache) sendLocked(p *Player, tag *playbackTag) bool {
+	select {
+	case p.tags <- tag:
+		return true
+	default:
+		p.dropped.Add(1)
+		if tag.tagType == flvtag.TagTypeVideo {
+			p.skipVideo = true
+		}
+		return false
+	}
+}
+
+// Add a player, which first receives the cached headers and GOP. queue is how many live tags
+// it may fall behind before frames are dropped
+func (c *GOPCache) Subscribe(queue int) *Player {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	p := &Player{tags: make(chan *playbackTag, queue+len(c.gop)+3)}
+	if c.closed {
+		p.closed = true
+		close(p.tags)
+		return p
+	}
+
+	// Headers are stamped with the start of the GOP, so the player's clock begins there
+	var start uint32
+	if len(c.gop) > 0 {
+		start = c.gop[0].timestamp
+	}
+	for _, header := range []*playbackTag{c.metadata, c.video, c.audio} {
+		if header != nil {
+			h := *header
+			h.timestamp = start
+			p.tags <- &h
+		}
+	}
+	for _, tag := range c.gop {
+		p.tags <- tag
+	}
+	// Without a cached keyframe, video starts at the next one
+	p.skipVideo = len(c.gop) == 0
+	c.players[p] = struct{}{}
+
+	return p
+}
+
+// Remove a player and close its channel. Safe to call more than once, and after Close
+func (c *GOPCache) Unsubscribe(p *Player) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.players, p)
+	if !p.closed {
+		p.closed = true
+		close(p.tags)
+	}
+}
+
+// Players currently subscribed
+func (c *GOPCache) Players() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.players)
+}
+
+// End the stream for every player. Later subscribers get a closed channel
+func (c *GOPCache) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	for p := range c.players {
+		delete(c.players, p)
+		p.closed = true
+		close(p.tags)
+	}
+	clear(c.gop)
+	c.gop = nil
+}
+
+// Send a tag to a player's connection on its stream, at timestamp
+func writePlaybackTag(conn *rtmp.Conn, streamID uint32, tag *playbackTag, timestamp uint32) error {
+	ctx := context.Background()
+
+	switch tag.tagType {
+	case flvtag.TagTypeAudio:
+		return conn.Write(ctx, playbackAudioChunkStream, timestamp, &rtmp.ChunkMessage{
+			StreamID: streamID,
+			Message:  &rtmpmsg.AudioMessage{Payload: bytes.NewReader(tag.body)},
+		})
+
+	case flvtag.TagTypeVideo:
+		return conn.Write(ctx, playbackVideoChunkStream, timestamp, &rtmp.ChunkMessage{
+			StreamID: streamID,
+			Message:  &rtmpmsg.VideoMessage{Payload: bytes.NewReader(tag.body)},
+		})
+
+	case flvtag.TagTypeScriptData:
+		// Players expect e.g. onMetaData as a data message of that name
+		for name, value := range tag.script.Objects {
+			var body bytes.Buffer
+			if err := rtmpmsg.NewAMFEncoder(&body, rtmpmsg.EncodingTypeAMF0).Encode(value); err != nil {
+				return errors.Wrap(err, "Failed to encode script data")
+			}
+			if err := conn.Write(ctx, playbackScriptChunkStream, timestamp, &rtmp.ChunkMessage{
+				StreamID: streamID,
+				Message: &rtmpmsg.DataMessage{
+					Name:     name,
+					Encoding: rtmpmsg.EncodingTypeAMF0,
+					Body:     &body,
+				},
+			}); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Client is requesting to watch a stream. It is sent the cached GOP, then the live tags. Players need
+// the same key as publishers, and name the stream the same way, e.g. live/<key> or cam?key=<key>
+func (h *Handler) OnPlay(ctx *rtmp.StreamContext, timestamp uint32, cmd *rtmpmsg.NetStreamPlay) error {
+	if h.publishing.Load() || h.streamName != "" || h.player != nil {
+		return errors.New("Cannot play on this connection")
+	}
+	name, key, err := parsePublishingName(cmd.StreamName)
+	if err != nil {
+		h.logger.Warn("Rejected play", "err", err)
+		return err
+	}
+	if h.auth != nil {
+		if name, err = h.auth.Authenticate(name, key); err != nil {
+			h.logger.Warn("Rejected play", "err", err)
+			return err
+		}
+	}
+
+	source, player, err := h.registry.Subscribe(name, h.playerQueue)
+	if err != nil {
+		h.logger.Warn("Rejected play", "stream", name, "err", err)
+		return err
+	}
+	h.logger = h.logger.With("stream", name)
+	h.logger.Info("Playing stream")
+	// Players only receive, the idle timeout is for publishers
+	if h.idleTimer != nil {
+		h.idleTimer.Stop()
+	}
+	h.playbackSource = source
+	h.player = player
+
+	go h.runPlayer(player, ctx.StreamID)
+
+	return nil
+}
+
+// Relay tags to the player until it falls off or the stream ends
+func (h *Handler) runPlayer(p *Player, streamID uint32) {
+	var (
+		base    uint32
+		started bool
+	)
+	for tag := range p.tags {
+		// Start the player's clock at 0, whatever the publisher's is
+		if !started {
+			base, started = tag.timestamp, true
+		}
+		ts := uint32(0)
+		if tag.timestamp > base {
+			ts = tag.timestamp - base
+		}
+
+		if err := writePlaybackTag(h.conn, streamID, tag, ts); err != nil {
+			h.logger.Info("Stopped playback", "err", err)
+			break
+		}
+	}
+
+	// Either the stream ended or the player is gone. A player sends no media, nothing to drain
+	_ = h.disconnect()
+}
+
+// Stop sending to this connection's player, if it is one
+func (h *Handler) closePlayer() {
+	if h.player == nil {
+		return
+	}
+	h.playbackSource.Unsubscribe(h.player)
+	h.logger.Info("Player left", "dropped_tags", h.player.Dropped())
+}
@@ -0,0 +1,146 @@
+package waldo
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+var (
+	testMetadata    = &playbackTag{tagType: flvtag.TagTypeScriptData, header: true, timestamp: 0}
+	testVideoHeader = &playbackTag{tagType: flvtag.TagTypeVideo, header: true, timestamp: 0}
+	testAudioHeader = &playbackTag{tagType: flvtag.TagTypeAudio, header: true, timestamp: 0}
+)
+
+func testVideoTag(timestamp uint32, keyframe bool) *playbackTag {
+	return &playbackTag{tagType: flvtag.TagTypeVideo, timestamp: timestamp, keyframe: keyframe}
+}
+
+// Everything queued for a player so far
+func drainPlayer(p *Player) []*playbackTag {
+	var tags []*playbackTag
+	for {
+		select {
+		case tag, ok := <-p.tags:
+			if !ok {
+				return tags
+			}
+			tags = append(tags, tag)
+		default:
+			return tags
+		}
+	}
+}
+
+func TestGOPCacheLateJoiner(t *testing.T) {
+	c := NewGOPCache()
+	k1, p1 := testVideoTag(100, true), testVideoTag(140, false)
+	k2, p2 := testVideoTag(200, true), testVideoTag(240, false)
+	for _, tag := range []*playbackTag{testMetadata, testVideoHeader, testAudioHeader, testVideoTag(40, false), k1, p1, k2, p2} {
+		c.Write(tag)
+	}
+
+	got := drainPlayer(c.Subscribe(4))
+	if len(got) != 5 {
+		t.Fatalf("Late joiner got %d tags, want 3 headers and the GOP", len(got))
+	}
+	for i, header := range []*playbackTag{testMetadata, testVideoHeader, testAudioHeader} {
+		if got[i].tagType != header.tagType || !got[i].header || got[i].timestamp != k2.timestamp {
+			t.Errorf("Tag %d = %+v, want the header stamped with the GOP start %d", i, got[i], k2.timestamp)
+		}
+	}
+	if got[3] != k2 || got[4] != p2 {
+		t.Errorf("GOP = %v, %v, want the last keyframe and what followed", got[3], got[4])
+	}
+	if testVideoHeader.timestamp != 0 {
+		t.Error("Restamping changed the cached header")
+	}
+}
+
+func TestGOPCacheSlowPlayerResumesAtKeyframe(t *testing.T) {
+	c := NewGOPCache()
+	c.Write(testVideoHeader)
+
+	// Without a cached keyframe the player waits for one, its queue holds 4 tags
+	p := c.Subscribe(1)
+	k1, p1, p2, p3, k2 := testVideoTag(40, true), testVideoTag(80, false), testVideoTag(120, false), testVideoTag(160, false), testVideoTag(200, true)
+	c.Write(testVideoTag(0, false))
+	c.Write(k1)
+	c.Write(p1)
+	c.Write(p2) // Queue full, dropped, video skips to the next keyframe
+	got := drainPlayer(p)
+	c.Write(p3)
+	c.Write(k2)
+	got = append(got, drainPlayer(p)...)
+
+	want := []*playbackTag{testVideoHeader, testVideoHeader, k1, p1, testVideoHeader, k2}
+	if len(got) != len(want) {
+		t.Fatalf("Player got %d tags, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].keyframe != want[i].keyframe || got[i].header != want[i].header || !want[i].header && got[i] != want[i] {
+			t.Errorf("Tag %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+	if d := p.Dropped(); d != 3 {
+		t.Errorf("Dropped = %d, want the frame before the first keyframe and the two after the overflow", d)
+	}
+}
+
+func TestGOPCacheClose(t *testing.T) {
+	c := NewGOPCache()
+	p := c.Subscribe(1)
+	c.Close()
+
+	if _, ok := <-p.tags; ok {
+		t.Error("Player channel still open after Close")
+	}
+	c.Unsubscribe(p) // Already closed, must not panic
+	c.Write(testVideoTag(0, true))
+
+	late := c.Subscribe(1)
+	if tags := drainPlayer(late); len(tags) != 0 {
+		t.Errorf("Subscriber after Close got %v", tags)
+	}
+	if _, ok := <-late.tags; ok {
+		t.Error("Subscriber after Close got an open channel")
+	}
+	if n := c.Players(); n != 0 {
+		t.Errorf("Players = %d after Close", n)
+	}
+}
+
+func TestPlaybackStartsOnKeyframe(t *testing.T) {
+	s, addr := startTestServer(t, Options{})
+	publisher := publishTestStream(t, addr, "cam")
+	// Keyframes at frames 0, 10 and 20, the player joins 5 frames into the last GOP
+	next := publisher.gops(t, 25, 10)
+	h := waitForStream(t, s, "cam")
+	deadline := time.Now().Add(5 * time.Second)
+	for h.stats.TagsWritten.Load() < 26 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Only %d of 26 tags written", h.stats.TagsWritten.Load())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	player := playTestStream(t, addr, "cam")
+	if body, _ := player.video(t); !bytes.Equal(body, avcSequenceHeader(testSPS, testPPS)) {
+		t.Fatalf("First video tag played % x, want the sequence header", body)
+	}
+	body, timestamp := player.video(t)
+	if !bytes.Equal(body, avcFrame(true, []byte{20})) || timestamp != 0 {
+		t.Fatalf("First picture played % x at %d, want the keyframe of frame 20 at 0", body, timestamp)
+	}
+
+	// Then the rest of the GOP and what is published live
+	publisher.video(t, next, avcFrame(false, []byte{25}))
+	for i := 21; i <= 25; i++ {
+		body, timestamp := player.video(t)
+		if !bytes.Equal(body, avcFrame(false, []byte{byte(i)})) || timestamp != uint32((i-20)*40) {
+			t.Errorf("Played % x at %d, want frame %d at %d", body, timestamp, i, (i-20)*40)
+		}
+	}
+}
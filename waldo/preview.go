@@ -0,0 +1,75 @@
+package waldo
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Boundary between the JPEGs of an MJPEG preview
+const previewBoundary = "waldoframe"
+
+// Stream frames from cache as MJPEG (multipart/x-mixed-replace) until the client disconnects or done is closed.
+// Each viewer has its own small queue, a slow one skips frames instead of holding up the others.
+// At most maxFPS frames are sent per second, 0 is unlimited
+func servePreview(w http.ResponseWriter, r *http.Request, cache *FrameCache, done <-chan struct{}, maxFPS float64) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	id, frames := cache.Subscribe(2)
+	defer cache.Unsubscribe(id)
+
+	var interval time.Duration
+	if maxFPS > 0 {
+		interval = time.Duration(float64(time.Second) / maxFPS)
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace; boundary="+previewBoundary)
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.WriteHeader(http.StatusOK)
+
+	var last time.Time
+	send := func(f CachedFrame) bool {
+		now := time.Now()
+		if interval > 0 && now.Sub(last) < interval {
+			return true
+		}
+		last = now
+
+		jpeg, err := f.JPEG()
+		if err != nil {
+			slog.Warn("Failed to encode preview frame", "err", err)
+			return true
+		}
+		if _, err := fmt.Fprintf(w, "--%s\r\nContent-Type: image/jpeg\r\nContent-Length: %d\r\n\r\n", previewBoundary, len(jpeg)); err != nil {
+			return false
+		}
+		if _, err := w.Write(append(jpeg, '\r', '\n')); err != nil {
+			return false
+		}
+		flusher.Flush()
+
+		return true
+	}
+
+	// Start with what the snapshot would show, rather than a blank page until the next frame
+	if f, ok := cache.Latest(); ok && !send(f) {
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-done:
+			return
+		case f := <-frames:
+			if !send(f) {
+				return
+			}
+		}
+	}
+}
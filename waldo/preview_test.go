@@ -0,0 +1,101 @@
+package waldo
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"gocv.io/x/gocv"
+)
+
+func TestServePreview(t *testing.T) {
+	cache := NewFrameCache(4)
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		servePreview(w, r, cache, done, 0)
+	}))
+	t.Cleanup(srv.Close)
+
+	// A new frame every 20ms while the test runs
+	frame := gocv.NewMatWithSize(48, 64, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+	cache.Put(0, frame)
+	stop := make(chan struct{})
+	putting := make(chan struct{})
+	go func() {
+		defer close(putting)
+		for ts := uint32(40); ; ts += 40 {
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+				cache.Put(ts, frame)
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-putting
+	}()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/x-mixed-replace" || params["boundary"] != previewBoundary {
+		t.Fatalf("Content-Type %q, want multipart/x-mixed-replace with boundary %s", resp.Header.Get("Content-Type"), previewBoundary)
+	}
+
+	parts := multipart.NewReader(resp.Body, params["boundary"])
+	for i := 0; i < 2; i++ {
+		part, err := parts.NextPart()
+		if err != nil {
+			t.Fatalf("Part %d: %v", i, err)
+		}
+		if part.Header.Get("Content-Type") != "image/jpeg" {
+			t.Errorf("Part %d is %q, want image/jpeg", i, part.Header.Get("Content-Type"))
+		}
+		data, err := io.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The part runs up to the CRLF before the next boundary
+		if n, err := strconv.Atoi(part.Header.Get("Content-Length")); err != nil || n != len(data) {
+			t.Errorf("Part %d has Content-Length %q, carries %d bytes", i, part.Header.Get("Content-Length"), len(data))
+		}
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Part %d is not a JPEG: %v", i, err)
+		}
+		if img.Bounds().Size() != image.Pt(64, 48) {
+			t.Errorf("Part %d is %v, want 64x48", i, img.Bounds().Size())
+		}
+	}
+
+	// The viewer leaving ends its subscription
+	_ = resp.Body.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cache.mu.RLock()
+		viewers := len(cache.subs)
+		cache.mu.RUnlock()
+		if viewers == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Preview still subscribed after the viewer left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(done)
+}
@@ -0,0 +1,405 @@
+package waldo
+
+import (
+	"bytes"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	flvtag "github.com/yutopp/go-flv/tag"
+	"gocv.io/x/gocv"
+)
+
+// GOPs waiting for the GOP writer before the read loop waits for it
+const gopQueue = 8
+
+// gopJob A group of pictures, from a keyframe up to the next one, and every tag recorded meanwhile.
+// The GOP writer takes its pictures from the decoder as they come, and once the GOP ends writes its tags
+// as they were, or with every picture re-encoded with boxes when CV found something on the keyframe
+type gopJob struct {
+	decoder    *H264StreamDecoder // nil when decoding is unavailable, the GOP is written untouched
+	analyse    bool               // Picked by the keyframe sampler
+	idr        bool               // Starts with an IDR picture, so nothing in it refers to earlier pictures
+	start      uint32             // Presentation time of the keyframe
+	profile    uint8
+	lengthSize int
+	sourceKbps int
+	fps        float64
+	result     ProcessedFrame
+
+	mu       sync.Mutex
+	tags     []orderedTag
+	pts      []uint32        // Presentation times of the pictures, in decode order
+	fed      map[uint32]bool // The ones given to decoder
+	reencode bool            // Set when sealed, whether replacing the pictures leaves the rest of the stream intact
+	sealed   chan struct{}   // Closed when the GOP ends, nothing is added after
+}
+
+// Hold a tag until the GOP is written
+func (g *gopJob) add(t orderedTag) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.tags = append(g.tags, t)
+}
+
+// Count a picture, and whether the decoder got it
+func (g *gopJob) addPicture(pts uint32, fed bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.pts = append(g.pts, pts)
+	if fed {
+		g.fed[pts] = true
+	}
+}
+
+// End the GOP. Pictures after nextIDR can not refer to this GOP's, so it may be replaced
+// when it starts with an IDR too, and the decoder got all of it
+func (g *gopJob) seal(nextIDR bool) {
+	g.mu.Lock()
+	g.reencode = g.analyse && g.idr && nextIDR && len(g.fed) == len(g.pts)
+	g.mu.Unlock()
+
+	close(g.sealed)
+}
+
+// Whether a decoded picture belongs to this GOP
+func (g *gopJob) has(pts uint32) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.fed[pts]
+}
+
+// Whether every picture given to the decoder came out, once nothing more will be added
+func (g *gopJob) decoded(n int) bool {
+	select {
+	case <-g.sealed:
+	default:
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return n >= len(g.fed)
+}
+
+// The GOP's tags with each picture replaced by its re-encoded access unit, one per picture in display order.
+// Tags keep their decode time, the composition time moves each to the display time of the frame now in it
+func (g *gopJob) reencoded(units [][]byte) []orderedTag {
+	pts := slices.Clone(g.pts)
+	slices.Sort(pts)
+
+	out := make([]orderedTag, len(g.tags))
+	i := 0
+	for n, t := range g.tags {
+		out[n] = t
+		video, ok := t.tag.Data.(*flvtag.VideoData)
+		if !ok || !isAVCPicture(video) || i >= len(units) {
+			continue
+		}
+		putTagBuffer(t.buf)
+
+		v := *video
+		v.CompositionTime = int32(pts[i] - t.tag.Timestamp)
+		v.Data = bytes.NewReader(units[i])
+		out[n] = orderedTag{tag: &flvtag.FlvTag{TagType: flvtag.TagTypeVideo, Timestamp: t.tag.Timestamp, Data: &v}}
+		i++
+	}
+
+	return out
+}
+
+// Whether a video tag carries an AVC picture, rather than a sequence header or another codec
+func isAVCPicture(video *flvtag.VideoData) bool {
+	return !isExVideo(video) && video.CodecID == flvtag.CodecIDAVC && video.AVCPacketType == flvtag.AVCPacketTypeNALU
+}
+
+// Start the GOP writer. Called once publishing starts, after the ordered writer
+func (h *Handler) startGOPWriter() {
+	h.gops = make(chan *gopJob, gopQueue)
+	h.gopsDone = make(chan struct{})
+	go h.runGOPWriter()
+}
+
+// End the last GOP, let the decoder finish and wait for the GOP writer. The read loop must be done
+func (h *Handler) stopGOPWriter() {
+	if h.gops == nil {
+		return
+	}
+	h.sealGOP(true)
+	h.closeGOPDecoder()
+	close(h.gops)
+	<-h.gopsDone
+}
+
+// With annotateOutput, cut AVC video into GOPs at keyframes and feed every picture to the GOP decoder.
+// Tags are held in the open GOP until the next keyframe, see emitTag
+func (h *Handler) splitGOP(data []byte, video *flvtag.VideoData, timestamp uint32) {
+	if video.AVCPacketType != flvtag.AVCPacketTypeNALU {
+		return
+	}
+	if h.avcConfig == nil {
+		h.warnOnce("no-avc-config", "Skipping CV until an AVC sequence header arrives")
+		return
+	}
+
+	keyframe := video.FrameType == flvtag.FrameTypeKeyFrame
+	pts := timestamp + uint32(video.CompositionTime)
+	if keyframe {
+		idr := hasIDRSlice(h.avcConfig, data)
+		h.sealGOP(idr)
+		h.openGOP(timestamp, pts, idr)
+	}
+	if h.gop == nil {
+		// Nothing to decode against before the first keyframe
+		return
+	}
+
+	h.gop.addPicture(pts, h.feedGOPDecoder(data, keyframe, pts))
+}
+
+// Start a GOP at a keyframe and queue it for the GOP writer
+func (h *Handler) openGOP(timestamp, pts uint32, idr bool) {
+	analyse := h.sampleKeyframe(timestamp)
+	if analyse {
+		h.keyframeSampler.End()
+	}
+
+	if h.gopDecoder == nil && !h.gopDecoderFailed {
+		dec, err := NewH264StreamDecoder(func(uint64) bool { return true }, true)
+		if err != nil {
+			h.logger.Warn("Decoding unavailable, recording without annotations", "err", err)
+			h.gopDecoderFailed = true
+		} else {
+			h.gopDecoder = dec
+		}
+	}
+
+	h.gop = &gopJob{
+		decoder:    h.gopDecoder,
+		analyse:    analyse,
+		idr:        idr,
+		start:      pts,
+		profile:    h.avcConfig.Profile,
+		lengthSize: h.avcConfig.LengthSize,
+		sourceKbps: h.sourceKbps(),
+		fps:        h.metadata.FrameRate,
+		result:     make(ProcessedFrame, 1),
+		fed:        make(map[uint32]bool),
+		sealed:     make(chan struct{}),
+	}
+	h.ordered <- h.gop.result
+	h.gops <- h.gop
+}
+
+// End the open GOP, if any. nextIDR tells whether the picture after it is an IDR
+func (h *Handler) sealGOP(nextIDR bool) {
+	if h.gop == nil {
+		return
+	}
+	h.gop.seal(nextIDR)
+	h.gop = nil
+}
+
+// Give a picture to the GOP decoder. False when it did not take it
+func (h *Handler) feedGOPDecoder(data []byte, keyframe bool, pts uint32) bool {
+	if h.gopDecoder == nil {
+		return false
+	}
+
+	stream, err := toAnnexB(h.avcConfig, data, keyframe)
+	if err != nil {
+		h.logger.Warn("Failed to convert video frame", "pts", pts, "err", err)
+		return false
+	}
+	// Lossless, so the unit is only ever refused on failure
+	queued, err := h.gopDecoder.Feed(stream, keyframe, pts)
+	if err != nil {
+		// Restart from the next keyframe
+		h.logger.Warn("GOP decoder failed", "pts", pts, "err", err)
+		h.closeGOPDecoder()
+		return false
+	}
+
+	return queued
+}
+
+// End the GOP decoder's input. The GOP writer takes what is left and stops it
+func (h *Handler) closeGOPDecoder() {
+	if h.gopDecoder == nil {
+		return
+	}
+	h.gopDecoder.CloseInput()
+	h.gopDecoder = nil
+}
+
+// gopWriter State the GOP writer carries from one GOP to the next
+type gopWriter struct {
+	decoder *H264StreamDecoder // Of the previous GOP
+	held    *DecodedFrame      // Came out after the previous GOP ended, so belongs to a later one
+}
+
+// Write GOPs in order, each once its pictures are decoded. Runs until stopGOPWriter
+func (h *Handler) runGOPWriter() {
+	defer close(h.gopsDone)
+
+	var w gopWriter
+	for g := range h.gops {
+		if g.decoder != w.decoder {
+			h.closeGOPWriterDecoder(&w)
+			w.decoder = g.decoder
+		}
+		h.writeGOP(&w, g)
+	}
+	h.closeGOPWriterDecoder(&w)
+}
+
+// Stop a decoder whose input has ended, releasing any pictures left in it
+func (h *Handler) closeGOPWriterDecoder(w *gopWriter) {
+	if w.held != nil {
+		_ = w.held.Mat.Close()
+		w.held = nil
+	}
+	if w.decoder == nil {
+		return
+	}
+	if err := w.decoder.Close(); err != nil {
+		h.logger.Warn("GOP decoder exited", "err", err)
+	}
+	w.decoder = nil
+}
+
+// Analyse a GOP's first picture and, with detections, re-encode every picture with the boxes drawn in.
+// Then hand its tags to the ordered writer
+func (h *Handler) writeGOP(w *gopWriter, g *gopJob) {
+	var enc *GOPEncoding
+	var detections []DetectionResult
+	n := 0
+	for {
+		f, ok := h.nextGOPFrame(w, g, n)
+		if !ok {
+			break
+		}
+		n++
+
+		if n == 1 && g.analyse {
+			detections = h.analyseGOP(f)
+			if len(detections) > 0 && g.idr {
+				enc = h.startGOPEncoder(g, f.Mat)
+			}
+		}
+		if enc != nil {
+			h.drawDetections(&f.Mat, detections)
+			if err := enc.Write(f.Mat); err != nil {
+				h.logRepeated(slog.LevelWarn, "reencode", "Failed to re-encode GOP, recording it without annotations", "err", err)
+				enc.Abort()
+				enc = nil
+			}
+		}
+		_ = f.Mat.Close()
+	}
+	<-g.sealed
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	tags := g.tags
+	if enc != nil {
+		// Every picture must have been replaced, or the ones left refer to pictures that are gone
+		if !g.reencode || n != len(g.pts) {
+			enc.Abort()
+		} else if units, err := enc.Finish(g.lengthSize); err != nil {
+			h.logRepeated(slog.LevelWarn, "reencode", "Failed to re-encode GOP, recording it without annotations", "err", err)
+		} else {
+			tags = g.reencoded(units)
+			h.stats.GOPsReencoded.Add(1)
+		}
+	}
+	if len(tags) > 0 {
+		tags[0].detections = detections
+	}
+	g.result <- tags
+}
+
+// The GOP's next decoded picture, in display order. False once all of them came out,
+// a picture of a later GOP did, or the decoder stopped
+func (h *Handler) nextGOPFrame(w *gopWriter, g *gopJob, n int) (DecodedFrame, bool) {
+	var frames <-chan DecodedFrame
+	if g.decoder != nil {
+		frames = g.decoder.Frames()
+	}
+	sealed := g.sealed
+
+	for !g.decoded(n) {
+		var f DecodedFrame
+		if w.held != nil {
+			f, w.held = *w.held, nil
+		} else {
+			select {
+			case next, ok := <-frames:
+				if !ok {
+					return DecodedFrame{}, false
+				}
+				f = next
+			case <-sealed:
+				// Check again whether that was the last picture
+				sealed = nil
+				continue
+			}
+		}
+
+		if g.has(f.Timestamp) {
+			return f, true
+		}
+		if f.Timestamp < g.start {
+			// Left over from an earlier GOP
+			_ = f.Mat.Close()
+			continue
+		}
+		w.held = &f
+		return DecodedFrame{}, false
+	}
+
+	return DecodedFrame{}, false
+}
+
+// Run CV on a GOP's first picture
+func (h *Handler) analyseGOP(f DecodedFrame) []DetectionResult {
+	if !h.cvLimiter.Allow() {
+		h.stats.FramesSkipped.Add(1)
+		return nil
+	}
+
+	start := time.Now()
+	results, err := h.applyComputerVision(&f.Mat, f.Timestamp)
+	if err != nil {
+		h.stats.FramesFailed.Add(1)
+		h.logger.Error("Failed to process video frame", "timestamp", f.Timestamp, "err", err)
+		return nil
+	}
+	h.frameProcessed(time.Since(start))
+
+	return results
+}
+
+// Start re-encoding a GOP at the size of its first picture. nil when the encoder is unavailable
+func (h *Handler) startGOPEncoder(g *gopJob, frame gocv.Mat) *GOPEncoding {
+	var err error
+	if h.encoder == nil {
+		if h.encoder, err = NewH264Encoder(*h.encodeCfg); err != nil {
+			h.warnOnce("no-encoder", "Encoding unavailable, recording without annotations", "err", err)
+			return nil
+		}
+	}
+
+	enc, err := h.encoder.StartGOP(frame.Cols(), frame.Rows(), g.fps, g.profile, g.sourceKbps)
+	if err != nil {
+		h.logRepeated(slog.LevelWarn, "reencode", "Failed to re-encode GOP, recording it without annotations", "err", err)
+		return nil
+	}
+
+	return enc
+}
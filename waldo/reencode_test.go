@@ -0,0 +1,240 @@
+package waldo
+
+import (
+	"bytes"
+	"image"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+// Replay an FLV through a handler that finds a box on every frame and burns it into the recording.
+// Returns the handler, closed, and the tags of its recording
+func replayAnnotated(t *testing.T, p string) (*Handler, []*flvtag.FlvTag) {
+	t.Helper()
+	s, err := NewServer(Options{
+		OutputDir: t.TempDir(),
+		NewDetector: func() (Detector, error) {
+			return &fixedDetector{detections: []Detection{{Rect: image.Rect(8, 8, 48, 48), Label: "waldo", Score: 0.9}}}, nil
+		},
+		AnnotateOutput: &H264EncoderConfig{},
+		Vision:         VisionConfig{Headless: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.newHandler()
+	h.limits = s.limits
+
+	if err := replayFLV(p, h); err != nil {
+		t.Fatal(err)
+	}
+
+	return h, readFLV(t, h.RecordingPath())
+}
+
+// Bodies of the AVC pictures among tags, in order
+func avcPictures(t *testing.T, tags []*flvtag.FlvTag) [][]byte {
+	t.Helper()
+	var pictures [][]byte
+	for _, tag := range tags {
+		video, ok := tag.Data.(*flvtag.VideoData)
+		if !ok || !isAVCPicture(video) {
+			continue
+		}
+		body, err := io.ReadAll(video.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		video.Data = bytes.NewReader(body)
+		pictures = append(pictures, body)
+	}
+
+	return pictures
+}
+
+func TestSplitAccessUnits(t *testing.T) {
+	annexB := []byte{
+		0, 0, 0, 1, 0x09, 0xf0, // AUD
+		0, 0, 0, 1, 0x67, 0xaa, // SPS
+		0, 0, 0, 1, 0x68, 0xbb, // PPS
+		0, 0, 0, 1, 0x06, 0xcc, // SEI
+		0, 0, 1, 0x65, 0xdd, 0xde, // IDR
+		0, 0, 0, 1, 0x09, 0xf0,
+		0, 0, 0, 1, 0x41, 0xee,
+	}
+
+	units := splitAccessUnits(annexB, 4)
+	if len(units) != 2 {
+		t.Fatalf("Got %d access units, want 2", len(units))
+	}
+	idr := []byte{0, 0, 0, 2, 0x67, 0xaa, 0, 0, 0, 2, 0x68, 0xbb, 0, 0, 0, 3, 0x65, 0xdd, 0xde}
+	if !bytes.Equal(units[0], idr) {
+		t.Errorf("First access unit % x, want % x", units[0], idr)
+	}
+	if p := []byte{0, 0, 0, 2, 0x41, 0xee}; !bytes.Equal(units[1], p) {
+		t.Errorf("Second access unit % x, want % x", units[1], p)
+	}
+}
+
+func TestGOPReencodedKeepsDecodeOrder(t *testing.T) {
+	g := &gopJob{fed: make(map[uint32]bool)}
+	picture := func(dts uint32, cts int32, keyframe bool) {
+		frameType := flvtag.FrameTypeInterFrame
+		if keyframe {
+			frameType = flvtag.FrameTypeKeyFrame
+		}
+		g.add(orderedTag{tag: &flvtag.FlvTag{TagType: flvtag.TagTypeVideo, Timestamp: dts, Data: &flvtag.VideoData{
+			FrameType: frameType, CodecID: flvtag.CodecIDAVC, AVCPacketType: flvtag.AVCPacketTypeNALU,
+			CompositionTime: cts, Data: bytes.NewReader([]byte{0xff}),
+		}}})
+		g.addPicture(dts+uint32(cts), true)
+	}
+
+	// I P B in decode order is I B P on screen
+	picture(0, 40, true)
+	audio := orderedTag{tag: &flvtag.FlvTag{TagType: flvtag.TagTypeAudio, Timestamp: 20, Data: &flvtag.AudioData{}}}
+	g.add(audio)
+	picture(40, 80, false)
+	picture(80, 0, false)
+
+	tags := g.reencoded([][]byte{{1}, {2}, {3}})
+	if len(tags) != 4 || tags[1].tag != audio.tag {
+		t.Fatalf("Tags %v, want the audio tag kept in its place", tags)
+	}
+
+	want := []struct {
+		dts  uint32
+		cts  int32
+		body byte
+	}{{0, 40, 1}, {40, 40, 2}, {80, 40, 3}}
+	for i, n := range []int{0, 2, 3} {
+		video := tags[n].tag.Data.(*flvtag.VideoData)
+		body, _ := io.ReadAll(video.Data)
+		if tags[n].tag.Timestamp != want[i].dts || video.CompositionTime != want[i].cts || !bytes.Equal(body, []byte{want[i].body}) {
+			t.Errorf("Picture %d is dts %d cts %d body % x, want dts %d cts %d body %x",
+				i, tags[n].tag.Timestamp, video.CompositionTime, body, want[i].dts, want[i].cts, want[i].body)
+		}
+	}
+	if video := tags[0].tag.Data.(*flvtag.VideoData); video.FrameType != flvtag.FrameTypeKeyFrame {
+		t.Error("The re-encoded IDR lost its keyframe flag")
+	}
+}
+
+func TestGOPSealDecidesReencode(t *testing.T) {
+	tests := []struct {
+		name     string
+		idr      bool
+		nextIDR  bool
+		skipFeed bool
+		want     bool
+	}{
+		{"closed GOP", true, true, false, true},
+		{"starts without an IDR", false, true, false, false},
+		{"followed by a non-IDR keyframe", true, false, false, false},
+		{"picture missing from the decoder", true, true, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &gopJob{analyse: true, idr: tt.idr, fed: make(map[uint32]bool), sealed: make(chan struct{})}
+			g.addPicture(0, true)
+			g.addPicture(40, !tt.skipFeed)
+			if g.decoded(2) {
+				t.Error("An open GOP reads as fully decoded")
+			}
+			g.seal(tt.nextIDR)
+			if g.reencode != tt.want {
+				t.Errorf("reencode = %v, want %v", g.reencode, tt.want)
+			}
+			if !g.decoded(len(g.fed)) {
+				t.Error("A sealed GOP with every fed picture out is not done")
+			}
+		})
+	}
+}
+
+func TestReplayReencodesAnnotatedGOPs(t *testing.T) {
+	sample := sampleFLV(t)
+	h, tags := replayAnnotated(t, sample)
+
+	if h.stats.GOPsReencoded.Load() == 0 {
+		t.Fatal("No GOP was re-encoded")
+	}
+	in, out := avcPictures(t, readFLV(t, sample)), avcPictures(t, tags)
+	if len(out) != len(in) {
+		t.Fatalf("Recorded %d pictures, published %d", len(out), len(in))
+	}
+
+	// Annotated GOPs open with the encoder's own SPS, after which every picture differs from the original
+	annotated := 0
+	for i := range out {
+		if bytes.Equal(out[i], in[i]) {
+			continue
+		}
+		annotated++
+		if annotated > 1 {
+			continue
+		}
+		stream, err := avccToAnnexB(out[i], 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var sps []byte
+		for _, nalu := range splitAnnexB(stream) {
+			if len(nalu) > 0 && nalu[0]&0x1f == 7 {
+				sps = nalu
+			}
+		}
+		if sps == nil {
+			t.Fatalf("Picture %d is the first re-encoded one, but carries no SPS", i)
+		}
+		// seq_parameter_set_id follows profile, constraint flags and level
+		r := &bitReader{data: nalToRBSP(sps[4:])}
+		if id, err := r.ue(); err != nil || id != encoderParamSetID {
+			t.Errorf("Re-encoded SPS has id %d (%v), want %d", id, err, encoderParamSetID)
+		}
+	}
+	if annotated == 0 {
+		t.Fatal("No recorded picture was annotated")
+	}
+
+	// The recording as a whole still decodes
+	ffmpeg, err := exec.LookPath("ffmpeg")
+	if err != nil {
+		t.Skip("ffmpeg not on PATH")
+	}
+	cmd := exec.Command(ffmpeg, "-v", "error", "-i", h.RecordingPath(), "-f", "null", "-")
+	if out, err := cmd.CombinedOutput(); err != nil || len(out) > 0 {
+		t.Errorf("Recording does not decode cleanly: %v\n%s", err, out)
+	}
+}
+
+func TestAnnotatedRecordingProbes(t *testing.T) {
+	sample := sampleFLV(t)
+	ffprobe, err := exec.LookPath("ffprobe")
+	if err != nil {
+		t.Skip("ffprobe not on PATH")
+	}
+	h, tags := replayAnnotated(t, sample)
+	if h.stats.GOPsReencoded.Load() == 0 {
+		t.Fatal("No GOP was re-encoded")
+	}
+
+	// Every recorded picture must decode, the re-encoded ones and the originals after them
+	cmd := exec.Command(ffprobe, "-v", "error", "-select_streams", "v:0", "-count_frames",
+		"-show_entries", "stream=nb_read_frames", "-of", "csv=p=0", h.RecordingPath())
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil || stderr.Len() > 0 {
+		t.Fatalf("ffprobe failed: %v\n%s", err, stderr.String())
+	}
+	want := len(avcPictures(t, tags))
+	if got := strings.TrimSpace(string(out)); got != strconv.Itoa(want) {
+		t.Errorf("ffprobe decoded %s frames, the recording has %d pictures", got, want)
+	}
+}
@@ -0,0 +1,79 @@
+package waldo
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// StreamRegistry Tracks the active publishing handlers keyed by PublishingName
+type StreamRegistry struct {
+	mu       sync.RWMutex
+	handlers map[string]*Handler
+}
+
+func NewStreamRegistry() *StreamRegistry {
+	return &StreamRegistry{
+		handlers: make(map[string]*Handler),
+	}
+}
+
+// Claim a stream name for a handler. Fails if another connection is already publishing to it
+func (r *StreamRegistry) Register(name string, h *Handler) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.handlers[name]; ok {
+		return errors.Errorf("Stream already published: %s", name)
+	}
+	r.handlers[name] = h
+
+	return nil
+}
+
+// Release a stream name, only if it is still held by the given handler
+func (r *StreamRegistry) Unregister(name string, h *Handler) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.handlers[name] == h {
+		delete(r.handlers, name)
+	}
+}
+
+// Look up the handler publishing a stream
+func (r *StreamRegistry) Get(name string) (*Handler, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	h, ok := r.handlers[name]
+	return h, ok
+}
+
+// Add a player to a published stream, returning the stream's cache to unsubscribe from
+func (r *StreamRegistry) Subscribe(name string, queue int) (*GOPCache, *Player, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	h, ok := r.handlers[name]
+	if !ok {
+		return nil, nil, errors.Errorf("Stream not published: %s", name)
+	}
+
+	return h.playback, h.playback.Subscribe(queue), nil
+}
+
+// Names of all streams currently being published, sorted
+func (r *StreamRegistry) List() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	names := make([]string, 0, len(r.handlers))
+	for name := range r.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
@@ -0,0 +1,325 @@
+package waldo
+
+import (
+	"bytes"
+	"crypto/tls"
+	"log/slog"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	flvtag "github.com/yutopp/go-flv/tag"
+	"github.com/yutopp/go-rtmp"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+// Reconnect delays after the upstream dropped or refused the relay, doubling up to the maximum
+const (
+	relayMinBackoff = time.Second
+	relayMaxBackoff = time.Minute
+)
+
+const (
+	relayDialTimeout = 10 * time.Second
+	relayChunkSize   = 4096
+)
+
+// RelayTargets Where streams are forwarded to. Parsed from a comma separated list of
+// <name>=<url> entries for single streams, and at most one plain URL for every other stream.
+// {name} in a URL is replaced by the stream name
+type RelayTargets struct {
+	byName   map[string]string
+	fallback string
+}
+
+func ParseRelayTargets(s string) (*RelayTargets, error) {
+	t := &RelayTargets{byName: make(map[string]string)}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		// Only an = before the scheme separates a name, URLs may have them in the query
+		name, target := "", entry
+		if eq, scheme := strings.Index(entry, "="), strings.Index(entry, "://"); eq >= 0 && eq < scheme {
+			name, target = entry[:eq], entry[eq+1:]
+		}
+		if _, err := parseRelayURL(strings.ReplaceAll(target, "{name}", "stream")); err != nil {
+			return nil, err
+		}
+
+		if name == "" {
+			if t.fallback != "" {
+				return nil, errors.New("More than one relay URL for all streams")
+			}
+			t.fallback = target
+		} else {
+			t.byName[name] = target
+		}
+	}
+
+	return t, nil
+}
+
+// URL to relay a stream to, empty when it is not relayed
+func (t *RelayTargets) URL(name string) string {
+	if t == nil {
+		return ""
+	}
+	target, ok := t.byName[name]
+	if !ok {
+		target = t.fallback
+	}
+
+	return strings.ReplaceAll(target, "{name}", name)
+}
+
+// relayURL The parts of rtmp[s]://host[:port]/app/key needed to publish
+type relayURL struct {
+	scheme string
+	addr   string // host:port
+	host   string
+	app    string
+	key    string // Last path element, with the query
+	tcURL  string // Everything up to the key
+}
+
+func parseRelayURL(s string) (*relayURL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid relay URL")
+	}
+
+	port := "1935"
+	switch u.Scheme {
+	case "rtmp":
+	case "rtmps":
+		port = "443"
+	default:
+		return nil, errors.Errorf("Relay URL must be rtmp:// or rtmps://, got %q", u.Scheme)
+	}
+	if u.Port() != "" {
+		port = u.Port()
+	}
+
+	app, key := path.Split(strings.Trim(u.Path, "/"))
+	app = strings.TrimSuffix(app, "/")
+	if u.Hostname() == "" || app == "" || key == "" {
+		return nil, errors.New("Relay URL needs a host, app and stream key, as in rtmp://host/app/key")
+	}
+	if u.RawQuery != "" {
+		key += "?" + u.RawQuery
+	}
+
+	return &relayURL{
+		scheme: u.Scheme,
+		addr:   net.JoinHostPort(u.Hostname(), port),
+		host:   u.Hostname(),
+		app:    app,
+		key:    key,
+		tcURL:  u.Scheme + "://" + u.Host + "/" + app,
+	}, nil
+}
+
+// Relay Republishes a stream to an upstream RTMP server, reconnecting with backoff whenever it drops.
+// It is fed like a player, so a slow or dead upstream only ever costs the relay frames,
+// never the recording or CV. Timestamps continue across reconnects
+type Relay struct {
+	target *relayURL
+	logger *slog.Logger
+	done   chan struct{}
+
+	client *rtmp.ClientConn // nil while disconnected
+	stream *rtmp.Stream
+
+	// Latest headers, sent first on every connection
+	metadata *playbackTag
+	video    *playbackTag
+	audio    *playbackTag
+
+	needKeyframe bool
+	retryAt      time.Time
+	backoff      time.Duration
+
+	base    uint32 // Timestamp of the first tag, relayed as 0
+	started bool
+}
+
+// Forward the stream to target until it ends. The relay subscribes to the cache like a player,
+// falling up to queue tags behind
+func StartRelay(target string, source *GOPCache, queue int, logger *slog.Logger) (*Relay, error) {
+	u, err := parseRelayURL(target)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Relay{
+		target:  u,
+		logger:  logger.With("relay", u.tcURL),
+		done:    make(chan struct{}),
+		backoff: relayMinBackoff,
+	}
+	go r.run(source.Subscribe(queue))
+
+	return r, nil
+}
+
+// Closed once the stream ended and the upstream connection is closed
+func (r *Relay) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *Relay) run(p *Player) {
+	defer close(r.done)
+	defer r.disconnect()
+
+	for tag := range p.tags {
+		if !r.started {
+			r.base, r.started = tag.timestamp, true
+		}
+		switch {
+		case tag.header && tag.tagType == flvtag.TagTypeScriptData:
+			r.metadata = tag
+		case tag.header && tag.tagType == flvtag.TagTypeVideo:
+			r.video = tag
+		case tag.header && tag.tagType == flvtag.TagTypeAudio:
+			r.audio = tag
+		}
+
+		if r.client == nil {
+			// A header was just sent by connect, along with the others
+			if !r.connect(tag.timestamp) || tag.header {
+				continue
+			}
+		}
+		if tag.tagType == flvtag.TagTypeVideo && !tag.header && r.needKeyframe {
+			if !tag.keyframe {
+				continue
+			}
+			r.needKeyframe = false
+		}
+
+		if err := r.write(tag, tag.timestamp); err != nil {
+			r.logger.Warn("Relay upstream failed, reconnecting", "err", err, "retry_in", r.backoff)
+			r.disconnect()
+			r.retryLater()
+		}
+	}
+	r.logger.Info("Relay finished", "dropped_tags", p.Dropped())
+}
+
+// Dial and publish, unless the last attempt failed too recently, then send the headers at timestamp.
+// Reports whether the relay is connected
+func (r *Relay) connect(timestamp uint32) bool {
+	if time.Now().Before(r.retryAt) {
+		return false
+	}
+
+	if err := r.dial(); err != nil {
+		r.logger.Warn("Failed to connect relay", "err", err, "retry_in", r.backoff)
+		r.disconnect()
+		r.retryLater()
+		return false
+	}
+
+	// The upstream decoder starts from scratch, and needs the headers before the next keyframe
+	for _, header := range []*playbackTag{r.metadata, r.video, r.audio} {
+		if header == nil {
+			continue
+		}
+		if err := r.write(header, timestamp); err != nil {
+			r.logger.Warn("Failed to send headers to relay", "err", err, "retry_in", r.backoff)
+			r.disconnect()
+			r.retryLater()
+			return false
+		}
+	}
+	r.needKeyframe = true
+	r.backoff = relayMinBackoff
+	r.logger.Info("Relaying stream")
+
+	return true
+}
+
+func (r *Relay) retryLater() {
+	r.retryAt = time.Now().Add(r.backoff)
+	r.backoff = min(r.backoff*2, relayMaxBackoff)
+}
+
+func (r *Relay) dial() error {
+	var (
+		client *rtmp.ClientConn
+		err    error
+	)
+	dialer := &net.Dialer{Timeout: relayDialTimeout}
+	if r.target.scheme == "rtmps" {
+		client, err = rtmp.DialWithTLSDialer(&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: r.target.host}},
+			"rtmps", r.target.addr, &rtmp.ConnConfig{})
+	} else {
+		client, err = rtmp.DialWithDialer(dialer, "rtmp", r.target.addr, &rtmp.ConnConfig{})
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to dial relay upstream")
+	}
+	r.client = client
+
+	if err := client.Connect(&rtmpmsg.NetConnectionConnect{
+		Command: rtmpmsg.NetConnectionConnectCommand{
+			App:      r.target.app,
+			Type:     "nonprivate",
+			FlashVer: "FMLE/3.0",
+			TCURL:    r.target.tcURL,
+		},
+	}); err != nil {
+		return errors.Wrap(err, "Relay upstream refused connect")
+	}
+
+	stream, err := client.CreateStream(nil, relayChunkSize)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create relay stream")
+	}
+	r.stream = stream
+
+	if err := stream.Publish(&rtmpmsg.NetStreamPublish{PublishingName: r.target.key, PublishingType: "live"}); err != nil {
+		return errors.Wrap(err, "Failed to publish to relay upstream")
+	}
+
+	return nil
+}
+
+func (r *Relay) disconnect() {
+	if r.client == nil {
+		return
+	}
+	_ = r.client.Close()
+	r.client = nil
+	r.stream = nil
+}
+
+// Send a tag upstream, at timestamp relative to the start of the stream
+func (r *Relay) write(tag *playbackTag, timestamp uint32) error {
+	ts := uint32(0)
+	if timestamp > r.base {
+		ts = timestamp - r.base
+	}
+
+	switch tag.tagType {
+	case flvtag.TagTypeAudio:
+		return r.stream.Write(playbackAudioChunkStream, ts, &rtmpmsg.AudioMessage{Payload: bytes.NewReader(tag.body)})
+	case flvtag.TagTypeVideo:
+		return r.stream.Write(playbackVideoChunkStream, ts, &rtmpmsg.VideoMessage{Payload: bytes.NewReader(tag.body)})
+	case flvtag.TagTypeScriptData:
+		var payload bytes.Buffer
+		if err := flvtag.EncodeScriptData(&payload, tag.script); err != nil {
+			return errors.Wrap(err, "Failed to encode script data")
+		}
+		return r.stream.WriteDataMessage(playbackScriptChunkStream, ts, "@setDataFrame",
+			&rtmpmsg.NetStreamSetDataFrame{Payload: payload.Bytes()})
+	}
+
+	return nil
+}
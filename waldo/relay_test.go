@@ -0,0 +1,63 @@
+package waldo
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	flvtag "github.com/yutopp/go-flv/tag"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+func TestRelayRecordsUpstream(t *testing.T) {
+	upstream, upstreamAddr := startTestServer(t, Options{})
+	relays, err := ParseRelayTargets("rtmp://" + upstreamAddr + "/live/{name}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	origin, addr := startTestServer(t, Options{Relays: relays, PlayerQueue: 256})
+
+	publisher := publishTestStream(t, addr, "cam")
+	if err := publisher.stream.Write(playbackAudioChunkStream, 0, &rtmpmsg.AudioMessage{Payload: bytes.NewReader([]byte{0xaf, 0, 0x12, 0x10})}); err != nil {
+		t.Fatal(err)
+	}
+	publisher.gops(t, 30, 10)
+	h := waitForStream(t, origin, "cam")
+	relayed := waitForStream(t, upstream, "cam")
+
+	// The relay finishes once the origin stream ends, then the upstream one ends too
+	_ = publisher.conn.Close()
+	waitForClose(t, h)
+	waitForClose(t, relayed)
+
+	// Same tags upstream, as many of each type and with the same bodies
+	bodies := func(p string) map[flvtag.TagType][][]byte {
+		byType := make(map[flvtag.TagType][][]byte)
+		for _, tag := range readFLV(t, p) {
+			var body []byte
+			switch data := tag.Data.(type) {
+			case *flvtag.AudioData:
+				body, _ = io.ReadAll(data.Data)
+			case *flvtag.VideoData:
+				body, _ = io.ReadAll(data.Data)
+			}
+			byType[tag.TagType] = append(byType[tag.TagType], body)
+		}
+		return byType
+	}
+	want, got := bodies(h.RecordingPath()), bodies(relayed.RecordingPath())
+	if len(want[flvtag.TagTypeVideo]) != 31 || len(want[flvtag.TagTypeAudio]) != 1 {
+		t.Fatalf("Origin recorded %d video and %d audio tags, want 31 and 1", len(want[flvtag.TagTypeVideo]), len(want[flvtag.TagTypeAudio]))
+	}
+	for tagType, bodies := range want {
+		if len(got[tagType]) != len(bodies) {
+			t.Errorf("Upstream recorded %d tags of type %d, the origin %d", len(got[tagType]), tagType, len(bodies))
+			continue
+		}
+		for i := range bodies {
+			if !bytes.Equal(got[tagType][i], bodies[i]) {
+				t.Errorf("Upstream tag %d of type %d is % x, want % x", i, tagType, got[tagType][i], bodies[i])
+			}
+		}
+	}
+}
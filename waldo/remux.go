@@ -0,0 +1,230 @@
+package waldo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Finished jobs kept for the status API
+const remuxHistory = 50
+
+// RemuxTool Copies a recording into an MP4 at dst without re-encoding
+type RemuxTool interface {
+	Remux(src, dst string) error
+}
+
+// FFmpegRemux Remuxes with ffmpeg, moving the moov box to the front so players can start before the download ends
+type FFmpegRemux struct {
+	Path string // ffmpeg binary, found in $PATH when empty
+}
+
+func (f FFmpegRemux) Remux(src, dst string) error {
+	bin := f.Path
+	if bin == "" {
+		bin = "ffmpeg"
+	}
+
+	cmd := exec.Command(bin, "-hide_banner", "-n", "-i", src, "-c", "copy", "-movflags", "+faststart", dst)
+	stderr := new(bytes.Buffer)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "ffmpeg failed: %s", strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// RemuxJob Progress of one recording's remux, as reported by the status API
+type RemuxJob struct {
+	Source   string     `json:"source"`
+	Output   string     `json:"output"`
+	State    string     `json:"state"` // queued, running, done, failed or dropped (the queue was full)
+	Error    string     `json:"error,omitempty"`
+	Queued   time.Time  `json:"queued"`
+	Finished *time.Time `json:"finished,omitempty"`
+}
+
+// Remuxer Copies finished FLV recordings into MP4 containers in the background. Jobs wait in a
+// bounded queue for a fixed number of workers, so any number of streams may end at once
+type Remuxer struct {
+	DeleteSource bool // Remove the FLV once its MP4 was written and verified
+
+	tool RemuxTool
+	jobs chan *RemuxJob
+	wg   sync.WaitGroup // Queued and running jobs
+
+	mu     sync.Mutex // Guards the jobs' State, Error and Finished, and recent
+	recent []*RemuxJob
+}
+
+// Start workers remuxing with tool, taking up to queue jobs waiting
+func NewRemuxer(tool RemuxTool, workers, queue int, deleteSource bool) *Remuxer {
+	r := &Remuxer{
+		DeleteSource: deleteSource,
+		tool:         tool,
+		jobs:         make(chan *RemuxJob, queue),
+	}
+	for range max(workers, 1) {
+		go r.work()
+	}
+
+	return r
+}
+
+// Queue flvPath to be remuxed to an .mp4 next to it. The FLV is always kept when anything fails
+func (r *Remuxer) Remux(flvPath string) {
+	job := &RemuxJob{
+		Source: flvPath,
+		Output: strings.TrimSuffix(flvPath, ".flv") + ".mp4",
+		State:  "queued",
+		Queued: time.Now(),
+	}
+	r.mu.Lock()
+	r.recent = append(r.recent, job)
+	if len(r.recent) > remuxHistory {
+		r.recent = r.recent[len(r.recent)-remuxHistory:]
+	}
+	r.mu.Unlock()
+
+	r.wg.Add(1)
+	select {
+	case r.jobs <- job:
+	default:
+		r.wg.Done()
+		r.finish(job, "dropped", errors.New("Remux queue is full"))
+		slog.Error("Remux queue is full, keeping the FLV only", "path", flvPath)
+	}
+}
+
+func (r *Remuxer) work() {
+	for job := range r.jobs {
+		r.run(job)
+		r.wg.Done()
+	}
+}
+
+func (r *Remuxer) run(job *RemuxJob) {
+	r.mu.Lock()
+	job.State = "running"
+	r.mu.Unlock()
+
+	err := r.tool.Remux(job.Source, job.Output)
+	if err == nil {
+		err = verifyMP4(job.Output)
+	}
+	if err != nil {
+		slog.Error("Failed to remux, keeping the FLV", "path", job.Source, "err", err)
+		_ = os.Remove(job.Output)
+		r.finish(job, "failed", err)
+		return
+	}
+	slog.Info("Remuxed recording", "path", job.Source, "mp4", job.Output)
+
+	if r.DeleteSource {
+		if err := os.Remove(job.Source); err != nil {
+			slog.Error("Failed to delete remuxed recording", "path", job.Source, "err", err)
+		}
+	}
+	r.finish(job, "done", nil)
+}
+
+func (r *Remuxer) finish(job *RemuxJob, state string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	job.State = state
+	job.Finished = &now
+	if err != nil {
+		job.Error = err.Error()
+	}
+}
+
+// The latest jobs, oldest first. Nil-safe, a disabled remuxer has none
+func (r *Remuxer) Jobs() []RemuxJob {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jobs := make([]RemuxJob, 0, len(r.recent))
+	for _, job := range r.recent {
+		jobs = append(jobs, *job)
+	}
+
+	return jobs
+}
+
+// Block until every queued remux has finished
+func (r *Remuxer) Wait() {
+	r.wg.Wait()
+}
+
+// Check that path holds a complete MP4: an ftyp box first, and a moov box
+func verifyMP4(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open MP4")
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "Failed to stat MP4")
+	}
+
+	var (
+		header  [16]byte
+		offset  int64
+		hasMoov bool
+	)
+	for first := true; ; first = false {
+		if _, err := io.ReadFull(f, header[:8]); err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrap(err, "Truncated MP4 box header")
+		}
+		size := int64(binary.BigEndian.Uint32(header[:4]))
+		kind := string(header[4:8])
+		switch size {
+		case 0: // To the end of the file
+			size = fi.Size() - offset
+		case 1: // 64 bit size follows
+			if _, err := io.ReadFull(f, header[8:16]); err != nil {
+				return errors.Wrap(err, "Truncated MP4 box header")
+			}
+			size = int64(binary.BigEndian.Uint64(header[8:16]))
+		}
+		if size < 8 {
+			return errors.Errorf("Invalid MP4 box %q of %d bytes", kind, size)
+		}
+
+		if first && kind != "ftyp" {
+			return errors.Errorf("MP4 starts with %q instead of ftyp", kind)
+		}
+		hasMoov = hasMoov || kind == "moov"
+
+		offset += size
+		if offset > fi.Size() {
+			return errors.Errorf("Truncated MP4 box %q", kind)
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return errors.Wrap(err, "Failed to seek MP4")
+		}
+	}
+	if !hasMoov {
+		return errors.New("MP4 has no moov box")
+	}
+
+	return nil
+}
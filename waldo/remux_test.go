@@ -0,0 +1,180 @@
+package waldo
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Call fn with the path (e.g. "moov/trak/mdia/hdlr") and payload of every box in data, descending into containers
+func walkMP4(t *testing.T, data []byte, parent string, fn func(path string, payload []byte)) {
+	t.Helper()
+	for len(data) > 0 {
+		if len(data) < 8 {
+			t.Fatalf("Truncated box header in %q", parent)
+		}
+		size := uint64(binary.BigEndian.Uint32(data))
+		header := uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			size, header = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < header || size > uint64(len(data)) {
+			t.Fatalf("Box %q in %q has invalid size %d", data[4:8], parent, size)
+		}
+
+		path := string(data[4:8])
+		if parent != "" {
+			path = parent + "/" + path
+		}
+		payload := data[header:size]
+		fn(path, payload)
+		switch string(data[4:8]) {
+		case "moov", "trak", "mdia", "minf", "stbl", "moof", "traf", "mvex":
+			walkMP4(t, payload, path, fn)
+		}
+		data = data[size:]
+	}
+}
+
+// Number of samples of the video track, from its stsz box
+func mp4VideoSamples(t *testing.T, p string) int {
+	t.Helper()
+	data, err := os.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	samples, video := -1, false
+	walkMP4(t, data, "", func(path string, payload []byte) {
+		switch path {
+		case "moov/trak":
+			video = false
+		case "moov/trak/mdia/hdlr":
+			// Version and flags, pre_defined, then the handler type
+			video = len(payload) >= 12 && string(payload[8:12]) == "vide"
+		case "moov/trak/mdia/minf/stbl/stsz":
+			if video && len(payload) >= 12 {
+				samples = int(binary.BigEndian.Uint32(payload[8:12]))
+			}
+		}
+	})
+	if samples < 0 {
+		t.Fatalf("%s has no video track", p)
+	}
+
+	return samples
+}
+
+func TestFFmpegRemuxFixture(t *testing.T) {
+	src := sampleFLV(t)
+	dst := filepath.Join(t.TempDir(), "sample.mp4")
+	if err := (FFmpegRemux{}).Remux(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyMP4(dst); err != nil {
+		t.Fatal(err)
+	}
+
+	// faststart: players can begin before the samples arrive
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var top []string
+	walkMP4(t, data, "", func(path string, _ []byte) {
+		if filepath.Dir(path) == "." {
+			top = append(top, path)
+		}
+	})
+	moov, mdat := -1, -1
+	for i, kind := range top {
+		switch kind {
+		case "moov":
+			moov = i
+		case "mdat":
+			mdat = i
+		}
+	}
+	if moov < 0 || mdat < 0 || moov > mdat {
+		t.Errorf("Top level boxes %v, want moov before mdat", top)
+	}
+}
+
+func TestVerifyMP4(t *testing.T) {
+	box := func(kind string, payload ...byte) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, uint32(8+len(payload))), append([]byte(kind), payload...)...)
+	}
+	join := func(boxes ...[]byte) []byte {
+		var b []byte
+		for _, x := range boxes {
+			b = append(b, x...)
+		}
+		return b
+	}
+	ftyp, moov := box("ftyp", 'i', 's', 'o', 'm'), box("moov")
+
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr bool
+	}{
+		{"complete", join(ftyp, moov, box("mdat", 1, 2, 3)), false},
+		{"no moov", join(ftyp, box("mdat", 1)), true},
+		{"moov first", join(moov, ftyp), true},
+		{"truncated box", join(ftyp, moov)[:len(ftyp)+4], true},
+		{"box past the end", join(ftyp, moov, box("mdat", 1, 2, 3))[:len(ftyp)+len(moov)+10], true},
+		{"empty", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := filepath.Join(t.TempDir(), "test.mp4")
+			if err := os.WriteFile(p, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if err := verifyMP4(p); (err != nil) != tt.wantErr {
+				t.Errorf("verifyMP4 = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRemuxerKeepsVideoSamples(t *testing.T) {
+	sample := sampleFLV(t)
+	pictures := len(avcPictures(t, readFLV(t, sample)))
+
+	// Several streams ending at once, each FLV deleted once its MP4 checks out
+	r := NewRemuxer(FFmpegRemux{}, 2, 4, true)
+	dir := t.TempDir()
+	var sources []string
+	for _, name := range []string{"a.flv", "b.flv", "c.flv"} {
+		data, err := os.ReadFile(sample)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		sources = append(sources, p)
+		r.Remux(p)
+	}
+	r.Wait()
+
+	for _, job := range r.Jobs() {
+		if job.State != "done" {
+			t.Fatalf("Remux of %s is %s: %s", job.Source, job.State, job.Error)
+		}
+		if got := mp4VideoSamples(t, job.Output); got != pictures {
+			t.Errorf("%s has %d video samples, the FLV %d pictures", job.Output, got, pictures)
+		}
+	}
+	for _, p := range sources {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s kept after remuxing: %v", p, err)
+		}
+	}
+}
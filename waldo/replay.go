@@ -0,0 +1,82 @@
+package waldo
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/yutopp/go-flv"
+	flvtag "github.com/yutopp/go-flv/tag"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+// Run CV over a recorded FLV as if it was being published as <file name>-replay, through the same
+// handler code as a live stream. The new recording, its detection timeline and sidecar are written
+// like any other. For tuning the detector against real footage
+func replayFLV(path string, h *Handler) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return errors.Wrap(err, "Failed to open replay file")
+	}
+	defer f.Close()
+
+	dec, err := flv.NewDecoder(f)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read FLV header")
+	}
+
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path)) + "-replay"
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: name, PublishingType: "live"}); err != nil {
+		return err
+	}
+	defer h.OnClose()
+
+	for {
+		var tag flvtag.FlvTag
+		if err := dec.Decode(&tag); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			// A recording cut short by a crash ends in a partial tag
+			h.logger.Warn("Replay stopped at an unreadable tag", "err", err)
+			break
+		}
+		err := replayTag(h, &tag)
+		tag.Close()
+		if err != nil {
+			return err
+		}
+	}
+	h.logger.Info("Replay finished", "path", path, "frames_processed", h.stats.FramesProcessed.Load(),
+		"detections", h.stats.Detections.Load())
+
+	return nil
+}
+
+// Hand a tag to the handler the way the RTMP server would
+func replayTag(h *Handler, tag *flvtag.FlvTag) error {
+	var body bytes.Buffer
+	switch data := tag.Data.(type) {
+	case *flvtag.ScriptData:
+		if err := flvtag.EncodeScriptData(&body, data); err != nil {
+			return errors.Wrap(err, "Failed to encode script data")
+		}
+		return h.OnSetDataFrame(tag.Timestamp, &rtmpmsg.NetStreamSetDataFrame{Payload: body.Bytes()})
+
+	case *flvtag.AudioData:
+		if err := flvtag.EncodeAudioData(&body, data); err != nil {
+			return errors.Wrap(err, "Failed to encode audio")
+		}
+		return h.OnAudio(tag.Timestamp, &body)
+
+	case *flvtag.VideoData:
+		if err := flvtag.EncodeVideoData(&body, data); err != nil {
+			return errors.Wrap(err, "Failed to encode video")
+		}
+		return h.OnVideo(tag.Timestamp, &body)
+	}
+
+	return nil
+}
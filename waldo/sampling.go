@@ -0,0 +1,277 @@
+package waldo
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SampleMode Which video frames are run through computer vision
+type SampleMode int
+
+const (
+	// Only keyframes, fed alone to the decoder
+	SampleKeyframes SampleMode = iota
+	// Every Nth decoded frame. Inter-frames need the whole stream decoded
+	SampleEveryNth
+	// Every decoded frame
+	SampleEveryFrame
+)
+
+// Parse a -sample flag value
+func ParseSampleMode(s string) (SampleMode, error) {
+	switch s {
+	case "keyframe", "":
+		return SampleKeyframes, nil
+	case "nth":
+		return SampleEveryNth, nil
+	case "all":
+		return SampleEveryFrame, nil
+	}
+
+	return 0, errors.Errorf("Unknown sample mode %q, want keyframe, nth or all", s)
+}
+
+// SamplingPolicy Decides which frames are processed. Frames that are not pass through untouched
+type SamplingPolicy struct {
+	Mode SampleMode
+	N    int // Used by SampleEveryNth, values below 2 process every frame
+
+	// Thinning of SampleKeyframes, see KeyframeSampler
+	MinInterval   time.Duration
+	KeyframeEvery int
+
+	// Most frames processed per second of stream time in any mode, 0 is unlimited.
+	// CVRateLimiter caps wall time on top of it
+	MaxFPS float64
+}
+
+// Shortest stream time between two processed frames allowed by MaxFPS
+func (p SamplingPolicy) fpsInterval() time.Duration {
+	if p.MaxFPS <= 0 {
+		return 0
+	}
+
+	return time.Duration(float64(time.Second) / p.MaxFPS)
+}
+
+// Whether every frame has to go through a persistent decoder, rather than keyframes alone
+func (p SamplingPolicy) DecodesStream() bool {
+	return p.Mode != SampleKeyframes
+}
+
+// Whether the decoded frame at index (counting from 0) should be processed
+func (p SamplingPolicy) Sample(index uint64) bool {
+	switch p.Mode {
+	case SampleEveryFrame:
+		return true
+	case SampleEveryNth:
+		return p.N < 2 || index%uint64(p.N) == 0
+	}
+
+	return false
+}
+
+// KeyframeSampler Decides which keyframes get CV: at most one per MinInterval of stream time,
+// only every Every-th keyframe, and never while the previous one is still being processed
+type KeyframeSampler struct {
+	MinInterval time.Duration
+	Every       int // Values below 2 consider every keyframe
+
+	busy      atomic.Bool
+	keyframes uint64
+	last      uint32 // Timestamp of the last processed keyframe
+	started   bool
+
+	processed atomic.Uint64
+	skipped   atomic.Uint64
+}
+
+func NewKeyframeSampler(policy SamplingPolicy) *KeyframeSampler {
+	return &KeyframeSampler{MinInterval: max(policy.MinInterval, policy.fpsInterval()), Every: policy.KeyframeEvery}
+}
+
+// Called for every keyframe. When it returns true the frame should be processed, and End called afterwards
+func (s *KeyframeSampler) Begin(timestamp uint32) bool {
+	s.keyframes++
+
+	ok := s.Every < 2 || (s.keyframes-1)%uint64(s.Every) == 0
+	if ok && s.started && s.MinInterval > 0 {
+		ok = time.Duration(timestamp-s.last)*time.Millisecond >= s.MinInterval
+	}
+	if ok {
+		ok = s.busy.CompareAndSwap(false, true)
+	}
+
+	if !ok {
+		s.skipped.Add(1)
+		return false
+	}
+	s.processed.Add(1)
+	s.last = timestamp
+	s.started = true
+
+	return true
+}
+
+// Mark the frame accepted by Begin as done
+func (s *KeyframeSampler) End() {
+	s.busy.Store(false)
+}
+
+// Keyframes processed and skipped so far
+func (s *KeyframeSampler) Counts() (processed, skipped uint64) {
+	return s.processed.Load(), s.skipped.Load()
+}
+
+// FrameThrottle Lets a frame through when at least MinInterval of stream time passed since the last one.
+// Not safe for concurrent use
+type FrameThrottle struct {
+	MinInterval time.Duration
+
+	last    uint32
+	started bool
+}
+
+// Whether the frame at timestamp should be processed
+func (t *FrameThrottle) Allow(timestamp uint32) bool {
+	if t.started && time.Duration(timestamp-t.last)*time.Millisecond < t.MinInterval {
+		return false
+	}
+	t.last = timestamp
+	t.started = true
+
+	return true
+}
+
+// WindowLimiter Allows at most Limit events per Window of wall time, and none within MinInterval
+// of the last one. Safe for concurrent use
+type WindowLimiter struct {
+	Limit       int
+	Window      time.Duration
+	MinInterval time.Duration
+
+	mu    sync.Mutex
+	start time.Time
+	count int
+	last  time.Time // Of the last allowed event
+}
+
+// Whether an event at now is within the limit, counting it if so
+func (l *WindowLimiter) Allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.start) >= l.Window {
+		l.start = now
+		l.count = 0
+	}
+	if l.count >= l.Limit || (!l.last.IsZero() && now.Sub(l.last) < l.MinInterval) {
+		return false
+	}
+	l.count++
+	l.last = now
+
+	return true
+}
+
+// CVRateLimiter Caps how often expensive CV runs for one stream, at most maxFPS times per second
+// of wall time, however fast frames arrive. Protects the host when a stream's clock runs ahead,
+// e.g. a replay. Safe for concurrent use, and nil allows everything
+type CVRateLimiter struct {
+	minInterval time.Duration
+
+	mu      sync.Mutex
+	ticker  *time.Ticker // Restarted by every run, a tick means minInterval has passed since
+	lastRun time.Time
+}
+
+// Nil when maxFPS is 0 or less, which is unlimited. Stop it when the stream ends
+func NewCVRateLimiter(maxFPS float64) *CVRateLimiter {
+	if maxFPS <= 0 {
+		return nil
+	}
+	interval := time.Duration(float64(time.Second) / maxFPS)
+
+	return &CVRateLimiter{minInterval: interval, ticker: time.NewTicker(interval)}
+}
+
+// Whether CV may run now, counting the run if so
+func (l *CVRateLimiter) Allow() bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !l.lastRun.IsZero() {
+		select {
+		case <-l.ticker.C:
+		default:
+			return false
+		}
+	}
+	l.lastRun = time.Now()
+	l.ticker.Reset(l.minInterval)
+
+	return true
+}
+
+// Release the ticker. Nil-safe
+func (l *CVRateLimiter) Stop() {
+	if l != nil {
+		l.ticker.Stop()
+	}
+}
+
+// StreamRates A frame rate for every stream, with overrides for some by name
+type StreamRates struct {
+	fallback float64
+	byName   map[string]float64
+}
+
+// Parse "<fps>" for every stream and/or comma separated "<name>=<fps>" entries, e.g. "5,lobby=1".
+// Streams without an entry and no fallback get 0
+func ParseStreamRates(s string) (*StreamRates, error) {
+	r := &StreamRates{byName: make(map[string]float64)}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		name, value, named := strings.Cut(entry, "=")
+		if !named {
+			value = name
+		}
+		fps, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || fps < 0 {
+			return nil, errors.Errorf("Invalid frame rate %q, want a number of frames per second of 0 or more", value)
+		}
+
+		if named {
+			r.byName[strings.TrimSpace(name)] = fps
+		} else {
+			r.fallback = fps
+		}
+	}
+
+	return r, nil
+}
+
+// The rate of the named stream. Nil-safe, giving 0
+func (r *StreamRates) Rate(name string) float64 {
+	if r == nil {
+		return 0
+	}
+	if fps, ok := r.byName[name]; ok {
+		return fps
+	}
+
+	return r.fallback
+}
@@ -0,0 +1,132 @@
+package waldo
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+func TestCVRateLimiter(t *testing.T) {
+	l := NewCVRateLimiter(2)
+	defer l.Stop()
+
+	// 10 frames spread over one second
+	runs := 0
+	for i := 0; i < 10; i++ {
+		if l.Allow() {
+			runs++
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if runs < 2 || runs > 3 {
+		t.Errorf("CV ran %d times for 10 frames in 1s at 2 fps, want 2 or 3", runs)
+	}
+}
+
+func TestCVRateLimiterBurst(t *testing.T) {
+	l := NewCVRateLimiter(10)
+	defer l.Stop()
+
+	if !l.Allow() {
+		t.Fatal("First frame refused")
+	}
+	// Frames arriving faster than the limit don't bank runs for later
+	for i := 0; i < 5; i++ {
+		if l.Allow() {
+			t.Fatal("Second frame in the same interval allowed")
+		}
+	}
+	time.Sleep(150 * time.Millisecond)
+	if !l.Allow() || l.Allow() {
+		t.Error("Want exactly one frame allowed after an interval")
+	}
+}
+
+func TestCVRateLimiterUnlimited(t *testing.T) {
+	l := NewCVRateLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !l.Allow() {
+			t.Fatal("Unlimited limiter refused a frame")
+		}
+	}
+	l.Stop()
+}
+
+func TestParseStreamRates(t *testing.T) {
+	tests := []struct {
+		in      string
+		rates   map[string]float64
+		wantErr bool
+	}{
+		{in: "", rates: map[string]float64{"cam": 0}},
+		{in: "5", rates: map[string]float64{"cam": 5, "lobby": 5}},
+		{in: "5, lobby=1", rates: map[string]float64{"cam": 5, "lobby": 1}},
+		{in: "lobby=0.5,live/door=2", rates: map[string]float64{"cam": 0, "lobby": 0.5, "live/door": 2}},
+		{in: "lobby=0", rates: map[string]float64{"lobby": 0}},
+		{in: "fast", wantErr: true},
+		{in: "cam=-1", wantErr: true},
+		{in: "cam=", wantErr: true},
+	}
+	for _, tt := range tests {
+		r, err := ParseStreamRates(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseStreamRates(%q) err = %v, want error %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		for name, want := range tt.rates {
+			if got := r.Rate(name); got != want {
+				t.Errorf("ParseStreamRates(%q).Rate(%q) = %v, want %v", tt.in, name, got, want)
+			}
+		}
+	}
+
+	var r *StreamRates
+	if r.Rate("cam") != 0 {
+		t.Error("Nil rates are not unlimited")
+	}
+}
+
+func TestKeyframeSamplerThroughOnVideo(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    SamplingPolicy
+		busy      bool // A previous detection still running
+		processed uint64
+	}{
+		{"every keyframe", SamplingPolicy{}, false, 20},
+		{"one per 200ms", SamplingPolicy{MinInterval: 200 * time.Millisecond}, false, 4},
+		{"every 3rd", SamplingPolicy{KeyframeEvery: 3}, false, 7},
+		{"max fps", SamplingPolicy{MaxFPS: 10}, false, 7}, // 0, 120, 240, ... 720
+		{"detection running", SamplingPolicy{}, true, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, h := newTestHandler(t, Options{Sampling: tt.policy})
+			if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+				t.Fatal(err)
+			}
+			defer h.OnClose()
+			h.keyframeSampler.busy.Store(tt.busy)
+
+			// A burst of 20 keyframes 40ms apart, with a picture between each
+			if err := h.OnVideo(0, bytes.NewReader(avcSequenceHeader(testSPS, testPPS))); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 40; i++ {
+				if err := h.OnVideo(uint32(i*20), bytes.NewReader(avcFrame(i%2 == 0, []byte{byte(i)}))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			processed, skipped := h.keyframeSampler.Counts()
+			if processed != tt.processed || skipped != 20-tt.processed {
+				t.Errorf("Processed %d and skipped %d keyframes, want %d and %d", processed, skipped, tt.processed, 20-tt.processed)
+			}
+			if got := h.stats.FramesSkipped.Load(); got != skipped {
+				t.Errorf("Stream stats count %d skipped frames, the sampler %d", got, skipped)
+			}
+		})
+	}
+}
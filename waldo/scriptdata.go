@@ -0,0 +1,146 @@
+package waldo
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+
+	"github.com/pkg/errors"
+	"github.com/yutopp/go-amf0"
+	flvtag "github.com/yutopp/go-flv/tag"
+)
+
+// Name of the script tags carrying detections, written right after the frame they were found in
+const detectionScriptName = "onDetection"
+
+// detectionScript Body of an onDetection script tag, one per detection.
+// Flat on purpose, go-amf0 cannot decode strict arrays into an interface
+type detectionScript struct {
+	Timestamp  uint32  `amf0:"timestamp"` // Of the frame, the tag itself may be stamped later
+	X          int     `amf0:"x"`
+	Y          int     `amf0:"y"`
+	Width      int     `amf0:"width"`
+	Height     int     `amf0:"height"`
+	Label      string  `amf0:"label"`
+	Confidence float64 `amf0:"confidence"`
+}
+
+// Convert a struct to the ECMA array of a script tag. Fields are keyed by their amf0 tag, or their name
+func scriptObject(v any) (amf0.ECMAArray, error) {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	if rv.Kind() != reflect.Struct {
+		return nil, errors.Errorf("Script data must be a struct, got %s", rv.Kind())
+	}
+
+	obj := make(amf0.ECMAArray, rv.NumField())
+	for i := 0; i < rv.NumField(); i++ {
+		field := rv.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		key := field.Tag.Get("amf0")
+		if key == "" {
+			key = field.Name
+		}
+		obj[key] = rv.Field(i).Interface()
+	}
+
+	return obj, nil
+}
+
+// Write a script tag named name with v as its body into the recording.
+// It is never stamped earlier than the last tag written, so late results keep the file monotonic
+func (h *Handler) injectScriptData(name string, v any, timestamp uint32) error {
+	obj, err := scriptObject(v)
+	if err != nil {
+		return err
+	}
+
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+
+	if timestamp < h.lastTimestamp {
+		timestamp = h.lastTimestamp
+	}
+
+	return h.writeTagLocked(&flvtag.FlvTag{
+		TagType:   flvtag.TagTypeScriptData,
+		Timestamp: timestamp,
+		Data:      &flvtag.ScriptData{Objects: map[string]amf0.ECMAArray{name: obj}},
+	})
+}
+
+// Record the detections found in the frame at timestamp as onDetection tags
+func (h *Handler) injectDetections(timestamp uint32, results []DetectionResult) {
+	for _, d := range results {
+		script := detectionScript{
+			Timestamp:  timestamp,
+			X:          d.Rect.Min.X,
+			Y:          d.Rect.Min.Y,
+			Width:      d.Rect.Dx(),
+			Height:     d.Rect.Dy(),
+			Label:      d.Label,
+			Confidence: d.Score,
+		}
+		if err := h.injectScriptData(detectionScriptName, script, timestamp); err != nil {
+			h.logger.Error("Failed to write detection", "timestamp", timestamp, "err", err)
+			return
+		}
+	}
+}
+
+// StreamMetadata Fields of the publisher's onMetaData, zero when missing
+type StreamMetadata struct {
+	Width        int
+	Height       int
+	FrameRate    float64
+	VideoCodecID flvtag.CodecID
+	AudioCodecID flvtag.SoundFormat
+}
+
+// Codec ids some encoders send as FourCC strings instead of numbers
+var (
+	metadataVideoFourCC = map[string]flvtag.CodecID{"avc1": flvtag.CodecIDAVC, "hvc1": codecIDHEVC, "hev1": codecIDHEVC}
+	metadataAudioFourCC = map[string]flvtag.SoundFormat{"mp4a": flvtag.SoundFormatAAC, ".mp3": flvtag.SoundFormatMP3}
+)
+
+// Extract the stream description from script data. False when it holds no onMetaData
+func parseStreamMetadata(script *flvtag.ScriptData) (StreamMetadata, bool) {
+	obj, ok := script.Objects["onMetaData"]
+	if !ok {
+		return StreamMetadata{}, false
+	}
+
+	var meta StreamMetadata
+	meta.Width = int(metadataNumber(obj["width"]))
+	meta.Height = int(metadataNumber(obj["height"]))
+	meta.FrameRate = metadataNumber(obj["framerate"])
+	if meta.FrameRate == 0 {
+		meta.FrameRate = metadataNumber(obj["fps"])
+	}
+	if s, ok := obj["videocodecid"].(string); ok {
+		meta.VideoCodecID = metadataVideoFourCC[s]
+	} else if n := metadataNumber(obj["videocodecid"]); n > 0xff && n <= math.MaxUint32 {
+		// Enhanced RTMP sends the FourCC as a number, e.g. 'hvc1' as 0x68766331
+		meta.VideoCodecID = metadataVideoFourCC[string(binary.BigEndian.AppendUint32(nil, uint32(n)))]
+	} else {
+		meta.VideoCodecID = flvtag.CodecID(metadataNumber(obj["videocodecid"]))
+	}
+	if s, ok := obj["audiocodecid"].(string); ok {
+		meta.AudioCodecID = metadataAudioFourCC[s]
+	} else {
+		meta.AudioCodecID = flvtag.SoundFormat(metadataNumber(obj["audiocodecid"]))
+	}
+
+	return meta, true
+}
+
+// AMF0 numbers decode as float64, anything else reads as 0
+func metadataNumber(v any) float64 {
+	n, _ := v.(float64)
+	if n < 0 {
+		return 0
+	}
+
+	return n
+}
@@ -0,0 +1,140 @@
+package waldo
+
+import (
+	"bytes"
+	"image"
+	"testing"
+
+	flvtag "github.com/yutopp/go-flv/tag"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+// A recorded tag, reduced to what the detection tests compare: a picture's timestamp or an onDetection's fields
+type detectionTrace struct {
+	tag       uint32 // Timestamp of the tag
+	detection bool
+	frame     uint32 // Of the frame the detection was found in
+	x, y      int
+	label     string
+}
+
+func traceDetections(t *testing.T, p string) []detectionTrace {
+	t.Helper()
+	var trace []detectionTrace
+	for _, tag := range readFLV(t, p) {
+		switch data := tag.Data.(type) {
+		case *flvtag.VideoData:
+			if data.AVCPacketType == flvtag.AVCPacketTypeNALU {
+				trace = append(trace, detectionTrace{tag: tag.Timestamp})
+			}
+		case *flvtag.ScriptData:
+			obj, ok := data.Objects[detectionScriptName]
+			if !ok {
+				continue
+			}
+			frame, _ := obj["timestamp"].(float64)
+			x, _ := obj["x"].(float64)
+			y, _ := obj["y"].(float64)
+			label, _ := obj["label"].(string)
+			trace = append(trace, detectionTrace{tag: tag.Timestamp, detection: true, frame: uint32(frame), x: int(x), y: int(y), label: label})
+		}
+	}
+
+	return trace
+}
+
+func TestDetectionsFollowTheirFrame(t *testing.T) {
+	_, h := newTestHandler(t, Options{})
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.OnVideo(0, bytes.NewReader(avcSequenceHeader(testSPS, testPPS))); err != nil {
+		t.Fatal(err)
+	}
+	picture := func(timestamp uint32, keyframe bool) *flvtag.FlvTag {
+		frameType := flvtag.FrameTypeInterFrame
+		if keyframe {
+			frameType = flvtag.FrameTypeKeyFrame
+		}
+		return &flvtag.FlvTag{TagType: flvtag.TagTypeVideo, Timestamp: timestamp, Data: &flvtag.VideoData{
+			FrameType:     frameType,
+			CodecID:       flvtag.CodecIDAVC,
+			AVCPacketType: flvtag.AVCPacketTypeNALU,
+			Data:          bytes.NewReader(avcFrame(keyframe, nil)[5:]),
+		}}
+	}
+
+	// Two detections found in the keyframe at 40, as the inline CV path hands them over
+	detections := []DetectionResult{
+		{Rect: image.Rect(10, 20, 30, 40), Label: "waldo", Score: 0.9},
+		{Rect: image.Rect(50, 60, 70, 80), Label: "wenda", Score: 0.8},
+	}
+	if err := h.emitTag(picture(40, true), nil, detections); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.emitTag(picture(80, false), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// A worker's late result for the keyframe lands after what was written since, never earlier
+	h.injectDetections(40, detections[:1])
+	h.OnClose()
+
+	want := []detectionTrace{
+		{tag: 40},
+		{tag: 40, detection: true, frame: 40, x: 10, y: 20, label: "waldo"},
+		{tag: 40, detection: true, frame: 40, x: 50, y: 60, label: "wenda"},
+		{tag: 80},
+		{tag: 80, detection: true, frame: 40, x: 10, y: 20, label: "waldo"},
+	}
+	got := traceDetections(t, h.RecordingPath())
+	if len(got) != len(want) {
+		t.Fatalf("Recorded %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Tag %d is %+v, want %+v", i, got[i], want[i])
+		}
+	}
+}
+
+func TestFakeDetectorWritesDetectionTags(t *testing.T) {
+	sample := sampleFLV(t)
+	s, err := NewServer(Options{
+		OutputDir: t.TempDir(),
+		NewDetector: func() (Detector, error) {
+			return &fixedDetector{detections: []Detection{{Rect: image.Rect(8, 8, 48, 48), Label: "waldo", Score: 0.9}}}, nil
+		},
+		Vision: VisionConfig{Headless: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := s.newHandler()
+	h.limits = s.limits
+	if err := replayFLV(sample, h); err != nil {
+		t.Fatal(err)
+	}
+
+	// Every detection names a frame already written, and no frame is reported twice
+	trace := traceDetections(t, h.RecordingPath())
+	written := make(map[uint32]bool)
+	reported := make(map[uint32]bool)
+	var last uint32
+	for _, d := range trace {
+		if d.tag < last {
+			t.Fatalf("Tag at %d after one at %d", d.tag, last)
+		}
+		last = d.tag
+		if !d.detection {
+			written[d.tag] = true
+			continue
+		}
+		if !written[d.frame] || reported[d.frame] || d.x != 8 || d.y != 8 || d.label != "waldo" {
+			t.Errorf("Unexpected detection %+v", d)
+		}
+		reported[d.frame] = true
+	}
+	if processed := h.stats.FramesProcessed.Load(); processed == 0 || uint64(len(reported)) != processed {
+		t.Errorf("%d frames processed, %d with detections recorded", processed, len(reported))
+	}
+}
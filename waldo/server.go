@@ -0,0 +1,426 @@
+// Package waldo An RTMP server that records streams and looks for Waldo in them. The FindingWaldo
+// command is a thin wrapper around Server, which other programs can embed with their own Detector
+package waldo
+
+import (
+	"context"
+	"image"
+	"io"
+	"log/slog"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/yutopp/go-rtmp"
+)
+
+// DetectionSink Receives the detections of every stream, e.g. for a program embedding the server.
+// Called from CV workers, possibly for several streams at once
+type DetectionSink interface {
+	Detections(stream string, timestamp uint32, results []DetectionResult)
+}
+
+// Options Settings of a Server, the flags of the FindingWaldo command. Zero values disable what they configure,
+// components (matcher, pipeline, notifier, remuxer, ...) are built and closed by the caller
+type Options struct {
+	// Listeners of ListenAndServe and ListenAndServeAPI. Serve and Handler take any listener
+	RTMPAddr string // host:port, empty is :1935
+	HTTPAddr string // Of the HTTP API, empty serves none
+
+	// Recordings
+	OutputDir       string
+	RecordingLayout string // Empty uses DefaultRecordingLayout
+	OutputFormat    string // flv or mp4, empty is flv
+	RejectExisting  bool
+	SegmentDuration time.Duration
+	SegmentSize     int64 // Bytes
+	FlushInterval   time.Duration
+	SyncInterval    time.Duration
+	Remuxer         *Remuxer
+
+	// Live outputs
+	HLSDir             string
+	HLSSegmentDuration time.Duration
+	HLSWindow          int
+	HLSCleanup         bool
+	PlayerQueue        int
+	Relays             *RelayTargets
+
+	// Connections
+	Auth               Authenticator // Of publishers and players, nil lets everyone in
+	StreamTimeout      time.Duration
+	MaxConnections     int
+	MaxPublishesPerKey int
+
+	// HTTP API
+	APIToken         string   // Every request must carry it when set, see Handler
+	WebSocketOrigins []string // Pages of other origins allowed to open the /ws endpoints, see checkWebSocketOrigin
+
+	// Computer vision
+	Vision             VisionConfig
+	NewDetector        func() (Detector, error) // Builds each stream's detector in place of Vision.Detector
+	Matcher            *TemplateMatcher         // Used instead of the detector when set
+	Pipeline           *Pipeline
+	Sampling           SamplingPolicy
+	DetectionThreshold float64
+	CVMaxFPS           *StreamRates // CV runs per second of wall time for each stream, nil is unlimited
+	CVResize           image.Point
+	CVWorkers          int
+	CVQueue            int
+	StripePrefilter    bool
+	AnnotateOutput     *H264EncoderConfig // Burns detections into the recording when set
+	AudioThreshold     float64
+
+	// Detection outputs
+	Sink                     DetectionSink
+	Notifier                 *Notifier
+	DetectionHistory         int
+	FrameCacheSize           int
+	EventThreshold           float64
+	EventThumbnails          bool
+	MaxThumbnails            int
+	DetectionFramesPerMinute int
+	DetectionSaveDir         string
+	DetectionSaveScore       float64
+	ThumbnailMargin          float64
+	AnnotatedFrames          bool
+	MetricsStreamLabels      bool
+	PreviewFPS               float64
+}
+
+// Clients of the HTTP API must send their request headers within apiReadHeaderTimeout,
+// keep-alive connections are closed after apiIdleTimeout without a request
+const (
+	apiReadHeaderTimeout = 10 * time.Second
+	apiIdleTimeout       = 2 * time.Minute
+)
+
+// Server Receives RTMP streams, records them and runs CV on them. It serves any number of listeners,
+// and its HTTP API through Handler
+type Server struct {
+	opts     Options
+	config   *Config
+	registry *StreamRegistry
+	events   *EventBroker
+	metrics  *Metrics
+	limits   *ConnLimiter
+	started  time.Time
+
+	connIDs atomic.Uint64
+
+	mu      sync.Mutex
+	servers []*rtmp.Server
+}
+
+// Check opts, see Validate, and set up the state shared by every stream
+func NewServer(opts Options) (*Server, error) {
+	if opts.RTMPAddr == "" {
+		opts.RTMPAddr = ":1935"
+	}
+	if opts.RecordingLayout == "" {
+		opts.RecordingLayout = DefaultRecordingLayout
+	}
+	if opts.OutputFormat == "" {
+		opts.OutputFormat = "flv"
+	}
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	config, err := NewConfig(opts.DetectionThreshold)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{
+		opts:     opts,
+		config:   config,
+		registry: NewStreamRegistry(),
+		events:   NewEventBroker(),
+		metrics:  NewMetrics(opts.MetricsStreamLabels),
+		limits:   &ConnLimiter{MaxConns: opts.MaxConnections, MaxPublishesPerKey: opts.MaxPublishesPerKey},
+		started:  time.Now(),
+	}, nil
+}
+
+// Accept RTMP connections on l until Close. Returns nil once closed
+func (s *Server) Serve(l net.Listener) error {
+	srv := rtmp.NewServer(&rtmp.ServerConfig{
+		OnConnect: func(conn net.Conn) (io.ReadWriteCloser, *rtmp.ConnConfig) {
+			h := s.newHandler()
+			h.remoteAddr = conn.RemoteAddr().String()
+			h.connID = s.connIDs.Add(1)
+			h.logger = h.logger.With("remote", h.remoteAddr, "conn_id", h.connID)
+			h.limits = s.limits
+
+			return conn, &rtmp.ConnConfig{
+				Handler: h,
+
+				ControlState: rtmp.StreamControlStateConfig{
+					DefaultBandwidthWindowSize: 6 * 1024 * 1024 / 8,
+				},
+			}
+		},
+	})
+	s.mu.Lock()
+	s.servers = append(s.servers, srv)
+	s.mu.Unlock()
+
+	if err := srv.Serve(l); err != nil && err != rtmp.ErrClosed {
+		return err
+	}
+
+	return nil
+}
+
+// The HTTP control API: /status, /metrics, /streams/..., /ws/... and the HLS files. With Options.APIToken
+// set, requests without it are refused
+func (s *Server) Handler() http.Handler {
+	api := newAPIHandler(s.config, s.registry, s.events, s.metrics, s.opts.Remuxer, s.started, s.opts.HLSDir, s.opts.PreviewFPS, s.opts.WebSocketOrigins)
+	return requireAPIToken(s.opts.APIToken, api)
+}
+
+// Events published for every detection, the same the /ws endpoints send
+func (s *Server) Events() *EventBroker {
+	return s.events
+}
+
+// Run CV over a recorded FLV as if it was published, writing a new recording and its detections.
+// Every keyframe is processed, inline and as fast as it decodes
+func (s *Server) Replay(path string) error {
+	h := s.newHandler()
+	h.cvWorkers = 0
+	h.cvMaxFPS = nil
+	h.streamTimeout = 0
+	h.hlsDir = ""
+
+	return replayFLV(path, h)
+}
+
+// Finish every active stream so its recording stays playable, then stop serving and wait for
+// MP4 remuxing and the webhooks still queued. Fails when ctx ends before the streams are finalized
+func (s *Server) Shutdown(ctx context.Context) error {
+	// Finish every active stream in parallel
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		finalized []string
+	)
+	for _, name := range s.registry.List() {
+		h, ok := s.registry.Get(name)
+		if !ok {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := h.Shutdown(ctx); err != nil {
+				slog.Error("Failed to shut down stream", "stream", name, "err", err)
+				return
+			}
+			mu.Lock()
+			finalized = append(finalized, name)
+			mu.Unlock()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "Shutdown timed out")
+	}
+	slog.Info("Finalized streams", "count", len(finalized), "streams", finalized)
+
+	s.Close()
+
+	if err := s.opts.Notifier.Close(ctx); err != nil {
+		slog.Warn("Shutdown timed out delivering webhooks", "err", err)
+	}
+	if s.opts.Remuxer != nil {
+		remuxed := make(chan struct{})
+		go func() {
+			s.opts.Remuxer.Wait()
+			close(remuxed)
+		}()
+		select {
+		case <-remuxed:
+		case <-ctx.Done():
+			slog.Warn("Shutdown timed out waiting for MP4 remuxing, the FLV recordings are complete")
+		}
+	}
+
+	return nil
+}
+
+// Stop accepting connections on every listener. Streams still running are cut off, see Shutdown
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, srv := range s.servers {
+		_ = srv.Close()
+	}
+	s.servers = nil
+}
+
+// Check the settings, so a typo fails at startup rather than with the first stream. Directories are
+// created when missing and must be writable, the detector's files readable
+func (o *Options) Validate() error {
+	if o.OutputFormat != "" && o.OutputFormat != "flv" && o.OutputFormat != "mp4" {
+		return errors.Errorf("Unknown output format %q, want flv or mp4", o.OutputFormat)
+	}
+	if o.RecordingLayout != "" {
+		if _, err := renderRecordingLayout(o.OutputDir, o.RecordingLayout, ".flv", "stream", 0, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	for _, dir := range []string{o.OutputDir, o.HLSDir, o.DetectionSaveDir} {
+		if dir == "" {
+			continue
+		}
+		if err := CheckWritableDir(dir); err != nil {
+			return err
+		}
+	}
+	detector := o.Vision.Detector
+	for _, path := range []string{detector.Model, detector.ModelConfig, detector.LabelsPath} {
+		if path == "" {
+			continue
+		}
+		if err := CheckReadableFile(path); err != nil {
+			return err
+		}
+	}
+
+	fractions := []struct {
+		name  string
+		value float64
+	}{
+		{"Detection threshold", o.DetectionThreshold},
+		{"Event threshold", o.EventThreshold},
+		{"Detection save score", o.DetectionSaveScore},
+		{"Motion threshold", o.Vision.MotionThreshold},
+	}
+	for _, f := range fractions {
+		if math.IsNaN(f.value) || f.value < 0 || f.value > 1 {
+			return errors.Errorf("%s must be between 0 and 1, got %g", f.name, f.value)
+		}
+	}
+	if o.CVResize.X < 0 || o.CVResize.Y < 0 {
+		return errors.Errorf("CV resize can't be negative, got %v", o.CVResize)
+	}
+	if o.CVWorkers < 0 || o.CVQueue < 0 {
+		return errors.New("CV workers and queue can't be negative")
+	}
+
+	return nil
+}
+
+// Listen on Options.RTMPAddr and accept RTMP connections until Close, see Serve
+func (s *Server) ListenAndServe() error {
+	l, err := net.Listen("tcp", s.opts.RTMPAddr)
+	if err != nil {
+		return errors.Wrap(err, "Failed to listen for RTMP")
+	}
+	slog.Info("RTMP listening", "addr", l.Addr().String())
+
+	return s.Serve(l)
+}
+
+// Serve the HTTP API on Options.HTTPAddr. Returns nil at once when there is none
+func (s *Server) ListenAndServeAPI() error {
+	if s.opts.HTTPAddr == "" {
+		return nil
+	}
+	slog.Info("HTTP API listening", "addr", s.opts.HTTPAddr)
+
+	// No write timeout: /ws/... and the MJPEG preview stay open as long as the client watches
+	srv := &http.Server{
+		Addr:              s.opts.HTTPAddr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: apiReadHeaderTimeout,
+		IdleTimeout:       apiIdleTimeout,
+	}
+
+	return srv.ListenAndServe()
+}
+
+// Build a fresh Handler for each incoming connection
+func (s *Server) newHandler() *Handler {
+	opts := &s.opts
+	h := &Handler{
+		closed:   make(chan struct{}),
+		logger:   slog.Default(),
+		auth:     opts.Auth,
+		registry: s.registry,
+		matcher:  opts.Matcher,
+		config:   s.config,
+		history:  NewDetectionHistory(opts.DetectionHistory),
+		frames:   NewFrameCache(opts.FrameCacheSize),
+		sidecar:  NewDetectionSidecar(),
+		events:   s.events,
+		notifier: opts.Notifier,
+		metrics:  s.metrics,
+
+		annotated:          NewFrameCache(1),
+		outputDir:          opts.OutputDir,
+		recordingLayout:    opts.RecordingLayout,
+		outputFormat:       opts.OutputFormat,
+		rejectExisting:     opts.RejectExisting,
+		remuxer:            opts.Remuxer,
+		relays:             opts.Relays,
+		segmentDuration:    opts.SegmentDuration,
+		segmentSize:        opts.SegmentSize,
+		flushInterval:      opts.FlushInterval,
+		syncInterval:       opts.SyncInterval,
+		streamTimeout:      opts.StreamTimeout,
+		hlsDir:             opts.HLSDir,
+		hlsSegmentDuration: opts.HLSSegmentDuration,
+		hlsWindow:          opts.HLSWindow,
+		hlsCleanup:         opts.HLSCleanup,
+		visionCfg:          opts.Vision,
+		newDetector:        opts.NewDetector,
+		sink:               opts.Sink,
+		eventThreshold:     opts.EventThreshold,
+		eventThumbnails:    opts.EventThumbnails,
+		maxThumbnails:      opts.MaxThumbnails,
+		stripePrefilter:    opts.StripePrefilter,
+		detectionSaveDir:   opts.DetectionSaveDir,
+		detectionSaveScore: opts.DetectionSaveScore,
+		thumbnailMargin:    opts.ThumbnailMargin,
+		sampling:           opts.Sampling,
+		keyframeSampler:    NewKeyframeSampler(opts.Sampling),
+		streamThrottle:     FrameThrottle{MinInterval: opts.Sampling.fpsInterval()},
+		cvMaxFPS:           opts.CVMaxFPS,
+		cvResize:           opts.CVResize,
+		pipeline:           opts.Pipeline,
+		cvWorkers:          opts.CVWorkers,
+		cvQueue:            opts.CVQueue,
+		playerQueue:        opts.PlayerQueue,
+	}
+	if opts.DetectionFramesPerMinute > 0 {
+		h.detectionFrames = &WindowLimiter{Limit: opts.DetectionFramesPerMinute, Window: time.Minute, MinInterval: time.Second}
+	}
+	if opts.AnnotatedFrames {
+		h.annotatedFrames = &AnnotatedFrames{}
+	}
+	if opts.AudioThreshold != 0 {
+		h.audioProc = &LoudnessDetector{Threshold: opts.AudioThreshold}
+	}
+	if opts.AnnotateOutput != nil {
+		h.annotateOutput = true
+		cfg := *opts.AnnotateOutput
+		h.encodeCfg = &cfg
+	}
+
+	return h
+}
@@ -0,0 +1,406 @@
+package waldo
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	flvtag "github.com/yutopp/go-flv/tag"
+	"github.com/yutopp/go-rtmp"
+	"github.com/yutopp/go-rtmp/handshake"
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+// Baseline 64x64 SPS and a matching PPS
+var (
+	testSPS = []byte{0x67, 0x42, 0xc0, 0x1e, 0xda, 0x10, 0x99}
+	testPPS = []byte{0x68, 0xce, 0x38, 0x80}
+)
+
+// Serve RTMP on a loopback port until the test ends, recording to a temporary directory without CV
+func startTestServer(t *testing.T, opts Options) (*Server, string) {
+	t.Helper()
+	if opts.OutputDir == "" {
+		opts.OutputDir = t.TempDir()
+	}
+	if opts.NewDetector == nil {
+		opts.NewDetector = func() (Detector, error) {
+			return nil, errors.New("No CV in tests")
+		}
+	}
+	s, err := NewServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		if err := s.Serve(l); err != nil {
+			t.Errorf("Serve: %v", err)
+		}
+	}()
+	t.Cleanup(s.Close)
+
+	return s, l.Addr().String()
+}
+
+// testPublisher A go-rtmp client publishing one stream
+type testPublisher struct {
+	conn   *rtmp.ClientConn
+	stream *rtmp.Stream
+}
+
+// Connect to addr and publish name
+func publishTestStream(t *testing.T, addr, name string) *testPublisher {
+	t.Helper()
+	conn, err := rtmp.Dial("rtmp", addr, &rtmp.ConnConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	err = conn.Connect(&rtmpmsg.NetConnectionConnect{
+		Command: rtmpmsg.NetConnectionConnectCommand{App: "live", Type: "nonprivate", FlashVer: "FMLE/3.0", TCURL: "rtmp://" + addr + "/live"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := conn.CreateStream(nil, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := stream.Publish(&rtmpmsg.NetStreamPublish{PublishingName: name, PublishingType: "live"}); err != nil {
+		t.Fatal(err)
+	}
+
+	return &testPublisher{conn: conn, stream: stream}
+}
+
+// testPlayer A bare RTMP client playing one stream. Streams created by go-rtmp's client have no
+// handler for what a server sends on them, so this one reads the chunk stream itself
+type testPlayer struct {
+	streamer *rtmp.ChunkStreamer
+	streamID uint32
+}
+
+// Connect to addr and play name, once the server created the stream
+func playTestStream(t *testing.T, addr, name string) *testPlayer {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	if err := handshake.HandshakeWithServer(conn, conn, &handshake.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	p := &testPlayer{streamer: rtmp.NewChunkStreamer(conn, conn, nil)}
+	t.Cleanup(func() { _ = p.streamer.Close() })
+
+	p.command(t, 0, "connect", 1, map[string]interface{}{"app": "live", "flashVer": "LNX 9,0,124,2", "tcUrl": "rtmp://" + addr + "/live"})
+	p.command(t, 0, "createStream", 2, nil)
+	for {
+		msg, _ := p.read(t)
+		cmd, ok := msg.(*rtmpmsg.CommandMessage)
+		if !ok || cmd.CommandName != "_result" || cmd.TransactionID != 2 {
+			continue
+		}
+		var result rtmpmsg.AMFConvertible
+		if err := rtmpmsg.DecodeBodyCreateStreamResult(cmd.Body, rtmpmsg.NewAMFDecoder(cmd.Body, cmd.Encoding), &result); err != nil {
+			t.Fatal(err)
+		}
+		p.streamID = result.(*rtmpmsg.NetConnectionCreateStreamResult).StreamID
+		break
+	}
+	p.command(t, p.streamID, "play", 0, nil, name, -2)
+
+	return p
+}
+
+// Send a command with its arguments on a message stream. go-rtmp cannot encode the play command itself
+func (p *testPlayer) command(t *testing.T, streamID uint32, name string, transactionID int64, args ...interface{}) {
+	t.Helper()
+	var buf bytes.Buffer
+	enc := rtmpmsg.NewAMFEncoder(&buf, rtmpmsg.EncodingTypeAMF0)
+	for _, arg := range args {
+		if err := enc.Encode(arg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := p.streamer.Write(context.Background(), 3, 0, &rtmp.ChunkMessage{
+		StreamID: streamID,
+		Message:  &rtmpmsg.CommandMessage{CommandName: name, TransactionID: transactionID, Encoding: rtmpmsg.EncodingTypeAMF0, Body: &buf},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The next message from the server and its timestamp, after applying any chunk size change
+func (p *testPlayer) read(t *testing.T) (rtmpmsg.Message, uint32) {
+	t.Helper()
+	var cmsg rtmp.ChunkMessage
+	_, timestamp, err := p.streamer.Read(&cmsg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, ok := cmsg.Message.(*rtmpmsg.SetChunkSize); ok {
+		if err := p.streamer.PeerState().SetChunkSize(size.ChunkSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return cmsg.Message, timestamp
+}
+
+// The next video tag body played and its timestamp
+func (p *testPlayer) video(t *testing.T) ([]byte, uint32) {
+	t.Helper()
+	for {
+		msg, timestamp := p.read(t)
+		if video, ok := msg.(*rtmpmsg.VideoMessage); ok {
+			body, err := io.ReadAll(video.Payload)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return body, timestamp
+		}
+	}
+}
+
+// Send a video tag body, e.g. from avcSequenceHeader or avcFrame
+func (p *testPublisher) video(t *testing.T, timestamp uint32, body []byte) {
+	t.Helper()
+	if err := p.stream.Write(playbackVideoChunkStream, timestamp, &rtmpmsg.VideoMessage{Payload: bytes.NewReader(body)}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Send the sequence header, then frames keyframes apart from frame 0 on, 40ms each. Returns the next timestamp
+func (p *testPublisher) gops(t *testing.T, frames, keyframes int) uint32 {
+	t.Helper()
+	p.video(t, 0, avcSequenceHeader(testSPS, testPPS))
+	for i := 0; i < frames; i++ {
+		p.video(t, uint32(i*40), avcFrame(i%keyframes == 0, []byte{byte(i)}))
+	}
+
+	return uint32(frames * 40)
+}
+
+// Video tag body of an AVC sequence header with one SPS and PPS
+func avcSequenceHeader(sps, pps []byte) []byte {
+	b := []byte{0x17, 0, 0, 0, 0, 1, sps[1], sps[2], sps[3], 0xff, 0xe1}
+	b = binary.BigEndian.AppendUint16(b, uint16(len(sps)))
+	b = append(b, sps...)
+	b = append(b, 1)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(pps)))
+
+	return append(b, pps...)
+}
+
+// Video tag body of one AVC picture: an IDR slice when keyframe, a P slice otherwise, carrying payload
+func avcFrame(keyframe bool, payload []byte) []byte {
+	frameType, nalType := byte(0x27), byte(0x41)
+	if keyframe {
+		frameType, nalType = 0x17, 0x65
+	}
+	nalu := append([]byte{nalType, 0x88}, payload...)
+	b := []byte{frameType, 1, 0, 0, 0}
+	b = binary.BigEndian.AppendUint32(b, uint32(len(nalu)))
+
+	return append(b, nalu...)
+}
+
+// The handler of a published stream, once the server registered it
+func waitForStream(t *testing.T, s *Server, name string) *Handler {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if h, ok := s.registry.Get(name); ok {
+			return h
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Stream %s never published", name)
+
+	return nil
+}
+
+// Wait for a stream to end and its handler to finish OnClose
+func waitForClose(t *testing.T, h *Handler) {
+	t.Helper()
+	select {
+	case <-h.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stream not closed")
+	}
+}
+
+func TestConcurrentPublishersRecordSeparately(t *testing.T) {
+	s, addr := startTestServer(t, Options{})
+	publishers := map[string]*testPublisher{
+		"cam1": publishTestStream(t, addr, "cam1"),
+		"cam2": publishTestStream(t, addr, "cam2"),
+	}
+
+	// Both streams send at once, each picture tagged with its stream
+	var wg sync.WaitGroup
+	errs := make(chan error, len(publishers))
+	for name, p := range publishers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			send := func(timestamp uint32, body []byte) error {
+				return p.stream.Write(playbackVideoChunkStream, timestamp, &rtmpmsg.VideoMessage{Payload: bytes.NewReader(body)})
+			}
+			if err := send(0, avcSequenceHeader(testSPS, testPPS)); err != nil {
+				errs <- err
+				return
+			}
+			for i := 0; i < 50; i++ {
+				if err := send(uint32(i*40), avcFrame(i%10 == 0, []byte(name))); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	handlers := make(map[string]*Handler)
+	for name := range publishers {
+		handlers[name] = waitForStream(t, s, name)
+	}
+	for name, p := range publishers {
+		_ = p.conn.Close()
+		waitForClose(t, handlers[name])
+	}
+
+	if handlers["cam1"].RecordingPath() == handlers["cam2"].RecordingPath() {
+		t.Fatalf("Both streams recorded to %s", handlers["cam1"].RecordingPath())
+	}
+	for name, h := range handlers {
+		tags := readFLV(t, h.RecordingPath())
+		if len(tags) != 51 {
+			t.Errorf("%s recorded %d tags, want the sequence header and 50 frames", name, len(tags))
+		}
+		for _, tag := range avcPictures(t, tags) {
+			if !bytes.HasSuffix(tag, []byte(name)) {
+				t.Fatalf("%s recorded a picture % x of another stream", name, tag)
+			}
+		}
+	}
+}
+
+func TestShutdownWhilePublishing(t *testing.T) {
+	s, addr := startTestServer(t, Options{})
+	publisher := publishTestStream(t, addr, "cam")
+	publisher.video(t, 0, avcSequenceHeader(testSPS, testPPS))
+	h := waitForStream(t, s, "cam")
+
+	// The publisher keeps sending until the server hangs up on it
+	stop := make(chan struct{})
+	sent := make(chan int)
+	go func() {
+		i := 0
+		defer func() { sent <- i }()
+		for ; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			err := publisher.stream.Write(playbackVideoChunkStream, uint32(i*40), &rtmpmsg.VideoMessage{Payload: bytes.NewReader(avcFrame(i%10 == 0, []byte{byte(i)}))})
+			if err != nil {
+				return
+			}
+		}
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for h.stats.VideoFrames.Load() < 50 {
+		if time.Now().After(deadline) {
+			t.Fatal("Publisher stalled")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	close(stop)
+	<-sent
+
+	// Whatever was cut off, the recording is a whole FLV file
+	tags := readFLV(t, h.RecordingPath())
+	if len(tags) < 50 {
+		t.Errorf("Recorded %d tags, more than 50 were received", len(tags))
+	}
+	if video := rawFLVVideo(t, h.RecordingPath()); len(video) != len(tags) {
+		t.Errorf("%d video tags in the file, %d decoded", len(video), len(tags))
+	}
+	for i := 1; i < len(tags); i++ {
+		if tags[i].Timestamp < tags[i-1].Timestamp {
+			t.Fatalf("Tag %d at %d after %d", i, tags[i].Timestamp, tags[i-1].Timestamp)
+		}
+	}
+	if _, ok := s.registry.Get("cam"); ok {
+		t.Error("Stream still registered after Shutdown")
+	}
+}
+
+// closingEncoder Wraps a recording's encoder, counting the calls to Close and the tags encoded after it
+type closingEncoder struct {
+	recordingEncoder
+	closes      int
+	afterClosed int
+}
+
+func (e *closingEncoder) Encode(tag *flvtag.FlvTag) error {
+	if e.closes > 0 {
+		e.afterClosed++
+	}
+	return e.recordingEncoder.Encode(tag)
+}
+
+func (e *closingEncoder) Close() error {
+	e.closes++
+	return nil
+}
+
+func TestShutdownClosesEncoder(t *testing.T) {
+	s, addr := startTestServer(t, Options{})
+	publisher := publishTestStream(t, addr, "cam")
+	h := waitForStream(t, s, "cam")
+	enc := &closingEncoder{}
+	h.writeMu.Lock()
+	enc.recordingEncoder, h.flvEnc = h.flvEnc, enc
+	h.writeMu.Unlock()
+	publisher.gops(t, 10, 5)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	waitForClose(t, h)
+
+	h.writeMu.Lock()
+	defer h.writeMu.Unlock()
+	if enc.closes != 1 || enc.afterClosed != 0 {
+		t.Errorf("Encoder closed %d times, %d tags encoded after, want once and none", enc.closes, enc.afterClosed)
+	}
+}
@@ -0,0 +1,76 @@
+package waldo
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// sidecarRect One detection in the sidecar file
+type sidecarRect struct {
+	X          int     `json:"x"`
+	Y          int     `json:"y"`
+	W          int     `json:"w"`
+	H          int     `json:"h"`
+	Confidence float64 `json:"confidence"`
+}
+
+// DetectionSidecar Per-keyframe detections of a recording, written next to the FLV as JSON
+// keyed by RTMP timestamp, so tools can seek to hits without re-running CV
+type DetectionSidecar struct {
+	mu     sync.Mutex
+	frames map[uint32][]sidecarRect
+}
+
+func NewDetectionSidecar() *DetectionSidecar {
+	return &DetectionSidecar{
+		frames: make(map[uint32][]sidecarRect),
+	}
+}
+
+// Record a processed keyframe, including ones where nothing was found
+func (s *DetectionSidecar) Add(timestamp uint32, results []DetectionResult) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	rects := make([]sidecarRect, 0, len(results))
+	for _, d := range results {
+		rects = append(rects, sidecarRect{
+			X:          d.Rect.Min.X,
+			Y:          d.Rect.Min.Y,
+			W:          d.Rect.Dx(),
+			H:          d.Rect.Dy(),
+			Confidence: d.Score,
+		})
+	}
+	s.frames[timestamp] = append(s.frames[timestamp], rects...)
+}
+
+func (s *DetectionSidecar) WriteFile(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.MarshalIndent(s.frames, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode detection sidecar")
+	}
+
+	return os.WriteFile(path, data, 0666)
+}
+
+// Forget recorded frames, when a new segment starts
+func (s *DetectionSidecar) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.frames = make(map[uint32][]sidecarRect)
+}
+
+// received/<name>.flv (or .mp4) -> received/<name>.json
+func sidecarPath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + ".json"
+}
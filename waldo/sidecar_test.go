@@ -0,0 +1,44 @@
+package waldo
+
+import (
+	"encoding/json"
+	"image"
+	"os"
+	"testing"
+
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+	"gocv.io/x/gocv"
+)
+
+func TestSidecarWrittenOnClose(t *testing.T) {
+	_, h := newTestHandler(t, Options{})
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+
+	h.recordDetections(gocv.Mat{}, 1000, []DetectionResult{
+		{Timestamp: 1000, Score: 0.75, Rect: image.Rect(10, 20, 50, 80)},
+	})
+	h.recordDetections(gocv.Mat{}, 2000, nil) // A keyframe where nothing was found
+	h.OnClose()
+
+	data, err := os.ReadFile(sidecarPath(h.RecordingPath()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var frames map[string][]sidecarRect
+	if err := json.Unmarshal(data, &frames); err != nil {
+		t.Fatalf("Sidecar is not JSON: %v\n%s", err, data)
+	}
+
+	want := sidecarRect{X: 10, Y: 20, W: 40, H: 60, Confidence: 0.75}
+	if got := frames["1000"]; len(got) != 1 || got[0] != want {
+		t.Errorf("Detections at 1000: %+v, want %+v", got, want)
+	}
+	if got, ok := frames["2000"]; !ok || len(got) != 0 {
+		t.Errorf("Detections at 2000: %+v, want an empty list", got)
+	}
+	if len(frames) != 2 {
+		t.Errorf("Sidecar has %d frames, want 2", len(frames))
+	}
+}
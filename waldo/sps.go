@@ -0,0 +1,219 @@
+package waldo
+
+import (
+	"github.com/pkg/errors"
+)
+
+// bitReader Reads the exp-Golomb coded fields of an H.264 RBSP
+type bitReader struct {
+	data []byte
+	pos  int // In bits
+}
+
+// Strip emulation prevention bytes (00 00 03 -> 00 00)
+func nalToRBSP(nalu []byte) []byte {
+	rbsp := make([]byte, 0, len(nalu))
+	zeros := 0
+	for _, b := range nalu {
+		if zeros >= 2 && b == 0x03 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		rbsp = append(rbsp, b)
+	}
+
+	return rbsp
+}
+
+func (r *bitReader) u(n int) (uint32, error) {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			return 0, errors.New("SPS truncated")
+		}
+		bit := (r.data[r.pos/8] >> (7 - uint(r.pos%8))) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+
+	return v, nil
+}
+
+func (r *bitReader) ue() (uint32, error) {
+	zeros := 0
+	for {
+		b, err := r.u(1)
+		if err != nil {
+			return 0, err
+		}
+		if b == 1 {
+			break
+		}
+		zeros++
+		if zeros > 31 {
+			return 0, errors.New("Invalid exp-Golomb code")
+		}
+	}
+	rest, err := r.u(zeros)
+	if err != nil {
+		return 0, err
+	}
+
+	return (1<<uint(zeros) - 1) + rest, nil
+}
+
+func (r *bitReader) se() (int32, error) {
+	v, err := r.ue()
+	if err != nil {
+		return 0, err
+	}
+	if v%2 == 1 {
+		return int32((v + 1) / 2), nil
+	}
+
+	return -int32(v / 2), nil
+}
+
+// SPSInfo Fields of a sequence parameter set needed to size decoded pictures
+type SPSInfo struct {
+	Profile uint8
+	Level   uint8
+	ID      uint32
+	Width   int
+	Height  int
+}
+
+// Parse an H.264 sequence parameter set NAL unit (ITU-T H.264 7.3.2.1.1)
+func parseSPS(nalu []byte) (*SPSInfo, error) {
+	if len(nalu) < 4 || nalu[0]&0x1f != 7 {
+		return nil, errors.New("Not an SPS NAL unit")
+	}
+
+	r := &bitReader{data: nalToRBSP(nalu[1:])}
+	info := &SPSInfo{}
+
+	// Collect the first decoding error, later reads are harmless no-ops
+	var err error
+	u := func(n int) uint32 {
+		v, e := r.u(n)
+		if err == nil {
+			err = e
+		}
+		return v
+	}
+	ue := func() uint32 {
+		v, e := r.ue()
+		if err == nil {
+			err = e
+		}
+		return v
+	}
+	se := func() int32 {
+		v, e := r.se()
+		if err == nil {
+			err = e
+		}
+		return v
+	}
+
+	info.Profile = uint8(u(8))
+	u(8) // constraint flags
+	info.Level = uint8(u(8))
+	info.ID = ue()
+
+	chromaFormat := uint32(1)
+	switch info.Profile {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = ue()
+		if chromaFormat == 3 {
+			u(1) // separate_colour_plane_flag
+		}
+		ue() // bit_depth_luma_minus8
+		ue() // bit_depth_chroma_minus8
+		u(1) // qpprime_y_zero_transform_bypass_flag
+
+		// seq_scaling_matrix_present_flag
+		if u(1) == 1 {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if u(1) == 0 {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size && err == nil; j++ {
+					if next != 0 {
+						next = (last + se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+
+	ue()          // log2_max_frame_num_minus4
+	switch ue() { // pic_order_cnt_type
+	case 0:
+		ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		u(1) // delta_pic_order_always_zero_flag
+		se() // offset_for_non_ref_pic
+		se() // offset_for_top_to_bottom_field
+		n := ue()
+		for i := uint32(0); i < n && err == nil; i++ {
+			se()
+		}
+	}
+	ue() // max_num_ref_frames
+	u(1) // gaps_in_frame_num_value_allowed_flag
+
+	widthMbs := ue() + 1
+	heightMapUnits := ue() + 1
+	frameMbsOnly := u(1)
+	if frameMbsOnly == 0 {
+		u(1) // mb_adaptive_frame_field_flag
+	}
+	u(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if u(1) == 1 {
+		cropLeft, cropRight, cropTop, cropBottom = ue(), ue(), ue(), ue()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	cropUnitX, cropUnitY := uint32(1), 2-frameMbsOnly
+	switch chromaFormat {
+	case 1:
+		cropUnitX, cropUnitY = 2, 2*(2-frameMbsOnly)
+	case 2:
+		cropUnitX = 2
+	}
+
+	// In 64 bits, so neither a huge size nor a huge crop can wrap around
+	width, height := uint64(widthMbs)*16, uint64(2-frameMbsOnly)*uint64(heightMapUnits)*16
+	cropX := (uint64(cropLeft) + uint64(cropRight)) * uint64(cropUnitX)
+	cropY := (uint64(cropTop) + uint64(cropBottom)) * uint64(cropUnitY)
+	if cropX >= width || cropY >= height {
+		return nil, errors.Errorf("SPS crops %dx%d off a %dx%d picture", cropX, cropY, width, height)
+	}
+
+	info.Width = int(width - cropX)
+	info.Height = int(height - cropY)
+
+	return info, nil
+}
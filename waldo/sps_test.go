@@ -0,0 +1,72 @@
+package waldo
+
+import (
+	"encoding/hex"
+	"testing"
+)
+
+func TestParseSPS(t *testing.T) {
+	tests := []struct {
+		name          string
+		sps           string
+		profile       uint8
+		width, height int
+	}{
+		// x264 1080p, cropped from 1088 lines
+		{"high 1080p", "67640028acd940780227e584000003000400000300f03c60c658", 100, 1920, 1080},
+		{"baseline 720p", "6742001f95a814016e40", 66, 1280, 720},
+		{"high 720p with VUI", "6764001facd9405005bb011000000300100000030320f1831960", 100, 1280, 720},
+		// Custom 4x4 intra Y list, and an 8x8 list cut short to fall back to the default
+		{"high with scaling lists", "67640028ada4924924924902116ca03c0113f2a0", 100, 1920, 1080},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nalu, err := hex.DecodeString(tt.sps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := parseSPS(nalu)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Profile != tt.profile || info.Width != tt.width || info.Height != tt.height {
+				t.Errorf("Got profile %d %dx%d, want profile %d %dx%d",
+					info.Profile, info.Width, info.Height, tt.profile, tt.width, tt.height)
+			}
+		})
+	}
+}
+
+func TestParseSPSRejectsBadCrop(t *testing.T) {
+	tests := []struct {
+		name string
+		sps  string
+	}{
+		// 64x64 pictures with 80 columns, then 80 lines, cropped off
+		{"wider than the picture", "6742c01eda109e0a74"},
+		{"taller than the picture", "6742c01eda109f0a8550"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nalu, err := hex.DecodeString(tt.sps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info, err := parseSPS(nalu); err == nil {
+				t.Errorf("Parsed as %dx%d, want an error", info.Width, info.Height)
+			}
+		})
+	}
+}
+
+func TestParseSPSTruncated(t *testing.T) {
+	nalu, err := hex.DecodeString("67640028acd940780227e584000003000400000300f03c60c658")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 4; n < 10; n++ {
+		if _, err := parseSPS(nalu[:n]); err == nil {
+			t.Errorf("SPS cut to %d bytes parsed", n)
+		}
+	}
+}
@@ -0,0 +1,401 @@
+package waldo
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StreamStats Counters a Handler updates while streaming, safe to read from other goroutines
+type StreamStats struct {
+	BytesReceived   atomic.Uint64
+	FramesProcessed atomic.Uint64 // Frames run through CV
+	FramesFailed    atomic.Uint64 // Frames where CV failed and the original was kept
+	FramesDropped   atomic.Uint64 // Keyframes skipped because the CV queue was full
+	FramesSkipped   atomic.Uint64 // Frames left out by the sampling policy, -cv-max-stream-fps or -cv-max-fps
+	FramesStatic    atomic.Uint64 // Decoded frames the motion filter kept from the detector
+	DecodeDropped   atomic.Uint64 // Pictures never decoded because the decoder was behind
+	Detections      atomic.Uint64
+	CVTime          atomic.Uint64 // Nanoseconds spent on the frames processed
+	GOPsReencoded   atomic.Uint64 // Recorded with the boxes drawn in, with -annotate-output
+
+	AudioBytes     atomic.Uint64 // Audio tag bodies, included in BytesReceived
+	VideoBytes     atomic.Uint64 // Video tag bodies, included in BytesReceived
+	VideoFrames    atomic.Uint64
+	TagsWritten    atomic.Uint64 // To the recording, across segments
+	BytesWritten   atomic.Uint64
+	VideoCodec     atomic.Value // string, set by the first video tag
+	Width          atomic.Int32 // Picture size, 0 until a sequence header or frame revealed it
+	Height         atomic.Int32
+	FirstTimestamp atomic.Uint32 // RTMP timestamp of the first audio or video tag
+	LastTimestamp  atomic.Uint32
+	hasTimestamp   atomic.Bool
+
+	// Tags whose timestamp went back from, or leapt ahead of, the previous tag of their kind
+	TimestampsBackwards atomic.Uint64
+	TimestampJumps      atomic.Uint64
+
+	// Rates over the last tick of run, in stream time
+	rateMu        sync.Mutex
+	bitrateBps    float64
+	fps           float64
+	cvFPS         float64
+	prevBytes     uint64
+	prevFrames    uint64
+	prevProcessed uint64
+	prevTS        uint32
+	prevTSValid   bool
+}
+
+// Note the timestamp of an audio or video tag
+func (s *StreamStats) observe(timestamp uint32) {
+	if s.hasTimestamp.CompareAndSwap(false, true) {
+		s.FirstTimestamp.Store(timestamp)
+	}
+	s.LastTimestamp.Store(timestamp)
+}
+
+// Largest step between two audio or two video tags that is not reported as a jump
+const timestampJumpLimit = 5 * time.Second
+
+// timestampTrack The previous timestamp of one kind of tag, to spot encoders or uplinks misbehaving
+type timestampTrack struct {
+	last uint32
+	seen bool
+}
+
+// Step in milliseconds from the previous timestamp, which wraps around like RTMP's 32 bit clock
+func (t *timestampTrack) next(timestamp uint32) (delta int64, ok bool) {
+	delta = int64(int32(timestamp - t.last))
+	ok = t.seen
+	t.last, t.seen = timestamp, true
+
+	return delta, ok
+}
+
+// Steps back smaller than this are encoder jitter, e.g. audio and video interleaving, and pass through
+const timestampJitterLimit = time.Second
+
+// TimestampNormalizer Maps the publisher timestamps of one track onto a monotonic timeline for the recording.
+// Steps are taken wrap-aware, so the 32 bit clock rolling over is a step forward like any other, and a publisher
+// restarting its clock (e.g. after a reconnect) is rebased to continue from the last tag. Audio and video need
+// one each, their interleaving would look like steps back. The output is 32 bits too, as FLV timestamps are,
+// so it wraps after 2^32 ms (~49.7 days) like the input would. Normalize and Apply are for the read loop only,
+// Offset and Rebases are safe for concurrent use
+type TimestampNormalizer struct {
+	last    uint32 // Latest input
+	out     int64  // Latest output, unwrapped
+	started bool
+	offset  atomic.Int64 // Added to inputs by rebasing, in milliseconds. Wraps need nothing added
+	rebases atomic.Uint64
+}
+
+// Map an audio or video timestamp onto the output timeline
+func (n *TimestampNormalizer) Normalize(timestamp uint32) uint32 {
+	if !n.started {
+		n.last, n.out, n.started = timestamp, int64(timestamp), true
+		return timestamp
+	}
+
+	delta := int64(int32(timestamp - n.last))
+	n.last = timestamp
+	if time.Duration(-delta)*time.Millisecond > timestampJitterLimit {
+		// Going back this far is a reset, pick up where the timeline was
+		n.offset.Add(-delta)
+		n.rebases.Add(1)
+		delta = 0
+	}
+	n.out += delta
+
+	return uint32(n.out)
+}
+
+// Map a timestamp without taking it as the latest, for script tags. A step back past the jitter limit
+// lands on the latest output, encoders often stamp them 0 mid-stream
+func (n *TimestampNormalizer) Apply(timestamp uint32) uint32 {
+	if !n.started {
+		return timestamp
+	}
+
+	delta := int64(int32(timestamp - n.last))
+	if time.Duration(-delta)*time.Millisecond > timestampJitterLimit {
+		delta = 0
+	}
+
+	return uint32(n.out + delta)
+}
+
+// Milliseconds added to the publisher's timestamps by rebasing so far. Detection timestamps are on
+// the output timeline, subtracting this gives the publisher's
+func (n *TimestampNormalizer) Offset() int64 {
+	return n.offset.Load()
+}
+
+// Times the publisher's clock was reset and the timeline rebased
+func (n *TimestampNormalizer) Rebases() uint64 {
+	return n.rebases.Load()
+}
+
+// Name of the video codec, empty before any video arrived
+func (s *StreamStats) videoCodec() string {
+	codec, _ := s.VideoCodec.Load().(string)
+	return codec
+}
+
+// Note the picture size, ignoring unknown (0) sizes
+func (s *StreamStats) setResolution(width, height int) {
+	if width > 0 && height > 0 {
+		s.Width.Store(int32(width))
+		s.Height.Store(int32(height))
+	}
+}
+
+// Bitrate, frame rate and CV processing rate measured by the latest update
+func (s *StreamStats) Rates() (bitrateBps, fps, cvFPS float64) {
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+
+	return s.bitrateBps, s.fps, s.cvFPS
+}
+
+// Measure the rates since the previous update against the RTMP timestamps, which unlike
+// the wall clock are not skewed by network jitter. A stalled stream reads as zero
+func (s *StreamStats) updateRates() {
+	bytes := s.AudioBytes.Load() + s.VideoBytes.Load()
+	frames := s.VideoFrames.Load()
+	processed := s.FramesProcessed.Load()
+	ts := s.LastTimestamp.Load()
+	valid := s.hasTimestamp.Load()
+
+	s.rateMu.Lock()
+	defer s.rateMu.Unlock()
+
+	s.bitrateBps, s.fps, s.cvFPS = 0, 0, 0
+	if valid && s.prevTSValid && ts > s.prevTS {
+		elapsed := float64(ts-s.prevTS) / 1000
+		s.bitrateBps = float64(bytes-s.prevBytes) * 8 / elapsed
+		s.fps = float64(frames-s.prevFrames) / elapsed
+		s.cvFPS = float64(processed-s.prevProcessed) / elapsed
+	}
+	s.prevBytes, s.prevFrames, s.prevProcessed, s.prevTS, s.prevTSValid = bytes, frames, processed, ts, valid
+}
+
+// Update the rates every interval until stop is closed
+func (s *StreamStats) run(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.updateRates()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// How often a stream's counters are logged at debug level
+const statsLogInterval = 10 * time.Second
+
+// Log the stream's tag counts and CV timings every interval at debug level, until stop is closed.
+// Cheaper and easier to read than a record per tag
+func (h *Handler) logStats(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var prevTags, prevFrames, prevProcessed, prevCVTime uint64
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		if !h.logger.Enabled(context.Background(), slog.LevelDebug) {
+			continue
+		}
+
+		tags, frames := h.stats.TagsWritten.Load(), h.stats.VideoFrames.Load()
+		processed, cvTime := h.stats.FramesProcessed.Load(), h.stats.CVTime.Load()
+		var cvAvg time.Duration
+		if processed > prevProcessed {
+			cvAvg = time.Duration((cvTime - prevCVTime) / (processed - prevProcessed))
+		}
+		h.logger.Debug("Stream counters",
+			"tags_written", tags-prevTags, "video_frames", frames-prevFrames, "cv_frames", processed-prevProcessed,
+			"cv_avg", cvAvg, "cv_skipped", h.stats.FramesSkipped.Load(), "cv_dropped", h.stats.FramesDropped.Load(),
+			"decode_dropped", h.stats.DecodeDropped.Load())
+		prevTags, prevFrames, prevProcessed, prevCVTime = tags, frames, processed, cvTime
+	}
+}
+
+// streamStatsResponse Body of GET /streams/{name}/stats
+type streamStatsResponse struct {
+	BytesReceived     uint64  `json:"bytes_received"`
+	AudioBytes        uint64  `json:"audio_bytes"`
+	VideoBytes        uint64  `json:"video_bytes"`
+	VideoFrames       uint64  `json:"video_frames"`
+	FirstTimestamp    uint32  `json:"first_timestamp"`
+	LastTimestamp     uint32  `json:"last_timestamp"`
+	CurrentBitrateBps float64 `json:"current_bitrate_bps"`
+	CurrentFPS        float64 `json:"current_fps"`
+	CurrentCVFPS      float64 `json:"current_cv_fps"`
+	FramesSkipped     uint64  `json:"frames_skipped"`
+	TSBackwards       uint64  `json:"timestamps_backwards"`
+	TSJumps           uint64  `json:"timestamp_jumps"`
+}
+
+func (s *StreamStats) response() streamStatsResponse {
+	bitrate, fps, cvFPS := s.Rates()
+
+	return streamStatsResponse{
+		BytesReceived:     s.BytesReceived.Load(),
+		AudioBytes:        s.AudioBytes.Load(),
+		VideoBytes:        s.VideoBytes.Load(),
+		VideoFrames:       s.VideoFrames.Load(),
+		FirstTimestamp:    s.FirstTimestamp.Load(),
+		LastTimestamp:     s.LastTimestamp.Load(),
+		CurrentBitrateBps: bitrate,
+		CurrentFPS:        fps,
+		CurrentCVFPS:      cvFPS,
+		FramesSkipped:     s.FramesSkipped.Load(),
+		TSBackwards:       s.TimestampsBackwards.Load(),
+		TSJumps:           s.TimestampJumps.Load(),
+	}
+}
+
+// streamStatus Entry in the GET /status listing
+type streamStatus struct {
+	Name            string    `json:"name"`
+	Remote          string    `json:"remote"`
+	RecordingPath   string    `json:"recording_path"`
+	Started         time.Time `json:"started"`
+	BytesReceived   uint64    `json:"bytes_received"`
+	FramesProcessed uint64    `json:"frames_processed"`
+	FramesFailed    uint64    `json:"frames_failed"`
+	FramesDropped   uint64    `json:"frames_dropped"`
+	FramesSkipped   uint64    `json:"frames_skipped"`
+	FramesStatic    uint64    `json:"frames_static"`
+	DecodeDropped   uint64    `json:"decode_dropped"`
+	Detections      uint64    `json:"detections"`
+	GOPsReencoded   uint64    `json:"gops_reencoded"`
+	TSBackwards     uint64    `json:"timestamps_backwards"`
+	TSJumps         uint64    `json:"timestamp_jumps"`
+	TSRebases       uint64    `json:"timestamp_rebases"`
+	TSOffset        int64     `json:"timestamp_offset_ms"`
+	CVFPS           float64   `json:"cv_fps"` // Frames processed per second of stream time, over the last second
+}
+
+// serverStatus Body of GET /status
+type serverStatus struct {
+	UptimeSeconds float64        `json:"uptime_seconds"`
+	Streams       []streamStatus `json:"streams"`
+	Remux         []RemuxJob     `json:"remux,omitempty"` // Latest MP4 remuxes, with -remux-to-mp4
+}
+
+// Collect the state of every active stream, and of recent remuxes
+func collectStatus(registry *StreamRegistry, remuxer *Remuxer, started time.Time) serverStatus {
+	status := serverStatus{
+		UptimeSeconds: time.Since(started).Seconds(),
+		Streams:       []streamStatus{},
+		Remux:         remuxer.Jobs(),
+	}
+	for _, name := range registry.List() {
+		h, ok := registry.Get(name)
+		if !ok {
+			continue
+		}
+		_, _, cvFPS := h.stats.Rates()
+		status.Streams = append(status.Streams, streamStatus{
+			Name:            name,
+			Remote:          h.remoteAddr,
+			RecordingPath:   h.RecordingPath(),
+			Started:         h.started,
+			BytesReceived:   h.stats.BytesReceived.Load(),
+			FramesProcessed: h.stats.FramesProcessed.Load(),
+			FramesFailed:    h.stats.FramesFailed.Load(),
+			FramesDropped:   h.stats.FramesDropped.Load(),
+			FramesSkipped:   h.stats.FramesSkipped.Load(),
+			FramesStatic:    h.stats.FramesStatic.Load(),
+			DecodeDropped:   h.stats.DecodeDropped.Load(),
+			Detections:      h.stats.Detections.Load(),
+			GOPsReencoded:   h.stats.GOPsReencoded.Load(),
+			TSBackwards:     h.stats.TimestampsBackwards.Load(),
+			TSJumps:         h.stats.TimestampJumps.Load(),
+			TSRebases:       h.audioNorm.Rebases() + h.videoNorm.Rebases(),
+			TSOffset:        h.videoNorm.Offset(),
+			CVFPS:           cvFPS,
+		})
+	}
+
+	return status
+}
+
+// Render the status in the Prometheus text exposition format
+func writeMetrics(w io.Writer, status serverStatus) {
+	fmt.Fprintf(w, "# HELP waldo_uptime_seconds Time since the server started.\n")
+	fmt.Fprintf(w, "# TYPE waldo_uptime_seconds gauge\n")
+	fmt.Fprintf(w, "waldo_uptime_seconds %g\n", status.UptimeSeconds)
+
+	fmt.Fprintf(w, "# HELP waldo_active_streams Streams currently publishing.\n")
+	fmt.Fprintf(w, "# TYPE waldo_active_streams gauge\n")
+	fmt.Fprintf(w, "waldo_active_streams %d\n", len(status.Streams))
+
+	counters := []struct {
+		name, help string
+		value      func(s streamStatus) uint64
+	}{
+		{"waldo_stream_received_bytes_total", "Bytes of audio, video and metadata received.", func(s streamStatus) uint64 { return s.BytesReceived }},
+		{"waldo_stream_frames_processed_total", "Frames run through computer vision.", func(s streamStatus) uint64 { return s.FramesProcessed }},
+		{"waldo_stream_frames_failed_total", "Frames where computer vision failed.", func(s streamStatus) uint64 { return s.FramesFailed }},
+		{"waldo_stream_frames_dropped_total", "Keyframes dropped because the CV queue was full.", func(s streamStatus) uint64 { return s.FramesDropped }},
+		{"waldo_stream_frames_skipped_total", "Frames left out of computer vision by sampling or the FPS cap.", func(s streamStatus) uint64 { return s.FramesSkipped }},
+		{"waldo_stream_frames_static_total", "Decoded frames not run through the detector for lack of motion.", func(s streamStatus) uint64 { return s.FramesStatic }},
+		{"waldo_stream_decode_dropped_total", "Pictures not decoded for computer vision because the decoder was behind.", func(s streamStatus) uint64 { return s.DecodeDropped }},
+		{"waldo_stream_detections_total", "Objects detected.", func(s streamStatus) uint64 { return s.Detections }},
+		{"waldo_stream_timestamps_backwards_total", "Audio or video tags timestamped before the previous one of their kind.", func(s streamStatus) uint64 { return s.TSBackwards }},
+		{"waldo_stream_timestamp_jumps_total", "Audio or video tags timestamped far after the previous one of their kind.", func(s streamStatus) uint64 { return s.TSJumps }},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+		for _, s := range status.Streams {
+			fmt.Fprintf(w, "%s{stream=\"%s\"} %d\n", c.name, escapeLabel(s.Name), c.value(s))
+		}
+	}
+
+	fmt.Fprintf(w, "# HELP waldo_stream_cv_fps Frames run through computer vision per second of stream time.\n")
+	fmt.Fprintf(w, "# TYPE waldo_stream_cv_fps gauge\n")
+	for _, s := range status.Streams {
+		fmt.Fprintf(w, "waldo_stream_cv_fps{stream=\"%s\"} %g\n", escapeLabel(s.Name), s.CVFPS)
+	}
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+// countingReader Adds the bytes read through it to counters
+type countingReader struct {
+	r        io.Reader
+	counters []*atomic.Uint64
+}
+
+func countReader(r io.Reader, counters ...*atomic.Uint64) io.Reader {
+	return &countingReader{r: r, counters: counters}
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	for _, counter := range c.counters {
+		counter.Add(uint64(n))
+	}
+	return n, err
+}
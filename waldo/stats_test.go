@@ -0,0 +1,156 @@
+package waldo
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	rtmpmsg "github.com/yutopp/go-rtmp/message"
+)
+
+func TestTimestampNormalizer(t *testing.T) {
+	tests := []struct {
+		desc    string
+		in      []uint32
+		want    []uint32
+		rebases uint64
+		offset  int64
+	}{
+		{
+			desc: "steady",
+			in:   []uint32{1000, 1033, 1066},
+			want: []uint32{1000, 1033, 1066},
+		},
+		{
+			desc: "32 bit wrap is a step forward",
+			in:   []uint32{math.MaxUint32 - 20, 12, 45},
+			want: []uint32{math.MaxUint32 - 20, 12, 45},
+		},
+		{
+			desc: "jitter passes through",
+			in:   []uint32{5000, 5040, 4990, 5080},
+			want: []uint32{5000, 5040, 4990, 5080},
+		},
+		{
+			desc:    "reset continues from the last tag",
+			in:      []uint32{60000, 60033, 0, 33},
+			want:    []uint32{60000, 60033, 60033, 60066},
+			rebases: 1,
+			offset:  60033,
+		},
+		{
+			desc:    "reset across the wrap",
+			in:      []uint32{math.MaxUint32 - 10, 20, 5},
+			want:    []uint32{math.MaxUint32 - 10, 20, 5},
+			rebases: 0,
+		},
+		{
+			desc:    "two resets add up",
+			in:      []uint32{10000, 0, 20000, 100},
+			want:    []uint32{10000, 10000, 30000, 30000},
+			rebases: 2,
+			offset:  30000 - 100,
+		},
+	}
+	for _, tt := range tests {
+		var n TimestampNormalizer
+		for i, ts := range tt.in {
+			if got := n.Normalize(ts); got != tt.want[i] {
+				t.Errorf("%s: Normalize(%d) = %d, want %d", tt.desc, ts, got, tt.want[i])
+			}
+		}
+		if n.Rebases() != tt.rebases || n.Offset() != tt.offset {
+			t.Errorf("%s: %d rebases with offset %d, want %d with %d", tt.desc, n.Rebases(), n.Offset(), tt.rebases, tt.offset)
+		}
+	}
+}
+
+func TestTimestampNormalizerApply(t *testing.T) {
+	var n TimestampNormalizer
+	if got := n.Apply(1234); got != 1234 {
+		t.Errorf("Apply before any tag = %d, want it unchanged", got)
+	}
+
+	n.Normalize(90000)
+	n.Normalize(0) // Reset, the timeline continues at 90000
+	n.Normalize(5000)
+
+	tests := []struct {
+		in, want uint32
+	}{
+		{5000, 95000},
+		{5020, 95020},
+		{4400, 94400}, // Jitter
+		{0, 95000},    // Stamped 0 mid-stream, lands on the latest output
+	}
+	for _, tt := range tests {
+		if got := n.Apply(tt.in); got != tt.want {
+			t.Errorf("Apply(%d) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+	if n.Rebases() != 1 {
+		t.Errorf("Apply changed the rebase count to %d", n.Rebases())
+	}
+
+	// Across the wrap
+	var w TimestampNormalizer
+	w.Normalize(math.MaxUint32 - 5)
+	if got := w.Apply(10); got != 10 {
+		t.Errorf("Apply after the wrap = %d, want 10", got)
+	}
+}
+
+// Audio and video interleave with steps back between them, which a shared normalizer
+// would take for resets once they drift apart by more than the jitter limit
+func TestTimestampNormalizerPerTrack(t *testing.T) {
+	var audio, video TimestampNormalizer
+	for ts := uint32(0); ts < 10000; ts += 100 {
+		audio.Normalize(ts + 1500)
+		video.Normalize(ts)
+	}
+	if audio.Rebases() != 0 || video.Rebases() != 0 {
+		t.Errorf("Interleaved tracks rebased %d and %d times", audio.Rebases(), video.Rebases())
+	}
+}
+
+func TestStreamStatsRatesConverge(t *testing.T) {
+	s, h := newTestHandler(t, Options{})
+	if err := h.OnPublish(nil, 0, &rtmpmsg.NetStreamPublish{PublishingName: "cam"}); err != nil {
+		t.Fatal(err)
+	}
+	defer h.OnClose()
+	// The ticker is stopped, the rates are updated by hand after each second's frames
+	close(h.statsStop)
+	h.statsStop = nil
+
+	// 25 frames per second of stream time, each 106 bytes of video data
+	payload := bytes.Repeat([]byte{0xaa}, 100)
+	var fps []float64
+	for second := 0; second < 4; second++ {
+		for i := second * 25; i < (second+1)*25; i++ {
+			if err := h.OnVideo(uint32(i*40), bytes.NewReader(avcFrame(i%25 == 0, payload))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		h.stats.updateRates()
+		_, rate, _ := h.stats.Rates()
+		fps = append(fps, rate)
+	}
+	// Nothing to measure against before the first update
+	if fps[0] != 0 || fps[1] != 25 || fps[2] != 25 || fps[3] != 25 {
+		t.Errorf("FPS per update %v, want 0 then 25", fps)
+	}
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/streams/cam/stats", nil))
+	var got streamStatsResponse
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("GET /streams/cam/stats: status %d, %v", w.Code, err)
+	}
+	if got.CurrentFPS != 25 || got.CurrentBitrateBps != 25*106*8 || got.VideoFrames != 100 || got.LastTimestamp != 99*40 {
+		t.Errorf("Stats %+v, want 25 fps at %d bps over 100 frames", got, 25*106*8)
+	}
+}
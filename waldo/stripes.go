@@ -0,0 +1,72 @@
+package waldo
+
+import (
+	"image"
+
+	"github.com/pkg/errors"
+	"gocv.io/x/gocv"
+)
+
+// Red in OpenCV's HSV (hue 0-180) wraps around 0, so it takes two ranges
+var (
+	stripeRedLow  = [2][3]float64{{0, 100, 80}, {170, 100, 80}}
+	stripeRedHigh = [2][3]float64{{10, 255, 255}, {180, 255, 255}}
+)
+
+// Shape of a candidate stripe: wide and short, but not a speck
+const (
+	stripeMinAspect = 2.5 // Width over height
+	stripeMinWidth  = 8
+	stripeMinHeight = 2
+)
+
+// Find Waldo's red horizontal stripes. Returns the bounding box of every red band that is
+// much wider than it is tall, a cheap way to narrow down where the template matcher has to look
+func (v *Vision) DetectWaldoStripes(frame gocv.Mat) ([]image.Rectangle, error) {
+	return detectWaldoStripes(frame)
+}
+
+func detectWaldoStripes(frame gocv.Mat) ([]image.Rectangle, error) {
+	hsv := gocv.NewMat()
+	defer hsv.Close()
+	if err := gocv.CvtColor(frame, &hsv, gocv.ColorBGRToHSV); err != nil {
+		return nil, errors.Wrap(err, "Failed to convert frame to HSV")
+	}
+
+	mask := gocv.NewMat()
+	defer mask.Close()
+	band := gocv.NewMat()
+	defer band.Close()
+	for i := range stripeRedLow {
+		lo, hi := stripeRedLow[i], stripeRedHigh[i]
+		if err := gocv.InRangeWithScalar(hsv, gocv.NewScalar(lo[0], lo[1], lo[2], 0), gocv.NewScalar(hi[0], hi[1], hi[2], 0), &band); err != nil {
+			return nil, errors.Wrap(err, "Failed to mask red")
+		}
+		if i == 0 {
+			band.CopyTo(&mask)
+		} else if err := gocv.BitwiseOr(mask, band, &mask); err != nil {
+			return nil, errors.Wrap(err, "Failed to combine red masks")
+		}
+	}
+
+	// Join the pieces of a stripe broken up by folds and shading, without merging stripes into each other
+	kernel := gocv.GetStructuringElement(gocv.MorphRect, image.Pt(9, 3))
+	defer kernel.Close()
+	if err := gocv.MorphologyEx(mask, &mask, gocv.MorphClose, kernel); err != nil {
+		return nil, errors.Wrap(err, "Failed to close red mask")
+	}
+
+	contours := gocv.FindContours(mask, gocv.RetrievalExternal, gocv.ChainApproxSimple)
+	defer contours.Close()
+
+	var stripes []image.Rectangle
+	for i := 0; i < contours.Size(); i++ {
+		r := gocv.BoundingRect(contours.At(i))
+		if r.Dx() < stripeMinWidth || r.Dy() < stripeMinHeight || float64(r.Dx()) < stripeMinAspect*float64(r.Dy()) {
+			continue
+		}
+		stripes = append(stripes, r)
+	}
+
+	return stripes, nil
+}
@@ -0,0 +1,51 @@
+package waldo
+
+import (
+	"image"
+	"image/color"
+	"sort"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+func TestDetectWaldoStripes(t *testing.T) {
+	frame := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(255, 255, 255, 0), 120, 160, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+	draw := func(r image.Rectangle, c color.RGBA) {
+		if err := gocv.Rectangle(&frame, r, c, -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Three stripes 6 pixels apart, the middle one red from the other end of the hue circle
+	stripes := []image.Rectangle{image.Rect(20, 10, 120, 16), image.Rect(20, 22, 120, 28), image.Rect(20, 34, 120, 40)}
+	draw(stripes[0], color.RGBA{R: 255})
+	draw(stripes[1], color.RGBA{R: 255, B: 60})
+	draw(stripes[2], color.RGBA{R: 200, G: 10, B: 10})
+	// Red, but not stripe shaped, then stripe shaped but orange
+	draw(image.Rect(130, 60, 150, 80), color.RGBA{R: 255})
+	draw(image.Rect(20, 60, 26, 100), color.RGBA{R: 255})
+	draw(image.Rect(40, 90, 140, 96), color.RGBA{R: 255, G: 165})
+
+	got, err := detectWaldoStripes(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(got, func(i, j int) bool { return got[i].Min.Y < got[j].Min.Y })
+	if len(got) != len(stripes) {
+		t.Fatalf("Found %v, want the %d stripes", got, len(stripes))
+	}
+	// OpenCV fills rectangles up to and including their far corner
+	for i, want := range stripes {
+		if got[i].Min != want.Min || got[i].Max.X-want.Max.X > 1 || got[i].Max.Y-want.Max.Y > 1 {
+			t.Errorf("Stripe %d found at %v, want %v", i, got[i], want)
+		}
+	}
+
+	blank := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(255, 255, 255, 0), 120, 160, gocv.MatTypeCV8UC3)
+	defer blank.Close()
+	if got, err := detectWaldoStripes(blank); err != nil || len(got) != 0 {
+		t.Errorf("Blank frame: %v, %v", got, err)
+	}
+}
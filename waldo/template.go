@@ -0,0 +1,236 @@
+package waldo
+
+import (
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gocv.io/x/gocv"
+)
+
+// DetectionResult A single match found in a frame
+type DetectionResult struct {
+	Timestamp uint32          `json:"timestamp"` // RTMP timestamp of the frame
+	Score     float64         `json:"score"`
+	Rect      image.Rectangle `json:"rect"`
+	Scale     float64         `json:"scale"`
+	Label     string          `json:"label,omitempty"` // Set by Detector backends, empty for template matches
+}
+
+// TemplateMatcherConfig Search parameters for multi-scale template matching
+type TemplateMatcherConfig struct {
+	MinScale  float64
+	MaxScale  float64
+	ScaleStep float64
+	Threshold float64 // Minimum normalized correlation, 0..1
+	TopN      int
+
+	// Matches overlapping a better one by more than this intersection over union are dropped, before TopN
+	NMSIoU float64
+}
+
+// TemplateMatcher Finds Waldo by matching reference images at several scales.
+// Templates are read-only after loading, so one matcher can be shared by every stream
+type TemplateMatcher struct {
+	templates []gocv.Mat // Grayscale
+	config    TemplateMatcherConfig
+}
+
+// color for the rect when Waldo is matched
+var matchOutline = color.RGBA{255, 0, 0, 0}
+
+// Load the template images at the given paths
+func NewTemplateMatcher(paths []string, config TemplateMatcherConfig) (*TemplateMatcher, error) {
+	if config.ScaleStep <= 0 || config.MinScale <= 0 || config.MaxScale < config.MinScale {
+		return nil, errors.Errorf("Invalid template scale range: %g..%g step %g", config.MinScale, config.MaxScale, config.ScaleStep)
+	}
+
+	m := &TemplateMatcher{config: config}
+	for _, p := range paths {
+		tmpl := gocv.IMRead(p, gocv.IMReadGrayScale)
+		if tmpl.Empty() {
+			m.Close()
+			return nil, errors.Errorf("Error reading template image: %s", p)
+		}
+		m.templates = append(m.templates, tmpl)
+	}
+
+	return m, nil
+}
+
+// The template images in dir: every .png, .jpg and .jpeg, by name
+func templateImages(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read template directory")
+	}
+
+	var paths []string
+	for _, e := range entries {
+		switch strings.ToLower(filepath.Ext(e.Name())) {
+		case ".png", ".jpg", ".jpeg":
+			if !e.IsDir() {
+				paths = append(paths, filepath.Join(dir, e.Name()))
+			}
+		}
+	}
+	if len(paths) == 0 {
+		return nil, errors.Errorf("No PNG or JPEG templates in %s", dir)
+	}
+
+	return paths, nil
+}
+
+// Replace every directory in paths with the template images in it
+func ExpandTemplatePaths(paths []string) ([]string, error) {
+	var expanded []string
+	for _, p := range paths {
+		if fi, err := os.Stat(p); err != nil || !fi.IsDir() {
+			expanded = append(expanded, p)
+			continue
+		}
+		images, err := templateImages(p)
+		if err != nil {
+			return nil, err
+		}
+		expanded = append(expanded, images...)
+	}
+
+	return expanded, nil
+}
+
+// Return the best matches above the threshold, highest score first
+func (m *TemplateMatcher) Match(frame gocv.Mat) []DetectionResult {
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(frame, &gray, gocv.ColorBGRToGray)
+
+	return m.best(m.matchGray(gray))
+}
+
+// Like Match, but only search around regions, e.g. from DetectWaldoStripes. Each region is grown
+// by the largest scaled template on every side, and overlapping ones are merged so nothing is searched twice
+func (m *TemplateMatcher) MatchRegions(frame gocv.Mat, regions []image.Rectangle) []DetectionResult {
+	gray := gocv.NewMat()
+	defer gray.Close()
+	gocv.CvtColor(frame, &gray, gocv.ColorBGRToGray)
+
+	var margin image.Point
+	for _, tmpl := range m.templates {
+		margin.X = max(margin.X, int(float64(tmpl.Cols())*m.config.MaxScale))
+		margin.Y = max(margin.Y, int(float64(tmpl.Rows())*m.config.MaxScale))
+	}
+	bounds := image.Rect(0, 0, gray.Cols(), gray.Rows())
+	grown := make([]image.Rectangle, 0, len(regions))
+	for _, r := range regions {
+		if r = (image.Rectangle{Min: r.Min.Sub(margin), Max: r.Max.Add(margin)}).Intersect(bounds); !r.Empty() {
+			grown = append(grown, r)
+		}
+	}
+
+	var results []DetectionResult
+	for _, r := range mergeOverlapping(grown) {
+		region := gray.Region(r)
+		for _, res := range m.matchGray(region) {
+			res.Rect = res.Rect.Add(r.Min)
+			results = append(results, res)
+		}
+		_ = region.Close()
+	}
+
+	return m.best(results)
+}
+
+// Union rectangles until none overlap
+func mergeOverlapping(rects []image.Rectangle) []image.Rectangle {
+	for merged := true; merged; {
+		merged = false
+		for i := 0; i < len(rects) && !merged; i++ {
+			for j := i + 1; j < len(rects); j++ {
+				if rects[i].Overlaps(rects[j]) {
+					rects[i] = rects[i].Union(rects[j])
+					rects = append(rects[:j], rects[j+1:]...)
+					merged = true
+					break
+				}
+			}
+		}
+	}
+
+	return rects
+}
+
+// Highest scoring TopN of the results above the threshold, after neighbouring scales and templates
+// finding the same Waldo again have been suppressed, best first
+func (m *TemplateMatcher) best(results []DetectionResult) []DetectionResult {
+	kept := results[:0]
+	for _, r := range results {
+		if r.Score >= m.config.Threshold {
+			kept = append(kept, r)
+		}
+	}
+	results = suppressOverlaps(kept, m.config.NMSIoU)
+	sort.SliceStable(results, func(i, j int) bool { return results[i].Score > results[j].Score })
+	if len(results) > m.config.TopN {
+		results = results[:m.config.TopN]
+	}
+
+	return results
+}
+
+// Every match above the threshold in a grayscale picture, up to TopN per template and scale
+func (m *TemplateMatcher) matchGray(gray gocv.Mat) []DetectionResult {
+	scaled := gocv.NewMat()
+	defer scaled.Close()
+	result := gocv.NewMat()
+	defer result.Close()
+	mask := gocv.NewMat()
+	defer mask.Close()
+
+	var results []DetectionResult
+	for _, tmpl := range m.templates {
+		for scale := m.config.MinScale; scale <= m.config.MaxScale+1e-9; scale += m.config.ScaleStep {
+			size := image.Pt(int(float64(tmpl.Cols())*scale), int(float64(tmpl.Rows())*scale))
+			if size.X < 1 || size.Y < 1 || size.X > gray.Cols() || size.Y > gray.Rows() {
+				continue
+			}
+			gocv.Resize(tmpl, &scaled, size, 0, 0, gocv.InterpolationArea)
+
+			if err := gocv.MatchTemplate(gray, scaled, &result, gocv.TmCcoeffNormed, mask); err != nil {
+				continue
+			}
+
+			// Pick peaks, blanking each one so the next best location can be found
+			for i := 0; i < m.config.TopN; i++ {
+				_, maxVal, _, maxLoc := gocv.MinMaxLoc(result)
+				if float64(maxVal) < m.config.Threshold {
+					break
+				}
+
+				rect := image.Rectangle{Min: maxLoc, Max: maxLoc.Add(size)}
+				results = append(results, DetectionResult{
+					Score: float64(maxVal),
+					Rect:  rect,
+					Scale: scale,
+				})
+
+				blank := image.Rectangle{Min: maxLoc.Sub(size.Div(2)), Max: maxLoc.Add(size.Div(2))}
+				gocv.Rectangle(&result, blank, color.RGBA{}, -1)
+			}
+		}
+	}
+
+	return results
+}
+
+// Release the template images
+func (m *TemplateMatcher) Close() {
+	for _, tmpl := range m.templates {
+		tmpl.Close()
+	}
+	m.templates = nil
+}
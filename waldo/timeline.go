@@ -0,0 +1,189 @@
+package waldo
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// TimelineRect One detection in a timeline entry
+type TimelineRect struct {
+	X     int     `json:"x"`
+	Y     int     `json:"y"`
+	W     int     `json:"w"`
+	H     int     `json:"h"`
+	Label string  `json:"label,omitempty"`
+	Score float64 `json:"score"`
+}
+
+// TimelineEntry A frame with detections. Label and Score are those of its best detection
+type TimelineEntry struct {
+	TimestampMs uint32         `json:"timestampMs"`
+	OffsetMs    int64          `json:"offsetMs,omitempty"` // Added to the publisher's timestamp by rebasing, see TimestampNormalizer
+	StreamName  string         `json:"streamName"`
+	Rects       []TimelineRect `json:"rects"`
+	Label       string         `json:"label,omitempty"`
+	Score       float64        `json:"score"`
+	Thumbnail   string         `json:"thumbnail,omitempty"` // Annotated JPEG of the frame, if one was saved
+}
+
+// TimelineSummary Footer written when the recording is closed
+type TimelineSummary struct {
+	FramesProcessed uint64 `json:"framesProcessed"`
+	Detections      uint64 `json:"detections"`
+}
+
+// timelineLine A line of the file, either an entry or the closing summary
+type timelineLine struct {
+	*TimelineEntry
+	Summary *TimelineSummary `json:"summary,omitempty"`
+}
+
+// DetectionTimeline Writes the detections of a recording next to it as JSON lines, one per frame with hits,
+// as they are found. Every line is complete on its own, so the file stays readable if the process dies.
+// Safe for concurrent use
+type DetectionTimeline struct {
+	mu      sync.Mutex
+	f       *os.File // nil while no recording is open
+	enc     *json.Encoder
+	summary TimelineSummary
+}
+
+// Start the timeline of a new recording, closing the previous one
+func (t *DetectionTimeline) Open(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create detection timeline")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.closeLocked(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	t.f = f
+	t.enc = json.NewEncoder(f)
+	t.summary = TimelineSummary{}
+
+	return nil
+}
+
+// Record a processed frame, what rebasing added to its timestamp, and the path of its thumbnail if there is one.
+// Frames without detections only count towards the summary
+func (t *DetectionTimeline) Add(stream string, timestamp uint32, offset int64, results []DetectionResult, thumbnail string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.f == nil {
+		return nil
+	}
+	t.summary.FramesProcessed++
+	t.summary.Detections += uint64(len(results))
+	if len(results) == 0 {
+		return nil
+	}
+
+	entry := &TimelineEntry{
+		TimestampMs: timestamp,
+		OffsetMs:    offset,
+		StreamName:  stream,
+		Rects:       make([]TimelineRect, 0, len(results)),
+		Thumbnail:   thumbnail,
+	}
+	for _, d := range results {
+		entry.Rects = append(entry.Rects, TimelineRect{
+			X:     d.Rect.Min.X,
+			Y:     d.Rect.Min.Y,
+			W:     d.Rect.Dx(),
+			H:     d.Rect.Dy(),
+			Label: d.Label,
+			Score: d.Score,
+		})
+		if d.Score >= entry.Score {
+			entry.Label, entry.Score = d.Label, d.Score
+		}
+	}
+
+	// Unbuffered, each line reaches the file in one write
+	return errors.Wrap(t.enc.Encode(timelineLine{TimelineEntry: entry}), "Failed to write detection timeline")
+}
+
+// Write the summary footer and close the file. Safe to call more than once
+func (t *DetectionTimeline) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.closeLocked()
+}
+
+func (t *DetectionTimeline) closeLocked() error {
+	if t.f == nil {
+		return nil
+	}
+
+	summary := t.summary
+	err := t.enc.Encode(timelineLine{Summary: &summary})
+	if cerr := t.f.Close(); err == nil {
+		err = cerr
+	}
+	t.f = nil
+	t.enc = nil
+
+	return errors.Wrap(err, "Failed to close detection timeline")
+}
+
+// Load a timeline written by DetectionTimeline. The summary is nil when the recording was never
+// closed, and a torn last line from a crash is ignored
+func ReadTimeline(path string) ([]TimelineEntry, *TimelineSummary, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to open detection timeline")
+	}
+	defer f.Close()
+
+	var (
+		entries []TimelineEntry
+		summary *TimelineSummary
+		torn    bool
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if torn {
+			return nil, nil, errors.Errorf("Malformed detection timeline line %d", n-1)
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var l timelineLine
+		if err := json.Unmarshal([]byte(line), &l); err != nil {
+			torn = true
+			continue
+		}
+		switch {
+		case l.Summary != nil:
+			summary = l.Summary
+		case l.TimelineEntry != nil:
+			entries = append(entries, *l.TimelineEntry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to read detection timeline")
+	}
+
+	return entries, summary, nil
+}
+
+// received/<name>.flv (or .mp4) -> received/<name>.detections.json
+func timelinePath(recordingPath string) string {
+	return strings.TrimSuffix(recordingPath, filepath.Ext(recordingPath)) + ".detections.json"
+}
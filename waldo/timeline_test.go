@@ -0,0 +1,103 @@
+package waldo
+
+import (
+	"image"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDetectionTimelineRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cam.detections.json")
+
+	var tl DetectionTimeline
+	if err := tl.Add("cam", 1, 0, []DetectionResult{{Score: 1}}, ""); err != nil {
+		t.Fatalf("Add before Open: %v", err)
+	}
+	if err := tl.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	results := []DetectionResult{
+		{Rect: image.Rect(10, 20, 40, 60), Label: "waldo", Score: 0.7},
+		{Rect: image.Rect(0, 0, 5, 5), Label: "face", Score: 0.9},
+	}
+	for _, add := range []struct {
+		timestamp uint32
+		results   []DetectionResult
+	}{{0, nil}, {40, results}, {80, nil}, {120, results[:1]}} {
+		if err := tl.Add("cam", add.timestamp, 1000, add.results, "cam/40.jpg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Close(); err != nil {
+		t.Errorf("Second Close: %v", err)
+	}
+
+	entries, summary, err := ReadTimeline(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []TimelineEntry{
+		{
+			TimestampMs: 40, OffsetMs: 1000, StreamName: "cam", Label: "face", Score: 0.9, Thumbnail: "cam/40.jpg",
+			Rects: []TimelineRect{{X: 10, Y: 20, W: 30, H: 40, Label: "waldo", Score: 0.7}, {W: 5, H: 5, Label: "face", Score: 0.9}},
+		},
+		{
+			TimestampMs: 120, OffsetMs: 1000, StreamName: "cam", Label: "waldo", Score: 0.7, Thumbnail: "cam/40.jpg",
+			Rects: []TimelineRect{{X: 10, Y: 20, W: 30, H: 40, Label: "waldo", Score: 0.7}},
+		},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("Entries = %+v, want %+v", entries, want)
+	}
+	if want := (&TimelineSummary{FramesProcessed: 4, Detections: 3}); !reflect.DeepEqual(summary, want) {
+		t.Errorf("Summary = %+v, want %+v", summary, want)
+	}
+}
+
+func TestReadTimelineAfterCrash(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cam.detections.json")
+
+	var tl DetectionTimeline
+	if err := tl.Open(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := tl.Add("cam", 40, 0, []DetectionResult{{Rect: image.Rect(0, 0, 1, 1), Score: 0.8}}, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// The process died halfway through the next line, the file was never closed
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"timestampMs":80,"stre`); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	entries, summary, err := ReadTimeline(path)
+	if err != nil {
+		t.Fatalf("Torn last line: %v", err)
+	}
+	if len(entries) != 1 || entries[0].TimestampMs != 40 || summary != nil {
+		t.Errorf("Got %+v and summary %+v, want the complete entry and no summary", entries, summary)
+	}
+	_ = tl.Close()
+}
+
+func TestReadTimelineMalformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cam.detections.json")
+	data := "{\"timestampMs\":40,\"streamName\":\"cam\",\"rects\":[],\"score\":1}\nnot json\n{\"summary\":{\"framesProcessed\":1}}\n"
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := ReadTimeline(path); err == nil {
+		t.Error("A malformed line before the end was accepted")
+	}
+}
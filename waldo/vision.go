@@ -0,0 +1,473 @@
+package waldo
+
+import (
+	stderrors "errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"gocv.io/x/gocv"
+)
+
+// Vision Runs a Detector on frames and shows the results
+type Vision struct {
+	window   *gocv.Window // nil when headless
+	img      gocv.Mat
+	detector Detector
+	outline  color.RGBA
+	closed   bool
+
+	detectorConfig DetectorConfig // Base settings for LoadDNNDetector
+	dnn            *DNNDetector   // The detector, when it is a network
+
+	maxDimension int
+	small        gocv.Mat // Downscaled frame, reused
+
+	roi image.Rectangle // Only this part of a frame is searched, empty searches it all
+
+	templates []gocv.Mat // Grayscale, from LoadTemplates
+
+	motion float64 // Score of the last IsStaticFrame
+}
+
+const DefaultCascadePath = "data/haarcascade_frontalface_default.xml"
+
+// VisionConfig Settings for NewVision
+type VisionConfig struct {
+	Detector DetectorConfig
+
+	// Skip the display window, for servers without X11
+	Headless bool
+
+	// Fraction of pixels (0-1) that must change from the last frame run through the detector
+	// for the next one to be, 0 disables. Applied by the handler, see IsStaticFrame
+	MotionThreshold float64
+
+	// Frames larger than this in either dimension are scaled down for the detector, 0 keeps the full size
+	MaxDimension int
+
+	// Region of interest: detectors only search this part of a frame, the zero rectangle searches it all
+	ROI image.Rectangle
+}
+
+// Pixels whose gray level changed by more than this count as moving
+const motionPixelDelta = 25
+
+// Find the cascade file, naming every location tried when it is missing
+func resolveCascadePath(p string) (string, error) {
+	if p == "" {
+		p = os.Getenv("WALDO_CASCADE_PATH")
+	}
+	if p == "" {
+		p = DefaultCascadePath
+	}
+
+	var candidates []string
+	if filepath.IsAbs(p) {
+		candidates = append(candidates, p)
+	} else {
+		if abs, err := filepath.Abs(p); err == nil {
+			candidates = append(candidates, abs)
+		}
+		if exe, err := os.Executable(); err == nil {
+			candidates = append(candidates, filepath.Join(filepath.Dir(exe), p))
+		}
+	}
+
+	for _, c := range candidates {
+		if _, err := os.Stat(c); err == nil {
+			return c, nil
+		}
+	}
+
+	return "", errors.Errorf("Cascade file not found, tried: %s", strings.Join(candidates, ", "))
+}
+
+// Allocate everything needed for detection. The caller owns the result and must Close it
+func NewVision(config VisionConfig) (*Vision, error) {
+	detector, err := NewDetector(config.Detector)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewVisionWithConfig(config, detector), nil
+}
+
+// Like NewVision, with a detector built by the caller in place of config.Detector.
+// The Vision takes ownership of it and closes it in Close
+func NewVisionWithConfig(config VisionConfig, detector Detector) *Vision {
+	v := NewVisionWithDetector(detector, config.Headless)
+	v.detectorConfig = config.Detector
+	v.dnn, _ = detector.(*DNNDetector)
+	v.maxDimension = config.MaxDimension
+	v.roi = config.ROI
+
+	return v
+}
+
+// Wrap a custom detector. The Vision takes ownership of it and closes it in Close
+func NewVisionWithDetector(detector Detector, headless bool) *Vision {
+	v := &Vision{detector: detector}
+
+	// color for the rect when objects detected
+	v.outline = color.RGBA{0, 0, 255, 0}
+
+	// open display window
+	if !headless {
+		v.window = gocv.NewWindow("Face Detect")
+	}
+
+	// prepare image matrix
+	v.img = gocv.NewMat()
+	v.small = gocv.NewMat()
+
+	return v
+}
+
+// Whether curr barely differs from prev: the fraction of pixels whose (blurred) gray level changed
+// is below threshold. An empty prev, a frame of another size or a failed comparison is never static
+func (v *Vision) IsStaticFrame(prev, curr gocv.Mat, threshold float64) bool {
+	v.motion = 1
+	if prev.Empty() || prev.Rows() != curr.Rows() || prev.Cols() != curr.Cols() {
+		return false
+	}
+
+	score, err := motionScore(prev, curr)
+	if err != nil {
+		return false
+	}
+	v.motion = score
+
+	return score < threshold
+}
+
+// Fraction of pixels that changed in the last IsStaticFrame comparison, 1 when there was none
+func (v *Vision) MotionScore() float64 {
+	return v.motion
+}
+
+// Fraction of pixels that changed between two frames of the same size (abs diff, threshold, nonzero count)
+func motionScore(prev, curr gocv.Mat) (float64, error) {
+	a, err := blurredGray(prev)
+	if err != nil {
+		return 0, err
+	}
+	defer a.Close()
+	b, err := blurredGray(curr)
+	if err != nil {
+		return 0, err
+	}
+	defer b.Close()
+
+	diff := gocv.NewMat()
+	defer diff.Close()
+	if err := gocv.AbsDiff(a, b, &diff); err != nil {
+		return 0, errors.Wrap(err, "Failed to diff frames")
+	}
+	gocv.Threshold(diff, &diff, motionPixelDelta, 255, gocv.ThresholdBinary)
+
+	total := diff.Rows() * diff.Cols()
+	if total == 0 {
+		return 0, nil
+	}
+
+	return float64(gocv.CountNonZero(diff)) / float64(total), nil
+}
+
+// Grayscale copy of the frame, blurred so sensor noise and compression artifacts don't read as motion
+func blurredGray(frame gocv.Mat) (gocv.Mat, error) {
+	gray := gocv.NewMat()
+	if frame.Channels() == 1 {
+		frame.CopyTo(&gray)
+	} else if err := gocv.CvtColor(frame, &gray, gocv.ColorBGRToGray); err != nil {
+		gray.Close()
+		return gray, errors.Wrap(err, "Failed to convert frame to grayscale")
+	}
+	if err := gocv.GaussianBlur(gray, &gray, image.Pt(5, 5), 0, 0, gocv.BorderDefault); err != nil {
+		gray.Close()
+		return gray, errors.Wrap(err, "Failed to blur frame")
+	}
+
+	return gray, nil
+}
+
+// Find objects in the frame, or only in its ROI when one is set. With a MaxDimension, large frames
+// are searched at a smaller size. Boxes are always in the frame's coordinates
+func (v *Vision) Detect(frame gocv.Mat) ([]Detection, error) {
+	region, r, ok := cropROI(frame, v.roi)
+	if !ok {
+		return nil, nil
+	}
+	if region != nil {
+		defer region.Close()
+		frame = *region
+	}
+
+	detections, err := v.detectScaled(frame)
+	for i := range detections {
+		detections[i].Rect = detections[i].Rect.Add(r.Min)
+	}
+
+	return detections, err
+}
+
+// The part of frame inside roi, nil when roi is empty and the whole frame is searched. The region
+// shares the frame's pixels and must be closed. False when the ROI lies outside the frame
+func cropROI(frame gocv.Mat, roi image.Rectangle) (*gocv.Mat, image.Rectangle, bool) {
+	if roi.Empty() {
+		return nil, image.Rectangle{}, true
+	}
+	r := roi.Intersect(image.Rect(0, 0, frame.Cols(), frame.Rows()))
+	if r.Empty() {
+		return nil, r, false
+	}
+	region := frame.Region(r)
+
+	return &region, r, true
+}
+
+func (v *Vision) detectScaled(frame gocv.Mat) ([]Detection, error) {
+	longest := max(frame.Cols(), frame.Rows())
+	if v.maxDimension <= 0 || longest <= v.maxDimension {
+		return v.detector.Detect(frame)
+	}
+
+	scale := float64(v.maxDimension) / float64(longest)
+	size := image.Pt(max(1, int(float64(frame.Cols())*scale)), max(1, int(float64(frame.Rows())*scale)))
+	if err := gocv.Resize(frame, &v.small, size, 0, 0, gocv.InterpolationArea); err != nil {
+		return nil, errors.Wrap(err, "Failed to downscale frame")
+	}
+
+	detections, err := v.detector.Detect(v.small)
+	if err != nil {
+		return nil, err
+	}
+	fx := float64(frame.Cols()) / float64(size.X)
+	fy := float64(frame.Rows()) / float64(size.Y)
+	for i := range detections {
+		detections[i].Rect = scaleRect(detections[i].Rect, fx, fy)
+	}
+
+	return detections, nil
+}
+
+// Replace the detector with a network. ONNX models are read with ReadNetFromONNX, others with ReadNet
+// and configPath. backend and target are gocv.NetBackendType and gocv.NetTargetType values.
+// Everything else, e.g. the input size and output format (SSD, YOLOv5 or YOLOv8), comes from the VisionConfig
+func (v *Vision) LoadDNNDetector(modelPath, configPath string, backend, target int) error {
+	config := v.detectorConfig
+	config.Backend = "dnn"
+	config.Model = modelPath
+	config.ModelConfig = configPath
+	config.NetBackend = gocv.NetBackendType(backend)
+	config.NetTarget = gocv.NetTargetType(target)
+
+	d, err := NewDNNDetector(config)
+	if err != nil {
+		return err
+	}
+	if v.detector != nil {
+		_ = v.detector.Close()
+	}
+	v.detector = d
+	v.dnn = d
+	v.detectorConfig = config
+
+	return nil
+}
+
+// Run the network loaded with LoadDNNDetector (or -detector dnn) on the frame at its full size,
+// or only on its ROI when one is set. Outputs are parsed by DNNDetector.Detect
+func (v *Vision) DNNDetect(frame gocv.Mat) ([]DetectionResult, error) {
+	if v.dnn == nil {
+		return nil, errors.New("No DNN detector loaded")
+	}
+	region, r, ok := cropROI(frame, v.roi)
+	if !ok {
+		return nil, nil
+	}
+	if region != nil {
+		defer region.Close()
+		frame = *region
+	}
+
+	detections, err := v.dnn.Detect(frame)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]DetectionResult, 0, len(detections))
+	for _, d := range detections {
+		results = append(results, DetectionResult{Score: float64(d.Score), Rect: d.Rect.Add(r.Min), Scale: 1, Label: d.Label})
+	}
+
+	return results, nil
+}
+
+// Size a frame of cols x rows is shrunk to before detection, for a target of width x height.
+// A 0 dimension follows the other one's aspect ratio. Frames are never enlarged, in which case
+// the frame's own size is returned
+func detectionSize(cols, rows int, target image.Point) image.Point {
+	size := target
+	switch {
+	case target.X <= 0 && target.Y <= 0:
+		return image.Pt(cols, rows)
+	case target.X <= 0:
+		size.X = max(1, int(math.Round(float64(cols)*float64(target.Y)/float64(rows))))
+	case target.Y <= 0:
+		size.Y = max(1, int(math.Round(float64(rows)*float64(target.X)/float64(cols))))
+	}
+	if size.X >= cols && size.Y >= rows {
+		return image.Pt(cols, rows)
+	}
+
+	return image.Pt(min(size.X, cols), min(size.Y, rows))
+}
+
+// Multiply a rectangle's coordinates by fx and fy
+func scaleRect(r image.Rectangle, fx, fy float64) image.Rectangle {
+	return image.Rect(
+		int(math.Round(float64(r.Min.X)*fx)), int(math.Round(float64(r.Min.Y)*fy)),
+		int(math.Round(float64(r.Max.X)*fx)), int(math.Round(float64(r.Max.Y)*fy)))
+}
+
+// Find objects in the frame and outline them in place
+func (v *Vision) DetectAndAnnotate(img *gocv.Mat) ([]Detection, error) {
+	detections, err := v.Detect(*img)
+	if err != nil {
+		return nil, err
+	}
+	v.Draw(img, detections)
+
+	return detections, nil
+}
+
+// Outline the detections on the frame
+func (v *Vision) Draw(img *gocv.Mat, detections []Detection) {
+	for _, d := range detections {
+		drawLabeledBox(img, d.Rect, d.Label, v.outline)
+	}
+}
+
+// Outline detection results with their confidence scores
+func (v *Vision) DrawDetections(frame *gocv.Mat, results []DetectionResult) {
+	drawDetections(frame, results, v.outline)
+}
+
+// Cut the detections out of the frame as JPEGs, each box grown by margin (a fraction of its size) on every side.
+// Call before drawing, or the outlines end up in the crops
+func (v *Vision) Crops(frame gocv.Mat, detections []Detection, margin float64) ([][]byte, error) {
+	bounds := image.Rect(0, 0, frame.Cols(), frame.Rows())
+
+	crops := make([][]byte, 0, len(detections))
+	for _, d := range detections {
+		dx := int(float64(d.Rect.Dx()) * margin)
+		dy := int(float64(d.Rect.Dy()) * margin)
+		r := image.Rect(d.Rect.Min.X-dx, d.Rect.Min.Y-dy, d.Rect.Max.X+dx, d.Rect.Max.Y+dy).Intersect(bounds)
+		if r.Empty() {
+			continue
+		}
+
+		region := frame.Region(r)
+		buf, err := gocv.IMEncode(gocv.JPEGFileExt, region)
+		_ = region.Close()
+		if err != nil {
+			return crops, errors.Wrap(err, "Failed to encode thumbnail")
+		}
+		crops = append(crops, append([]byte(nil), buf.GetBytes()...))
+		buf.Close()
+	}
+
+	return crops, nil
+}
+
+// Add every .png and .jpg in dir to the templates DetectWithTemplates searches for
+func (v *Vision) LoadTemplates(dir string) error {
+	var paths []string
+	for _, pattern := range []string{"*.png", "*.jpg"} {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return errors.Wrap(err, "Invalid template directory")
+		}
+		paths = append(paths, matches...)
+	}
+	if len(paths) == 0 {
+		return errors.Errorf("No PNG or JPEG templates in %s", dir)
+	}
+
+	for _, p := range paths {
+		tmpl := gocv.IMRead(p, gocv.IMReadGrayScale)
+		if tmpl.Empty() {
+			_ = tmpl.Close()
+			return errors.Errorf("Error reading template image: %s", p)
+		}
+		v.templates = append(v.templates, tmpl)
+	}
+
+	return nil
+}
+
+// Match every loaded template against the frame, as TemplateMatcher does. The hits of all templates
+// are merged before suppressing overlaps, so a Waldo found by several of them is reported once
+func (v *Vision) DetectWithTemplates(frame gocv.Mat, config TemplateMatcherConfig) []DetectionResult {
+	m := TemplateMatcher{templates: v.templates, config: config}
+	return m.Match(frame)
+}
+
+// Display the frame in the window. No-op when headless
+func (v *Vision) Show(img gocv.Mat) {
+	if v.window == nil {
+		return
+	}
+
+	img.CopyTo(&v.img)
+	v.window.IMShow(v.img)
+	v.window.WaitKey(1)
+}
+
+// Burn a box and its label into the frame, keeping the text inside the picture
+func drawLabeledBox(img *gocv.Mat, r image.Rectangle, label string, c color.RGBA) {
+	gocv.Rectangle(img, r, c, 3)
+
+	org := image.Pt(r.Min.X, r.Min.Y-6)
+	if org.Y < 16 {
+		org.Y = r.Max.Y + 18
+	}
+	gocv.PutText(img, label, org, gocv.FontHersheySimplex, 0.6, c, 2)
+}
+
+// Outline each result, labelled with its score. Unlabelled results are template matches, so Waldo
+func drawDetections(img *gocv.Mat, results []DetectionResult, c color.RGBA) {
+	for _, d := range results {
+		label := d.Label
+		if label == "" {
+			label = "Waldo"
+		}
+		drawLabeledBox(img, d.Rect, fmt.Sprintf("%s %.2f", label, d.Score), c)
+	}
+}
+
+// Release the window, image matrices, templates and detector. Safe to call more than once
+func (v *Vision) Close() error {
+	if v.closed {
+		return nil
+	}
+	v.closed = true
+
+	var errs []error
+	if v.window != nil {
+		errs = append(errs, v.window.Close())
+		v.window = nil
+	}
+	for _, tmpl := range v.templates {
+		errs = append(errs, tmpl.Close())
+	}
+	v.templates = nil
+	errs = append(errs, v.img.Close(), v.small.Close(), v.detector.Close())
+
+	return stderrors.Join(errs...)
+}
@@ -0,0 +1,324 @@
+package waldo
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gocv.io/x/gocv"
+)
+
+// fixedDetector Reports the same boxes for every frame and remembers the size of the last one
+type fixedDetector struct {
+	detections []Detection
+	seen       image.Point
+	closed     bool
+}
+
+func (d *fixedDetector) Detect(frame gocv.Mat) ([]Detection, error) {
+	d.seen = image.Pt(frame.Cols(), frame.Rows())
+	return append([]Detection(nil), d.detections...), nil
+}
+
+func (d *fixedDetector) Close() error {
+	d.closed = true
+	return nil
+}
+
+func TestVisionCrops(t *testing.T) {
+	frame := gocv.NewMatWithSize(200, 300, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+
+	v := NewVisionWithDetector(&fixedDetector{}, true)
+	defer v.Close()
+
+	detections := []Detection{
+		{Rect: image.Rect(100, 50, 140, 90)},   // Grows by 10 on every side
+		{Rect: image.Rect(280, 180, 300, 200)}, // Clipped at the corner
+		{Rect: image.Rect(400, 400, 420, 420)}, // Outside the frame, skipped
+	}
+	crops, err := v.Crops(frame, detections, 0.25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(crops) != 2 {
+		t.Fatalf("Got %d crops, want 2", len(crops))
+	}
+
+	for i, want := range []image.Point{{60, 60}, {25, 25}} {
+		img, err := jpeg.Decode(bytes.NewReader(crops[i]))
+		if err != nil {
+			t.Fatalf("Crop %d is not a JPEG: %v", i, err)
+		}
+		if got := img.Bounds().Size(); got != want {
+			t.Errorf("Crop %d is %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestVisionMaxDimension(t *testing.T) {
+	frame := gocv.NewMatWithSize(400, 800, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+
+	detector := &fixedDetector{detections: []Detection{{Rect: image.Rect(10, 10, 50, 50)}}}
+	v := NewVisionWithConfig(VisionConfig{Headless: true, MaxDimension: 400}, detector)
+	defer v.Close()
+
+	detections, err := v.Detect(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detector.seen != image.Pt(400, 200) {
+		t.Errorf("Detector ran on %v, want 400x200", detector.seen)
+	}
+	// Boxes come back at the frame's own scale
+	if len(detections) != 1 || detections[0].Rect != image.Rect(20, 20, 100, 100) {
+		t.Errorf("Got %v, want one box at (20,20)-(100,100)", detections)
+	}
+
+	// Frames within the limit are searched as they are
+	small := gocv.NewMatWithSize(300, 400, gocv.MatTypeCV8UC3)
+	defer small.Close()
+	if detections, err = v.Detect(small); err != nil {
+		t.Fatal(err)
+	}
+	if detector.seen != image.Pt(400, 300) || detections[0].Rect != image.Rect(10, 10, 50, 50) {
+		t.Errorf("Frame within the limit: detector saw %v, got %v", detector.seen, detections)
+	}
+}
+
+func TestVisionDetectWithTemplates(t *testing.T) {
+	white := color.RGBA{255, 255, 255, 0}
+	black := gocv.NewScalar(0, 0, 0, 0)
+
+	// A vertical and a horizontal bar, which do not correlate with each other
+	dir := t.TempDir()
+	bars := map[string]image.Rectangle{
+		"vertical.png":   image.Rect(8, 0, 16, 24),
+		"horizontal.jpg": image.Rect(0, 8, 24, 16),
+	}
+	for name, bar := range bars {
+		tmpl := gocv.NewMatWithSizeFromScalar(black, 24, 24, gocv.MatTypeCV8UC3)
+		gocv.Rectangle(&tmpl, bar, white, -1)
+		ok := gocv.IMWrite(filepath.Join(dir, name), tmpl)
+		tmpl.Close()
+		if !ok {
+			t.Fatalf("Failed to write %s", name)
+		}
+	}
+
+	frame := gocv.NewMatWithSizeFromScalar(black, 120, 200, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+	gocv.Rectangle(&frame, bars["vertical.png"].Add(image.Pt(30, 30)), white, -1)
+	gocv.Rectangle(&frame, bars["horizontal.jpg"].Add(image.Pt(130, 60)), white, -1)
+
+	v := NewVisionWithDetector(&fixedDetector{}, true)
+	defer v.Close()
+	if err := v.LoadTemplates(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.templates) != 2 {
+		t.Fatalf("Loaded %d templates, want 2", len(v.templates))
+	}
+
+	config := TemplateMatcherConfig{MinScale: 1, MaxScale: 1, ScaleStep: 0.1, Threshold: 0.95, TopN: 5, NMSIoU: 0.3}
+	results := v.DetectWithTemplates(frame, config)
+	want := []image.Rectangle{image.Rect(30, 30, 54, 54), image.Rect(130, 60, 154, 84)}
+	if len(results) != len(want) {
+		t.Fatalf("Got %v, want boxes %v", results, want)
+	}
+	for _, w := range want {
+		found := false
+		for _, r := range results {
+			found = found || r.Rect == w
+		}
+		if !found {
+			t.Errorf("No match at %v in %v", w, results)
+		}
+	}
+
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if v.templates != nil {
+		t.Error("Templates kept after Close")
+	}
+}
+
+func TestVisionHeadless(t *testing.T) {
+	// As on a server: no display to open a window on
+	t.Setenv("DISPLAY", "")
+	t.Setenv("WAYLAND_DISPLAY", "")
+
+	frame := gocv.NewMatWithSize(120, 160, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+
+	detector := &fixedDetector{detections: []Detection{{Rect: image.Rect(40, 40, 80, 80), Label: "face"}}}
+	v := NewVisionWithConfig(VisionConfig{Headless: true}, detector)
+	if v.window != nil {
+		t.Fatal("Headless vision opened a window")
+	}
+
+	detections, err := v.DetectAndAnnotate(&frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detections) != 1 || detector.seen != image.Pt(160, 120) {
+		t.Fatalf("Got %v from a %v frame, want the detector's box on 160x120", detections, detector.seen)
+	}
+	// The outline is drawn on the Mat itself
+	if c := frame.GetVecbAt(40, 40); c[0] == 0 && c[1] == 0 && c[2] == 0 {
+		t.Error("No outline drawn around the detection")
+	}
+	v.Show(frame)
+
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if !detector.closed {
+		t.Error("Close left the detector open")
+	}
+	if err := v.Close(); err != nil {
+		t.Errorf("Second Close: %v", err)
+	}
+}
+
+func TestVisionROIOffsetsDetections(t *testing.T) {
+	frame := gocv.NewMatWithSize(400, 400, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+
+	roi, err := ParseROI("100,100,200,200")
+	if err != nil {
+		t.Fatal(err)
+	}
+	detector := &fixedDetector{detections: []Detection{{Rect: image.Rect(5, 5, 25, 25)}}}
+	v := NewVisionWithConfig(VisionConfig{Headless: true, ROI: roi}, detector)
+	defer v.Close()
+
+	detections, err := v.Detect(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detector.seen != image.Pt(200, 200) {
+		t.Errorf("Detector ran on %v, want the 200x200 ROI", detector.seen)
+	}
+	if len(detections) != 1 || detections[0].Rect != image.Rect(105, 105, 125, 125) {
+		t.Errorf("Got %v, want one box at (105,105)-(125,125)", detections)
+	}
+
+	// An ROI off the frame finds nothing rather than searching all of it
+	v.roi = image.Rect(500, 500, 600, 600)
+	if detections, err := v.Detect(frame); err != nil || len(detections) != 0 {
+		t.Errorf("Got %v, %v with the ROI off the frame, want nothing", detections, err)
+	}
+}
+
+func TestDetectionSizeScalesBack(t *testing.T) {
+	tests := []struct {
+		name   string
+		target image.Point
+		want   image.Point
+	}{
+		{"off", image.Pt(0, 0), image.Pt(640, 480)},
+		{"both", image.Pt(320, 240), image.Pt(320, 240)},
+		{"width keeps aspect", image.Pt(320, 0), image.Pt(320, 240)},
+		{"height keeps aspect", image.Pt(0, 240), image.Pt(320, 240)},
+		{"never enlarged", image.Pt(1280, 0), image.Pt(640, 480)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := detectionSize(640, 480, tt.target); got != tt.want {
+				t.Errorf("detectionSize = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	// A box found on the half size frame, at the frame's own scale
+	size := detectionSize(640, 480, image.Pt(320, 0))
+	fx, fy := 640/float64(size.X), 480/float64(size.Y)
+	if got := scaleRect(image.Rect(10, 10, 50, 50), fx, fy); got != image.Rect(20, 20, 100, 100) {
+		t.Errorf("scaleRect = %v, want (20,20)-(100,100)", got)
+	}
+}
+
+// Face cascade bundled with the tests, the same one OpenCV ships
+var testCascadePath = filepath.Join("..", "test", "haarcascade_frontalface_default.xml")
+
+func TestNewVisionDetectsFace(t *testing.T) {
+	v, err := NewVision(VisionConfig{Headless: true, Detector: DetectorConfig{Backend: "haar", CascadePath: testCascadePath}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v.Close()
+
+	img := gocv.IMRead(filepath.Join("..", "test", "face.jpg"), gocv.IMReadColor)
+	if img.Empty() {
+		t.Fatal("Failed to read test/face.jpg")
+	}
+	defer img.Close()
+
+	detections, err := v.Detect(img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds := image.Rect(0, 0, img.Cols(), img.Rows())
+	if len(detections) != 1 || detections[0].Label != "face" || !detections[0].Rect.In(bounds) {
+		t.Fatalf("Got %v, want one face inside %v", detections, bounds)
+	}
+	v.Draw(&img, detections)
+}
+
+func TestNewVisionDetectClose(t *testing.T) {
+	v, err := NewVision(VisionConfig{Headless: true, Detector: DetectorConfig{Backend: "haar", CascadePath: testCascadePath}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A flat gray frame, nothing to find but the classifier must still be alive to say so
+	frame := gocv.NewMatWithSizeFromScalar(gocv.NewScalar(128, 128, 128, 0), 240, 320, gocv.MatTypeCV8UC3)
+	defer frame.Close()
+	detections, err := v.Detect(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(detections) != 0 {
+		t.Errorf("Found %v in a blank frame", detections)
+	}
+
+	if err := v.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Close(); err != nil {
+		t.Errorf("Second Close: %v", err)
+	}
+}
+
+func TestNewVisionMissingCascade(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "missing.xml")
+	_, err := NewVision(VisionConfig{Headless: true, Detector: DetectorConfig{Backend: "haar", CascadePath: p}})
+	if err == nil || !strings.Contains(err.Error(), p) {
+		t.Errorf("Got error %v, want one naming %s", err, p)
+	}
+}
+
+func TestVisionLoadTemplatesEmptyDir(t *testing.T) {
+	v := &Vision{}
+	if err := v.LoadTemplates(t.TempDir()); err == nil {
+		t.Error("Directory without templates accepted")
+	}
+}
+
+func TestVisionDNNWithoutNetwork(t *testing.T) {
+	v := &Vision{detector: &fixedDetector{}}
+	if _, err := v.DNNDetect(gocv.Mat{}); err == nil {
+		t.Error("DNNDetect without a network succeeded")
+	}
+	// The input size comes from the config, a model cannot run without one
+	if err := v.LoadDNNDetector("model.onnx", "", 0, 0); err == nil {
+		t.Error("Network loaded without an input size")
+	}
+}
@@ -0,0 +1,274 @@
+package waldo
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gocv.io/x/gocv"
+)
+
+// WebhookPayload Body POSTed to every webhook URL when a stream has detections
+type WebhookPayload struct {
+	Stream    string `json:"stream"`
+	Timestamp uint32 `json:"timestamp"` // RTMP timestamp of the frame
+	Rects     int    `json:"rects"`
+	Thumbnail []byte `json:"thumbnail,omitempty"` // JPEG, base64 in the JSON
+}
+
+// NotifierConfig Where and how often detections are reported
+type NotifierConfig struct {
+	URLs       []string
+	Cooldown   time.Duration // At most one notification per stream in this window
+	Retries    int           // Extra attempts per URL after a failure
+	RetryDelay time.Duration // Doubled after every failed attempt
+	QueueSize  int           // Notifications waiting for delivery before new ones are dropped
+	Timeout    time.Duration // Per request
+	Thumbnails bool          // Attach a JPEG of the frame
+
+	// Bodies are signed with HMAC-SHA256 of this key, hex in the X-Signature header, so receivers can
+	// check where they came from. Empty sends them unsigned
+	Secret string
+	// POST every detection above the event threshold as a DetectionEvent, instead of a WebhookPayload
+	// per stream and cooldown
+	EveryDetection bool
+}
+
+// Width of attached thumbnails, larger frames are scaled down
+const webhookThumbnailWidth = 320
+
+// A failed webhook is tried once more, this long after the failure
+const (
+	DefaultWebhookRetries    = 1
+	DefaultWebhookRetryDelay = 2 * time.Second
+)
+
+// webhookMessage An encoded notification for every URL
+type webhookMessage struct {
+	stream    string
+	timestamp uint32
+	body      []byte
+}
+
+// Notifier POSTs detections to webhooks from a background goroutine, so a slow or dead endpoint
+// never holds up CV. Failed POSTs are retried on timers, so they don't hold up later notifications
+// either. Shared by all streams
+type Notifier struct {
+	cfg    NotifierConfig
+	client *http.Client
+	queue  chan webhookMessage
+
+	mu     sync.Mutex
+	last   map[string]time.Time // Stream -> last notification accepted
+	closed bool
+
+	drained chan struct{}  // Closed once run has delivered the queue after Close
+	retries sync.WaitGroup // Retries waiting for their timer or in flight
+}
+
+func NewNotifier(cfg NotifierConfig) *Notifier {
+	if cfg.QueueSize < 1 {
+		cfg.QueueSize = 1
+	}
+	n := &Notifier{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: cfg.Timeout},
+		queue:   make(chan webhookMessage, cfg.QueueSize),
+		last:    make(map[string]time.Time),
+		drained: make(chan struct{}),
+	}
+	go n.run()
+
+	return n
+}
+
+// Whether stream is out of its cooldown. A true result starts the next cooldown, so call Enqueue after it
+func (n *Notifier) Allow(stream string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	if last, ok := n.last[stream]; ok && now.Sub(last) < n.cfg.Cooldown {
+		return false
+	}
+	n.last[stream] = now
+
+	return true
+}
+
+// Queue a notification without blocking. False when the queue is full and it was dropped
+func (n *Notifier) Enqueue(p WebhookPayload) bool {
+	body, err := json.Marshal(p)
+	if err != nil {
+		slog.Error("Failed to encode webhook payload", "stream", p.Stream, "err", err)
+		return false
+	}
+
+	return n.enqueue(webhookMessage{stream: p.Stream, timestamp: p.Timestamp, body: body})
+}
+
+// Queue a detection in EveryDetection mode without blocking. False when the queue is full and it was dropped
+func (n *Notifier) Notify(event DetectionEvent) bool {
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode detection webhook", "stream", event.Stream, "err", err)
+		return false
+	}
+
+	return n.enqueue(webhookMessage{stream: event.Stream, timestamp: event.Timestamp, body: body})
+}
+
+func (n *Notifier) enqueue(m webhookMessage) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.closed {
+		return false
+	}
+	select {
+	case n.queue <- m:
+		return true
+	default:
+		slog.Warn("Webhook queue full, dropping notification", "stream", m.stream, "timestamp", m.timestamp)
+		return false
+	}
+}
+
+// Stop taking notifications and deliver the ones queued, including their retries, until ctx ends. Nil-safe
+func (n *Notifier) Close(ctx context.Context) error {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		close(n.queue)
+	}
+	n.mu.Unlock()
+
+	delivered := make(chan struct{})
+	go func() {
+		<-n.drained
+		n.retries.Wait()
+		close(delivered)
+	}()
+	select {
+	case <-delivered:
+		return nil
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "Webhooks still pending")
+	}
+}
+
+func (n *Notifier) run() {
+	defer close(n.drained)
+	for m := range n.queue {
+		for _, url := range n.cfg.URLs {
+			n.deliver(url, m, 0, n.cfg.RetryDelay)
+		}
+	}
+}
+
+// POST m to url. A failure is tried again after delay from a timer, with the delay doubled for the next
+func (n *Notifier) deliver(url string, m webhookMessage, attempt int, delay time.Duration) {
+	err := n.post(url, m.body)
+	if err == nil {
+		return
+	}
+	if attempt >= n.cfg.Retries {
+		slog.Error("Webhook failed", "url", url, "stream", m.stream, "attempts", attempt+1, "err", err)
+		return
+	}
+
+	slog.Debug("Webhook attempt failed, retrying", "url", url, "attempt", attempt+1, "delay", delay, "err", err)
+	n.retries.Add(1)
+	time.AfterFunc(delay, func() {
+		defer n.retries.Done()
+		n.deliver(url, m, attempt+1, delay*2)
+	})
+}
+
+func (n *Notifier) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.cfg.Secret != "" {
+		req.Header.Set("X-Signature", signWebhook(n.cfg.Secret, body))
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.Errorf("Webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+// WebhookNotifier POSTs every detection event to a single URL, signed with secret, retrying a failure
+// once after DefaultWebhookRetryDelay. A Notifier in EveryDetection mode, so Close it the same way
+type WebhookNotifier struct {
+	*Notifier
+}
+
+func NewWebhookNotifier(url string, secret string, timeout time.Duration) *WebhookNotifier {
+	return &WebhookNotifier{NewNotifier(NotifierConfig{
+		URLs:           []string{url},
+		Retries:        DefaultWebhookRetries,
+		RetryDelay:     DefaultWebhookRetryDelay,
+		QueueSize:      16,
+		Timeout:        timeout,
+		Secret:         secret,
+		EveryDetection: true,
+	})}
+}
+
+// Queue the event as JSON without blocking. A full queue drops it with a warning
+func (n *WebhookNotifier) Notify(event DetectionEvent) {
+	n.Notifier.Notify(event)
+}
+
+// Hex HMAC-SHA256 of body, the X-Signature of webhooks
+func signWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Compress a frame as a JPEG no wider than webhookThumbnailWidth
+func encodeThumbnail(frame gocv.Mat) ([]byte, error) {
+	img := frame
+	if frame.Cols() > webhookThumbnailWidth {
+		small := gocv.NewMat()
+		defer small.Close()
+		height := frame.Rows() * webhookThumbnailWidth / frame.Cols()
+		if err := gocv.Resize(frame, &small, image.Pt(webhookThumbnailWidth, height), 0, 0, gocv.InterpolationArea); err != nil {
+			return nil, errors.Wrap(err, "Failed to scale thumbnail")
+		}
+		img = small
+	}
+
+	buf, err := gocv.IMEncode(gocv.JPEGFileExt, img)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to encode thumbnail")
+	}
+	defer buf.Close()
+
+	return append([]byte(nil), buf.GetBytes()...), nil
+}
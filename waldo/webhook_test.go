@@ -0,0 +1,222 @@
+package waldo
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"image"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRecorder An endpoint failing the first fail requests, recording every request it gets
+type webhookRecorder struct {
+	fail int
+
+	mu       sync.Mutex
+	requests []recordedWebhook
+}
+
+type recordedWebhook struct {
+	body      []byte
+	signature string
+	at        time.Time
+	status    int
+}
+
+func (rec *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	status := http.StatusNoContent
+	if len(rec.requests) < rec.fail {
+		status = http.StatusServiceUnavailable
+	}
+	rec.requests = append(rec.requests, recordedWebhook{body: body, signature: r.Header.Get("X-Signature"), at: time.Now(), status: status})
+	w.WriteHeader(status)
+}
+
+func (rec *webhookRecorder) received() []recordedWebhook {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]recordedWebhook(nil), rec.requests...)
+}
+
+func closeNotifier(t *testing.T, n *Notifier) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := n.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNotifierSignsAndRetriesOnce(t *testing.T) {
+	rec := &webhookRecorder{fail: 1}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	n := NewNotifier(NotifierConfig{
+		URLs:           []string{srv.URL},
+		Retries:        1,
+		RetryDelay:     50 * time.Millisecond,
+		QueueSize:      4,
+		Timeout:        time.Second,
+		Secret:         "s3cret",
+		EveryDetection: true,
+	})
+	event := DetectionEvent{Stream: "cam", Timestamp: 1234, Confidence: 0.9}
+	if !n.Notify(event) {
+		t.Fatal("Notify dropped the event")
+	}
+	closeNotifier(t, n)
+
+	got := rec.received()
+	if len(got) != 2 {
+		t.Fatalf("Endpoint got %d requests, want the failed one and one retry", len(got))
+	}
+	if got[1].at.Sub(got[0].at) < 50*time.Millisecond {
+		t.Errorf("Retried after %v, before the retry delay", got[1].at.Sub(got[0].at))
+	}
+	for i, r := range got {
+		if want := signWebhook("s3cret", r.body); r.signature != want {
+			t.Errorf("Request %d X-Signature = %q, want %q", i, r.signature, want)
+		}
+		var decoded DetectionEvent
+		if err := json.Unmarshal(r.body, &decoded); err != nil || decoded.Stream != "cam" || decoded.Timestamp != 1234 {
+			t.Errorf("Request %d body %s is not the event", i, r.body)
+		}
+	}
+}
+
+func TestNotifierGivesUpAfterRetries(t *testing.T) {
+	rec := &webhookRecorder{fail: 100}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	n := NewNotifier(NotifierConfig{URLs: []string{srv.URL}, Retries: 2, RetryDelay: time.Millisecond, QueueSize: 1, Timeout: time.Second})
+	n.Enqueue(WebhookPayload{Stream: "cam"})
+	closeNotifier(t, n)
+
+	if got := len(rec.received()); got != 3 {
+		t.Errorf("Endpoint got %d requests, want 1 and 2 retries", got)
+	}
+	if got := rec.received()[0].signature; got != "" {
+		t.Errorf("Unsigned notifier sent X-Signature %q", got)
+	}
+}
+
+func TestNotifierRetryDoesNotBlockQueue(t *testing.T) {
+	rec := &webhookRecorder{fail: 1}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	n := NewNotifier(NotifierConfig{URLs: []string{srv.URL}, Retries: 1, RetryDelay: 300 * time.Millisecond, QueueSize: 4, Timeout: time.Second})
+	n.Enqueue(WebhookPayload{Stream: "first"})
+	n.Enqueue(WebhookPayload{Stream: "second"})
+	closeNotifier(t, n)
+
+	var streams []string
+	for _, r := range rec.received() {
+		var p WebhookPayload
+		if err := json.Unmarshal(r.body, &p); err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, p.Stream)
+	}
+	// The second notification goes out while the first waits for its retry
+	if len(streams) != 3 || streams[0] != "first" || streams[1] != "second" || streams[2] != "first" {
+		t.Errorf("Delivery order %v, want [first second first]", streams)
+	}
+}
+
+func TestNotifierCooldown(t *testing.T) {
+	n := NewNotifier(NotifierConfig{Cooldown: time.Hour})
+	defer closeNotifier(t, n)
+
+	if !n.Allow("cam") {
+		t.Fatal("First notification refused")
+	}
+	if n.Allow("cam") {
+		t.Error("Second notification within the cooldown allowed")
+	}
+	if !n.Allow("lobby") {
+		t.Error("Cooldown of one stream held back another")
+	}
+
+	n = NewNotifier(NotifierConfig{})
+	defer closeNotifier(t, n)
+	if !n.Allow("cam") || !n.Allow("cam") {
+		t.Error("No cooldown still refused a notification")
+	}
+}
+
+func TestNotifierDropsWhenFullOrClosed(t *testing.T) {
+	// Nothing delivers while the one URL hangs, so the queue fills up
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer srv.Close()
+
+	n := NewNotifier(NotifierConfig{URLs: []string{srv.URL}, QueueSize: 1, Timeout: 5 * time.Second})
+	accepted := 0
+	for i := 0; i < 5; i++ {
+		if n.Enqueue(WebhookPayload{Stream: "cam"}) {
+			accepted++
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if accepted != 2 {
+		t.Errorf("Accepted %d notifications, want one in flight and one queued", accepted)
+	}
+
+	close(release)
+	closeNotifier(t, n)
+	if n.Enqueue(WebhookPayload{Stream: "cam"}) {
+		t.Error("Closed notifier accepted a notification")
+	}
+	if err := (*Notifier)(nil).Close(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	rec := &webhookRecorder{fail: 1}
+	srv := httptest.NewServer(rec)
+	defer srv.Close()
+
+	n := NewWebhookNotifier(srv.URL, "s3cret", time.Second)
+	event := DetectionEvent{Stream: "cam", Timestamp: 1234, Rect: image.Rect(10, 20, 30, 40), Confidence: 0.9}
+	n.Notify(event)
+	closeNotifier(t, n.Notifier)
+
+	got := rec.received()
+	if len(got) != 2 {
+		t.Fatalf("Endpoint got %d requests, want the failed one and one retry", len(got))
+	}
+	if wait := got[1].at.Sub(got[0].at); wait < DefaultWebhookRetryDelay {
+		t.Errorf("Retried after %v, want %v", wait, DefaultWebhookRetryDelay)
+	}
+	for i, r := range got {
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write(r.body)
+		if want := hex.EncodeToString(mac.Sum(nil)); r.signature != want {
+			t.Errorf("Request %d X-Signature = %q, want %q", i, r.signature, want)
+		}
+		var decoded DetectionEvent
+		if err := json.Unmarshal(r.body, &decoded); err != nil {
+			t.Fatalf("Request %d body %s: %v", i, r.body, err)
+		}
+		if decoded != event {
+			t.Errorf("Request %d sent %+v, want %+v", i, decoded, event)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package waldo
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/websocket"
+)
+
+// Largest client message accepted. Clients have nothing to tell us, their messages are read and dropped
+const wsMaxMessageSize = 64 * 1024
+
+// Clients are pinged every wsPingInterval, and dropped when a ping or event can't be sent within wsWriteTimeout
+const (
+	wsPingInterval = 30 * time.Second
+	wsWriteTimeout = 5 * time.Second
+)
+
+// Only pages served from the API's own host, or from one of allowed, may open a WebSocket, so another site
+// can't use a visitor's browser to read the events. "*" allows any page. Clients sending no Origin,
+// which browsers always do, are not pages and get in
+func checkWebSocketOrigin(allowed []string) func(*websocket.Config, *http.Request) error {
+	return func(config *websocket.Config, r *http.Request) error {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			return nil
+		}
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" {
+			return errors.Errorf("Invalid origin %q", origin)
+		}
+		if strings.EqualFold(u.Host, r.Host) {
+			return nil
+		}
+		for _, a := range allowed {
+			if a == "*" || strings.EqualFold(strings.TrimRight(strings.TrimSpace(a), "/"), u.Scheme+"://"+u.Host) {
+				return nil
+			}
+		}
+		slog.Warn("WebSocket from a page of another origin refused", "origin", origin, "remote", r.RemoteAddr)
+
+		return errors.Errorf("Origin %q not allowed", origin)
+	}
+}
+
+// WebSocket endpoint sending the events of subscribe's channel, which is unsubscribed once the client left
+func eventsWebSocket[T any](allowedOrigins []string, subscribe func() (uint64, <-chan T), unsubscribe func(uint64)) http.Handler {
+	return websocket.Server{
+		Handshake: checkWebSocketOrigin(allowedOrigins),
+		Handler: func(ws *websocket.Conn) {
+			id, ch := subscribe()
+			defer unsubscribe(id)
+			pumpEvents(ws, ch, wsPingInterval)
+		},
+	}
+}
+
+// Send events from ch as JSON text messages until the client goes away or can't keep up
+func pumpEvents[T any](ws *websocket.Conn, ch <-chan T, pingInterval time.Duration) {
+	ws.MaxPayloadBytes = wsMaxMessageSize
+
+	// Reading answers pings and notices the close, whatever the client sends is dropped
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var msg []byte
+			if err := websocket.Message.Receive(ws, &msg); err != nil && err != websocket.ErrFrameTooLarge {
+				return
+			}
+		}
+	}()
+
+	// Keeps the connection busy, so a client that vanished fails a write instead of lingering
+	ping := time.NewTicker(pingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ping.C:
+			if err := writeWebSocket(ws, websocket.PingFrame, nil); err != nil {
+				return
+			}
+		case ev := <-ch:
+			data, err := json.Marshal(ev)
+			if err != nil {
+				slog.Error("Failed to encode detection event", "err", err)
+				continue
+			}
+			if err := writeWebSocket(ws, websocket.TextFrame, data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// Send one frame of payloadType within wsWriteTimeout. Only pumpEvents writes, so PayloadType is not shared
+func writeWebSocket(ws *websocket.Conn, payloadType byte, data []byte) error {
+	ws.PayloadType = payloadType
+	_ = ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := ws.Write(data)
+
+	return err
+}
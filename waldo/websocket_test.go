@@ -0,0 +1,198 @@
+package waldo
+
+import (
+	"bufio"
+	"image"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// Open a WebSocket to url, from a page of origin (x/net always sends one)
+func dialWebSocket(t *testing.T, url, origin string) *websocket.Conn {
+	t.Helper()
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(url, "http"), "", origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ws.Close() })
+	_ = ws.SetDeadline(time.Now().Add(5 * time.Second))
+
+	return ws
+}
+
+// Wait until events has a detection subscriber, or has none left. False on timeout
+func waitForSubscriber(events *EventBroker, subscribed bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		found := false
+		events.subs.Range(func(_, _ any) bool {
+			found = true
+			return false
+		})
+		if found == subscribed {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return false
+}
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	events := NewEventBroker()
+	srv := httptest.NewServer(eventsWebSocket(nil,
+		func() (uint64, <-chan DetectionEvent) { return events.Subscribe(1) }, events.Unsubscribe))
+	t.Cleanup(srv.Close)
+	ws := dialWebSocket(t, srv.URL, srv.URL)
+
+	// Subscribed once the handler runs
+	if !waitForSubscriber(events, true) {
+		t.Fatal("Client never subscribed")
+	}
+
+	event := DetectionEvent{Stream: "cam", Timestamp: 40, Rect: image.Rect(1, 2, 3, 4), Confidence: 0.9}
+	events.Publish(event)
+	var got DetectionEvent
+	if err := websocket.JSON.Receive(ws, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, event) {
+		t.Fatalf("Got event %+v, want %+v", got, event)
+	}
+
+	// Client messages are dropped, the subscription ends with the connection
+	if err := websocket.Message.Send(ws, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	_ = ws.Close()
+	if !waitForSubscriber(events, false) {
+		t.Error("Still subscribed after the client left")
+	}
+}
+
+func TestWebSocketOriginPolicy(t *testing.T) {
+	events := NewEventBroker()
+	srv := httptest.NewServer(eventsWebSocket([]string{"https://dashboard.example.com"},
+		func() (uint64, <-chan DetectionEvent) { return events.Subscribe(1) }, events.Unsubscribe))
+	t.Cleanup(srv.Close)
+
+	tests := []struct {
+		name   string
+		origin string
+		want   int
+	}{
+		{"no origin", "", http.StatusSwitchingProtocols},
+		{"same host", srv.URL, http.StatusSwitchingProtocols},
+		{"allowed", "https://dashboard.example.com", http.StatusSwitchingProtocols},
+		{"other site", "https://evil.example.com", http.StatusForbidden},
+		{"allowed host over another scheme", "http://dashboard.example.com", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+			req.Header.Set("Connection", "Upgrade")
+			req.Header.Set("Upgrade", "websocket")
+			req.Header.Set("Sec-WebSocket-Version", "13")
+			req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			resp, err := http.DefaultTransport.RoundTrip(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.want {
+				t.Errorf("Handshake status %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebSocketPingsIdleClient(t *testing.T) {
+	srv := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		pumpEvents(ws, make(chan DetectionEvent), 20*time.Millisecond)
+	}))
+	t.Cleanup(srv.Close)
+
+	// A raw connection, websocket.Conn answers pings without showing them
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Origin", srv.URL)
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Handshake status %d, want 101", resp.StatusCode)
+	}
+
+	for i := 0; i < 2; i++ {
+		var head [2]byte
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			t.Fatal(err)
+		}
+		if head != [2]byte{0x80 | websocket.PingFrame, 0} {
+			t.Fatalf("Got frame % x, want an empty ping", head)
+		}
+	}
+}
+
+func TestWebSocketReceivesDetectionFromOnVideo(t *testing.T) {
+	sample := sampleFLV(t)
+	s, err := NewServer(Options{
+		OutputDir: t.TempDir(),
+		NewDetector: func() (Detector, error) {
+			return &fixedDetector{detections: []Detection{{Rect: image.Rect(8, 8, 48, 48), Label: "waldo", Score: 0.9}}}, nil
+		},
+		EventThreshold: 0.5,
+		Vision:         VisionConfig{Headless: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	ws := dialWebSocket(t, srv.URL+"/ws/detections", srv.URL)
+
+	if !waitForSubscriber(s.Events(), true) {
+		t.Fatal("Client never subscribed")
+	}
+
+	h := s.newHandler()
+	h.limits = s.limits
+	if err := replayFLV(sample, h); err != nil {
+		t.Fatal(err)
+	}
+
+	var got DetectionEvent
+	if err := websocket.JSON.Receive(ws, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Stream != "sample-replay" || got.Rect != image.Rect(8, 8, 48, 48) || got.Confidence != 0.9 {
+		t.Errorf("Got event %+v, want the detector's box on sample-replay", got)
+	}
+}